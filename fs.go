@@ -0,0 +1,281 @@
+package os_brick
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//FS The read access to the file system needed to inspect /dev and sysfs.
+type FS interface {
+	Stat(name string) (os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	ReadFile(name string) ([]byte, error)
+	Glob(pattern string) ([]string, error)
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	Readlink(name string) (string, error)
+	EvalSymlinks(path string) (string, error)
+}
+
+//DefaultFS is the FS used to inspect the host, replace it to run against a
+//chroot or a fake tree in tests.
+var DefaultFS FS = osFS{}
+
+//osFS The FS of the running host.
+type osFS struct{}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (osFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (osFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+func (osFS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (osFS) EvalSymlinks(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
+
+//maxSymlinkHops is how many symlinks MemFS follows before giving up on a loop.
+const maxSymlinkHops = 255
+
+//MemFS An in memory FS, to build hermetic /dev and sysfs trees in tests.
+type MemFS struct {
+	mu    sync.RWMutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	data []byte
+	link string
+	dir  bool
+}
+
+//NewMemFS Create an empty MemFS with only the root directory.
+func NewMemFS() *MemFS {
+	return &MemFS{nodes: map[string]*memNode{"/": {dir: true}}}
+}
+
+//WriteFile Create or replace a regular file, creating its parent directories.
+func (m *MemFS) WriteFile(name string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	m.mkdirAll(filepath.Dir(name))
+	m.nodes[name] = &memNode{data: data}
+}
+
+//Symlink Create a symlink name pointing to target, creating its parent directories.
+func (m *MemFS) Symlink(target, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	m.mkdirAll(filepath.Dir(name))
+	m.nodes[name] = &memNode{link: target}
+}
+
+//MkdirAll Create a directory and its parents.
+func (m *MemFS) MkdirAll(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mkdirAll(filepath.Clean(name))
+}
+
+//RemoveAll Remove a path and everything under it, without following symlinks.
+func (m *MemFS) RemoveAll(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	for n := range m.nodes {
+		if n == name || strings.HasPrefix(n, name+"/") {
+			delete(m.nodes, n)
+		}
+	}
+}
+
+func (m *MemFS) mkdirAll(name string) {
+	for ; name != "/" && name != "."; name = filepath.Dir(name) {
+		if _, ok := m.nodes[name]; !ok {
+			m.nodes[name] = &memNode{dir: true}
+		}
+	}
+}
+
+//resolve Find the node of a path, following the symlinks in it, and the last
+//one too when followLast is set.
+func (m *MemFS) resolve(op, name string, followLast bool, hops int) (string, *memNode, error) {
+	if !filepath.IsAbs(name) {
+		return "", nil, &os.PathError{Op: op, Path: name, Err: fmt.Errorf("path is not absolute")}
+	}
+	current := "/"
+	node := m.nodes[current]
+	parts := strings.Split(strings.Trim(filepath.Clean(name), "/"), "/")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		if !node.dir {
+			return "", nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		current = filepath.Join(current, part)
+		node = m.nodes[current]
+		if node == nil {
+			return "", nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		if node.link == "" || (i == len(parts)-1 && !followLast) {
+			continue
+		}
+		if hops++; hops > maxSymlinkHops {
+			return "", nil, &os.PathError{Op: op, Path: name, Err: fmt.Errorf("too many levels of symbolic links")}
+		}
+		target := node.link
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(current), target)
+		}
+		var err error
+		if current, node, err = m.resolve(op, target, true, hops); err != nil {
+			return "", nil, err
+		}
+	}
+	return current, node, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	path, node, err := m.resolve("stat", name, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	return memFileInfo{name: filepath.Base(path), node: node}, nil
+}
+
+func (m *MemFS) Open(name string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, node, err := m.resolve("open", name, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	if node.dir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+	return ioutil.NopCloser(bytes.NewReader(node.data)), nil
+}
+
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	f, err := m.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+//Glob Match the pattern against the paths of the files, directories and
+//symlinks created, patterns going through a symlinked directory don't match.
+func (m *MemFS) Glob(pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	matches := make([]string, 0)
+	for p := range m.nodes {
+		if ok, _ := filepath.Match(pattern, p); ok {
+			matches = append(matches, p)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+//ReadDir List a directory sorted by name, like ioutil.ReadDir symlinks are
+//reported as such rather than followed.
+func (m *MemFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	path, node, err := m.resolve("open", dirname, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !node.dir {
+		return nil, &os.PathError{Op: "readdirent", Path: dirname, Err: fmt.Errorf("not a directory")}
+	}
+	infos := make([]os.FileInfo, 0)
+	for p, n := range m.nodes {
+		if p != "/" && filepath.Dir(p) == path {
+			infos = append(infos, memFileInfo{name: filepath.Base(p), node: n})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m *MemFS) Readlink(name string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, node, err := m.resolve("readlink", name, false, 0)
+	if err != nil {
+		return "", err
+	}
+	if node.link == "" {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: fmt.Errorf("invalid argument")}
+	}
+	return node.link, nil
+}
+
+func (m *MemFS) EvalSymlinks(path string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	resolved, _, err := m.resolve("lstat", path, true, 0)
+	return resolved, err
+}
+
+type memFileInfo struct {
+	name string
+	node *memNode
+}
+
+func (fi memFileInfo) Name() string { return fi.name }
+
+func (fi memFileInfo) Size() int64 { return int64(len(fi.node.data)) }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	switch {
+	case fi.node.dir:
+		return os.ModeDir | 0755
+	case fi.node.link != "":
+		return os.ModeSymlink | 0777
+	}
+	return 0644
+}
+
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+
+func (fi memFileInfo) IsDir() bool { return fi.node.dir }
+
+func (fi memFileInfo) Sys() interface{} { return nil }
@@ -0,0 +1,46 @@
+package os_brick
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	fs.WriteFile("/sys/devices/platform/host2/target2:0:0/2:0:0:1/rev", []byte("0001\n"))
+	fs.Symlink("../../devices/platform/host2/target2:0:0/2:0:0:1", "/sys/block/sdb/device")
+	fs.Symlink("/sys/block/sdb/device", "/dev/sdb-device")
+	fs.Symlink("/sys/block/sdc/device", "/dev/sdc-device")
+
+	if path, err := fs.EvalSymlinks("/dev/sdb-device/rev"); err != nil || path != "/sys/devices/platform/host2/target2:0:0/2:0:0:1/rev" {
+		t.Errorf("unexpected realpath %q, %v", path, err)
+	}
+	if link, err := fs.Readlink("/sys/block/sdb/device"); err != nil || link != "../../devices/platform/host2/target2:0:0/2:0:0:1" {
+		t.Errorf("unexpected link %q, %v", link, err)
+	}
+	if _, err := fs.Stat("/dev/sdc-device"); !os.IsNotExist(err) {
+		t.Errorf("expected dangling link to not exist, got %v", err)
+	}
+	f, err := fs.Open("/sys/block/sdb/device/rev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if content, _ := ioutil.ReadAll(f); string(content) != "0001\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+	if content, err := fs.ReadFile("/dev/sdb-device/rev"); err != nil || string(content) != "0001\n" {
+		t.Errorf("unexpected content %q, %v", content, err)
+	}
+	if matches, err := fs.Glob("/dev/sd*-device"); err != nil || len(matches) != 2 || matches[0] != "/dev/sdb-device" {
+		t.Errorf("unexpected matches %v, %v", matches, err)
+	}
+	infos, err := fs.ReadDir("/dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name() != "sdb-device" || infos[0].Mode()&os.ModeSymlink == 0 {
+		t.Errorf("unexpected dir entries %v", infos)
+	}
+}
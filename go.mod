@@ -1,3 +1,3 @@
 module github.com/ydcool/os-brick-go
 
-go 1.13
+go 1.18
@@ -1,33 +1,186 @@
 package connectors
 
 import (
+	"context"
+	"errors"
 	osBrick "github.com/ydcool/os-brick-go"
 	"github.com/ydcool/os-brick-go/initiator"
 	"log"
-	"path/filepath"
+	"math"
+	"sort"
+	"strings"
 	"time"
 )
 
+//flattenConnectionProperties Lift the fields of a Cinder connection_info
+//envelope, {"driver_volume_type": ..., "data": {...}}, to the top level.
+//
+//	Top level keys win over the ones under data. Properties without
+//	a data map are returned as is, otherwise a new map is returned.
+func flattenConnectionProperties(connectionProperties map[string]interface{}) map[string]interface{} {
+	data, ok := connectionProperties["data"].(map[string]interface{})
+	if !ok {
+		return connectionProperties
+	}
+	flat := make(map[string]interface{}, len(connectionProperties)+len(data))
+	for k, v := range data {
+		flat[k] = v
+	}
+	for k, v := range connectionProperties {
+		if k != "data" {
+			flat[k] = v
+		}
+	}
+	return flat
+}
+
+//volumeLocks serializes the operations on the same volume.
+var volumeLocks osBrick.KeyedMutex
+
+//VolumeKey Get the key identifying the volume of connection properties, its
+//target ports and luns, e.g. 20210002ac00383d:1,20220002ac00383d:1.
+func VolumeKey(connectionProperties map[string]interface{}) (string, error) {
+	connectionProperties = flattenConnectionProperties(connectionProperties)
+	//addTargetsToConnectionProperties normalizes the map in place
+	props := make(map[string]interface{}, len(connectionProperties))
+	for k, v := range connectionProperties {
+		props[k] = v
+	}
+	props, err := addTargetsToConnectionProperties(props)
+	if err != nil {
+		return "", err
+	}
+	targets := make([]string, 0)
+	for _, target := range props["targets"].([]initiator.Target) {
+		targets = append(targets, targetLunKey(target[0], target[1]))
+	}
+	sort.Strings(targets)
+	return strings.Join(targets, ","), nil
+}
+
+//LockVolume Lock the volume of connection properties, returns the func unlocking it.
+//
+//	ConnectVolume, DisconnectVolume, ExtendVolume and ReassembleMultipath
+//	lock the volume they operate on, so a connect and a disconnect of the
+//	same volume, e.g. a retry and a cancel, don't race on its devices. Use
+//	it to serialize other operations on the volume with them, the lock is
+//	not reentrant so don't call them while holding it. Each target port
+//	and lun of the volume is locked, the keys DisconnectAllForTarget
+//	locks from the paths of the volume it finds.
+func LockVolume(connectionProperties map[string]interface{}) func() {
+	key, err := VolumeKey(connectionProperties)
+	if err != nil {
+		//the operation fails on the same properties anyway
+		log.Printf("failed get the key of volume %#v, not locking it: %v", connectionProperties, err)
+		return func() {}
+	}
+	return lockTargetLuns(strings.Split(key, ","))
+}
+
+//targetLunKey Get the key of a target port and lun in volumeLocks, e.g.
+//20210002ac00383d:1.
+func targetLunKey(targetWWN, lun string) string {
+	return initiator.NormalizeWWN(targetWWN) + ":" + lun
+}
+
+//lockTargetLuns Lock the target port and lun keys of a volume, see
+//targetLunKey, returns the func unlocking them.
+//
+//	The keys are locked in order, so two operations sharing some of them
+//	can't deadlock.
+func lockTargetLuns(keys []string) func() {
+	keys = append([]string{}, keys...)
+	sort.Strings(keys)
+	unlocks := make([]func(), 0, len(keys))
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		unlocks = append(unlocks, volumeLocks.Lock(key))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+//EnforceMultipath makes ConnectVolume fail with initiator.ErrMultipathUnavailable
+//when use_multipath is requested on a host without the multipath tools, by
+//default it goes on with a single path.
+var EnforceMultipath = false
+
+//useMultipath Tell whether the connection uses multipath, use_multipath
+//defaults to true and is downgraded when the multipath tools are missing,
+//unless enforce is set.
+func useMultipath(connectionProperties map[string]interface{}, enforce bool) (bool, error) {
+	if um, ok := connectionProperties["use_multipath"].(bool); ok && !um {
+		return false, nil
+	}
+	if err := initiator.CheckMultipathTools(); err != nil {
+		if enforce {
+			return false, err
+		}
+		log.Printf("WARNING: use_multipath is requested but %v, using a single path", err)
+		return false, nil
+	}
+	return true, nil
+}
+
+//getMultipathTimeout Get the multipath_timeout of the connection properties,
+//in whole seconds, to wait for the multipath device. ok is false when it's
+//absent or invalid.
+func getMultipathTimeout(connProperties map[string]interface{}) (time.Duration, bool) {
+	v, ok := connProperties["multipath_timeout"]
+	if !ok || v == nil {
+		return 0, false
+	}
+	seconds, err := osBrick.ToInt64(v)
+	if err != nil || seconds < 0 || seconds > math.MaxInt64/int64(time.Second) {
+		log.Printf("invalid multipath_timeout %#v, using the default wait", v)
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
 //This method discovers a multipath device.
 //
 //	Discover a multipath device based on a defined connection_property
 //	and a device_wwn and return the multipath_id and path of the multipath
 //	enabled device if there is one.
-func discoverMPathDevice(deviceWwn string, connProperties map[string]interface{}, deviceName string) (string, string, error) {
-	path, err := initiator.FindMultipathDevicePath(deviceWwn)
+func discoverMPathDevice(ctx context.Context, deviceWwn string, connProperties map[string]interface{}, deviceName string) (string, string, error) {
+	if managed, err := initiator.IsMultipathManagedContext(ctx, deviceWwn, deviceName); err != nil {
+		log.Printf("failed check multipath manages %s, waiting for its multipath device: %v", deviceWwn, err)
+	} else if !managed {
+		//blacklisted, its multipath device will never show up
+		log.Printf("multipath doesn't manage %s, using the single path %s", deviceWwn, deviceName)
+		return deviceName, "", nil
+	}
+	var (
+		path string
+		err  error
+	)
+	if timeout, ok := getMultipathTimeout(connProperties); ok {
+		path, err = initiator.WaitForMultipathDeviceContext(ctx, deviceWwn, timeout)
+	} else {
+		path, err = initiator.FindMultipathDevicePathContext(ctx, deviceWwn)
+	}
 	if err != nil {
-		return "", "", err
+		if !DeferMultipathAssembly {
+			return "", "", err
+		}
+		log.Printf("%v, looking for the multipath device of %s", err, deviceName)
 	}
 	var (
 		devicePath, multipathID string
 	)
 	if path == "" {
 		//find_multipath_device only accept realpath not symbolic path
-		deviceRealPath, err := filepath.EvalSymlinks(deviceName)
+		deviceRealPath, err := osBrick.DefaultFS.EvalSymlinks(deviceName)
 		if err != nil {
 			return "", "", err
 		}
-		mPathInfo, err := initiator.FindMultipathDevice(deviceRealPath)
+		mPathInfo, err := initiator.FindMultipathDeviceContext(ctx, deviceRealPath)
 		if mPathInfo != nil && err == nil {
 			devicePath = mPathInfo["device"].(string)
 			multipathID = deviceWwn
@@ -43,12 +196,10 @@ func discoverMPathDevice(deviceWwn string, connProperties map[string]interface{}
 	if am, ok := connProperties["access_mode"]; ok && am != "ro" {
 		//Sometimes the multipath devices will show up as read only
 		//initially and need additional time/rescans to get to RW.
-		success := osBrick.RunWithRetry(5, time.Second, func(_ int) bool {
-			err := initiator.WaitForRW(deviceWwn, devicePath)
-			return err == nil
-		})
-		if !success {
-			log.Printf("block device %s is still read-only. Continuing anyway.", devicePath)
+		if err := initiator.WaitForRWContext(ctx, deviceWwn, devicePath); errors.Is(err, initiator.ErrDeviceReadOnly) {
+			return "", "", err
+		} else if err != nil {
+			log.Printf("failed check block device %s is read-write, continuing anyway: %v", devicePath, err)
 		}
 	}
 	return devicePath, multipathID, nil
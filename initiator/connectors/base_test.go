@@ -1 +1,290 @@
 package connectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	osBrick "github.com/ydcool/os-brick-go"
+	"github.com/ydcool/os-brick-go/initiator"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//tempDir creates a temporary directory removed when the test ends.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "connectors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+//newFakeSysFS points initiator.SysFSRoot at a temporary directory for the test.
+func newFakeSysFS(t *testing.T) string {
+	dir := tempDir(t)
+	root := initiator.SysFSRoot
+	initiator.SysFSRoot = dir
+	t.Cleanup(func() { initiator.SysFSRoot = root })
+	return dir
+}
+
+//fakeExecutor replaces the command executors with handler for the test, the
+//env of ExecuteEnv is dropped.
+func fakeExecutor(t *testing.T, handler osBrick.Executor) {
+	e, env := osBrick.DefaultExecutor, osBrick.DefaultEnvExecutor
+	osBrick.DefaultExecutor = handler
+	osBrick.DefaultEnvExecutor = func(_ []string, name string, arg ...string) (string, error) {
+		return handler(name, arg...)
+	}
+	t.Cleanup(func() { osBrick.DefaultExecutor, osBrick.DefaultEnvExecutor = e, env })
+}
+
+//writeFakeFile creates a file with content under root, creating parents.
+func writeFakeFile(t *testing.T, root, path, content string) {
+	p := filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//symlink creates a symlink under root, creating parents.
+func symlink(t *testing.T, root, target, path string) {
+	p := filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//newFakeByPath points DevDiskByPathRoot at a temporary directory for the test.
+func newFakeByPath(t *testing.T) string {
+	dir := tempDir(t)
+	root := DevDiskByPathRoot
+	DevDiskByPathRoot = dir
+	Reset()
+	t.Cleanup(func() {
+		DevDiskByPathRoot = root
+		Reset()
+	})
+	return dir
+}
+
+//fakeFCHost A fake host with a single FC HBA, and a scanned device sdb behind
+//the by-path entry for target 20210002ac00383d lun 1.
+type fakeFCHost struct {
+	sysfs  string
+	byPath string
+	dev    string
+	//handler answers the commands not handled by the fake host itself
+	handler osBrick.Executor
+	//missing are the commands reported as not installed
+	missing map[string]bool
+	//systool is the output of systool -c fc_host -v
+	systool string
+}
+
+const fakeSystoolOutput = `Class = "fc_host"
+
+  Class Device = "host2"
+  Class Device path = "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.2/host2/fc_host/host2"
+    node_name           = "0x200010604b010459"
+    port_name           = "0x100010604b010459"
+    port_state          = "Online"
+
+    Device = "host2"
+    Device path = "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.2/host2"
+
+
+`
+
+func newFakeFCHost(t *testing.T) *fakeFCHost {
+	h := &fakeFCHost{sysfs: newFakeSysFS(t), byPath: newFakeByPath(t), dev: tempDir(t), missing: make(map[string]bool), systool: fakeSystoolOutput}
+	//the fake devices are plain files, read them without dd
+	validator := osBrick.DefaultDeviceValidator
+	osBrick.DefaultDeviceValidator = osBrick.ReadValidDevice
+	t.Cleanup(func() { osBrick.DefaultDeviceValidator = validator })
+	//scsi_id is faked, no need to wait for the device to settle
+	interval := initiator.SCSIWWNRetryInterval
+	initiator.SCSIWWNRetryInterval = time.Millisecond
+	t.Cleanup(func() { initiator.SCSIWWNRetryInterval = interval })
+	//every command is installed unless the test says otherwise
+	lookup := osBrick.DefaultPathLookup
+	osBrick.DefaultPathLookup = func(file string) (string, error) {
+		if h.missing[filepath.Base(file)] {
+			return "", exec.ErrNotFound
+		}
+		return "/usr/sbin/" + filepath.Base(file), nil
+	}
+	t.Cleanup(func() { osBrick.DefaultPathLookup = lookup })
+	writeFakeFile(t, h.sysfs, "class/fc_host/host2/port_name", "0x100010604b010459\n")
+	writeFakeFile(t, h.sysfs, "block/sdb/device/delete", "")
+	symlink(t, h.sysfs, "../../block/sdb", "class/block/sdb")
+	writeFakeFile(t, h.dev, "sdb", "")
+	symlink(t, h.byPath, filepath.Join(h.dev, "sdb"), "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1")
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch name {
+		case "systool":
+			return h.systool, nil
+		}
+		if h.handler != nil {
+			return h.handler(name, arg...)
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	return h
+}
+
+//deleted tells whether the device was removed through sysfs.
+func (h *fakeFCHost) deleted(t *testing.T, device string) bool {
+	out, err := ioutil.ReadFile(filepath.Join(h.sysfs, "block", device, "device/delete"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out) == "1\n"
+}
+
+//fcConnectionProperties The single lun example of the ConnectVolume doc.
+func fcConnectionProperties() map[string]interface{} {
+	return map[string]interface{}{
+		"target_discovered": true,
+		"encrypted":         false,
+		"target_lun":        "1",
+		"access_mode":       "rw",
+		"target_wwn":        []string{"20210002AC00383D"},
+		"use_multipath":     false,
+	}
+}
+
+//fastDeviceScan shortens the device scan interval for the test.
+func fastDeviceScan(t *testing.T) {
+	interval := DeviceScanInterval
+	DeviceScanInterval = time.Millisecond
+	t.Cleanup(func() { DeviceScanInterval = interval })
+}
+
+func TestConnectVolumeMultipathUnavailable(t *testing.T) {
+	for _, enforce := range []bool{false, true} {
+		h := newFakeFCHost(t)
+		h.missing["multipathd"] = true
+		scanned := false
+		h.handler = func(name string, arg ...string) (string, error) {
+			switch name {
+			case "/lib/udev/scsi_id":
+				scanned = true
+				return "3600a0980383036347224000000000001\n", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		}
+		defer func(e bool) { EnforceMultipath = e }(EnforceMultipath)
+		EnforceMultipath = enforce
+		props := fcConnectionProperties()
+		props["use_multipath"] = true
+
+		info, err := ConnectVolume(props)
+		if enforce {
+			if !errors.Is(err, initiator.ErrMultipathUnavailable) {
+				t.Fatalf("expected ErrMultipathUnavailable, got %v", err)
+			}
+			if scanned {
+				t.Error("expected to fail before looking for the device")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := info["multipath_id"]; ok || info["path"] != filepath.Join(h.byPath, "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1") {
+			t.Errorf("expected a single path attach, got %v", info)
+		}
+	}
+}
+
+func TestDisconnectVolumeMultipathUnavailable(t *testing.T) {
+	newMemFSHost(t, func(name string, arg ...string) (string, error) {
+		if name == "sg_scan" {
+			return arg[0] + ": scsi2 channel=0 id=0 lun=1\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	lookup := osBrick.DefaultPathLookup
+	osBrick.DefaultPathLookup = func(file string) (string, error) {
+		if filepath.Base(file) == "multipathd" {
+			return "", exec.ErrNotFound
+		}
+		return "/usr/sbin/" + filepath.Base(file), nil
+	}
+	defer func() { osBrick.DefaultPathLookup = lookup }()
+	defer func(e bool) { EnforceMultipath = e }(EnforceMultipath)
+	EnforceMultipath = true
+	defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+	removed := make([]string, 0)
+	removeSCSIDevice = func(_ context.Context, device string, flush bool) error {
+		removed = append(removed, device)
+		return nil
+	}
+	props := fcConnectionProperties()
+	props["use_multipath"] = true
+
+	//only a new attach is refused, the volume is still detached
+	if err := DisconnectVolume(props, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, []string{"/dev/sdb"}) {
+		t.Errorf("expected sdb removed, got %v", removed)
+	}
+}
+
+func TestLockVolume(t *testing.T) {
+	newMemFSHost(t, func(name string, arg ...string) (string, error) {
+		if name == "sg_scan" {
+			return arg[0] + ": scsi2 channel=0 id=0 lun=1\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+	removeSCSIDevice = func(context.Context, string, bool) error { return nil }
+
+	//the same volume with the wwn in another case
+	props := fcConnectionProperties()
+	props["target_wwn"] = []string{"20210002ac00383d"}
+	unlock := LockVolume(props)
+	done := make(chan error, 1)
+	go func() {
+		done <- DisconnectVolume(fcConnectionProperties(), nil)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("disconnect ran while the volume was locked: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	//other volumes aren't held up
+	other := fcConnectionProperties()
+	other["target_lun"] = "2"
+	locked := make(chan struct{})
+	go func() {
+		LockVolume(other)()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("another volume was blocked by the lock")
+	}
+
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
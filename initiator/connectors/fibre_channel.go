@@ -9,6 +9,8 @@ Inspired by github.com/openstack/os-brick
 package connectors
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	osBrick "github.com/ydcool/os-brick-go"
 	"github.com/ydcool/os-brick-go/initiator"
@@ -17,9 +19,91 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 )
 
+var pciAddressRegex = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-9a-f]+$`)
+
+var (
+	//ErrVolumeDeviceNotFound is returned by ConnectVolume when the volume
+	//can't show up on this host, no HBA is connected to its target ports.
+	ErrVolumeDeviceNotFound = errors.New("fibre Channel volume device not found")
+
+	//ErrDeviceDiscoveryTimeout is returned by ConnectVolume when the target
+	//ports are connected but the volume device didn't show up in the
+	//device scans, see device_scan_attempts.
+	ErrDeviceDiscoveryTimeout = errors.New("timed out waiting for the fibre Channel volume device")
+
+	//ErrEmptySCSIWWN is returned by ConnectVolume when the device has no
+	//WWN on page 0x83 and FailOnEmptyWWN is set.
+	ErrEmptySCSIWWN = errors.New("device has no scsi wwn")
+)
+
+//DevDiskByPathRoot is where the by-path device links are looked for,
+//override it when the host /dev is mounted elsewhere (e.g. containers).
+var DevDiskByPathRoot = "/dev/disk/by-path"
+
+//DeviceScanInterval is the interval between the device scans of ConnectVolume.
+var DeviceScanInterval = time.Second * 5
+
+//FailureCleanupMode What ConnectVolume does with the devices it scanned when
+//the attach fails.
+type FailureCleanupMode int
+
+const (
+	//CleanupOnFailure flushes and removes the devices scanned in by the
+	//failed call, the devices already there before it are left alone.
+	CleanupOnFailure FailureCleanupMode = iota
+	//KeepOnFailure leaves the scanned devices in place.
+	KeepOnFailure
+	//KeepAndLogOnFailure leaves the scanned devices in place and logs
+	//their /dev/sdX paths so they can be inspected.
+	KeepAndLogOnFailure
+)
+
+//ConnectFailureCleanup is applied to the scanned devices when ConnectVolume
+//fails, they're kept by default.
+var ConnectFailureCleanup = KeepOnFailure
+
+//EnableQoS applies connection_properties["qos_specs"] to the attached
+//device through the blkio cgroup after a successful attach.
+var EnableQoS = false
+
+//DeferMultipathAssembly makes ConnectVolume return the single path found
+//when multipath is requested but no multipath device is assembled yet,
+//flagged by "multipath_pending" along with the "expected_paths", so it can
+//be picked up by ReassembleMultipath once the other paths are up.
+var DeferMultipathAssembly = false
+
+//FailOnDegradedMultipath makes ConnectVolume fail when some paths of the
+//multipath device are failed, by default they are reported in failed_paths.
+var FailOnDegradedMultipath = false
+
+//FailOnEmptyWWN makes ConnectVolume fail with ErrEmptySCSIWWN when the device
+//has no WWN, by default the device is attached as a single path without it.
+var FailOnEmptyWWN = false
+
+//SCSIQueueDepth is set as queue depth of every path of an attached volume,
+//0 keeps the device default.
+var SCSIQueueDepth = 0
+
+//IOScheduler is set as io scheduler of every path of an attached volume,
+//e.g. none or mq-deadline, empty keeps the device default.
+var IOScheduler = ""
+
+//SettleUdev makes ConnectVolume wait for udev after scanning the hosts, so
+//the by-path links of the new devices are there when they are looked for.
+var SettleUdev = true
+
+//UdevSettleTimeout is the longest ConnectVolume waits for udev on each scan.
+var UdevSettleTimeout = time.Second * 10
+
+//TeardownFCoEOnLastVolume makes DisconnectVolume destroy the FCoE interface a
+//volume was attached through once no other volume is left on it.
+var TeardownFCoEOnLastVolume = false
+
 //Connect to a volume.
 //
 //  The connection_properties describes the information needed by
@@ -90,82 +174,409 @@ import (
 //  :param connection_properties: The dictionary that describes all
 //                                of the target volume attributes.
 //  :type connection_properties: dict
-//  :returns: map[string]string{"path":"/dev/disk/by-path/pci-0000:08:00.0-fc-0x2100001b32808c84-lun-1", "scsi_wwn":"23265626235666332", "type":"block"}
+//  :returns: map[string]string{"path":"/dev/disk/by-path/pci-0000:08:00.0-fc-0x2100001b32808c84-lun-1", "scsi_wwn":"23265626235666332", "type":"block", "device_kind":"disk"}
+//
+//  When the multipath device has failed paths they are listed in the
+//  comma separated "failed_paths", see FailOnDegradedMultipath.
+//
+//  The serial of page 0x80 is returned as "serial" when the device has one.
+//  A device without WWN is attached as a single path, see FailOnEmptyWWN.
+//  The optional multipath_timeout, in seconds, is how long the multipath
+//  device of the volume is waited for, e.g. for slow arrays.
+//
+//  When the device doesn't show up the error wraps ErrVolumeDeviceNotFound
+//  or ErrDeviceDiscoveryTimeout, to tell a volume not exported to this host
+//  from one worth retrying.
 func ConnectVolume(connectionProperties map[string]interface{}) (map[string]string, error) {
+	return ConnectVolumeContext(context.Background(), connectionProperties)
+}
+
+//ConnectVolumeContext Attach the volume like ConnectVolume, running the
+//commands with the executor of ctx, see osBrick.WithExecutor.
+//
+//	ctx only picks the executor, the attach isn't cut short when ctx is
+//	done.
+func ConnectVolumeContext(ctx context.Context, connectionProperties map[string]interface{}) (_ map[string]string, err error) {
 	deviceInfo := map[string]string{
 		"type": "block",
 	}
+	connectionProperties = flattenConnectionProperties(connectionProperties)
+	unlock := LockVolume(connectionProperties)
+	defer unlock()
 	connProperties, err := addTargetsToConnectionProperties(connectionProperties)
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("add Targets To connProps: %#v", connProperties)
-	hbas, err := initiator.GetFCHBAsInfo()
+	//see if the new drive could be part of a multipath device before scanning
+	multipath, err := useMultipath(connProperties, EnforceMultipath)
+	if err != nil {
+		return nil, err
+	}
+	hbas, err := initiator.GetFCHBAsInfoContext(ctx)
 	log.Printf("FC HBAs Info: %#v", hbas)
 	if err != nil {
 		return nil, err
 	}
 	if len(hbas) == 0 {
-		return nil, fmt.Errorf("we are unable to locate any Fibre Channel devices")
+		return nil, fmt.Errorf("%w: we are unable to locate any Fibre Channel devices", ErrVolumeDeviceNotFound)
 	}
 	hostDevices, err := getPossibleVolumePaths(connProperties["targets"].([]initiator.Target), hbas)
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("possibleVolumePaths: %#v", hostDevices)
+	//the devices there before the scans aren't this call's to remove
+	existing := getScannedDevices(hostDevices)
+	defer func() {
+		if err != nil {
+			handleConnectFailure(ctx, hostDevices, existing)
+		}
+	}()
+	if discovered, ok := connProperties["target_discovered"].(bool); ok && !discovered {
+		//the array hasn't registered the target with us, look for it first
+		initiator.DiscoverFCTargets(hbas, connProperties)
+	}
 
 	var hostDevice, deviceName string
 	// The /dev/disk/by-path/... node is not always present immediately
 	// We only need to find the first device.  Once we see the first device
 	// multipath will have any others.
-	if !osBrick.RunWithRetry(initiator.DeviceScanAttemptsDefault, time.Second*5, func(_ int) bool {
+	findDevice := func(_ int) bool {
 		for _, dev := range hostDevices {
 			if osBrick.IsFileExists(dev) && osBrick.CheckValidDevice(dev) {
 				//get the /dev/sdX device. This is used to find the multipath device.
 				hostDevice = dev
-				deviceName, _ = filepath.EvalSymlinks(dev)
+				deviceName, _ = osBrick.DefaultFS.EvalSymlinks(dev)
 				return true
 			}
 		}
 		initiator.RescanHosts(hbas, connProperties)
+		settleUdev(ctx)
 		return false
-	}) {
-		return nil, fmt.Errorf("fibre Channel volume device not found")
+	}
+	settleUdev(ctx)
+	scanAttempts := getDeviceScanAttempts(connProperties)
+	if !osBrick.RunWithRetry(scanAttempts, DeviceScanInterval, findDevice) {
+		targets := connProperties["targets"].([]initiator.Target)
+		//on a slow fabric the target ports may still be logging in
+		if blocked := getBlockedTargetPorts(targets); len(blocked) > 0 {
+			log.Printf("target ports %v still blocked, extending device scan", blocked)
+			if !osBrick.RunWithRetry(scanAttempts, DeviceScanInterval, findDevice) {
+				return nil, missingDeviceError(targets)
+			}
+		} else {
+			return nil, missingDeviceError(targets)
+		}
 	}
 
-	//find out the WWN of the device
-	deviceWwn, err := initiator.GetSCSIWWN(hostDevice)
-	if err != nil {
+	//find out the WWN of the device, it may still be settling
+	var deviceWwn string
+	scsiID, err := initiator.WaitForSCSIIDContext(ctx, hostDevice)
+	switch {
+	case errors.Is(err, initiator.ErrNoSCSIID):
+		//e.g. a passthrough device, scsi_id works but reports nothing
+		log.Printf("device %s has no scsi id: %v", hostDevice, err)
+	case err != nil:
 		return nil, err
+	case scsiID.Type == initiator.SCSIIDTypeWWN:
+		deviceWwn = scsiID.ID
+		deviceInfo["scsi_wwn"] = deviceWwn
+		//some backends reuse a WWN across snapshots, the serial tells them apart
+		if serial, err := initiator.GetSCSISerialContext(ctx, hostDevice); err != nil {
+			log.Printf("failed get serial of %s: %v", hostDevice, err)
+		} else if serial != "" {
+			deviceInfo["serial"] = serial
+		}
+	default:
+		deviceInfo["scsi_serial"] = scsiID.ID
+		deviceInfo["serial"] = scsiID.ID
+	}
+	if deviceWwn == "" && FailOnEmptyWWN {
+		return nil, fmt.Errorf("%w: %s", ErrEmptySCSIWWN, hostDevice)
 	}
-	deviceInfo["scsi_wwn"] = deviceWwn
 	//see if the new drive is part of a multipath device.  If so, we'll use the multipath device.
-	var (
-		devicePath   string
-		useMultipath = true
-	)
-	if um, ok := connProperties["use_multipath"]; ok {
-		if umb, ok := um.(bool); ok {
-			useMultipath = umb
-		}
+	var devicePath string
+	if multipath && deviceWwn == "" {
+		//the multipath device can't be looked up without the wwn
+		log.Printf("device %s has no wwn, not using multipath", hostDevice)
+		multipath = false
 	}
-	if useMultipath {
+	if multipath {
 		var multipathId string
-		devicePath, multipathId, err = discoverMPathDevice(deviceWwn, connProperties, deviceName)
+		devicePath, multipathId, err = discoverMPathDevice(ctx, deviceWwn, connProperties, deviceName)
 		if err != nil {
 			return nil, err
 		}
+		if multipathId == "" && DeferMultipathAssembly {
+			//the other paths may come up later, see ReassembleMultipath
+			log.Printf("no multipath device for %s yet, using %s until it is reassembled", deviceWwn, devicePath)
+			deviceInfo["multipath_pending"] = "true"
+			deviceInfo["expected_paths"] = strings.Join(hostDevices, ",")
+		}
 		if multipathId != "" {
 			// only set the multipath_id if we found one
 			deviceInfo["multipath_id"] = multipathId
+			//the map may have assembled with some paths already failed
+			if failed, err := initiator.GetFailedMultipathPathsContext(ctx, devicePath); err != nil {
+				log.Printf("failed check the paths of multipath device %s: %v", devicePath, err)
+			} else if len(failed) > 0 {
+				log.Printf("WARNING: multipath device %s has failed paths %v", devicePath, failed)
+				deviceInfo["failed_paths"] = strings.Join(failed, ",")
+				if FailOnDegradedMultipath {
+					return nil, fmt.Errorf("multipath device %s has failed paths: %s", devicePath, deviceInfo["failed_paths"])
+				}
+			}
 		}
 	} else {
 		devicePath = hostDevice
 	}
 	deviceInfo["path"] = devicePath
+	if kind, err := initiator.GetDeviceKind(devicePath); err != nil {
+		log.Printf("failed get device kind of %s: %v", devicePath, err)
+	} else {
+		deviceInfo["device_kind"] = kind
+	}
+	if SCSIQueueDepth > 0 {
+		for _, dev := range getScannedDevices(hostDevices) {
+			if err = initiator.SetSCSIQueueDepth(dev, SCSIQueueDepth); err != nil {
+				return nil, fmt.Errorf("failed set queue depth of %s: %v", dev, err)
+			}
+		}
+	}
+	if IOScheduler != "" {
+		for _, dev := range getScannedDevices(hostDevices) {
+			if err = initiator.SetIOScheduler(dev, IOScheduler); err != nil {
+				return nil, fmt.Errorf("failed set io scheduler of %s: %v", dev, err)
+			}
+		}
+	}
+	if EnableQoS {
+		spec, err := initiator.ParseQoSSpec(connProperties)
+		if err != nil {
+			return nil, err
+		}
+		if err = initiator.ApplyQoSSpec(devicePath, spec); err != nil {
+			return nil, fmt.Errorf("failed apply qos specs to %s: %v", devicePath, err)
+		}
+	}
 	return deviceInfo, nil
 }
 
+//settleUdev Wait for udev to create the device links, see SettleUdev.
+func settleUdev(ctx context.Context) {
+	if !SettleUdev {
+		return
+	}
+	if err := initiator.UdevSettleContext(ctx, UdevSettleTimeout); err != nil {
+		log.Printf("failed settle udev: %v", err)
+	}
+}
+
+//ReassembleMultipath Pick up the paths of a volume that came up after it was
+//connected with a single path, see DeferMultipathAssembly, and return the
+//device info of its multipath device.
+//
+//	When the expected_paths returned by ConnectVolume are passed along in
+//	connectionProperties, it fails until all of them are up and only they
+//	are added. The paths must share the WWN of the volume.
+func ReassembleMultipath(connectionProperties map[string]interface{}) (map[string]string, error) {
+	connectionProperties = flattenConnectionProperties(connectionProperties)
+	unlock := LockVolume(connectionProperties)
+	defer unlock()
+	connProperties, err := addTargetsToConnectionProperties(connectionProperties)
+	if err != nil {
+		return nil, err
+	}
+	hbas, err := initiator.GetFCHBAsInfo()
+	if err != nil {
+		return nil, err
+	}
+	initiator.RescanHosts(hbas, connProperties)
+	volumePaths, err := GetVolumePaths(connProperties["targets"].([]initiator.Target))
+	if err != nil {
+		return nil, fmt.Errorf("failed get volume paths: %v", err)
+	}
+	if expected := getExpectedPaths(connProperties); len(expected) > 0 {
+		up := make(map[string]bool, len(volumePaths))
+		for _, path := range volumePaths {
+			up[path] = true
+		}
+		missing := make([]string, 0)
+		for _, path := range expected {
+			if !up[path] {
+				missing = append(missing, path)
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("expected paths %v of the volume are not up yet", missing)
+		}
+		volumePaths = expected
+	}
+	if len(volumePaths) < 2 {
+		return nil, fmt.Errorf("only %d paths of the volume are up, can't assemble a multipath device", len(volumePaths))
+	}
+	wwns, err := initiator.GetSCSIWWNs(volumePaths)
+	if err != nil {
+		return nil, err
+	}
+	var wwn string
+	paths := make([]string, 0, len(volumePaths))
+	for _, path := range volumePaths {
+		w, ok := wwns[path]
+		if !ok {
+			log.Printf("skip volume path %s, its wwn is unknown", path)
+			continue
+		}
+		if wwn == "" {
+			wwn = w
+		} else if w != wwn {
+			return nil, fmt.Errorf("volume path %s has wwn %s, not %s of the other paths", path, w, wwn)
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) < 2 {
+		return nil, fmt.Errorf("only %d paths of the volume have a wwn, can't assemble a multipath device", len(paths))
+	}
+	for _, path := range paths {
+		device, err := initiator.ResolveBlockDevice(path)
+		if err != nil {
+			log.Printf("skip volume path %s: %v", path, err)
+			continue
+		}
+		if err := initiator.MultipathAddPath(device); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	devicePath, err := initiator.FindMultipathDevicePath(wwn)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"type":         "block",
+		"path":         devicePath,
+		"scsi_wwn":     wwn,
+		"multipath_id": wwn,
+	}, nil
+}
+
+//getExpectedPaths Get the expected_paths of the connection properties, the
+//comma separated string of ConnectVolume or a list.
+func getExpectedPaths(connProperties map[string]interface{}) []string {
+	switch v := connProperties["expected_paths"].(type) {
+	case string:
+		if v != "" {
+			return strings.Split(v, ",")
+		}
+	case []string:
+		return v
+	}
+	return nil
+}
+
+//getDeviceScanAttempts Get the device_scan_attempts of the connection
+//properties, initiator.DeviceScanAttemptsDefault when absent or invalid.
+func getDeviceScanAttempts(connProperties map[string]interface{}) int {
+	v, ok := connProperties["device_scan_attempts"]
+	if !ok || v == nil {
+		return initiator.DeviceScanAttemptsDefault
+	}
+	attempts, err := osBrick.ToInt64(v)
+	if err != nil || attempts < 1 {
+		log.Printf("invalid device_scan_attempts %#v, using %d", v, initiator.DeviceScanAttemptsDefault)
+		return initiator.DeviceScanAttemptsDefault
+	}
+	return int(attempts)
+}
+
+//getBlockedTargetPorts Get the target WWPNs whose remote port is Blocked.
+func getBlockedTargetPorts(targets []initiator.Target) []string {
+	states, err := initiator.GetFCRemotePortStates()
+	if err != nil {
+		log.Printf("failed get fc remote port states: %v", err)
+		return nil
+	}
+	blocked := make([]string, 0)
+	for _, t := range targets {
+		if wwpn := initiator.NormalizeWWN(t[0]); states[wwpn] == "Blocked" {
+			blocked = append(blocked, wwpn)
+		}
+	}
+	return blocked
+}
+
+//missingDeviceError Tell a transient fabric delay from a masking problem
+//when the volume device didn't show up.
+//
+//	ErrVolumeDeviceNotFound is wrapped when none of the target ports is
+//	logged in, ErrDeviceDiscoveryTimeout otherwise.
+func missingDeviceError(targets []initiator.Target) error {
+	states, err := initiator.GetFCRemotePortStates()
+	if err != nil {
+		return fmt.Errorf("%w: unable to check target port states: %v", ErrDeviceDiscoveryTimeout, err)
+	}
+	blocked, online := make([]string, 0), 0
+	for _, t := range targets {
+		wwpn := initiator.NormalizeWWN(t[0])
+		switch states[wwpn] {
+		case "Online":
+			online++
+		case "Blocked":
+			blocked = append(blocked, wwpn)
+		}
+	}
+	if len(blocked) > 0 {
+		return fmt.Errorf("%w: target port still blocked: %v", ErrDeviceDiscoveryTimeout, blocked)
+	}
+	if online > 0 {
+		return fmt.Errorf("%w: target ports online, LUN not masked to this host", ErrDeviceDiscoveryTimeout)
+	}
+	return fmt.Errorf("%w: no target port logged in, check the zoning", ErrVolumeDeviceNotFound)
+}
+
+//getScannedDevices Get the /dev/sdX devices behind the host device paths which showed up.
+func getScannedDevices(hostDevices []string) []string {
+	devices := make([]string, 0)
+	for _, dev := range hostDevices {
+		if realPath, err := osBrick.DefaultFS.EvalSymlinks(dev); err == nil {
+			devices = append(devices, "/dev/"+filepath.Base(realPath))
+		}
+	}
+	return devices
+}
+
+//handleConnectFailure Deal with the devices scanned in by a failed
+//ConnectVolume according to ConnectFailureCleanup, existing are the devices
+//found before it scanned.
+func handleConnectFailure(ctx context.Context, hostDevices []string, existing []string) {
+	found := make(map[string]bool, len(existing))
+	for _, dev := range existing {
+		found[dev] = true
+	}
+	devices := make([]string, 0)
+	for _, dev := range getScannedDevices(hostDevices) {
+		if !found[dev] {
+			devices = append(devices, dev)
+		}
+	}
+	if len(devices) == 0 {
+		return
+	}
+	switch ConnectFailureCleanup {
+	case KeepOnFailure:
+		return
+	case KeepAndLogOnFailure:
+		log.Printf("connect volume failed, keeping scanned devices: %v", devices)
+		return
+	}
+	log.Printf("connect volume failed, removing scanned devices: %v", devices)
+	for _, dev := range devices {
+		if err := removeSCSIDevice(ctx, dev, true); err != nil {
+			log.Printf("failed remove scsi device %s, ERROR: %v", dev, err)
+		}
+	}
+}
+
 //Detach the volume from instance_name.
 //
 //	:param connection_properties: The dictionary that describes all
@@ -177,42 +588,139 @@ func ConnectVolume(connectionProperties map[string]interface{}) (map[string]stri
 //	connection_properties for Fibre Channel must include:
 //	target_wwn - World Wide Name
 //	target_lun - LUN id of the volume
+//
+//	A volume already detached isn't an error, nil is returned.
+//	The multipath_id of device_info, or of connection_properties, is used
+//	to find the multipath device when given, instead of reading the wwn
+//	of the paths.
 func DisconnectVolume(connectionProperties map[string]interface{}, deviceInfo map[string]string) error {
-	useMultipath := true
-	if um, ok := connectionProperties["use_multipath"]; ok {
-		if umb, ok := um.(bool); ok {
-			useMultipath = umb
-		}
+	return disconnectVolume(context.Background(), connectionProperties, deviceInfo, &pendingDevices{})
+}
+
+//DisconnectVolumeContext Detach the volume like DisconnectVolume, until ctx is done.
+//
+//	The commands are run with the executor of ctx, see osBrick.WithExecutor.
+//	A multipath flush running when ctx is done is killed and ctx.Err()
+//	is returned, leaving the devices in place.
+func DisconnectVolumeContext(ctx context.Context, connectionProperties map[string]interface{}, deviceInfo map[string]string) error {
+	return disconnectVolume(ctx, connectionProperties, deviceInfo, &pendingDevices{})
+}
+
+//DisconnectVolumeWithTimeout Detach the volume like DisconnectVolume, giving up after timeout.
+//
+//	When the timeout expires or some devices couldn't be removed an
+//	*OrphanedDevicesError listing the devices left behind is returned.
+//	A multipath flush still running at the timeout is killed, the other
+//	removal steps keep running in the background.
+func DisconnectVolumeWithTimeout(connectionProperties map[string]interface{}, deviceInfo map[string]string, timeout time.Duration) error {
+	pending := &pendingDevices{}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return runWithTimeout(timeout, pending, func() error {
+		return disconnectVolume(ctx, connectionProperties, deviceInfo, pending)
+	})
+}
+
+//DetachRequest A volume to detach with DisconnectVolumes, the arguments of DisconnectVolume.
+type DetachRequest struct {
+	ConnectionProperties map[string]interface{}
+	DeviceInfo           map[string]string
+}
+
+//DisconnectVolumes Detach many volumes, up to concurrency of them at once.
+//
+//	The multipath maps of the volumes are flushed concurrently, which is
+//	what makes a mass detach slow, while the removals of the scsi devices
+//	stay serialized. Returns the error of each request, in order, nil for
+//	the volumes detached.
+func DisconnectVolumes(list []DetachRequest, concurrency int) []error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	errs := make([]error, len(list))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i, req := range list {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, req DetachRequest) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = DisconnectVolume(req.ConnectionProperties, req.DeviceInfo)
+		}(i, req)
 	}
+	wg.Wait()
+	return errs
+}
+
+//flushMultipathDevice is replaced in tests to fake multipath -f.
+var flushMultipathDevice = initiator.FlushMultipathDeviceContext
+
+func disconnectVolume(ctx context.Context, connectionProperties map[string]interface{}, deviceInfo map[string]string, pending *pendingDevices) error {
+	connectionProperties = flattenConnectionProperties(connectionProperties)
+	unlock := LockVolume(connectionProperties)
+	defer unlock()
+	//a volume attached before the multipath tools went away is still detached
+	multipath, _ := useMultipath(connectionProperties, false)
 	devices := make([]map[string]string, 0)
 	connProperties, err := addTargetsToConnectionProperties(connectionProperties)
 	if err != nil {
-		log.Printf("failed addTargetsToConnectionProperties: %#v, ERROR:%v", connectionProperties, err)
+		return err
 	}
-	volumePaths, err := GetVolumePaths(connProperties["targets"].([]initiator.Target))
+	volumePaths, err := getVolumePaths(ctx, connProperties["targets"].([]initiator.Target))
 	if err != nil {
 		return fmt.Errorf("failed get volume paths: %v", err)
 	}
 	log.Printf("get volume paths: %#v", volumePaths)
+	pending.set(volumePaths)
+	//an open dm-crypt mapper keeps the devices busy
+	for _, path := range volumePaths {
+		if err := initiator.CloseCryptHoldersContext(ctx, path); err != nil {
+			return err
+		}
+	}
 	mPathPath := ""
+	//find and flush the multipath device of the volume
+	flushMultipath := func(wwn string) error {
+		mPathPath, err = initiator.FindMultipathDevicePathContext(ctx, wwn)
+		if err != nil {
+			log.Printf("failed find multipath device path for wwn: %s, ERROR:%v", wwn, err)
+		} else if mPathPath != "" {
+			if err := flushMultipathDevice(ctx, mPathPath); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				log.Printf("failed flush multipath device %s, ERROR:%v", mPathPath, err)
+			}
+		}
+		return nil
+	}
+	var wwns map[string]string
+	multipathID := deviceInfo["multipath_id"]
+	if multipathID == "" {
+		multipathID, _ = connectionProperties["multipath_id"].(string)
+	}
+	if multipath && multipathID != "" {
+		//known since the connect, no need to read it from the paths
+		if err := flushMultipath(multipathID); err != nil {
+			return err
+		}
+	} else if multipath {
+		//one scsi_id per path, run them all at once
+		if wwns, err = initiator.GetSCSIWWNsContext(ctx, volumePaths); err != nil {
+			log.Printf("failed get scsi wwns for paths %v, ERROR:%v", volumePaths, err)
+		}
+	}
 	for _, path := range volumePaths {
 		realPath := initiator.GetNameFromPath(path)
-		if useMultipath && mPathPath != "" && osBrick.CheckValidDevice(path) {
-			wwn, err := initiator.GetSCSIWWN(path)
-			if err != nil {
-				log.Printf("failed get scsi wwn for path %s, ERROR:%v", path, err)
-				continue
-			}
-			mPathPath, err = initiator.FindMultipathDevicePath(wwn)
-			if err != nil {
-				log.Printf("failed find multipath device path for wwn: %s, ERROR:%v", wwn, err)
-				continue
-			}
-			if mPathPath != "" {
-				initiator.FlushMultipathDevice(mPathPath)
+		if wwn, ok := wwns[path]; ok && mPathPath == "" && osBrick.CheckValidDevice(path) {
+			if err := flushMultipath(wwn); err != nil {
+				return err
 			}
 		}
-		deviceInfo, err := initiator.GetDeviceInfo(realPath)
+		deviceInfo, err := initiator.GetDeviceInfoContext(ctx, realPath)
 		if err != nil {
 			log.Printf("failed get device info for path: %s, ERROR:%v", realPath, err)
 			continue
@@ -221,27 +729,125 @@ func DisconnectVolume(connectionProperties map[string]interface{}, deviceInfo ma
 	}
 
 	if len(devices) == 0 {
-		return fmt.Errorf("no device to remove")
+		//already detached, e.g. a retried NodeUnstage
+		log.Printf("no device to remove for targets %v, volume already detached", connProperties["targets"])
+		return nil
 	}
 	log.Printf("devices to remove = %#v", devices)
-	err = removeDevices(connProperties, devices, deviceInfo)
+	err = removeDevices(ctx, connProperties, devices, deviceInfo, pending)
 	if err != nil {
-		return fmt.Errorf("failed remove devices %#v: %v", devices, err)
+		return err
 	}
 	log.Print("devices removed successfully")
+	if TeardownFCoEOnLastVolume {
+		teardownIdleFCoEInterfaces(ctx, devices)
+	}
 	return nil
 }
 
+//teardownIdleFCoEInterfaces Destroy the FCoE interfaces of the hosts the
+//removed devices were on, when no scsi device is left on them.
+//
+//	The detach is already done, failures are only logged.
+func teardownIdleFCoEInterfaces(ctx context.Context, devices []map[string]string) {
+	hosts := make(map[string]bool)
+	for _, d := range devices {
+		if d["host"] != "" {
+			hosts["host"+d["host"]] = true
+		}
+	}
+	hbas, err := initiator.GetFCoEHBAs()
+	if err != nil {
+		log.Printf("failed get fcoe hbas: %v", err)
+		return
+	}
+	//an interface may carry several hosts, all must be idle
+	detached := make([]string, 0)
+	busy := make(map[string]bool)
+	for _, hba := range hbas {
+		iface := hba["fcoe_interface"]
+		if hosts[hba["host_device"]] {
+			detached = append(detached, iface)
+		}
+		used, err := initiator.HasSCSIDevices(hba["host_device"])
+		if err != nil {
+			log.Printf("failed check scsi devices of %s: %v", hba["host_device"], err)
+			used = true
+		}
+		busy[iface] = busy[iface] || used
+	}
+	for _, iface := range detached {
+		if busy[iface] {
+			continue
+		}
+		log.Printf("last volume detached from fcoe interface %s, destroying it", iface)
+		if err := initiator.DestroyFCoEInterfaceContext(ctx, iface); err != nil {
+			log.Printf("%v", err)
+		}
+		busy[iface] = true
+	}
+}
+
+//GetConnectorProperties Get the Fibre Channel properties of this host the
+//backend needs to export a volume to it.
+//
+//	The WWPNs and WWNNs of the online ports are reported as wwpns and
+//	wwnns, hosts without FC support get none. Every port is listed
+//	in fc_ports with the speed, port_type and supported_classes of its
+//	link, e.g. to tell a port that negotiated 8 Gbit instead of 16 Gbit.
+//	The host is identified by its system uuid, platform and os_type, see
+//	initiator.GetHostInfo.
+func GetConnectorProperties() (map[string]interface{}, error) {
+	props := make(map[string]interface{})
+	host, err := initiator.GetHostInfo()
+	if err != nil {
+		log.Printf("failed get the system uuid of the host: %v", err)
+	} else {
+		props["system uuid"] = host.UUID
+	}
+	props["platform"] = host.Platform
+	props["os_type"] = host.OSType
+	if !initiator.HasFCSupport() {
+		return props, nil
+	}
+	wwpns, err := initiator.GetFCWWPNs()
+	if err != nil {
+		return nil, err
+	}
+	wwnns, err := initiator.GetFCWWNNS()
+	if err != nil {
+		return nil, err
+	}
+	hbas, err := initiator.GetFCHBAsInfo()
+	if err != nil {
+		return nil, err
+	}
+	ports := make([]map[string]string, 0, len(hbas))
+	for _, hba := range hbas {
+		port := map[string]string{"wwpn": hba["port_name"], "host_device": hba["host_device"]}
+		for _, attr := range initiator.FCHostLinkAttrs {
+			port[attr] = hba[attr]
+		}
+		ports = append(ports, port)
+	}
+	if len(wwpns) > 0 {
+		props["wwpns"] = wwpns
+	}
+	if len(wwnns) > 0 {
+		props["wwnns"] = wwnns
+	}
+	props["fc_ports"] = ports
+	return props, nil
+}
+
 //Update the local kernel's size information.
 //
 //	Try and update the local kernel's size information for an FC volume.
 func ExtendVolume(connectionProperties map[string]interface{}) error {
-	useMultipath := true
-	if um, ok := connectionProperties["use_multipath"]; ok {
-		if umb, ok := um.(bool); ok {
-			useMultipath = umb
-		}
-	}
+	connectionProperties = flattenConnectionProperties(connectionProperties)
+	unlock := LockVolume(connectionProperties)
+	defer unlock()
+	multipath, _ := useMultipath(connectionProperties, false)
 	connProperties, err := addTargetsToConnectionProperties(connectionProperties)
 	if err != nil {
 		return fmt.Errorf("failed add targets to connection properties:%v", err)
@@ -253,7 +859,7 @@ func ExtendVolume(connectionProperties map[string]interface{}) error {
 	if len(volumePaths) == 0 {
 		return fmt.Errorf("couldn't find any volume paths on the host to extend volume for %#v", connProperties)
 	}
-	if newSize, err := initiator.DoExtendVolume(volumePaths, useMultipath); err != nil {
+	if newSize, err := initiator.DoExtendVolume(volumePaths, multipath); err != nil {
 		return err
 	} else {
 		log.Print("volume extended to new size: ", newSize)
@@ -262,11 +868,15 @@ func ExtendVolume(connectionProperties map[string]interface{}) error {
 }
 
 func GetVolumePaths(targets []initiator.Target) ([]string, error) {
+	return getVolumePaths(context.Background(), targets)
+}
+
+func getVolumePaths(ctx context.Context, targets []initiator.Target) ([]string, error) {
 	//first fetch all of the potential paths that might exist
 	//how the FC fabric is zoned may alter the actual list
 	//that shows up on the system.  So, we verify each path.
 	volumePaths := make([]string, 0)
-	hbas, err := initiator.GetFCHBAsInfo()
+	hbas, err := initiator.GetFCHBAsInfoContext(ctx)
 	if err != nil {
 		return volumePaths, fmt.Errorf("failed get fc HBAs info: %v", err)
 	}
@@ -275,40 +885,399 @@ func GetVolumePaths(targets []initiator.Target) ([]string, error) {
 		return volumePaths, fmt.Errorf("failed get possible volume paths: %v", err)
 	}
 	for _, path := range devicePaths {
-		if osBrick.IsFileExists(path) {
-			volumePaths = append(volumePaths, path)
+		//stale by-path links may point to removed devices
+		if _, err := initiator.ResolveBlockDevice(path); err != nil {
+			if _, lErr := os.Lstat(path); lErr == nil {
+				log.Printf("skip stale volume path %s: %v", path, err)
+			}
+			continue
 		}
+		volumePaths = append(volumePaths, path)
 	}
 	return volumePaths, nil
 }
 
+//GetClassifiedVolumePaths Get the paths of the volume like GetVolumePaths,
+//along with the multipath device they belong to.
+//
+//	singlePaths are the by-path links of the single paths, mpathPath is
+//	the multipath device holding them, empty when the paths aren't part
+//	of any multipath map.
+func GetClassifiedVolumePaths(targets []initiator.Target) (singlePaths []string, mpathPath string, err error) {
+	singlePaths, err = GetVolumePaths(targets)
+	if err != nil {
+		return singlePaths, "", err
+	}
+	for _, path := range singlePaths {
+		device := initiator.GetNameFromPath(path)
+		if device == "" {
+			continue
+		}
+		_, mPath, err := initiator.GetMultipathDeviceForPath(device)
+		if err != nil {
+			log.Printf("failed get multipath device for path %s, ERROR: %v", path, err)
+			continue
+		}
+		if mPath == "" {
+			continue
+		}
+		if mpathPath == "" {
+			mpathPath = mPath
+		} else if mPath != mpathPath {
+			log.Printf("path %s belongs to multipath device %s, expected %s", path, mPath, mpathPath)
+		}
+	}
+	return singlePaths, mpathPath, nil
+}
+
+//GetVolumeDevices Get the /dev/sdX devices of the volume paths of
+//GetVolumePaths, the paths which don't resolve are skipped.
+func GetVolumeDevices(targets []initiator.Target) ([]string, error) {
+	volumePaths, err := GetVolumePaths(targets)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]string, 0, len(volumePaths))
+	for _, path := range volumePaths {
+		if device := initiator.GetNameFromPath(path); device != "" {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+//AttachedVolume Host side view of a volume attached to this host.
+type AttachedVolume struct {
+	WWN         string
+	DevicePath  string
+	Multipath   bool
+	ReadOnly    bool
+	Paths       []AttachedPath
+	Mountpoints []string
+}
+
+//AttachedPath A single path /dev/sdX of an attached volume and its scsi address.
+type AttachedPath struct {
+	Device string
+	HCTL   initiator.HCTL
+}
+
+//GetAllFCVolumePaths Get all the fibre channel by-path entries on the host.
+func GetAllFCVolumePaths() ([]string, error) {
+	searchPath := DevDiskByPathRoot
+	names, err := osBrick.DefaultFS.ReadDir(searchPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed read dir %s: %v", searchPath, err)
+	}
+	paths := make([]string, 0)
+	for _, n := range names {
+		if strings.Contains(n.Name(), "-fc-0x") && strings.Contains(n.Name(), "-lun-") {
+			paths = append(paths, filepath.Join(searchPath, n.Name()))
+		}
+	}
+	return paths, nil
+}
+
+//ListAttachedVolumes List the fibre channel volumes currently attached to this host.
+//
+//	Each volume is reported once by WWN, using the multipath device when
+//	the paths are part of a multipath map, along with its member paths and
+//	where it's mounted. This is a read-only enumeration.
+func ListAttachedVolumes() ([]AttachedVolume, error) {
+	paths, err := GetAllFCVolumePaths()
+	if err != nil {
+		return nil, err
+	}
+	return listAttachedVolumes(paths)
+}
+
+func listAttachedVolumes(paths []string) ([]AttachedVolume, error) {
+	roDevices, err := initiator.GetBlockDevicesRO()
+	if err != nil {
+		return nil, err
+	}
+	wwns := initiator.NewWWNCache()
+	volumes := make([]*AttachedVolume, 0)
+	byWWN := make(map[string]*AttachedVolume)
+	for _, path := range paths {
+		realPath, err := osBrick.DefaultFS.EvalSymlinks(path)
+		if err != nil {
+			log.Printf("failed get realpath for path: %s, ERROR: %v", path, err)
+			continue
+		}
+		device := "/dev/" + filepath.Base(realPath)
+		wwn, err := wwns.GetSCSIWWN(device)
+		if err != nil || wwn == "" {
+			log.Printf("failed get scsi wwn for path %s, ERROR: %v", device, err)
+			continue
+		}
+		attachedPath := AttachedPath{Device: device}
+		if attachedPath.HCTL, err = initiator.GetHCTL(device); err != nil {
+			log.Printf("failed get scsi address of %s, ERROR: %v", device, err)
+		}
+		if volume, ok := byWWN[wwn]; ok {
+			volume.Paths = append(volume.Paths, attachedPath)
+			continue
+		}
+		volume := &AttachedVolume{WWN: wwn, DevicePath: device, ReadOnly: roDevices[filepath.Base(device)]}
+		volume.Paths = []AttachedPath{attachedPath}
+		if _, mPath, err := initiator.GetMultipathDeviceForPath(device); err != nil {
+			log.Printf("failed get multipath device for path %s, ERROR: %v", device, err)
+		} else if mPath != "" {
+			volume.DevicePath = mPath
+			volume.Multipath = true
+			volume.ReadOnly = roDevices[filepath.Base(mPath)]
+		}
+		byWWN[wwn] = volume
+		volumes = append(volumes, volume)
+	}
+	attached := make([]AttachedVolume, 0, len(volumes))
+	for _, volume := range volumes {
+		if volume.Mountpoints, err = osBrick.GetMountpoints(volume.DevicePath); err != nil {
+			log.Printf("failed get mountpoints of %s, ERROR: %v", volume.DevicePath, err)
+		}
+		attached = append(attached, *volume)
+	}
+	return attached, nil
+}
+
+//DisconnectAllForTarget Detach every volume reachable through a target port,
+//e.g. before a storage controller is taken down.
+//
+//	The paths of the attached volumes behind the target are removed, the
+//	multipath device of a volume is flushed first when none of its paths
+//	are left through other targets, otherwise the paths are taken out of
+//	it. Each volume is locked by its WWN while detached. Without force a
+//	volume still mounted is refused and the first failure stops the
+//	detach, with force the failures are skipped and the devices left
+//	behind are reported with an *OrphanedDevicesError. Nothing is done
+//	when no volume is attached through the target anymore.
+func DisconnectAllForTarget(targetWWN string, force bool) error {
+	addresses, err := initiator.GetFCTargetAddresses(targetWWN)
+	if err != nil {
+		return err
+	}
+	if len(addresses) == 0 {
+		log.Printf("target %s is not logged in, nothing to detach", targetWWN)
+		return nil
+	}
+	behindTarget := func(hctl initiator.HCTL) bool {
+		for _, a := range addresses {
+			if a.Host == hctl.Host && a.Channel == hctl.Channel && a.Target == hctl.Target {
+				return true
+			}
+		}
+		return false
+	}
+	volumes, err := ListAttachedVolumes()
+	if err != nil {
+		return err
+	}
+	orphaned := make([]string, 0)
+	errs := make([]string, 0)
+	fail := func(devices []string, err error) error {
+		if !force {
+			return err
+		}
+		log.Printf("%v, skipping it as forced", err)
+		orphaned = append(orphaned, devices...)
+		errs = append(errs, err.Error())
+		return nil
+	}
+	detach := func(volume AttachedVolume, paths []string) error {
+		//the volume isn't known by its connection properties here, lock
+		//the target port and lun of its paths like LockVolume does
+		keys := make([]string, 0, len(paths))
+		for _, p := range volume.Paths {
+			if behindTarget(p.HCTL) {
+				keys = append(keys, targetLunKey(targetWWN, p.HCTL.Lun))
+			}
+		}
+		unlock := lockTargetLuns(keys)
+		defer unlock()
+		log.Printf("detaching paths %v of volume %s from target %s", paths, volume.WWN, targetWWN)
+		last := len(paths) == len(volume.Paths)
+		if last {
+			//the volume is gone from the host with its last paths
+			if len(volume.Mountpoints) > 0 {
+				return fail(paths, fmt.Errorf("volume %s is mounted on %v", volume.WWN, volume.Mountpoints))
+			}
+			if volume.Multipath {
+				if err := flushMultipathDevice(context.Background(), volume.DevicePath); err != nil {
+					return fail(paths, fmt.Errorf("failed flush multipath device %s: %v", volume.DevicePath, err))
+				}
+			}
+		}
+		for _, path := range paths {
+			var err error
+			if volume.Multipath && !last {
+				//the paths left keep the multipath device, take these out of its map
+				err = removePath(path, false)
+			} else {
+				//the multipath flush takes care of the IO
+				flush := !volume.Multipath && !force && initiator.IsSCSIDeviceOnline(path)
+				err = removeSCSIDevice(context.Background(), path, flush)
+			}
+			if err != nil {
+				if err := fail([]string{path}, fmt.Errorf("failed remove scsi device %s: %v", path, err)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, volume := range volumes {
+		paths := make([]string, 0)
+		for _, p := range volume.Paths {
+			if behindTarget(p.HCTL) {
+				paths = append(paths, p.Device)
+			}
+		}
+		if len(paths) == 0 {
+			continue
+		}
+		if err := detach(volume, paths); err != nil {
+			return err
+		}
+	}
+	if len(orphaned) > 0 {
+		return &OrphanedDevicesError{Devices: orphaned, Err: fmt.Errorf("failed detach from target %s: %s", targetWWN, strings.Join(errs, "; "))}
+	}
+	return nil
+}
+
+//OrphanedDevicesError Devices of a volume left behind by a detach.
+type OrphanedDevicesError struct {
+	Devices []string
+	Err     error
+}
+
+func (e *OrphanedDevicesError) Error() string {
+	return fmt.Sprintf("orphaned devices %v: %v", e.Devices, e.Err)
+}
+
+//pendingDevices Devices of a detach not removed yet.
+type pendingDevices struct {
+	mu      sync.Mutex
+	devices []string
+}
+
+func (p *pendingDevices) set(devices []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.devices = append([]string{}, devices...)
+}
+
+func (p *pendingDevices) done(device string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, d := range p.devices {
+		if d == device {
+			p.devices = append(p.devices[:i], p.devices[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *pendingDevices) list() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.devices...)
+}
+
+//runWithTimeout Run fn, reporting the pending devices as orphaned if it
+//doesn't return within timeout.
+func runWithTimeout(timeout time.Duration, pending *pendingDevices, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return &OrphanedDevicesError{Devices: pending.list(), Err: fmt.Errorf("timed out after %v", timeout)}
+	}
+}
+
+//removeSCSIDevice is replaced in tests to simulate stuck removals.
+var removeSCSIDevice = initiator.RemoveSCSIDeviceContext
+
+//removePath is replaced in tests to fake the removal of a multipath path.
+var removePath = initiator.RemovePath
+
 //There may have been more than 1 device mounted
 //by the kernel for this volume.  We have to remove all of them
-func removeDevices(connProperties map[string]interface{}, devices []map[string]string, deviceInfo map[string]string) error {
+func removeDevices(ctx context.Context, connProperties map[string]interface{}, devices []map[string]string, deviceInfo map[string]string, pending *pendingDevices) error {
 	pathUsed := initiator.GetDevPath(connProperties, deviceInfo)
-	wasMultipath := !strings.Contains(pathUsed, "/pci-")
+	wasMultipath := pathUsed != "" && initiator.IsMultipathPath(pathUsed)
+	devicePaths := make([]string, 0)
 	for _, device := range devices {
-		devicePath := device["device"]
+		devicePaths = append(devicePaths, device["device"])
+	}
+	pending.set(devicePaths)
+	orphaned := make([]string, 0)
+	errs := make([]string, 0)
+	for _, devicePath := range devicePaths {
 		flush, err := initiator.RequiresFlush(devicePath, pathUsed, wasMultipath)
 		if err != nil {
-			return fmt.Errorf("failed requires flush: devicePath:%s, pathUsed:%s, wasMultipath:%t", devicePath, pathUsed, wasMultipath)
+			log.Printf("failed requires flush: devicePath:%s, pathUsed:%s, wasMultipath:%t, ERROR: %v", devicePath, pathUsed, wasMultipath, err)
+			orphaned = append(orphaned, devicePath)
+			errs = append(errs, err.Error())
+			continue
+		}
+		if flush && !initiator.IsSCSIDeviceOnline(devicePath) {
+			//flushing a dead path hangs, there is nothing to flush it to anyway
+			log.Printf("device %s is not online, removing it without flush", devicePath)
+			flush = false
 		}
-		if err = initiator.RemoveSCSIDevice(devicePath, flush); err != nil {
-			return fmt.Errorf("failed remove scsi device: devicePath:%s, flush:%t", devicePath, flush)
+		if err = removeSCSIDevice(ctx, devicePath, flush); err != nil {
+			log.Printf("failed remove scsi device: devicePath:%s, flush:%t, ERROR: %v", devicePath, flush, err)
+			orphaned = append(orphaned, devicePath)
+			errs = append(errs, err.Error())
+			continue
 		}
+		pending.done(devicePath)
+	}
+	if len(orphaned) > 0 {
+		return &OrphanedDevicesError{Devices: orphaned, Err: fmt.Errorf("failed remove devices: %s", strings.Join(errs, "; "))}
 	}
 	return nil
 }
 
+//getPossibleVolumePaths Get the by-path entries the targets may show up as.
+//
+//	The HBAs are queried one by one so a failing controller doesn't block
+//	the discovery through the others, the failures are logged and an error
+//	is only returned when none of the HBAs could be queried.
 func getPossibleVolumePaths(targets []initiator.Target, hbas []initiator.HBA) ([]string, error) {
-	possibleDevs := getPossibleDevices(hbas, targets)
-	hostPaths, err := getHostDevices(possibleDevs)
-	if err != nil {
-		return nil, err
+	hostPaths := make([]string, 0)
+	var lastErr error
+	failed := 0
+	for _, hba := range hbas {
+		paths, err := getHBAVolumePaths(targets, hba)
+		if err != nil {
+			log.Printf("failed get possible volume paths behind HBA %s: %v", hba["host_device"], err)
+			lastErr = err
+			failed++
+			continue
+		}
+		hostPaths = append(hostPaths, paths...)
+	}
+	if failed > 0 && failed == len(hbas) {
+		return nil, fmt.Errorf("none of the %d HBAs could be queried, last error: %v", failed, lastErr)
 	}
 	return hostPaths, nil
 }
 
+//getHBAVolumePaths Get the by-path entries the targets may show up as behind a single HBA.
+func getHBAVolumePaths(targets []initiator.Target, hba initiator.HBA) ([]string, error) {
+	if getPCINum(hba) == "" {
+		return nil, fmt.Errorf("no pci address found for device path %q", hba["device_path"])
+	}
+	return getHostDevices(getPossibleDevices([]initiator.HBA{hba}, targets))
+}
+
 //Compute the possible fibre channel device options.
 //	:param hbas: available hba devices.
 //	:param targets: tuple of possible wwn addresses and lun combinations.
@@ -338,13 +1307,25 @@ func getPossibleDevices(hbas []initiator.HBA, targets []initiator.Target) []init
 ///sys/devices/pci0000:20/0000:20:03.0/0000:21:00.2/net/ens2f2/ctlr_2
 ///host3/fc_host/host3
 //we always want the value prior to the host or net value
+//
+//NPIV vports have host directories nested in the physical host one, so the
+//last PCI address found before the first host or net value is used.
+//
+//FCoE on VLAN interfaces has no PCI address in the device path, the one of
+//the physical interface is in pci_address.
 func getPCINum(hba initiator.HBA) string {
+	if pci, ok := hba["pci_address"]; ok && pci != "" {
+		return pci
+	}
 	if hba != nil {
 		if devicePath, ok := hba["device_path"]; ok {
-			devicePaths := strings.Split(devicePath, "/")
-			for i, v := range devicePaths {
+			pciNum := ""
+			for _, v := range strings.Split(devicePath, "/") {
 				if strings.HasPrefix(v, "net") || strings.HasPrefix(v, "host") {
-					return devicePaths[i-1]
+					return pciNum
+				}
+				if pciAddressRegex.MatchString(v) {
+					pciNum = v
 				}
 			}
 		}
@@ -362,18 +1343,18 @@ func getHostDevices(possibleDevs []initiator.Device) ([]string, error) {
 		if lunID, err := initiator.ProcessLunID(d[2]); err != nil {
 			return nil, err
 		} else {
-			hostDevice := fmt.Sprintf("/dev/disk/by-path/%spci-%s-fc-%s-lun-%v", prefix, d[0], d[1], lunID)
-			rp, err := filepath.EvalSymlinks(hostDevice)
+			hostDevice := fcByPath(prefix, d, lunID)
+			rp, err := osBrick.DefaultFS.EvalSymlinks(hostDevice)
 			if err != nil || !osBrick.IsFileExists(rp) {
 				//on kylinos / arm64, host device has a special prefix:
 				// /dev/disk/by-path/platform-40000000.pcie-controller-pci-0000:01:00.1-fc-0x2101001b32a08c84-lun-0
 				log.Printf("host device %s with default prefix is not exists, we'll try to find it out", hostDevice)
 				prefix, err = getPossibleHostPathPrefix()
 				if err != nil {
-					log.Printf("cannot found possible host device for %v under path /dev/disk/by-path/, ERROR: %v", d, err)
+					log.Printf("cannot found possible host device for %v under path %s, ERROR: %v", d, DevDiskByPathRoot, err)
 					continue
 				}
-				hostDevice = fmt.Sprintf("/dev/disk/by-path/%spci-%s-fc-%s-lun-%v", prefix, d[0], d[1], lunID)
+				hostDevice = fcByPath(prefix, d, lunID)
 			}
 			hostDevices = append(hostDevices, hostDevice)
 		}
@@ -381,23 +1362,90 @@ func getHostDevices(possibleDevs []initiator.Device) ([]string, error) {
 	return hostDevices, nil
 }
 
+//fcByPath Get the by-path entry of a (pci_id, wwn, lun) device, with the
+//platform prefix of the host if any.
+func fcByPath(prefix string, d initiator.Device, lunID interface{}) string {
+	return filepath.Join(DevDiskByPathRoot, fmt.Sprintf("%spci-%s-fc-%s-lun-%v", prefix, d[0], d[1], lunID))
+}
+
+//ExpectedFCDevicePaths Get the by-path entries ConnectVolume looks for, to
+//check udev and the zoning by hand when a volume device doesn't show up.
+//
+//	Each entry is listed without prefix, and with the platform prefix,
+//	e.g. platform-40000000.pcie-controller-, when the host has one.
+func ExpectedFCDevicePaths(connectionProperties map[string]interface{}) ([]string, error) {
+	connectionProperties = flattenConnectionProperties(connectionProperties)
+	connProperties, err := addTargetsToConnectionProperties(connectionProperties)
+	if err != nil {
+		return nil, err
+	}
+	hbas, err := initiator.GetFCHBAsInfo()
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := getPossibleHostPathPrefix()
+	if err != nil {
+		log.Printf("no platform prefix found: %v", err)
+		prefix = ""
+	}
+	paths := make([]string, 0)
+	for _, d := range getPossibleDevices(hbas, connProperties["targets"].([]initiator.Target)) {
+		lunID, err := initiator.ProcessLunID(d[2])
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, fcByPath("", d, lunID))
+		if prefix != "" {
+			paths = append(paths, fcByPath(prefix, d, lunID))
+		}
+	}
+	return paths, nil
+}
+
+//hostPathPrefix caches the host path prefix found by getPossibleHostPathPrefix.
+var hostPathPrefix struct {
+	sync.Mutex
+	prefix string
+	found  bool
+}
+
+//Reset Drop all the cached host state, e.g. after the SAN was reconfigured,
+//so it's read again on next use.
+func Reset() {
+	hostPathPrefix.Lock()
+	hostPathPrefix.prefix, hostPathPrefix.found = "", false
+	hostPathPrefix.Unlock()
+}
+
 //Where do we look for FC based volumes
+//
+//	The prefix found is cached until Reset is called.
 func getPossibleHostPathPrefix() (string, error) {
-	searchPath := "/dev/disk/by-path"
+	hostPathPrefix.Lock()
+	defer hostPathPrefix.Unlock()
+	if hostPathPrefix.found {
+		return hostPathPrefix.prefix, nil
+	}
+	prefix, err := findPossibleHostPathPrefix()
+	if err != nil {
+		return "", err
+	}
+	hostPathPrefix.prefix, hostPathPrefix.found = prefix, true
+	return prefix, nil
+}
+
+func findPossibleHostPathPrefix() (string, error) {
+	searchPath := DevDiskByPathRoot
 	reg, err := regexp.Compile(`(.*)pci-[a-z0-9]{4}:[a-z0-9]{2}:[a-z0-9]{2}.[a-z0-9]+-fc-0x[a-z0-9]{16}-lun-[a-z0-9]+`)
 	if err != nil {
 		return "", fmt.Errorf("failed compile regex: %v", err)
 	}
-	dir, err := os.Open(searchPath)
+	paths, err := osBrick.DefaultFS.ReadDir(searchPath)
 	if err != nil {
 		return "", fmt.Errorf("failed read dir %s: %v", searchPath, err)
 	}
-	paths, err := dir.Readdirnames(-1)
-	if err != nil {
-		return "", fmt.Errorf("failed read dirnames for dir %s: %v", searchPath, err)
-	}
 	for _, p := range paths {
-		matches := reg.FindStringSubmatch(p)
+		matches := reg.FindStringSubmatch(p.Name())
 		log.Printf("possible host path and prefix: %#v", matches)
 		if len(matches) > 1 {
 			return matches[1], nil
@@ -406,95 +1454,45 @@ func getPossibleHostPathPrefix() (string, error) {
 	return "", fmt.Errorf("no matched path found under search path:%s", searchPath)
 }
 
-func addTargetsToConnectionProperties(connectionProperties map[string]interface{}) (map[string]interface{}, error) {
-	var wwns []string
-	targetWwn := connectionProperties["target_wwn"]
-	targetWwns := connectionProperties["target_wwns"]
-	if targetWwns != nil {
-		wwns = targetWwns.([]string)
-	} else {
-		switch targetWwn.(type) {
-		case []string:
-			wwns = targetWwn.([]string)
-		case string:
-			wwns = []string{targetWwn.(string)}
-		default:
-			wwns = make([]string, 0)
-		}
-	}
-	//Convert wwns to lower case
-	lowWwns := make([]string, 0)
-	for _, v := range wwns {
-		vv := strings.ToLower(v)
-		lowWwns = append(lowWwns, vv)
-	}
-	wwns = lowWwns
-	if targetWwns != nil {
-		connectionProperties["target_wwns"] = wwns
-	} else if targetWwn != nil {
-		connectionProperties["target_wwn"] = wwns
-	}
-
-	var luns []string
-	targetLun := connectionProperties["target_lun"]
-	targetLuns := connectionProperties["target_luns"]
-	if targetLuns != nil {
-		luns = targetLuns.([]string)
-	} else if _, ok := targetLun.(string); ok {
-		luns = []string{targetLun.(string)}
-	} else {
-		luns = make([]string, 0)
-	}
-
-	var targets []initiator.Target
-	if len(luns) == len(wwns) && len(luns) > 0 {
-		//Handles single wwwn + lun or multiple, potentially
-		//different wwns or luns
-		//targets = list(zip(wwns, luns))
-		for i, w := range wwns {
-			targets = append(targets, initiator.Target{w, luns[i]})
-		}
-	} else if len(luns) == 1 && len(wwns) > 1 {
-		//For the case of multiple wwns, but a single lun (old path)
-		targets = make([]initiator.Target, 0)
-		for _, w := range wwns {
-			targets = append(targets, initiator.Target{w, luns[0]})
+//splitWWNs Get the wwns of a target_wwn(s) property, which some backends give
+//as a single comma or space separated string instead of a list.
+func splitWWNs(v interface{}) []string {
+	wwns := make([]string, 0)
+	switch v := v.(type) {
+	case []string:
+		wwns = append(wwns, v...)
+	case []interface{}:
+		for _, w := range v {
+			if w, ok := w.(string); ok {
+				wwns = append(wwns, w)
+			}
 		}
-	} else {
-		//Something is wrong, this shouldn't happen.
-		return nil, fmt.Errorf("unable to find potential volume paths for FC device with luns %#v and wwns %#v", luns, wwns)
+	case string:
+		wwns = append(wwns, strings.FieldsFunc(v, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})...)
 	}
+	return wwns
+}
 
-	connectionProperties["targets"] = targets
-	wwpnLunMap := make(map[string]string)
-	for _, t := range targets {
-		wwpnLunMap[t[0]] = t[1]
+//addTargetsToConnectionProperties Add the targets of the volume to the
+//connection properties, normalized in place, see normalizeConnectionProperties.
+func addTargetsToConnectionProperties(connectionProperties map[string]interface{}) (map[string]interface{}, error) {
+	props, err := normalizeConnectionProperties(connectionProperties)
+	if err != nil {
+		log.Printf("invalid FC connection properties %#v: %v", connectionProperties, err)
+		return nil, err
+	}
+	if connectionProperties["target_wwns"] != nil {
+		connectionProperties["target_wwns"] = props.TargetWWNs
+	} else {
+		connectionProperties["target_wwn"] = props.TargetWWNs
 	}
+	connectionProperties["targets"] = props.Targets
 	//If there is an initiator_target_map we can update it too
-	if itMap, ok := connectionProperties["initiator_target_map"]; ok {
-		//Convert it to lower
-		//itmap = {k.lower(): [port.lower() for port in v] for k, v in itmap.items()}
-		if itMap, ok := itMap.(map[string][]string); ok {
-			lowItMap := make(map[string][]string)
-			for k, v := range itMap {
-				for _, port := range v {
-					lowItMap[strings.ToLower(k)] = append(lowItMap[strings.ToLower(k)], strings.ToLower(port))
-				}
-			}
-			connectionProperties["initiator_target_map"] = lowItMap
-
-			newItMap := make(map[string][]string)
-			for initWwpn, targetWwpns := range lowItMap {
-				initTargets := make([]string, 0)
-				for _, targetWwpn := range targetWwpns {
-					if w, ok := wwpnLunMap[targetWwpn]; ok {
-						initTargets = append(initTargets, w)
-					}
-				}
-				newItMap[initWwpn] = initTargets
-			}
-			connectionProperties["initiator_target_lun_map"] = newItMap
-		}
+	if props.InitiatorTargetMap != nil {
+		connectionProperties["initiator_target_map"] = props.InitiatorTargetMap
+		connectionProperties["initiator_target_lun_map"] = props.InitiatorTargetLunMap
 	}
 	return connectionProperties, nil
 }
@@ -1 +1,1626 @@
 package connectors
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	osBrick "github.com/ydcool/os-brick-go"
+	"github.com/ydcool/os-brick-go/initiator"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAddTargetsToConnectionPropertiesCountMismatch(t *testing.T) {
+	props := map[string]interface{}{
+		"target_wwns": []string{"20210002AC00383D", "20220002AC00383D"},
+		"target_luns": []string{"1", "2", "3"},
+	}
+	_, err := addTargetsToConnectionProperties(props)
+	if err == nil {
+		t.Fatal("expected error for 2 wwns and 3 luns")
+	}
+	for _, want := range []string{"2 wwns", "3 luns"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestAddTargetsToConnectionPropertiesSingleLun(t *testing.T) {
+	props := map[string]interface{}{
+		"target_wwns": []string{"20210002AC00383D", "20220002AC00383D"},
+		"target_luns": []string{"1"},
+	}
+	p, err := addTargetsToConnectionProperties(props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := p["targets"].([]initiator.Target)
+	if len(targets) != 2 || targets[0][0] != "20210002ac00383d" || targets[1][1] != "1" {
+		t.Errorf("unexpected targets: %#v", targets)
+	}
+}
+
+func TestAddTargetsToConnectionPropertiesNumericLun(t *testing.T) {
+	for _, lun := range []interface{}{1, int64(1), 1.0, "1"} {
+		props := map[string]interface{}{
+			"target_wwn": []string{"20210002AC00383D"},
+			"target_lun": lun,
+		}
+		p, err := addTargetsToConnectionProperties(props)
+		if err != nil {
+			t.Fatalf("target_lun %#v: %v", lun, err)
+		}
+		expected := []initiator.Target{{"20210002ac00383d", "1"}}
+		if targets := p["targets"].([]initiator.Target); !reflect.DeepEqual(targets, expected) {
+			t.Errorf("target_lun %#v: expected %v, got %v", lun, expected, targets)
+		}
+	}
+	for _, lun := range []interface{}{1.5, -1, true} {
+		props := map[string]interface{}{
+			"target_wwn": []string{"20210002AC00383D"},
+			"target_lun": lun,
+		}
+		if _, err := addTargetsToConnectionProperties(props); err == nil {
+			t.Errorf("target_lun %#v: expected an error", lun)
+		}
+	}
+}
+
+func TestAddTargetsToConnectionPropertiesWWNString(t *testing.T) {
+	for _, wwns := range []interface{}{
+		[]string{"20210002AC00383D", "20220002AC00383D"},
+		[]interface{}{"20210002AC00383D", "20220002AC00383D"},
+		"20210002AC00383D,20220002AC00383D",
+		"20210002AC00383D, 20220002AC00383D",
+		"20210002AC00383D 20220002AC00383D",
+	} {
+		props := map[string]interface{}{
+			"target_wwns": wwns,
+			"target_lun":  "1",
+		}
+		p, err := addTargetsToConnectionProperties(props)
+		if err != nil {
+			t.Fatalf("%#v: %v", wwns, err)
+		}
+		want := []initiator.Target{{"20210002ac00383d", "1"}, {"20220002ac00383d", "1"}}
+		if targets := p["targets"].([]initiator.Target); !reflect.DeepEqual(targets, want) {
+			t.Errorf("%#v: unexpected targets: %#v", wwns, targets)
+		}
+	}
+}
+
+func TestListAttachedVolumes(t *testing.T) {
+	sysfs := newFakeSysFS(t)
+	writeFakeFile(t, sysfs, "block/dm-0/dm/uuid", "mpath-3600a0980383036347224000000000001\n")
+	writeFakeFile(t, sysfs, "block/dm-0/dm/name", "mpatha\n")
+	writeFakeFile(t, sysfs, "block/sdb/holders/dm-0", "")
+	writeFakeFile(t, sysfs, "block/sdc/holders/dm-0", "")
+	writeFakeFile(t, sysfs, "block/sdd/holders/.keep", "")
+	for _, hctl := range []string{"host2/target2:0:0/2:0:0:1", "host3/target3:0:0/3:0:0:1", "host2/target2:0:0/2:0:0:2"} {
+		writeFakeFile(t, sysfs, "devices/platform/"+hctl+"/.keep", "")
+	}
+	symlink(t, sysfs, "../../devices/platform/host2/target2:0:0/2:0:0:1", "block/sdb/device")
+	symlink(t, sysfs, "../../devices/platform/host3/target3:0:0/3:0:0:1", "block/sdc/device")
+	symlink(t, sysfs, "../../devices/platform/host2/target2:0:0/2:0:0:2", "block/sdd/device")
+
+	mountInfo := filepath.Join(tempDir(t), "mountinfo")
+	writeFakeFile(t, "/", mountInfo, "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"+
+		"98 22 253:0 / /mnt/data rw,relatime shared:50 - ext4 /dev/mapper/mpatha rw\n"+
+		"99 22 253:0 /sub /mnt/data\\040sub rw,relatime shared:51 - ext4 /dev/mapper/mpatha rw\n")
+	defer func(orig string) { osBrick.MountInfoPath = orig }(osBrick.MountInfoPath)
+	osBrick.MountInfoPath = mountInfo
+
+	dev := tempDir(t)
+	for _, d := range []string{"sdb", "sdc", "sdd"} {
+		writeFakeFile(t, dev, d, "")
+	}
+	byPath := tempDir(t)
+	paths := []string{
+		filepath.Join(byPath, "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1"),
+		filepath.Join(byPath, "pci-0000:05:00.3-fc-0x20220002ac00383d-lun-1"),
+		filepath.Join(byPath, "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-2"),
+	}
+	symlink(t, "/", filepath.Join(dev, "sdb"), paths[0])
+	symlink(t, "/", filepath.Join(dev, "sdc"), paths[1])
+	symlink(t, "/", filepath.Join(dev, "sdd"), paths[2])
+
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch name {
+		case "lsblk":
+			return `{"blockdevices": [{"name": "sdb", "ro": false, "children": [{"name": "mpatha", "ro": false}]},` +
+				`{"name": "sdc", "ro": false, "children": [{"name": "mpatha", "ro": false}]}, {"name": "sdd", "ro": true}]}`, nil
+		case "/lib/udev/scsi_id":
+			if arg[len(arg)-1] == "/dev/sdd" {
+				return "3600a0980383036347224000000000002\n", nil
+			}
+			return "3600a0980383036347224000000000001\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+
+	volumes, err := listAttachedVolumes(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []AttachedVolume{
+		{
+			WWN:        "3600a0980383036347224000000000001",
+			DevicePath: "/dev/mapper/mpatha",
+			Multipath:  true,
+			Paths: []AttachedPath{
+				{Device: "/dev/sdb", HCTL: initiator.HCTL{Host: "2", Channel: "0", Target: "0", Lun: "1"}},
+				{Device: "/dev/sdc", HCTL: initiator.HCTL{Host: "3", Channel: "0", Target: "0", Lun: "1"}},
+			},
+			Mountpoints: []string{"/mnt/data", "/mnt/data sub"},
+		},
+		{
+			WWN:         "3600a0980383036347224000000000002",
+			DevicePath:  "/dev/sdd",
+			ReadOnly:    true,
+			Paths:       []AttachedPath{{Device: "/dev/sdd", HCTL: initiator.HCTL{Host: "2", Channel: "0", Target: "0", Lun: "2"}}},
+			Mountpoints: []string{},
+		},
+	}
+	if !reflect.DeepEqual(volumes, expected) {
+		t.Errorf("unexpected volumes: %#v", volumes)
+	}
+}
+
+func TestDisconnectAllForTarget(t *testing.T) {
+	sysfs := newFakeSysFS(t)
+	writeFakeFile(t, sysfs, "class/fc_transport/target2:0:0/port_name", "0x20210002ac00383d\n")
+	writeFakeFile(t, sysfs, "class/fc_transport/target3:0:0/port_name", "0x20220002ac00383d\n")
+	//two volumes on target 20210002ac00383d, one on 20220002ac00383d
+	devices := map[string]string{"sdb": "2:0:0:1", "sdc": "3:0:0:1", "sdd": "2:0:0:2"}
+	dev := tempDir(t)
+	byPath := newFakeByPath(t)
+	for d, hctl := range devices {
+		address := strings.Split(hctl, ":")
+		device := fmt.Sprintf("devices/platform/host%s/target%s:%s:%s/%s", address[0], address[0], address[1], address[2], hctl)
+		writeFakeFile(t, sysfs, device+"/state", "running\n")
+		symlink(t, sysfs, "../../"+device, "block/"+d+"/device")
+		writeFakeFile(t, sysfs, "block/"+d+"/holders/.keep", "")
+		writeFakeFile(t, dev, d, "")
+	}
+	symlink(t, byPath, filepath.Join(dev, "sdb"), "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1")
+	symlink(t, byPath, filepath.Join(dev, "sdc"), "pci-0000:05:00.3-fc-0x20220002ac00383d-lun-1")
+	symlink(t, byPath, filepath.Join(dev, "sdd"), "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-2")
+	mountInfo := filepath.Join(tempDir(t), "mountinfo")
+	writeFakeFile(t, "/", mountInfo, "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n")
+	defer func(orig string) { osBrick.MountInfoPath = orig }(osBrick.MountInfoPath)
+	osBrick.MountInfoPath = mountInfo
+
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch name {
+		case "lsblk":
+			return `{"blockdevices": [{"name": "sdb", "ro": false}, {"name": "sdc", "ro": false}, {"name": "sdd", "ro": false}]}`, nil
+		case "/lib/udev/scsi_id":
+			return "3600a098038303634722400000000000" + map[string]string{"/dev/sdb": "1", "/dev/sdc": "3", "/dev/sdd": "2"}[arg[len(arg)-1]] + "\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	removed := make([]string, 0)
+	defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+	removeSCSIDevice = func(_ context.Context, device string, flush bool) error {
+		removed = append(removed, device)
+		//the by-path entries go away with the device
+		links, _ := filepath.Glob(filepath.Join(byPath, "*"))
+		for _, link := range links {
+			if target, _ := os.Readlink(link); filepath.Base(target) == filepath.Base(device) {
+				return os.Remove(link)
+			}
+		}
+		return nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := DisconnectAllForTarget("20:21:00:02:AC:00:38:3D", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(removed)
+	if !reflect.DeepEqual(removed, []string{"/dev/sdb", "/dev/sdd"}) {
+		t.Errorf("expected the devices of the target to be removed once, got %v", removed)
+	}
+}
+
+func TestDisconnectAllForTargetMultipath(t *testing.T) {
+	const wwn = "3600a0980383036347224000000000001"
+	sysfs := newFakeSysFS(t)
+	writeFakeFile(t, sysfs, "class/fc_transport/target2:0:0/port_name", "0x20210002ac00383d\n")
+	writeFakeFile(t, sysfs, "class/fc_transport/target3:0:0/port_name", "0x20220002ac00383d\n")
+	writeFakeFile(t, sysfs, "block/dm-0/dm/uuid", "mpath-"+wwn+"\n")
+	writeFakeFile(t, sysfs, "block/dm-0/dm/name", "mpatha\n")
+	//a volume with a path through each target
+	dev := tempDir(t)
+	byPath := newFakeByPath(t)
+	for d, hctl := range map[string]string{"sdb": "2:0:0:1", "sdc": "3:0:0:1"} {
+		address := strings.Split(hctl, ":")
+		device := fmt.Sprintf("devices/platform/host%s/target%s:%s:%s/%s", address[0], address[0], address[1], address[2], hctl)
+		writeFakeFile(t, sysfs, device+"/state", "running\n")
+		symlink(t, sysfs, "../../"+device, "block/"+d+"/device")
+		writeFakeFile(t, sysfs, "block/"+d+"/holders/dm-0", "")
+		writeFakeFile(t, dev, d, "")
+	}
+	symlink(t, byPath, filepath.Join(dev, "sdb"), "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1")
+	symlink(t, byPath, filepath.Join(dev, "sdc"), "pci-0000:05:00.3-fc-0x20220002ac00383d-lun-1")
+	mountInfo := filepath.Join(tempDir(t), "mountinfo")
+	writeFakeFile(t, "/", mountInfo, "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n")
+	defer func(orig string) { osBrick.MountInfoPath = orig }(osBrick.MountInfoPath)
+	osBrick.MountInfoPath = mountInfo
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch name {
+		case "lsblk":
+			return `{"blockdevices": [{"name": "sdb", "ro": false}, {"name": "sdc", "ro": false}]}`, nil
+		case "/lib/udev/scsi_id":
+			return wwn + "\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	ops := make([]string, 0)
+	defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+	removeSCSIDevice = func(_ context.Context, device string, flush bool) error {
+		ops = append(ops, "remove "+device)
+		return nil
+	}
+	defer func(f func(string, bool) error) { removePath = f }(removePath)
+	removePath = func(device string, flush bool) error {
+		ops = append(ops, "remove path "+device)
+		return nil
+	}
+	defer func(f func(context.Context, string) error) { flushMultipathDevice = f }(flushMultipathDevice)
+	flushMultipathDevice = func(_ context.Context, device string) error {
+		ops = append(ops, "flush "+device)
+		return nil
+	}
+
+	//a detach of the volume in progress holds it
+	unlock := LockVolume(fcConnectionProperties())
+	done := make(chan error, 1)
+	go func() {
+		done <- DisconnectAllForTarget("20210002ac00383d", false)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("detached while the volume is locked: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	//sdc is left, sdb is only taken out of the multipath device
+	if !reflect.DeepEqual(ops, []string{"remove path /dev/sdb"}) {
+		t.Errorf("unexpected ops %v", ops)
+	}
+}
+
+func TestDisconnectAllForTargetLocksVolume(t *testing.T) {
+	h := newFakeFCHost(t)
+	writeFakeFile(t, h.sysfs, "class/fc_transport/target2:0:0/port_name", "0x20210002ac00383d\n")
+	device := "devices/platform/host2/target2:0:0/2:0:0:1"
+	writeFakeFile(t, h.sysfs, device+"/state", "running\n")
+	//the by-path entries list the device through its hctl
+	if err := os.RemoveAll(filepath.Join(h.sysfs, "block/sdb/device")); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, h.sysfs, "../../"+device, "block/sdb/device")
+	writeFakeFile(t, h.sysfs, "block/sdb/holders/.keep", "")
+	mountInfo := filepath.Join(tempDir(t), "mountinfo")
+	writeFakeFile(t, "/", mountInfo, "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n")
+	defer func(orig string) { osBrick.MountInfoPath = orig }(osBrick.MountInfoPath)
+	osBrick.MountInfoPath = mountInfo
+	h.handler = func(name string, arg ...string) (string, error) {
+		switch name {
+		case "lsblk":
+			return `{"blockdevices": [{"name": "sdb", "ro": false}]}`, nil
+		case "/lib/udev/scsi_id":
+			return "3600a0980383036347224000000000001\n", nil
+		case "sg_scan":
+			return arg[0] + ": scsi2 channel=0 id=0 lun=1\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	}
+	var active, overlaps int32
+	defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+	removeSCSIDevice = func(_ context.Context, device string, flush bool) error {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		defer atomic.AddInt32(&active, -1)
+		//long enough for the other detach to get here unless it waits
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- DisconnectAllForTarget("20210002ac00383d", false) }()
+	go func() { errs <- DisconnectVolume(fcConnectionProperties(), nil) }()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if overlaps > 0 {
+		t.Error("the detaches of the volume overlapped")
+	}
+}
+
+func TestGetPossibleVolumePathsWithByPathRoot(t *testing.T) {
+	byPath := newFakeByPath(t)
+	dev := tempDir(t)
+	writeFakeFile(t, dev, "sdb", "")
+	symlink(t, byPath, filepath.Join(dev, "sdb"), "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1")
+
+	hbas := []initiator.HBA{{
+		"port_name":   "100010604b010459",
+		"node_name":   "200010604b010459",
+		"host_device": "host2",
+		"device_path": "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.2/host2/fc_host/host2",
+	}}
+	paths, err := getPossibleVolumePaths([]initiator.Target{{"20210002AC00383D", "1"}}, hbas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(byPath, "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1")}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected paths: %#v", paths)
+	}
+}
+
+func TestGetPossibleHostPathPrefix(t *testing.T) {
+	byPath := newFakeByPath(t)
+	writeFakeFile(t, byPath, "platform-40000000.pcie-controller-pci-0000:01:00.1-fc-0x2101001b32a08c84-lun-0", "")
+	prefix, err := getPossibleHostPathPrefix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix != "platform-40000000.pcie-controller-" {
+		t.Errorf("unexpected prefix: %q", prefix)
+	}
+}
+
+func TestGetPossibleHostPathPrefixGolden(t *testing.T) {
+	defer func(fs osBrick.FS) { osBrick.DefaultFS = fs }(osBrick.DefaultFS)
+	defer func(root string) { DevDiskByPathRoot = root }(DevDiskByPathRoot)
+	DevDiskByPathRoot = "/dev/disk/by-path"
+	for _, c := range []struct {
+		entries []string
+		prefix  string
+	}{
+		{[]string{"pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1"}, ""},
+		{[]string{"platform-40000000.pcie-controller-pci-0000:01:00.1-fc-0x2101001b32a08c84-lun-0"}, "platform-40000000.pcie-controller-"},
+		{[]string{
+			"ip-10.0.0.1:3260-iscsi-iqn.2010-10.org.openstack:volume-1-lun-1",
+			"platform-50000000.pcie-controller-pci-0000:01:00.1-fc-0x2101001b32a08c84-lun-12",
+		}, "platform-50000000.pcie-controller-"},
+	} {
+		fs := osBrick.NewMemFS()
+		for _, entry := range c.entries {
+			fs.Symlink("../../sdb", filepath.Join(DevDiskByPathRoot, entry))
+		}
+		osBrick.DefaultFS = fs
+		Reset()
+		prefix, err := getPossibleHostPathPrefix()
+		if err != nil {
+			t.Fatalf("%v: %v", c.entries, err)
+		}
+		if prefix != c.prefix {
+			t.Errorf("%v: expected prefix %q, got %q", c.entries, c.prefix, prefix)
+		}
+	}
+	osBrick.DefaultFS = osBrick.NewMemFS()
+	Reset()
+	if _, err := getPossibleHostPathPrefix(); err == nil {
+		t.Error("expected error without a by-path directory")
+	}
+	Reset()
+}
+
+func TestResetHostPathPrefix(t *testing.T) {
+	byPath := newFakeByPath(t)
+	old := filepath.Join(byPath, "platform-40000000.pcie-controller-pci-0000:01:00.1-fc-0x2101001b32a08c84-lun-0")
+	writeFakeFile(t, byPath, filepath.Base(old), "")
+	if prefix, err := getPossibleHostPathPrefix(); err != nil || prefix != "platform-40000000.pcie-controller-" {
+		t.Fatalf("unexpected prefix %q, %v", prefix, err)
+	}
+
+	if err := os.Remove(old); err != nil {
+		t.Fatal(err)
+	}
+	writeFakeFile(t, byPath, "platform-50000000.pcie-controller-pci-0000:01:00.1-fc-0x2101001b32a08c84-lun-0", "")
+	if prefix, _ := getPossibleHostPathPrefix(); prefix != "platform-40000000.pcie-controller-" {
+		t.Errorf("expected cached prefix, got %q", prefix)
+	}
+	Reset()
+	if prefix, _ := getPossibleHostPathPrefix(); prefix != "platform-50000000.pcie-controller-" {
+		t.Errorf("expected prefix read again after reset, got %q", prefix)
+	}
+}
+
+func TestConnectVolumeFailureCleanup(t *testing.T) {
+	if ConnectFailureCleanup != KeepOnFailure {
+		t.Errorf("expected the devices to be kept by default, got mode %d", ConnectFailureCleanup)
+	}
+	defer func(m FailureCleanupMode) { ConnectFailureCleanup = m }(ConnectFailureCleanup)
+	defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+	var removed []string
+	removeSCSIDevice = func(_ context.Context, device string, flush bool) error {
+		if !flush {
+			t.Errorf("expected %s to be flushed before removal", device)
+		}
+		removed = append(removed, device)
+		return nil
+	}
+	for _, c := range []struct {
+		mode    FailureCleanupMode
+		scanned bool
+		removed bool
+	}{
+		{CleanupOnFailure, true, true},
+		{CleanupOnFailure, false, false},
+		{KeepOnFailure, true, false},
+		{KeepAndLogOnFailure, true, false},
+	} {
+		h := newFakeFCHost(t)
+		fastDeviceScan(t)
+		sdb := filepath.Join(h.dev, "sdb")
+		if c.scanned {
+			//sdb only shows up once the host is scanned
+			if err := os.Remove(sdb); err != nil {
+				t.Fatal(err)
+			}
+		}
+		h.handler = func(name string, arg ...string) (string, error) {
+			if name == "udevadm" {
+				writeFakeFile(t, h.dev, "sdb", "")
+				return "", nil
+			}
+			//scsi_id fails on both pages
+			return "", fmt.Errorf("scsi_id failed")
+		}
+		ConnectFailureCleanup = c.mode
+		removed = nil
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		_, err := ConnectVolume(fcConnectionProperties())
+		log.SetOutput(os.Stderr)
+		if err == nil {
+			t.Fatalf("mode %d: expected connect to fail", c.mode)
+		}
+		if (len(removed) == 1 && removed[0] == "/dev/sdb") != c.removed {
+			t.Errorf("mode %d, scanned %t: expected sdb removed to be %t, removed %v", c.mode, c.scanned, c.removed, removed)
+		}
+		if c.mode == KeepAndLogOnFailure && !strings.Contains(logs.String(), "keeping scanned devices: [/dev/sdb]") {
+			t.Errorf("kept devices not logged: %s", logs.String())
+		}
+	}
+}
+
+func TestConnectVolumeDeviceNotFoundDiagnostic(t *testing.T) {
+	for state, expected := range map[string]string{
+		"Blocked": "target port still blocked",
+		"Online":  "LUN not masked",
+	} {
+		h := newFakeFCHost(t)
+		fastDeviceScan(t)
+		if err := os.Remove(filepath.Join(h.byPath, "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1")); err != nil {
+			t.Fatal(err)
+		}
+		writeFakeFile(t, h.sysfs, "class/fc_remote_ports/rport-2:0-0/port_name", "0x20210002ac00383d\n")
+		writeFakeFile(t, h.sysfs, "class/fc_remote_ports/rport-2:0-0/port_state", state+"\n")
+		_, err := ConnectVolume(fcConnectionProperties())
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("port %s: expected error mentioning %q, got %v", state, expected, err)
+		}
+	}
+}
+
+func TestConnectVolumeDeviceNotFoundErrors(t *testing.T) {
+	for state, expected := range map[string]error{
+		"":        ErrVolumeDeviceNotFound,
+		"Blocked": ErrDeviceDiscoveryTimeout,
+		"Online":  ErrDeviceDiscoveryTimeout,
+	} {
+		h := newFakeFCHost(t)
+		fastDeviceScan(t)
+		if err := os.Remove(filepath.Join(h.byPath, "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1")); err != nil {
+			t.Fatal(err)
+		}
+		if state != "" {
+			writeFakeFile(t, h.sysfs, "class/fc_remote_ports/rport-2:0-0/port_name", "0x20210002ac00383d\n")
+			writeFakeFile(t, h.sysfs, "class/fc_remote_ports/rport-2:0-0/port_state", state+"\n")
+		}
+		if _, err := ConnectVolume(fcConnectionProperties()); !errors.Is(err, expected) {
+			t.Errorf("port %q: expected %v, got %v", state, expected, err)
+		}
+	}
+
+	//no HBA at all
+	h := newFakeFCHost(t)
+	if err := os.RemoveAll(filepath.Join(h.sysfs, "class/fc_host/host2")); err != nil {
+		t.Fatal(err)
+	}
+	h.systool = ""
+	if _, err := ConnectVolume(fcConnectionProperties()); !errors.Is(err, ErrVolumeDeviceNotFound) {
+		t.Errorf("no HBA: expected %v, got %v", ErrVolumeDeviceNotFound, err)
+	}
+}
+
+func TestRemoveDevicesTimeoutReportsOrphans(t *testing.T) {
+	release, finished := make(chan struct{}), make(chan struct{})
+	defer func(f func(context.Context, string, bool) error) {
+		//let the removal running in the background finish first
+		close(release)
+		<-finished
+		removeSCSIDevice = f
+	}(removeSCSIDevice)
+	removeSCSIDevice = func(_ context.Context, device string, flush bool) error {
+		switch device {
+		case "/dev/sdc":
+			//the flush of sdc hangs
+			<-release
+		case "/dev/sdd":
+			close(finished)
+		}
+		return nil
+	}
+
+	devices := []map[string]string{{"device": "/dev/sdb"}, {"device": "/dev/sdc"}, {"device": "/dev/sdd"}}
+	pending := &pendingDevices{}
+	start := time.Now()
+	err := runWithTimeout(50*time.Millisecond, pending, func() error {
+		return removeDevices(context.Background(), map[string]interface{}{}, devices, nil, pending)
+	})
+	if time.Since(start) > time.Second {
+		t.Errorf("remove devices didn't return within the timeout")
+	}
+	orphaned, ok := err.(*OrphanedDevicesError)
+	if !ok {
+		t.Fatalf("expected OrphanedDevicesError, got %v", err)
+	}
+	if !reflect.DeepEqual(orphaned.Devices, []string{"/dev/sdc", "/dev/sdd"}) {
+		t.Errorf("unexpected orphaned devices: %v", orphaned.Devices)
+	}
+}
+
+func TestRemoveDevicesReportsFailures(t *testing.T) {
+	defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+	removeSCSIDevice = func(_ context.Context, device string, flush bool) error {
+		if device == "/dev/sdb" {
+			return fmt.Errorf("device busy")
+		}
+		return nil
+	}
+	devices := []map[string]string{{"device": "/dev/sdb"}, {"device": "/dev/sdc"}}
+	err := removeDevices(context.Background(), map[string]interface{}{}, devices, nil, &pendingDevices{})
+	orphaned, ok := err.(*OrphanedDevicesError)
+	if !ok || !reflect.DeepEqual(orphaned.Devices, []string{"/dev/sdb"}) {
+		t.Errorf("expected sdb orphaned, got %v", err)
+	}
+}
+
+func TestGetPCINum(t *testing.T) {
+	for devicePath, expected := range map[string]string{
+		"/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.3/host2/fc_host/host2":                   "0000:05:00.3",
+		"/sys/devices/pci0000:20/0000:20:03.0/0000:21:00.2/net/ens2f2/ctlr_2/host3/fc_host/host3": "0000:21:00.2",
+		"/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.2/host2/vport-2:0-0/host5/fc_host/host5": "0000:05:00.2",
+		"/sys/devices/platform/host4/fc_host/host4":                                               "",
+	} {
+		if pciNum := getPCINum(initiator.HBA{"device_path": devicePath}); pciNum != expected {
+			t.Errorf("unexpected pci num for %s: %q", devicePath, pciNum)
+		}
+	}
+	//FCoE on a VLAN interface
+	hba := initiator.HBA{
+		"device_path": "/sys/devices/virtual/net/ens2f2.100/ctlr_3/host4/fc_host/host4",
+		"pci_address": "0000:21:00.2",
+	}
+	if pciNum := getPCINum(hba); pciNum != "0000:21:00.2" {
+		t.Errorf("unexpected pci num for fcoe vlan: %q", pciNum)
+	}
+}
+
+func TestGetVolumePathsSkipsStaleLinks(t *testing.T) {
+	host := newFakeFCHost(t)
+	//sdc is gone, but its by-path link is left behind
+	symlink(t, host.byPath, filepath.Join(host.dev, "sdc"), "pci-0000:05:00.2-fc-0x20220002ac00383d-lun-1")
+	//sdd still has a node in /dev, but the kernel has removed the device
+	writeFakeFile(t, host.dev, "sdd", "")
+	symlink(t, host.byPath, filepath.Join(host.dev, "sdd"), "pci-0000:05:00.2-fc-0x20230002ac00383d-lun-1")
+
+	paths, err := GetVolumePaths([]initiator.Target{
+		{"20210002ac00383d", "1"}, {"20220002ac00383d", "1"}, {"20230002ac00383d", "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(host.byPath, "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1")}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+}
+
+func TestGetVolumePathsFailingHBA(t *testing.T) {
+	//host3 lost its controller, its device path has no pci address left
+	const brokenHost = `  Class Device = "host3"
+  Class Device path = "/sys/devices/virtual/host3/fc_host/host3"
+    node_name           = "0x200010604b01045a"
+    port_name           = "0x100010604b01045a"
+    port_state          = "Linkdown"
+
+
+`
+	host := newFakeFCHost(t)
+	host.systool = fakeSystoolOutput + brokenHost
+	targets := []initiator.Target{{"20210002ac00383d", "1"}}
+	paths, err := GetVolumePaths(targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(host.byPath, "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1")}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+
+	host.systool = "Class = \"fc_host\"\n\n" + brokenHost
+	if _, err := GetVolumePaths(targets); err == nil {
+		t.Error("expected an error when no HBA could be queried")
+	}
+}
+
+func TestConnectVolumeTargetDiscovery(t *testing.T) {
+	for _, discovered := range []bool{true, false} {
+		h := newFakeFCHost(t)
+		h.handler = func(name string, arg ...string) (string, error) {
+			return "", fmt.Errorf("scsi_id failed")
+		}
+		scan := filepath.Join(h.sysfs, "class/scsi_host/host2/scan")
+		writeFakeFile(t, h.sysfs, "class/scsi_host/host2/scan", "")
+		props := fcConnectionProperties()
+		props["target_discovered"] = discovered
+		if _, err := ConnectVolume(props); err == nil {
+			t.Fatal("expected connect to fail")
+		}
+		out, err := ioutil.ReadFile(scan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//only lun 1 of the volume is looked for
+		if scanned := string(out) == "- - 1\n"; scanned == discovered {
+			t.Errorf("target_discovered %t: unexpected scan %q", discovered, out)
+		}
+	}
+}
+
+//memSysFS is the SysFSRoot of the MemFS hosts, it doesn't exist on the real
+//host so scans written there can't reach it.
+const memSysFS = "/nonexistent/sys"
+
+//newMemFSHost A fake host with a single FC HBA in a MemFS, seeing lun 1 of
+//target 20210002ac00383d as sdb.
+func newMemFSHost(t *testing.T, handler osBrick.Executor) *osBrick.MemFS {
+	fs := newMemFSHostFS(t)
+	fakeExecutor(t, memFSHostExecutor(handler))
+	return fs
+}
+
+//newMemFSHostFS Same host as newMemFSHost, leaving the executors alone.
+func newMemFSHostFS(t *testing.T) *osBrick.MemFS {
+	fs := osBrick.NewMemFS()
+	sysfs := initiator.SysFSRoot
+	initiator.SysFSRoot = memSysFS
+	t.Cleanup(func() { initiator.SysFSRoot = sysfs })
+	fs.MkdirAll(memSysFS+"/class/fc_host/host2")
+	fs.WriteFile("/dev/sdb", nil)
+	fs.MkdirAll(memSysFS+"/block/sdb")
+	fs.Symlink("../../sdb", "/dev/disk/by-path/pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1")
+	pathWait := initiator.PathWaitInterval
+	initiator.PathWaitInterval = time.Millisecond
+	t.Cleanup(func() { initiator.PathWaitInterval = pathWait })
+	orig := osBrick.DefaultFS
+	osBrick.DefaultFS = fs
+	t.Cleanup(func() { osBrick.DefaultFS = orig })
+
+	validator := osBrick.DefaultDeviceValidator
+	osBrick.DefaultDeviceValidator = func(string) bool { return true }
+	t.Cleanup(func() { osBrick.DefaultDeviceValidator = validator })
+	lookup := osBrick.DefaultPathLookup
+	osBrick.DefaultPathLookup = func(file string) (string, error) { return "/usr/sbin/" + filepath.Base(file), nil }
+	t.Cleanup(func() { osBrick.DefaultPathLookup = lookup })
+	root := DevDiskByPathRoot
+	DevDiskByPathRoot = "/dev/disk/by-path"
+	Reset()
+	t.Cleanup(func() {
+		DevDiskByPathRoot = root
+		Reset()
+	})
+	return fs
+}
+
+//memFSHostExecutor Answer the commands about the host of newMemFSHostFS,
+//passing the others to handler.
+func memFSHostExecutor(handler osBrick.Executor) osBrick.Executor {
+	return func(name string, arg ...string) (string, error) {
+		switch name {
+		case "systool":
+			return fakeSystoolOutput, nil
+		case "/lib/udev/scsi_id":
+			return "3600a0980383036347224000000000001\n", nil
+		case "lsblk":
+			return `{"blockdevices": []}`, nil
+		}
+		return handler(name, arg...)
+	}
+}
+
+//addMemFSMultipath Assemble the multipath device mpatha, dm-0, of the volume.
+func addMemFSMultipath(fs *osBrick.MemFS) {
+	fs.WriteFile("/dev/dm-0", nil)
+	fs.Symlink("../../dm-0", "/dev/disk/by-id/dm-uuid-mpath-3600a0980383036347224000000000001")
+	fs.Symlink("../dm-0", "/dev/mapper/mpatha")
+	fs.WriteFile(memSysFS+"/block/dm-0/dm/uuid", []byte("mpath-3600a0980383036347224000000000001\n"))
+}
+
+func TestConnectVolumeFailedPaths(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		fs := newMemFSHost(t, func(name string, arg ...string) (string, error) {
+			if name == "multipath" {
+				return "mpatha (3600a0980383036347224000000000001) dm-0 NETAPP,LUN C-Mode\n" +
+					"size=2.0G features='1 queue_if_no_path' hwhandler='1 alua' wp=rw\n" +
+					"`-+- policy='service-time 0' prio=0 status=active\n" +
+					"  |- 2:0:0:1 sdb 8:16 active undef running\n" +
+					"  |- 2:0:1:1 sdc 8:32 failed undef running\n" +
+					"  `- 3:0:0:1 sdd 8:48 active undef running\n", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		})
+		addMemFSMultipath(fs)
+		fs.WriteFile(memSysFS+"/block/sdb/device/state", []byte("running\n"))
+		fs.WriteFile(memSysFS+"/block/sdc/device/state", []byte("running\n"))
+		fs.WriteFile(memSysFS+"/block/sdd/device/state", []byte("offline\n"))
+		defer func(f bool) { FailOnDegradedMultipath = f }(FailOnDegradedMultipath)
+		FailOnDegradedMultipath = strict
+		props := fcConnectionProperties()
+		props["use_multipath"] = true
+
+		info, err := ConnectVolume(props)
+		if strict {
+			if err == nil || !strings.Contains(err.Error(), "/dev/sdc,/dev/sdd") {
+				t.Errorf("expected the failed paths in the error, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info["failed_paths"] != "/dev/sdc,/dev/sdd" || info["multipath_id"] != "3600a0980383036347224000000000001" {
+			t.Errorf("unexpected device info %v", info)
+		}
+	}
+}
+
+func TestConnectVolumeDeviceScanAttempts(t *testing.T) {
+	for attempts, expected := range map[interface{}]int{nil: 3, 5: 5, "7": 7, "0x4": 4, 2.0: 2, 2.5: 3, "x": 3} {
+		newFakeFCHost(t)
+		fastDeviceScan(t)
+		//sdb never becomes readable
+		scans := 0
+		osBrick.DefaultDeviceValidator = func(string) bool {
+			scans++
+			return false
+		}
+		props := fcConnectionProperties()
+		if attempts != nil {
+			props["device_scan_attempts"] = attempts
+		}
+		if _, err := ConnectVolume(props); err == nil {
+			t.Fatal("expected connect to fail")
+		}
+		if scans != expected {
+			t.Errorf("device_scan_attempts %#v: expected %d scans, got %d", attempts, expected, scans)
+		}
+	}
+}
+
+func TestReassembleMultipath(t *testing.T) {
+	added := make([]string, 0)
+	fs := newMemFSHost(t, func(name string, arg ...string) (string, error) {
+		switch name {
+		case "multipath":
+			//no multipath device yet
+			return "", nil
+		case "multipathd":
+			if arg[0] == "add" {
+				added = append(added, arg[2])
+				return "ok\n", nil
+			}
+			return "uuid\n3600a0980383036347224000000000001\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	defer func(d bool) { DeferMultipathAssembly = d }(DeferMultipathAssembly)
+	DeferMultipathAssembly = true
+	props := fcConnectionProperties()
+	props["use_multipath"] = true
+	props["target_wwn"] = []string{"20210002AC00383D", "20220002AC00383D"}
+
+	info, err := ConnectVolume(props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info["multipath_pending"] != "true" || info["path"] != "/dev/sdb" || !strings.Contains(info["expected_paths"], "0x20220002ac00383d-lun-1") {
+		t.Errorf("expected a pending single path attach, got %v", info)
+	}
+	props["expected_paths"] = info["expected_paths"]
+	if _, err := ReassembleMultipath(props); err == nil {
+		t.Error("expected reassembly to fail with a single path up")
+	}
+
+	//the second path comes up and multipathd assembles the map
+	fs.WriteFile("/dev/sdc", nil)
+	fs.MkdirAll(memSysFS+"/block/sdc")
+	fs.Symlink("../../sdc", "/dev/disk/by-path/pci-0000:05:00.2-fc-0x20220002ac00383d-lun-1")
+	addMemFSMultipath(fs)
+	//at first the lun behind the second path is another volume
+	executor := osBrick.DefaultExecutor
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		if name == "/lib/udev/scsi_id" && strings.Contains(strings.Join(arg, " "), "0x20220002ac00383d") {
+			return "3600a0980383036347224000000000002\n", nil
+		}
+		return executor(name, arg...)
+	})
+	if _, err := ReassembleMultipath(props); err == nil || !strings.Contains(err.Error(), "3600a0980383036347224000000000002") || len(added) > 0 {
+		t.Errorf("expected reassembly of paths of different volumes to fail, got %v, added %v", err, added)
+	}
+	fakeExecutor(t, executor)
+	info, err = ReassembleMultipath(props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info["path"] != "/dev/disk/by-id/dm-uuid-mpath-3600a0980383036347224000000000001" || info["multipath_id"] != "3600a0980383036347224000000000001" {
+		t.Errorf("unexpected device info %v", info)
+	}
+	if !reflect.DeepEqual(added, []string{"/dev/sdb", "/dev/sdc"}) {
+		t.Errorf("unexpected paths added to multipathd: %v", added)
+	}
+}
+
+func TestConnectVolumeMultipathNotFound(t *testing.T) {
+	defer func(d bool) { DeferMultipathAssembly = d }(DeferMultipathAssembly)
+	for _, deferred := range []bool{false, true} {
+		newMemFSHost(t, func(name string, arg ...string) (string, error) {
+			switch name {
+			case "multipath":
+				//no multipath device
+				return "", nil
+			case "multipathd":
+				return "uuid\n3600a0980383036347224000000000001\n", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		})
+		DeferMultipathAssembly = deferred
+		props := fcConnectionProperties()
+		props["use_multipath"] = true
+
+		info, err := ConnectVolume(props)
+		if !deferred {
+			if err == nil {
+				t.Errorf("expected connect to fail without multipath device, got %v", info)
+			}
+			continue
+		}
+		if err != nil || info["multipath_pending"] != "true" {
+			t.Errorf("expected a pending single path attach, got %v, %v", info, err)
+		}
+	}
+}
+
+func TestRemoveDevicesSkipsFlushOfOfflinePath(t *testing.T) {
+	for state, expected := range map[string]bool{"running": true, "offline": false, "transport-offline": false} {
+		fs := newMemFSHost(t, func(name string, arg ...string) (string, error) {
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		})
+		fs.WriteFile(memSysFS+"/block/sdb/device/state", []byte(state+"\n"))
+		fs.WriteFile("/dev/sdc", nil)
+		fs.WriteFile(memSysFS+"/block/sdc/device/state", []byte("running\n"))
+		flushed := make(map[string]bool)
+		defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+		removeSCSIDevice = func(_ context.Context, device string, flush bool) error {
+			flushed[device] = flush
+			return nil
+		}
+		//sdb was used directly, sdc is another path of the volume
+		devices := []map[string]string{{"device": "/dev/sdb"}, {"device": "/dev/sdc"}}
+		deviceInfo := map[string]string{"path": "/dev/disk/by-path/pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1"}
+		if err := removeDevices(context.Background(), map[string]interface{}{}, devices, deviceInfo, &pendingDevices{}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(flushed, map[string]bool{"/dev/sdb": expected, "/dev/sdc": false}) {
+			t.Errorf("sdb %s: unexpected flushes %v", state, flushed)
+		}
+	}
+}
+
+func TestConnectVolumeBlacklistedWWN(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		paths    string
+		check    string
+		checkErr error
+		managed  bool
+	}{
+		{"monitored", "uuid\n3600a0980383036347224000000000001\n", "", nil, true},
+		{"blacklisted", "uuid\n", "/dev/sdb is not a valid multipath device path\n", errors.New("exit status 1"), false},
+		//can't tell, the multipath device is waited for
+		{"unknown", "uuid\n", "", errors.New("exit status 2"), true},
+	} {
+		listed := false
+		fs := newMemFSHost(t, func(name string, arg ...string) (string, error) {
+			switch {
+			case name == "multipathd":
+				return c.paths, nil
+			case name == "multipath" && arg[0] == "-c":
+				if arg[1] != "/dev/sdb" {
+					t.Errorf("%s: unexpected path checked %s", c.name, arg[1])
+				}
+				return c.check, c.checkErr
+			case name == "multipath":
+				listed = true
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		})
+		addMemFSMultipath(fs)
+		props := fcConnectionProperties()
+		props["use_multipath"] = true
+
+		info, err := ConnectVolume(props)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.managed {
+			if info["path"] != "/dev/disk/by-id/dm-uuid-mpath-3600a0980383036347224000000000001" {
+				t.Errorf("%s: expected the multipath device, got %v", c.name, info)
+			}
+			continue
+		}
+		if info["path"] != "/dev/sdb" || info["multipath_id"] != "" || listed {
+			t.Errorf("%s: expected a single path attach without multipath lookup, got %v", c.name, info)
+		}
+	}
+}
+
+func TestConnectVolumeEmptyWWN(t *testing.T) {
+	defer func(fail bool) { FailOnEmptyWWN = fail }(FailOnEmptyWWN)
+	for _, fail := range []bool{false, true} {
+		h := newFakeFCHost(t)
+		multipathCommands := make([]string, 0)
+		h.handler = func(name string, arg ...string) (string, error) {
+			switch name {
+			case "/lib/udev/scsi_id":
+				//a passthrough device without page 0x83 nor 0x80
+				return "\n", nil
+			case "multipath", "multipathd":
+				multipathCommands = append(multipathCommands, name+" "+strings.Join(arg, " "))
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		}
+		FailOnEmptyWWN = fail
+		props := fcConnectionProperties()
+		props["use_multipath"] = true
+		info, err := ConnectVolume(props)
+		if fail {
+			if !errors.Is(err, ErrEmptySCSIWWN) {
+				t.Errorf("expected ErrEmptySCSIWWN, got %v, %v", info, err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		} else if info["path"] != filepath.Join(h.byPath, "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1") || info["scsi_wwn"] != "" || info["multipath_id"] != "" {
+			t.Errorf("expected the single path without wwn, got %v", info)
+		}
+		if len(multipathCommands) > 0 {
+			t.Errorf("fail %t: unexpected multipath lookups %v without a wwn", fail, multipathCommands)
+		}
+	}
+}
+
+func TestConnectVolumeSerial(t *testing.T) {
+	for _, serial := range []string{"D7ZSy$JBBGrD", ""} {
+		h := newFakeFCHost(t)
+		h.handler = func(name string, arg ...string) (string, error) {
+			if name == "/lib/udev/scsi_id" {
+				if arg[1] == "0x80" {
+					if serial == "" {
+						return "", fmt.Errorf("exit status 1")
+					}
+					return serial + "\n", nil
+				}
+				return "3600a0980383036347224000000000001\n", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		}
+		info, err := ConnectVolume(fcConnectionProperties())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info["scsi_wwn"] != "3600a0980383036347224000000000001" {
+			t.Errorf("unexpected scsi_wwn in %v", info)
+		}
+		if s, ok := info["serial"]; s != serial || ok != (serial != "") {
+			t.Errorf("expected serial %q, got %v", serial, info)
+		}
+	}
+}
+
+func TestConnectVolumeMultipathTimeout(t *testing.T) {
+	for _, timeout := range []interface{}{1, "2", float64(2), json.Number("1")} {
+		fs := newMemFSHost(t, func(name string, arg ...string) (string, error) {
+			switch name {
+			case "multipathd":
+				return "uuid\n3600a0980383036347224000000000001\n", nil
+			case "multipath":
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		})
+		//the slow array assembles the map well after the default wait
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			time.Sleep(50 * time.Millisecond)
+			addMemFSMultipath(fs)
+		}()
+		props := fcConnectionProperties()
+		props["use_multipath"] = true
+		props["multipath_timeout"] = timeout
+		info, err := ConnectVolume(props)
+		<-done
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info["path"] != "/dev/disk/by-id/dm-uuid-mpath-3600a0980383036347224000000000001" {
+			t.Errorf("multipath_timeout %#v: expected the multipath device, got %v", timeout, info)
+		}
+	}
+}
+
+func TestGetMultipathTimeout(t *testing.T) {
+	for v, expected := range map[interface{}]time.Duration{
+		30:                30 * time.Second,
+		int64(5):          5 * time.Second,
+		2.0:               2 * time.Second,
+		json.Number("20"): 20 * time.Second,
+		" 10 ":            10 * time.Second,
+		2.5:               -1,
+		"-1":              -1,
+		"slow":            -1,
+		"NaN":             -1,
+		true:              -1,
+		float64(1e300):    -1,
+		int64(1) << 62:    -1,
+	} {
+		timeout, ok := getMultipathTimeout(map[string]interface{}{"multipath_timeout": v})
+		if expected < 0 {
+			if ok {
+				t.Errorf("%#v: expected invalid, got %v", v, timeout)
+			}
+		} else if !ok || timeout != expected {
+			t.Errorf("%#v: expected %v, got %v, %t", v, expected, timeout, ok)
+		}
+	}
+	if _, ok := getMultipathTimeout(map[string]interface{}{}); ok {
+		t.Error("expected no timeout when multipath_timeout is absent")
+	}
+}
+
+func TestExpectedFCDevicePaths(t *testing.T) {
+	//the fibre_channel single lun example of ConnectVolume
+	props := func() map[string]interface{} {
+		return map[string]interface{}{
+			"driver_volume_type": "fibre_channel",
+			"data": map[string]interface{}{
+				"initiator_target_map": map[string][]string{
+					"100010604b010459": {"20210002AC00383D"},
+					"100010604b01045d": {"20220002AC00383D"},
+				},
+				"target_discovered": true,
+				"encrypted":         false,
+				"qos_specs":         nil,
+				"target_lun":        "1",
+				"access_mode":       "rw",
+				"target_wwn":        []string{"20210002AC00383D", "20220002AC00383D"},
+			},
+		}
+	}
+	names := []string{
+		"pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1",
+		"pci-0000:05:00.2-fc-0x20220002ac00383d-lun-1",
+	}
+
+	h := newFakeFCHost(t)
+	paths, err := ExpectedFCDevicePaths(props())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(h.byPath, names[0]), filepath.Join(h.byPath, names[1])}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+
+	//an arm64 host naming the entries after its platform pcie controller
+	const prefix = "platform-40000000.pcie-controller-"
+	h = newFakeFCHost(t)
+	if err := os.Rename(filepath.Join(h.byPath, names[0]), filepath.Join(h.byPath, prefix+names[0])); err != nil {
+		t.Fatal(err)
+	}
+	paths, err = ExpectedFCDevicePaths(props())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		filepath.Join(h.byPath, names[0]), filepath.Join(h.byPath, prefix+names[0]),
+		filepath.Join(h.byPath, names[1]), filepath.Join(h.byPath, prefix+names[1]),
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+}
+
+func TestDisconnectVolumes(t *testing.T) {
+	fs := newMemFSHost(t, func(name string, arg ...string) (string, error) {
+		if name == "sg_scan" {
+			lun := arg[0][len(arg[0])-1] - 'a'
+			return fmt.Sprintf("%s: scsi2 channel=0 id=0 lun=%d\n", arg[0], lun), nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	//one volume per lun, lun N on sd<b+N-1>, with the multipath device dm-N
+	requests := make([]DetachRequest, 0)
+	wwns := make(map[string]string)
+	for lun := 1; lun <= 6; lun++ {
+		dev := fmt.Sprintf("sd%c", 'a'+lun)
+		wwn := fmt.Sprintf("3600a098038303634722400000000000%d", lun)
+		path := fmt.Sprintf("/dev/disk/by-path/pci-0000:05:00.2-fc-0x20210002ac00383d-lun-%d", lun)
+		fs.WriteFile("/dev/"+dev, nil)
+		fs.MkdirAll(memSysFS + "/block/" + dev)
+		fs.Symlink("../../"+dev, path)
+		fs.WriteFile(fmt.Sprintf("/dev/dm-%d", lun), nil)
+		fs.Symlink(fmt.Sprintf("../../dm-%d", lun), "/dev/disk/by-id/dm-uuid-mpath-"+wwn)
+		wwns[path] = wwn
+		props := fcConnectionProperties()
+		props["target_lun"] = strconv.Itoa(lun)
+		props["use_multipath"] = true
+		requests = append(requests, DetachRequest{ConnectionProperties: props})
+	}
+	executor := osBrick.DefaultExecutor
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		if name == "/lib/udev/scsi_id" {
+			return wwns[arg[len(arg)-1]] + "\n", nil
+		}
+		return executor(name, arg...)
+	})
+	var (
+		mu            sync.Mutex
+		running, peak int
+		flushed       = make(map[string]bool)
+		removed       = make(map[string]bool)
+	)
+	defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+	removeSCSIDevice = func(_ context.Context, device string, flush bool) error {
+		mu.Lock()
+		defer mu.Unlock()
+		removed[device] = true
+		return nil
+	}
+	defer func(f func(context.Context, string) error) { flushMultipathDevice = f }(flushMultipathDevice)
+	flushMultipathDevice = func(ctx context.Context, mPathPath string) error {
+		mu.Lock()
+		if running++; running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		flushed[mPathPath] = true
+		mu.Unlock()
+		return nil
+	}
+
+	for i, err := range DisconnectVolumes(requests, 3) {
+		if err != nil {
+			t.Errorf("volume %d: %v", i, err)
+		}
+	}
+	if peak > 3 {
+		t.Errorf("expected at most 3 concurrent flushes, got %d", peak)
+	}
+	if peak < 2 {
+		t.Errorf("expected concurrent flushes, got %d at most", peak)
+	}
+	for _, wwn := range wwns {
+		if !flushed["/dev/disk/by-id/dm-uuid-mpath-"+wwn] {
+			t.Errorf("multipath device of %s not flushed", wwn)
+		}
+	}
+	if len(removed) != len(wwns) {
+		t.Errorf("expected %d devices removed, got %v", len(wwns), removed)
+	}
+}
+
+func TestGetConnectorProperties(t *testing.T) {
+	fs := newMemFSHost(t, func(name string, arg ...string) (string, error) {
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	//systool of the fake host doesn't report the link, it is read from sysfs
+	fs.WriteFile(memSysFS+"/class/fc_host/host2/speed", []byte("8 Gbit\n"))
+	fs.WriteFile(memSysFS+"/class/fc_host/host2/port_type", []byte("NPort (fabric via point-to-point)\n"))
+	fs.WriteFile(memSysFS+"/class/fc_host/host2/supported_classes", []byte("Class 3\n"))
+	fs.WriteFile(memSysFS+"/class/dmi/id/product_uuid", []byte("4C4C4544-0038-5110-8058-B4C04F4E4D32\n"))
+
+	props, err := GetConnectorProperties()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"system uuid": "4c4c4544-0038-5110-8058-b4c04f4e4d32",
+		"platform":    runtime.GOARCH,
+		"os_type":     "linux",
+		"wwpns": []string{"100010604b010459"},
+		"wwnns": []string{"200010604b010459"},
+		"fc_ports": []map[string]string{{
+			"wwpn":              "100010604b010459",
+			"host_device":       "host2",
+			"speed":             "8 Gbit",
+			"port_type":         "NPort (fabric via point-to-point)",
+			"supported_classes": "Class 3",
+		}},
+	}
+	if !reflect.DeepEqual(props, expected) {
+		t.Errorf("expected %v, got %v", expected, props)
+	}
+}
+
+func TestDisconnectVolumeClosesCryptHolder(t *testing.T) {
+	var ops []string
+	fs := newMemFSHost(t, func(name string, arg ...string) (string, error) {
+		switch name {
+		case "sg_scan":
+			return arg[0] + ": scsi2 channel=0 id=0 lun=1\n", nil
+		case "cryptsetup":
+			ops = append(ops, "cryptsetup "+strings.Join(arg, " "))
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	//sdb opened with cryptsetup luksOpen /dev/sdb crypt-vol
+	fs.WriteFile(memSysFS+"/block/sdb/holders/dm-1", nil)
+	fs.WriteFile(memSysFS+"/block/dm-1/dm/uuid", []byte("CRYPT-LUKS2-4b2d3ad5a3b14a8aa0e7e1e52e5c2f0e-crypt-vol\n"))
+	fs.WriteFile(memSysFS+"/block/dm-1/dm/name", []byte("crypt-vol\n"))
+	defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+	removeSCSIDevice = func(_ context.Context, device string, flush bool) error {
+		ops = append(ops, "remove "+device)
+		return nil
+	}
+
+	if err := DisconnectVolume(fcConnectionProperties(), nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"cryptsetup luksClose crypt-vol", "remove /dev/sdb"}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected %v, got %v", expected, ops)
+	}
+}
+
+func TestDisconnectVolumeAlreadyDetached(t *testing.T) {
+	newMemFSHost(t, func(name string, arg ...string) (string, error) {
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+	removeSCSIDevice = func(_ context.Context, device string, flush bool) error {
+		t.Errorf("unexpected removal of %s", device)
+		return nil
+	}
+
+	//lun 2 isn't attached to this host
+	props := fcConnectionProperties()
+	props["target_lun"] = "2"
+	if err := DisconnectVolume(props, nil); err != nil {
+		t.Errorf("expected nil for an already detached volume, got %v", err)
+	}
+}
+
+func TestDisconnectVolumeTeardownFCoE(t *testing.T) {
+	defer func(teardown bool) { TeardownFCoEOnLastVolume = teardown }(TeardownFCoEOnLastVolume)
+	for _, c := range []struct {
+		teardown    bool
+		otherVolume bool
+		expected    []string
+	}{
+		{true, false, []string{"fcoeadm -d ens2f2.100"}},
+		{true, true, []string{}},
+		{false, false, []string{}},
+	} {
+		commands := make([]string, 0)
+		fs := newMemFSHost(t, func(name string, arg ...string) (string, error) {
+			switch name {
+			case "sg_scan":
+				return arg[0] + ": scsi2 channel=0 id=0 lun=1\n", nil
+			case "fcoeadm":
+				commands = append(commands, name+" "+strings.Join(arg, " "))
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		})
+		//host2 is the fc host of the fcoe controller of a VLAN interface
+		vlan := memSysFS + "/devices/virtual/net/ens2f2.100"
+		fs.WriteFile(vlan+"/ctlr_2/host2/fc_host/host2/port_name", []byte("0x100010604b010459\n"))
+		fs.Symlink("../../../devices/virtual/net/ens2f2.100/ctlr_2", memSysFS+"/bus/fcoe/devices/ctlr_2")
+		fs.MkdirAll(memSysFS + "/bus/scsi/devices/2:0:0:1")
+		if c.otherVolume {
+			fs.MkdirAll(memSysFS + "/bus/scsi/devices/2:0:0:2")
+		}
+		defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+		removeSCSIDevice = func(_ context.Context, device string, flush bool) error {
+			fs.RemoveAll(memSysFS + "/bus/scsi/devices/2:0:0:1")
+			return nil
+		}
+		TeardownFCoEOnLastVolume = c.teardown
+
+		if err := DisconnectVolume(fcConnectionProperties(), nil); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(commands, c.expected) {
+			t.Errorf("teardown %t, other volume %t: expected %v, got %v", c.teardown, c.otherVolume, c.expected, commands)
+		}
+	}
+}
+
+func TestGetClassifiedVolumePaths(t *testing.T) {
+	fs := newMemFSHost(t, func(name string, arg ...string) (string, error) {
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	//the lun is seen through a second target port as sdc, both in mpatha
+	fs.WriteFile("/dev/sdc", nil)
+	fs.Symlink("../../sdc", "/dev/disk/by-path/pci-0000:05:00.2-fc-0x21210002ac00383d-lun-1")
+	addMemFSMultipath(fs)
+	fs.WriteFile(memSysFS+"/block/dm-0/dm/name", []byte("mpatha\n"))
+	fs.WriteFile(memSysFS+"/block/sdb/holders/dm-0", nil)
+	fs.WriteFile(memSysFS+"/block/sdc/holders/dm-0", nil)
+
+	props := fcConnectionProperties()
+	props["target_wwn"] = []string{"20210002AC00383D", "21210002AC00383D"}
+	connProperties, err := addTargetsToConnectionProperties(props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	singlePaths, mpathPath, err := GetClassifiedVolumePaths(connProperties["targets"].([]initiator.Target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"/dev/disk/by-path/pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1",
+		"/dev/disk/by-path/pci-0000:05:00.2-fc-0x21210002ac00383d-lun-1",
+	}
+	if !reflect.DeepEqual(singlePaths, expected) {
+		t.Errorf("expected single paths %v, got %v", expected, singlePaths)
+	}
+	if mpathPath != "/dev/mapper/mpatha" {
+		t.Errorf("expected /dev/mapper/mpatha, got %s", mpathPath)
+	}
+}
+
+func TestConnectVolumeUdevSettle(t *testing.T) {
+	for _, settle := range []bool{true, false} {
+		h := newFakeFCHost(t)
+		fastDeviceScan(t)
+		defer func(s bool) { SettleUdev = s }(SettleUdev)
+		SettleUdev = settle
+		//the link is created by udev after the host is scanned
+		link := filepath.Join(h.byPath, "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1")
+		if err := os.Remove(link); err != nil {
+			t.Fatal(err)
+		}
+		//lun 0 of the target is attached already
+		writeFakeFile(t, h.dev, "sda", "")
+		symlink(t, h.byPath, filepath.Join(h.dev, "sda"), "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-0")
+		writeFakeFile(t, h.sysfs, "class/scsi_host/host2/scan", "")
+		ops := make([]string, 0)
+		rescanned := func() {
+			scan := filepath.Join(h.sysfs, "class/scsi_host/host2/scan")
+			if out, _ := ioutil.ReadFile(scan); len(out) > 0 {
+				ops = append(ops, "rescan")
+				ioutil.WriteFile(scan, nil, 0644)
+			}
+		}
+		h.handler = func(name string, arg ...string) (string, error) {
+			if strings.HasSuffix(name, "scsi_id") {
+				return "3600a0980383036347224000000000001\n", nil
+			}
+			if name != "udevadm" {
+				return "", fmt.Errorf("unexpected command %s %v", name, arg)
+			}
+			rescanned()
+			ops = append(ops, strings.Join(append([]string{name}, arg...), " "))
+			if len(ops) == 3 {
+				symlink(t, h.byPath, filepath.Join(h.dev, "sdb"), filepath.Base(link))
+			}
+			return "", nil
+		}
+
+		_, err := ConnectVolume(fcConnectionProperties())
+		rescanned()
+		if settle {
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []string{"udevadm settle --timeout=10", "rescan", "udevadm settle --timeout=10"}
+			if !reflect.DeepEqual(ops, expected) {
+				t.Errorf("expected %v, got %v", expected, ops)
+			}
+		} else if err == nil || len(ops) == 0 || ops[0] != "rescan" {
+			t.Errorf("expected the device not found without udev settle, got %v, ops %v", err, ops)
+		}
+	}
+}
+
+func TestGetVolumeDevices(t *testing.T) {
+	newMemFSHost(t, func(name string, arg ...string) (string, error) {
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	connProperties, err := addTargetsToConnectionProperties(fcConnectionProperties())
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := GetVolumeDevices(connProperties["targets"].([]initiator.Target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"/dev/sdb"}; !reflect.DeepEqual(devices, expected) {
+		t.Errorf("expected %v, got %v", expected, devices)
+	}
+}
+
+func TestDisconnectVolumeMultipathID(t *testing.T) {
+	fs := newMemFSHost(t, func(name string, arg ...string) (string, error) {
+		if name == "sg_scan" {
+			return arg[0] + ": scsi2 channel=0 id=0 lun=1\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	addMemFSMultipath(fs)
+	executor := osBrick.DefaultExecutor
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		if strings.HasSuffix(name, "scsi_id") {
+			t.Errorf("unexpected scsi_id %v, the multipath_id is known", arg)
+		}
+		return executor(name, arg...)
+	})
+	ops := make([]string, 0)
+	defer func(f func(context.Context, string) error) { flushMultipathDevice = f }(flushMultipathDevice)
+	flushMultipathDevice = func(ctx context.Context, device string) error {
+		ops = append(ops, "flush "+device)
+		return nil
+	}
+	defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+	removeSCSIDevice = func(_ context.Context, device string, flush bool) error {
+		ops = append(ops, "remove "+device)
+		return nil
+	}
+
+	props := fcConnectionProperties()
+	props["use_multipath"] = true
+	deviceInfo := map[string]string{"multipath_id": "3600a0980383036347224000000000001"}
+	if err := DisconnectVolume(props, deviceInfo); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"flush /dev/disk/by-id/dm-uuid-mpath-3600a0980383036347224000000000001", "remove /dev/sdb"}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected %v, got %v", expected, ops)
+	}
+}
+
+//contextExecutor Record the commands run with the executor of the context,
+//failing the test when the default executors were swapped to run them.
+func contextExecutor(t *testing.T, commands *[]string, handler osBrick.Executor) osBrick.Executor {
+	global, globalEnv := reflect.ValueOf(osBrick.DefaultExecutor).Pointer(), reflect.ValueOf(osBrick.DefaultEnvExecutor).Pointer()
+	return func(name string, arg ...string) (string, error) {
+		if reflect.ValueOf(osBrick.DefaultExecutor).Pointer() != global || reflect.ValueOf(osBrick.DefaultEnvExecutor).Pointer() != globalEnv {
+			t.Errorf("the default executors were replaced to run %s %v", name, arg)
+		}
+		*commands = append(*commands, strings.TrimSpace(name+" "+strings.Join(arg, " ")))
+		return handler(name, arg...)
+	}
+}
+
+func TestConnectVolumeContextExecutor(t *testing.T) {
+	fs := newMemFSHostFS(t)
+	addMemFSMultipath(fs)
+	fs.WriteFile(memSysFS+"/block/sdb/device/state", []byte("running\n"))
+	commands := make([]string, 0)
+	ctx := osBrick.WithExecutor(context.Background(), contextExecutor(t, &commands, memFSHostExecutor(func(name string, arg ...string) (string, error) {
+		switch name {
+		case "udevadm":
+			return "", nil
+		case "multipathd":
+			return "3600a0980383036347224000000000001\n", nil
+		case "multipath":
+			return "mpatha (3600a0980383036347224000000000001) dm-0 NETAPP,LUN C-Mode\n" +
+				"size=2.0G features='1 queue_if_no_path' hwhandler='1 alua' wp=rw\n" +
+				"`-+- policy='service-time 0' prio=0 status=active\n" +
+				"  `- 2:0:0:1 sdb 8:16 active undef running\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})))
+	props := fcConnectionProperties()
+	props["use_multipath"] = true
+
+	info, err := ConnectVolumeContext(ctx, props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info["multipath_id"] != "3600a0980383036347224000000000001" {
+		t.Errorf("unexpected device info %v", info)
+	}
+	//the host has none of these, they only answer through the context
+	for _, cmd := range []string{
+		"systool -c fc_host -v",
+		"udevadm settle --timeout=" + strconv.Itoa(int(UdevSettleTimeout.Seconds())),
+		"/lib/udev/scsi_id --page 0x83 --whitelisted /dev/disk/by-path/pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1",
+		"multipathd show paths format %w",
+		"lsblk -J -O -b",
+		"multipath -l /dev/disk/by-id/dm-uuid-mpath-3600a0980383036347224000000000001",
+	} {
+		found := false
+		for _, c := range commands {
+			found = found || c == cmd
+		}
+		if !found {
+			t.Errorf("expected %q to run with the executor of the context, got %v", cmd, commands)
+		}
+	}
+}
+
+func TestDisconnectVolumeContextExecutor(t *testing.T) {
+	fs := newMemFSHostFS(t)
+	addMemFSMultipath(fs)
+	defer func(f func(context.Context, string, bool) error) { removeSCSIDevice = f }(removeSCSIDevice)
+	removeSCSIDevice = func(_ context.Context, device string, flush bool) error { return nil }
+
+	commands := make([]string, 0)
+	ctx := osBrick.WithExecutor(context.Background(), contextExecutor(t, &commands, memFSHostExecutor(func(name string, arg ...string) (string, error) {
+		switch name {
+		case "sg_scan":
+			return arg[0] + ": scsi2 channel=0 id=0 lun=1\n", nil
+		case "multipath":
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})))
+	props := fcConnectionProperties()
+	props["use_multipath"] = true
+	deviceInfo := map[string]string{"multipath_id": "3600a0980383036347224000000000001"}
+	if err := DisconnectVolumeContext(ctx, props, deviceInfo); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"systool -c fc_host -v", "multipath -f /dev/disk/by-id/dm-uuid-mpath-3600a0980383036347224000000000001", "sg_scan /dev/sdb"}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected %v to run with the executor of the context, got %v", expected, commands)
+	}
+}
@@ -0,0 +1,184 @@
+package connectors
+
+import (
+	"errors"
+	"fmt"
+	osBrick "github.com/ydcool/os-brick-go"
+	"github.com/ydcool/os-brick-go/initiator"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//MountOptions Options of AttachAndMount.
+type MountOptions struct {
+	//FSType is created on the device when it has no filesystem yet,
+	//leave it empty to never format the device.
+	FSType string
+	//MkfsArgs are extra args passed to mkfs when FSType is created.
+	MkfsArgs []string
+	//Flags passed to mount -o, defaults to the access_mode of the volume.
+	Flags string
+	//UsePartition mounts the first partition of the device if it has one.
+	UsePartition bool
+	//Discard mounts with the discard option when the device supports it,
+	//also enabled by the discard connection property.
+	Discard bool
+	//WaitForRW waits for a read-only device to become read-write when
+	//it's mounted rw, instead of failing with initiator.ErrDeviceReadOnly.
+	WaitForRW bool
+}
+
+//AttachAndMount Connect to a volume and mount it on mountPoint.
+//
+//	Returns the device info of ConnectVolume, with the device mounted
+//	as mount_device. Mounting a read-only device rw fails with
+//	initiator.ErrDeviceReadOnly, see MountOptions.WaitForRW.
+func AttachAndMount(connectionProperties map[string]interface{}, mountPoint string, opts MountOptions) (map[string]string, error) {
+	connectionProperties = flattenConnectionProperties(connectionProperties)
+	deviceInfo, err := ConnectVolume(connectionProperties)
+	if err != nil {
+		return nil, err
+	}
+	device := deviceInfo["path"]
+	if opts.UsePartition && deviceInfo["device_kind"] != initiator.DeviceKindPartition {
+		if device, err = initiator.GetFirstPartition(device); err != nil {
+			return nil, err
+		}
+	}
+	flags := opts.Flags
+	if flags == "" {
+		flags = "rw"
+		if am, ok := connectionProperties["access_mode"].(string); ok && am == "ro" {
+			flags = "ro"
+		}
+	}
+	if !hasMountFlag(flags, "ro") {
+		if err = checkDeviceRW(device, deviceInfo["scsi_wwn"], opts.WaitForRW); err != nil {
+			return nil, err
+		}
+	}
+	if opts.FSType != "" {
+		if err = osBrick.MkfsIfEmpty(device, opts.FSType, opts.MkfsArgs...); err != nil {
+			return nil, err
+		}
+	}
+	if discard, _ := connectionProperties["discard"].(bool); discard || opts.Discard {
+		if supported, err := initiator.SupportsDiscard(device); err != nil {
+			log.Printf("failed check discard support of %s, mounting without discard: %v", device, err)
+		} else if !supported {
+			log.Printf("device %s doesn't support discard, mounting without discard", device)
+		} else {
+			flags += ",discard"
+		}
+	}
+	if err = os.MkdirAll(mountPoint, 0750); err != nil {
+		return nil, fmt.Errorf("failed create mount point %s: %v", mountPoint, err)
+	}
+	if err = osBrick.MountDir(device, mountPoint, flags); err != nil {
+		return nil, err
+	}
+	log.Printf("volume %s mounted on %s", device, mountPoint)
+	deviceInfo["mount_device"] = device
+	return deviceInfo, nil
+}
+
+//hasMountFlag Whether the mount -o flags contain flag.
+func hasMountFlag(flags string, flag string) bool {
+	for _, f := range strings.Split(flags, ",") {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+//checkDeviceRW Check the device to mount rw is not read-only.
+//
+//	When the read-only flag can't be probed from lsblk the mount goes on.
+//	A read-only device fails with initiator.ErrDeviceReadOnly unless wait
+//	is set, then it's waited for to become read-write.
+func checkDeviceRW(device string, wwn string, wait bool) error {
+	ro, err := initiator.IsDeviceReadOnly(device)
+	if err != nil {
+		log.Printf("failed check whether %s is read-only: %v", device, err)
+		return nil
+	}
+	if !ro {
+		return nil
+	}
+	if !wait {
+		return fmt.Errorf("%w: can't mount %s rw", initiator.ErrDeviceReadOnly, device)
+	}
+	//lsblk names a multipath device by its wwn, a single path by its kernel name
+	if realpath, err := osBrick.DefaultFS.EvalSymlinks(device); err == nil && !strings.HasPrefix(filepath.Base(realpath), "dm-") {
+		wwn = filepath.Base(realpath)
+	}
+	return initiator.WaitForRW(wwn, device)
+}
+
+//UnmountAndDetach Unmount mountPoint and detach the volume, the reverse of AttachAndMount.
+//
+//	deviceInfo is the one AttachAndMount returned, the device mounted on
+//	mountPoint is checked against its mount_device so another volume
+//	mounted there isn't detached. A mountPoint already unmounted, e.g.
+//	on a retry, goes straight to the detach.
+func UnmountAndDetach(connectionProperties map[string]interface{}, deviceInfo map[string]string, mountPoint string) error {
+	device, err := osBrick.GetDeviceForMountpoint(mountPoint)
+	if err != nil && !errors.Is(err, osBrick.ErrNotMounted) {
+		return err
+	}
+	if err == nil {
+		if mountDevice := deviceInfo["mount_device"]; mountDevice != "" {
+			expected, err := osBrick.DefaultFS.EvalSymlinks(mountDevice)
+			if err != nil {
+				return fmt.Errorf("failed get realpath of %s: %v", mountDevice, err)
+			}
+			if expected != device {
+				return fmt.Errorf("%s is mounted on %s, expected %s of the volume", device, mountPoint, expected)
+			}
+		}
+		if err = osBrick.UnmountDir(mountPoint, false); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("%s is not mounted, detaching the volume", mountPoint)
+	}
+	return DisconnectVolume(connectionProperties, deviceInfo)
+}
+
+//ExtendVolumeAndFS Extend the volume mounted on mountPoint like ExtendVolume,
+//then grow its filesystem, returns the size in bytes of the filesystem.
+//
+//	The filesystem is resized even when the device didn't grow, with a
+//	warning, a filesystem left behind by an earlier extend which grew the
+//	device but failed the resize is caught up, the resize is a no-op
+//	otherwise.
+func ExtendVolumeAndFS(connectionProperties map[string]interface{}, mountPoint string) (int64, error) {
+	device, err := osBrick.GetDeviceForMountpoint(mountPoint)
+	if err != nil {
+		return 0, err
+	}
+	oldSize, err := initiator.GetDeviceSizeBytes(device)
+	if err != nil {
+		return 0, err
+	}
+	if err = ExtendVolume(connectionProperties); err != nil {
+		return 0, err
+	}
+	newSize, err := initiator.GetDeviceSizeBytes(device)
+	if err != nil {
+		return 0, err
+	}
+	if newSize <= oldSize {
+		log.Printf("WARNING: %s mounted on %s didn't grow after extend, still %d bytes", device, mountPoint, newSize)
+	} else {
+		log.Printf("%s grown from %d to %d bytes", device, oldSize, newSize)
+	}
+	log.Printf("resizing the filesystem on %s", mountPoint)
+	if err = osBrick.ResizeFS(device, mountPoint); err != nil {
+		return 0, err
+	}
+	return osBrick.GetFSSize(mountPoint)
+}
@@ -0,0 +1,196 @@
+package connectors
+
+import (
+	"errors"
+	"fmt"
+	osBrick "github.com/ydcool/os-brick-go"
+	"github.com/ydcool/os-brick-go/initiator"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAttachAndMountDiscard(t *testing.T) {
+	for _, c := range []struct {
+		discard  bool
+		maxBytes string
+		flags    string
+	}{
+		{true, "2147450880\n", "rw,discard"},
+		{true, "0\n", "rw"},
+		{false, "2147450880\n", "rw"},
+	} {
+		h := newFakeFCHost(t)
+		writeFakeFile(t, h.sysfs, "block/sdb/queue/discard_max_bytes", c.maxBytes)
+		var flags string
+		h.handler = func(name string, arg ...string) (string, error) {
+			switch name {
+			case "/lib/udev/scsi_id":
+				return "3600a0980383036347224000000000001\n", nil
+			case "blkid":
+				return "ext4\n", nil
+			case "mount":
+				flags = arg[1]
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		}
+		props := fcConnectionProperties()
+		props["discard"] = c.discard
+		if _, err := AttachAndMount(props, filepath.Join(tempDir(t), "mnt"), MountOptions{FSType: "ext4"}); err != nil {
+			t.Fatal(err)
+		}
+		if flags != c.flags {
+			t.Errorf("discard %t, discard_max_bytes %q: expected flags %q, got %q", c.discard, c.maxBytes, c.flags, flags)
+		}
+	}
+}
+
+func TestAttachAndMountNestedProperties(t *testing.T) {
+	h := newFakeFCHost(t)
+	var flags string
+	h.handler = func(name string, arg ...string) (string, error) {
+		switch name {
+		case "/lib/udev/scsi_id":
+			return "3600a0980383036347224000000000001\n", nil
+		case "mount":
+			flags = arg[1]
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	}
+	//the fibre_channel single lun example of ConnectVolume
+	props := map[string]interface{}{
+		"driver_volume_type": "fibre_channel",
+		"data": map[string]interface{}{
+			"initiator_target_map": map[string]interface{}{"100010604b010459": []string{"20210002AC00383D"}},
+			"target_discovered":    true,
+			"encrypted":            false,
+			"qos_specs":            nil,
+			"target_lun":           "1",
+			"access_mode":          "ro",
+			"target_wwn":           []string{"20210002AC00383D"},
+			"use_multipath":        false,
+		},
+	}
+	deviceInfo, err := AttachAndMount(props, filepath.Join(tempDir(t), "mnt"), MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deviceInfo["scsi_wwn"] != "3600a0980383036347224000000000001" || deviceInfo["device_kind"] != "disk" {
+		t.Errorf("unexpected device info %v", deviceInfo)
+	}
+	if flags != "ro" {
+		t.Errorf("expected the nested access_mode to be used, got flags %q", flags)
+	}
+	if _, ok := props["targets"]; ok {
+		t.Error("the caller's properties were modified")
+	}
+}
+
+func TestAttachAndMountReadOnlyDevice(t *testing.T) {
+	defer func(attempts int, interval time.Duration) {
+		initiator.RWWaitAttempts, initiator.RWWaitInterval = attempts, interval
+	}(initiator.RWWaitAttempts, initiator.RWWaitInterval)
+	initiator.RWWaitAttempts, initiator.RWWaitInterval = 3, time.Millisecond
+	for _, wait := range []bool{false, true} {
+		h := newFakeFCHost(t)
+		reloaded, mounted := false, false
+		h.handler = func(name string, arg ...string) (string, error) {
+			switch name {
+			case "/lib/udev/scsi_id":
+				return "3600a0980383036347224000000000001\n", nil
+			case "lsblk":
+				//the device turns read-write once the maps are reloaded
+				return fmt.Sprintf(`{"blockdevices": [{"name": "sdb", "kname": "sdb", "type": "disk", "ro": %t}]}`, !reloaded), nil
+			case "multipath":
+				reloaded = true
+				return "", nil
+			case "mount":
+				mounted = true
+				return "", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		}
+		_, err := AttachAndMount(fcConnectionProperties(), filepath.Join(tempDir(t), "mnt"), MountOptions{WaitForRW: wait})
+		if wait {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reloaded || !mounted {
+				t.Errorf("expected the device to be waited for and mounted, reloaded %t, mounted %t", reloaded, mounted)
+			}
+		} else {
+			if !errors.Is(err, initiator.ErrDeviceReadOnly) {
+				t.Fatalf("expected ErrDeviceReadOnly, got %v", err)
+			}
+			if mounted {
+				t.Error("a read-only device was mounted rw")
+			}
+		}
+	}
+}
+
+func TestExtendVolumeAndFS(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		//the device grows once rescanned, or grew on an earlier extend
+		grow, grown bool
+		size        int64
+	}{
+		{"grow", true, false, 2105540608},
+		{"no growth", false, false, 1052770304},
+		{"resize left behind", false, true, 2105540608},
+	} {
+		h := newFakeFCHost(t)
+		mountPoint := filepath.Join(tempDir(t), "mnt")
+		writeFakeFile(t, h.dev, "mountinfo", "98 22 8:16 / "+mountPoint+" rw,relatime shared:50 - ext4 "+filepath.Join(h.dev, "sdb")+" rw\n")
+		defer func(orig string) { osBrick.MountInfoPath = orig }(osBrick.MountInfoPath)
+		osBrick.MountInfoPath = filepath.Join(h.dev, "mountinfo")
+		writeFakeFile(t, h.sysfs, "bus/scsi/devices/2:0:0:1/rescan", "")
+		big := func() bool {
+			rescan, _ := ioutil.ReadFile(filepath.Join(h.sysfs, "bus/scsi/devices/2:0:0:1/rescan"))
+			return c.grown || c.grow && string(rescan) == "1\n"
+		}
+		resized := make([]string, 0)
+		fsSize := "1052770304"
+		h.handler = func(name string, arg ...string) (string, error) {
+			switch name {
+			case "/lib/udev/scsi_id":
+				return "3600a0980383036347224000000000001\n", nil
+			case "sg_scan":
+				return arg[0] + ": scsi2 channel=0 id=0 lun=1 [em]\n", nil
+			case "blockdev":
+				if big() {
+					return "2147483648\n", nil
+				}
+				return "1073741824\n", nil
+			case "blkid":
+				return "ext4\n", nil
+			case "resize2fs":
+				resized = append(resized, arg[0])
+				if big() {
+					fsSize = "2105540608"
+				}
+				return "", nil
+			case "df":
+				return "   1B-blocks\n" + fsSize + "\n", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		}
+
+		size, err := ExtendVolumeAndFS(fcConnectionProperties(), mountPoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != c.size {
+			t.Errorf("%s: expected filesystem size %d, got %d", c.name, c.size, size)
+		}
+		//resizing an already fitting filesystem is a no-op
+		if !reflect.DeepEqual(resized, []string{filepath.Join(h.dev, "sdb")}) {
+			t.Errorf("%s: expected resize2fs of sdb, got %v", c.name, resized)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package connectors
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	osBrick "github.com/ydcool/os-brick-go"
+	"github.com/ydcool/os-brick-go/initiator"
+	"strconv"
+	"strings"
+)
+
+//FCProperties Builds the connection properties of a fibre channel volume,
+//with the key names and value types ConnectVolume expects.
+//
+//	props, err := NewFCProperties().
+//		WithTargetWWNs([]string{"20210002AC00383D", "20220002AC00383D"}).
+//		WithTargetLuns([]int{1}).
+//		WithMultipath(true).
+//		Build()
+type FCProperties struct {
+	props map[string]interface{}
+	wwns  []string
+	luns  []string
+	err   error
+}
+
+//NewFCProperties Start the connection properties of a read-write,
+//unencrypted fibre channel volume without qos specs.
+func NewFCProperties() *FCProperties {
+	return &FCProperties{props: map[string]interface{}{
+		"encrypted":   false,
+		"qos_specs":   nil,
+		"access_mode": "rw",
+	}}
+}
+
+//WithTargetWWNs Set the WWPNs of the target ports, target_wwns.
+func (p *FCProperties) WithTargetWWNs(wwns []string) *FCProperties {
+	for _, wwn := range wwns {
+		if n := initiator.NormalizeWWN(wwn); len(n) != 16 {
+			p.fail(fmt.Errorf("invalid target wwn %q", wwn))
+		} else if _, err := strconv.ParseUint(n, 16, 64); err != nil {
+			p.fail(fmt.Errorf("invalid target wwn %q", wwn))
+		}
+	}
+	p.wwns = append([]string{}, wwns...)
+	return p
+}
+
+//WithTargetLun Set a single LUN shared by all the target ports, target_lun.
+func (p *FCProperties) WithTargetLun(lun int) *FCProperties {
+	return p.WithTargetLuns([]int{lun})
+}
+
+//WithTargetLuns Set the LUN of each target port, or a single one shared by
+//all of them, target_luns.
+func (p *FCProperties) WithTargetLuns(luns []int) *FCProperties {
+	p.luns = make([]string, 0, len(luns))
+	for _, lun := range luns {
+		if lun < 0 {
+			p.fail(fmt.Errorf("invalid target lun %d", lun))
+		}
+		p.luns = append(p.luns, strconv.Itoa(lun))
+	}
+	return p
+}
+
+//WithInitiatorTargetMap Set the target ports each initiator port is zoned with, initiator_target_map.
+func (p *FCProperties) WithInitiatorTargetMap(itMap map[string][]string) *FCProperties {
+	m := make(map[string][]string, len(itMap))
+	for initiatorWWN, targets := range itMap {
+		m[initiatorWWN] = append([]string{}, targets...)
+	}
+	p.props["initiator_target_map"] = m
+	return p
+}
+
+//WithMultipath Set whether the volume is attached through multipath, use_multipath.
+func (p *FCProperties) WithMultipath(useMultipath bool) *FCProperties {
+	p.props["use_multipath"] = useMultipath
+	return p
+}
+
+//WithTargetDiscovered Set whether the array has already registered the target
+//with the host, target_discovered.
+func (p *FCProperties) WithTargetDiscovered(discovered bool) *FCProperties {
+	p.props["target_discovered"] = discovered
+	return p
+}
+
+//WithAccessMode Set the access mode, rw or ro, access_mode.
+func (p *FCProperties) WithAccessMode(mode string) *FCProperties {
+	if mode != "rw" && mode != "ro" {
+		p.fail(fmt.Errorf("invalid access mode %q, expected rw or ro", mode))
+	}
+	p.props["access_mode"] = mode
+	return p
+}
+
+//WithEncrypted Set whether the volume is encrypted, encrypted.
+func (p *FCProperties) WithEncrypted(encrypted bool) *FCProperties {
+	p.props["encrypted"] = encrypted
+	return p
+}
+
+//WithWildcardScan Set whether a wildcard scan is allowed when the host finds
+//no target port, enable_wildcard_scan.
+func (p *FCProperties) WithWildcardScan(enable bool) *FCProperties {
+	p.props["enable_wildcard_scan"] = enable
+	return p
+}
+
+func (p *FCProperties) fail(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+//Build Get the connection properties, or the first invalid value set.
+//
+//	There should be either as many luns as wwns or a single lun.
+func (p *FCProperties) Build() (map[string]interface{}, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if len(p.wwns) == 0 {
+		return nil, fmt.Errorf("no target wwns set")
+	}
+	if len(p.luns) == 0 {
+		return nil, fmt.Errorf("no target luns set")
+	}
+	if len(p.luns) != 1 && len(p.luns) != len(p.wwns) {
+		return nil, fmt.Errorf("got %d wwns and %d luns, expected as many luns as wwns or a single lun", len(p.wwns), len(p.luns))
+	}
+	props := make(map[string]interface{}, len(p.props)+2)
+	for k, v := range p.props {
+		props[k] = v
+	}
+	props["target_wwns"] = append([]string{}, p.wwns...)
+	if len(p.luns) == 1 {
+		props["target_lun"] = p.luns[0]
+	} else {
+		props["target_luns"] = append([]string{}, p.luns...)
+	}
+	return props, nil
+}
+
+//ParseConnectionProperties Decode the connection properties of a volume from
+//JSON, e.g. the Cinder connection_info, into the shapes the connectors expect.
+//
+//	The data of a connection_info envelope is lifted to the top level. The
+//	LUNs, JSON numbers or strings, become decimal strings, target_wwn(s)
+//	become []string and initiator_target_map a map[string][]string. The
+//	other properties are left as decoded by encoding/json.
+func ParseConnectionProperties(jsonData []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	//keep the LUNs exact, float64 can't hold every 64 bit LUN
+	decoder.UseNumber()
+	var props map[string]interface{}
+	if err := decoder.Decode(&props); err != nil {
+		return nil, fmt.Errorf("failed decode connection properties: %v", err)
+	}
+	if props == nil {
+		return nil, fmt.Errorf("connection properties should be a JSON object")
+	}
+	props = flattenConnectionProperties(props)
+	if lun, ok := props["target_lun"]; ok && lun != nil {
+		l, err := parseLun(lun)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target_lun: %v", err)
+		}
+		props["target_lun"] = l
+	}
+	if luns, ok := props["target_luns"]; ok && luns != nil {
+		list, ok := luns.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid target_luns %v, expected a list", luns)
+		}
+		parsed := make([]string, 0, len(list))
+		for _, lun := range list {
+			l, err := parseLun(lun)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target_luns: %v", err)
+			}
+			parsed = append(parsed, l)
+		}
+		props["target_luns"] = parsed
+	}
+	for _, key := range []string{"target_wwn", "target_wwns"} {
+		if wwns, ok := props[key]; ok && wwns != nil {
+			parsed, err := parseStrings(wwns)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", key, err)
+			}
+			props[key] = parsed
+		}
+	}
+	if itMap, ok := props["initiator_target_map"]; ok && itMap != nil {
+		m, ok := itMap.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid initiator_target_map %v, expected an object", itMap)
+		}
+		parsed := make(map[string][]string, len(m))
+		for initiatorWWN, targets := range m {
+			wwns, err := parseStrings(targets)
+			if err != nil {
+				return nil, fmt.Errorf("invalid initiator_target_map of %s: %v", initiatorWWN, err)
+			}
+			parsed[initiatorWWN] = wwns
+		}
+		props["initiator_target_map"] = parsed
+	}
+	return props, nil
+}
+
+//parseLun Get a LUN as a decimal string.
+//
+//	Strings are decimal, or hex with the 0x prefix, the other LUNs ints,
+//	float64 or json.Number as decoded from JSON. Anything but a
+//	non-negative integer is an error.
+func parseLun(lun interface{}) (string, error) {
+	n, err := osBrick.ToInt64(lun)
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("lun %#v is not a non-negative integer", lun)
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+//parseStrings Get a list of strings decoded from JSON, a single string is
+//split on commas and spaces like the WWNs of target_wwn.
+func parseStrings(v interface{}) ([]string, error) {
+	switch list := v.(type) {
+	case string:
+		return splitWWNs(list), nil
+	case []interface{}:
+		parsed := make([]string, 0, len(list))
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v is not a string", item)
+			}
+			parsed = append(parsed, s)
+		}
+		return parsed, nil
+	}
+	return nil, fmt.Errorf("%v is neither a list nor a string", v)
+}
+
+//NormalizedProps The targets of the connection properties of a fibre channel
+//volume, typed, see normalizeConnectionProperties.
+type NormalizedProps struct {
+	//lower case WWPNs of target_wwns, or target_wwn
+	TargetWWNs []string
+	//decimal LUNs of target_luns, or target_lun
+	TargetLuns []string
+	//(wwn, lun) of each target port
+	Targets []initiator.Target
+	//lower case initiator_target_map, nil when there is none
+	InitiatorTargetMap map[string][]string
+	//the targets of each initiator port of InitiatorTargetMap
+	InitiatorTargetLunMap map[string][]initiator.Target
+}
+
+//normalizeConnectionProperties Get the targets of the connection properties,
+//whatever the types of their values.
+//
+//	WWNs are taken from []string, []interface{} or a comma separated string,
+//	LUNs from strings, ints, float64 or json.Number and their lists, see
+//	parseLun. Values of any other type are an error, the properties are
+//	never panicked on.
+func normalizeConnectionProperties(connectionProperties map[string]interface{}) (NormalizedProps, error) {
+	var props NormalizedProps
+	key := "target_wwn"
+	if connectionProperties["target_wwns"] != nil {
+		key = "target_wwns"
+	}
+	for _, wwn := range splitWWNs(connectionProperties[key]) {
+		props.TargetWWNs = append(props.TargetWWNs, strings.ToLower(wwn))
+	}
+
+	var err error
+	if luns := connectionProperties["target_luns"]; luns != nil {
+		if props.TargetLuns, err = normalizeLuns(luns); err != nil {
+			return NormalizedProps{}, fmt.Errorf("invalid target_luns: %v", err)
+		}
+	} else if lun := connectionProperties["target_lun"]; lun != nil {
+		l, err := parseLun(lun)
+		if err != nil {
+			return NormalizedProps{}, fmt.Errorf("invalid target_lun: %v", err)
+		}
+		props.TargetLuns = []string{l}
+	}
+
+	wwns, luns := props.TargetWWNs, props.TargetLuns
+	if len(luns) == len(wwns) && len(luns) > 0 {
+		//Handles single wwwn + lun or multiple, potentially
+		//different wwns or luns
+		for i, w := range wwns {
+			props.Targets = append(props.Targets, initiator.Target{w, luns[i]})
+		}
+	} else if len(luns) == 1 && len(wwns) > 1 {
+		//For the case of multiple wwns, but a single lun (old path)
+		for _, w := range wwns {
+			props.Targets = append(props.Targets, initiator.Target{w, luns[0]})
+		}
+	} else {
+		return NormalizedProps{}, fmt.Errorf("unable to find potential volume paths for FC device: got %d wwns and %d luns, "+
+			"expected equal non-zero counts or a single lun with multiple wwns", len(wwns), len(luns))
+	}
+
+	itMap, ok := connectionProperties["initiator_target_map"]
+	if !ok || itMap == nil {
+		return props, nil
+	}
+	props.InitiatorTargetMap = make(map[string][]string)
+	switch m := itMap.(type) {
+	case map[string][]string:
+		for initiatorWWN, targetWWNs := range m {
+			props.addInitiatorTargets(initiatorWWN, targetWWNs)
+		}
+	case map[string]interface{}:
+		for initiatorWWN, targetWWNs := range m {
+			props.addInitiatorTargets(initiatorWWN, splitWWNs(targetWWNs))
+		}
+	default:
+		return NormalizedProps{}, fmt.Errorf("invalid initiator_target_map %#v, expected a map of initiator to target wwns", itMap)
+	}
+	wwpnLunMap := make(map[string]string)
+	for _, t := range props.Targets {
+		wwpnLunMap[t[0]] = t[1]
+	}
+	props.InitiatorTargetLunMap = make(map[string][]initiator.Target)
+	for initWwpn, targetWwpns := range props.InitiatorTargetMap {
+		initTargets := make([]initiator.Target, 0)
+		for _, targetWwpn := range targetWwpns {
+			if lun, ok := wwpnLunMap[targetWwpn]; ok {
+				initTargets = append(initTargets, initiator.Target{targetWwpn, lun})
+			}
+		}
+		props.InitiatorTargetLunMap[initWwpn] = initTargets
+	}
+	return props, nil
+}
+
+//addInitiatorTargets Add the target ports of an initiator port to the
+//initiator target map, lower cased.
+func (p *NormalizedProps) addInitiatorTargets(initiatorWWN string, targetWWNs []string) {
+	initiatorWWN = strings.ToLower(initiatorWWN)
+	for _, port := range targetWWNs {
+		p.InitiatorTargetMap[initiatorWWN] = append(p.InitiatorTargetMap[initiatorWWN], strings.ToLower(port))
+	}
+}
+
+//normalizeLuns Get a list of LUNs as decimal strings, see parseLun.
+func normalizeLuns(luns interface{}) ([]string, error) {
+	var list []interface{}
+	switch l := luns.(type) {
+	case []string:
+		for _, lun := range l {
+			list = append(list, lun)
+		}
+	case []int:
+		for _, lun := range l {
+			list = append(list, lun)
+		}
+	case []interface{}:
+		list = l
+	default:
+		return nil, fmt.Errorf("%#v is not a list of luns", luns)
+	}
+	normalized := make([]string, 0, len(list))
+	for _, lun := range list {
+		l, err := parseLun(lun)
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, l)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,250 @@
+package connectors
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ydcool/os-brick-go/initiator"
+	"reflect"
+	"testing"
+)
+
+func TestFCPropertiesDocExamples(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		builder  *FCProperties
+		expected map[string]interface{}
+		targets  []initiator.Target
+	}{
+		{
+			name: "single lun",
+			builder: NewFCProperties().
+				WithInitiatorTargetMap(map[string][]string{
+					"100010604b010459": {"20210002AC00383D"},
+					"100010604b01045d": {"20220002AC00383D"},
+				}).
+				WithTargetDiscovered(true).
+				WithTargetLun(1).
+				WithTargetWWNs([]string{"20210002AC00383D", "20220002AC00383D"}),
+			expected: map[string]interface{}{
+				"initiator_target_map": map[string][]string{
+					"100010604b010459": {"20210002AC00383D"},
+					"100010604b01045d": {"20220002AC00383D"},
+				},
+				"target_discovered": true,
+				"encrypted":         false,
+				"qos_specs":         nil,
+				"target_lun":        "1",
+				"access_mode":       "rw",
+				"target_wwns":       []string{"20210002AC00383D", "20220002AC00383D"},
+			},
+			targets: []initiator.Target{{"20210002ac00383d", "1"}, {"20220002ac00383d", "1"}},
+		},
+		{
+			name: "different luns",
+			builder: NewFCProperties().
+				WithInitiatorTargetMap(map[string][]string{
+					"100010604b010459": {"20210002AC00383D", "20220002AC00383D"},
+					"100010604b01045d": {"20210002AC00383D", "20220002AC00383D"},
+				}).
+				WithTargetDiscovered(true).
+				WithTargetLuns([]int{1, 2}).
+				WithAccessMode("rw").
+				WithTargetWWNs([]string{"20210002AC00383D", "20220002AC00383D"}),
+			expected: map[string]interface{}{
+				"initiator_target_map": map[string][]string{
+					"100010604b010459": {"20210002AC00383D", "20220002AC00383D"},
+					"100010604b01045d": {"20210002AC00383D", "20220002AC00383D"},
+				},
+				"target_discovered": true,
+				"encrypted":         false,
+				"qos_specs":         nil,
+				"target_luns":       []string{"1", "2"},
+				"access_mode":       "rw",
+				"target_wwns":       []string{"20210002AC00383D", "20220002AC00383D"},
+			},
+			targets: []initiator.Target{{"20210002ac00383d", "1"}, {"20220002ac00383d", "2"}},
+		},
+	} {
+		props, err := c.builder.Build()
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(props, c.expected) {
+			t.Errorf("%s: expected %#v, got %#v", c.name, c.expected, props)
+		}
+		props, err = addTargetsToConnectionProperties(props)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if targets := props["targets"].([]initiator.Target); !reflect.DeepEqual(targets, c.targets) {
+			t.Errorf("%s: expected targets %v, got %v", c.name, c.targets, targets)
+		}
+	}
+}
+
+func TestFCPropertiesValidation(t *testing.T) {
+	wwns := []string{"20210002AC00383D", "20220002AC00383D"}
+	for name, builder := range map[string]*FCProperties{
+		"no wwns":        NewFCProperties().WithTargetLun(1),
+		"no luns":        NewFCProperties().WithTargetWWNs(wwns),
+		"bad wwn":        NewFCProperties().WithTargetWWNs([]string{"2021"}).WithTargetLun(1),
+		"negative lun":   NewFCProperties().WithTargetWWNs(wwns).WithTargetLun(-1),
+		"lun mismatch":   NewFCProperties().WithTargetWWNs(wwns).WithTargetLuns([]int{1, 2, 3}),
+		"bad accessmode": NewFCProperties().WithTargetWWNs(wwns).WithTargetLun(1).WithAccessMode("wr"),
+	} {
+		if _, err := builder.Build(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseConnectionPropertiesDocExamples(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		json    string
+		targets []initiator.Target
+	}{
+		{
+			name: "single lun",
+			json: `{"driver_volume_type": "fibre_channel",
+				"data": {
+					"initiator_target_map": {"100010604b010459": ["20210002AC00383D"],
+						"100010604b01045d": ["20220002AC00383D"]},
+					"target_discovered": true,
+					"encrypted": false,
+					"qos_specs": null,
+					"target_lun": 1,
+					"access_mode": "rw",
+					"target_wwn": ["20210002AC00383D", "20220002AC00383D"]
+				}}`,
+			targets: []initiator.Target{{"20210002ac00383d", "1"}, {"20220002ac00383d", "1"}},
+		},
+		{
+			name: "different luns",
+			json: `{"driver_volume_type": "fibre_channel",
+				"data": {
+					"initiator_target_map": {
+						"100010604b010459": ["20210002AC00383D", "20220002AC00383D"],
+						"100010604b01045d": ["20210002AC00383D", "20220002AC00383D"]},
+					"target_discovered": true,
+					"encrypted": false,
+					"qos_specs": null,
+					"target_luns": [1, 2],
+					"access_mode": "rw",
+					"target_wwns": ["20210002AC00383D", "20220002AC00383D"]
+				}}`,
+			targets: []initiator.Target{{"20210002ac00383d", "1"}, {"20220002ac00383d", "2"}},
+		},
+	} {
+		props, err := ParseConnectionProperties([]byte(c.json))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if _, ok := props["initiator_target_map"].(map[string][]string); !ok {
+			t.Errorf("%s: unexpected initiator_target_map %#v", c.name, props["initiator_target_map"])
+		}
+		if props["driver_volume_type"] != "fibre_channel" || props["target_discovered"] != true {
+			t.Errorf("%s: unexpected properties %#v", c.name, props)
+		}
+		connProps, err := addTargetsToConnectionProperties(props)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(connProps["targets"], c.targets) {
+			t.Errorf("%s: expected targets %v, got %v", c.name, c.targets, connProps["targets"])
+		}
+	}
+
+	for _, invalid := range []string{
+		`[1, 2]`,
+		`{"target_lun": 1.5, "target_wwn": "20210002AC00383D"}`,
+		`{"target_lun": -1, "target_wwn": "20210002AC00383D"}`,
+		`{"target_lun": "abc", "target_wwn": "20210002AC00383D"}`,
+		`{"target_lun": "-1", "target_wwn": "20210002AC00383D"}`,
+		`{"target_luns": 1, "target_wwns": ["20210002AC00383D"]}`,
+		`{"target_lun": 1, "target_wwn": [20210002]}`,
+		`{"target_lun": 1, "target_wwn": "20210002AC00383D", "initiator_target_map": ["100010604b010459"]}`,
+	} {
+		if _, err := ParseConnectionProperties([]byte(invalid)); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestNormalizeConnectionProperties(t *testing.T) {
+	props, err := normalizeConnectionProperties(map[string]interface{}{
+		"target_wwns":          []interface{}{"20210002AC00383D", "20220002AC00383D"},
+		"target_luns":          []int{1, 2},
+		"initiator_target_map": map[string]interface{}{"100010604B010459": []interface{}{"20210002AC00383D"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := NormalizedProps{
+		TargetWWNs:            []string{"20210002ac00383d", "20220002ac00383d"},
+		TargetLuns:            []string{"1", "2"},
+		Targets:               []initiator.Target{{"20210002ac00383d", "1"}, {"20220002ac00383d", "2"}},
+		InitiatorTargetMap:    map[string][]string{"100010604b010459": {"20210002ac00383d"}},
+		InitiatorTargetLunMap: map[string][]initiator.Target{"100010604b010459": {{"20210002ac00383d", "1"}}},
+	}
+	if !reflect.DeepEqual(props, expected) {
+		t.Errorf("expected %#v, got %#v", expected, props)
+	}
+	for lun, expected := range map[interface{}]string{"010": "10", "0x10": "16", 3: "3", json.Number("4"): "4"} {
+		props, err := normalizeConnectionProperties(map[string]interface{}{"target_wwn": "20210002AC00383D", "target_lun": lun})
+		if err != nil || !reflect.DeepEqual(props.TargetLuns, []string{expected}) {
+			t.Errorf("lun %#v: expected %s, got %v, %v", lun, expected, props.TargetLuns, err)
+		}
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		nil,
+		{"target_wwn": "20210002AC00383D", "target_lun": []string{"1"}},
+		{"target_wwn": "20210002AC00383D", "target_luns": "1"},
+		{"target_wwn": "20210002AC00383D", "target_luns": []interface{}{"1", nil}},
+		{"target_wwn": "20210002AC00383D", "target_lun": "abc"},
+		{"target_wwn": "20210002AC00383D", "target_lun": "-1"},
+		{"target_wwn": "20210002AC00383D", "target_luns": []string{"1", "-1"}},
+		{"target_wwn": "20210002AC00383D", "target_lun": "1", "initiator_target_map": []string{"100010604b010459"}},
+		{"target_wwn": 20210002, "target_lun": "1"},
+	} {
+		if _, err := normalizeConnectionProperties(invalid); err == nil {
+			t.Errorf("%#v: expected an error", invalid)
+		}
+	}
+}
+
+func FuzzNormalizeConnectionProperties(f *testing.F) {
+	for _, seed := range []string{
+		`{"target_discovered": true, "target_lun": 1, "target_wwn": "20210002AC00383D"}`,
+		`{"driver_volume_type": "fibre_channel", "data": {"initiator_target_map": {"100010604b010459": ["20210002AC00383D"]}, "target_luns": [1, 2], "target_wwns": ["20210002AC00383D", "20220002AC00383D"]}}`,
+		`{"target_wwn": ["20210002AC00383D", 1, null], "target_lun": 1.5}`,
+		`{"target_wwns": {"a": 1}, "target_luns": [[1]], "initiator_target_map": {"x": 1}}`,
+		`{"target_wwn": "20210002AC00383D", "target_lun": -1, "initiator_target_map": []}`,
+		`{"data": null, "target_lun": 18446744073709551616}`,
+		`{}`,
+		`null`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, useNumber := range []bool{false, true} {
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			if useNumber {
+				decoder.UseNumber()
+			}
+			var props map[string]interface{}
+			if err := decoder.Decode(&props); err != nil {
+				return
+			}
+			props = flattenConnectionProperties(props)
+			normalized, err := normalizeConnectionProperties(props)
+			if err == nil && len(normalized.Targets) == 0 {
+				t.Errorf("no targets and no error for %s", data)
+			}
+			//nor the paths built on it
+			VolumeKey(props)
+			addTargetsToConnectionProperties(props)
+		}
+	})
+}
@@ -0,0 +1,67 @@
+/**
+Storage stack health probes
+
+*/
+package initiator
+
+import (
+	"errors"
+	osBrick "github.com/ydcool/os-brick-go"
+	"strings"
+)
+
+//RequiredBinaries are the commands CheckHealth expects on the host, multipathd
+//is covered by the check of the daemon itself.
+var RequiredBinaries = []string{
+	"/lib/udev/scsi_id",
+	"multipath",
+	"blockdev",
+	"lsblk",
+	"sg_scan",
+}
+
+//HealthResult The status of one component of the storage stack.
+type HealthResult struct {
+	//Component is e.g. fc, iscsi, multipathd or the name of a binary
+	Component string
+	//Status is a short description like running, found or not configured
+	Status  string
+	Healthy bool
+}
+
+//CheckHealth Probe the storage stack of the host without attaching anything.
+//	Every component is reported, it is up to the caller to decide which of
+//	them it needs, e.g. an iSCSI only host has no FC support.
+func CheckHealth() []HealthResult {
+	results := make([]HealthResult, 0, len(RequiredBinaries)+3)
+
+	if HasFCSupport() {
+		results = append(results, HealthResult{"fc", "supported", true})
+	} else {
+		results = append(results, HealthResult{"fc", "not supported", false})
+	}
+
+	if _, err := GetInitiatorIQN(); err == nil {
+		results = append(results, HealthResult{"iscsi", "configured", true})
+	} else if errors.Is(err, ErrISCSINotConfigured) {
+		results = append(results, HealthResult{"iscsi", "not configured", false})
+	} else {
+		results = append(results, HealthResult{"iscsi", err.Error(), false})
+	}
+
+	if HasMultipath() {
+		results = append(results, HealthResult{"multipathd", "running", true})
+	} else {
+		results = append(results, HealthResult{"multipathd", "not running", false})
+	}
+
+	for _, bin := range RequiredBinaries {
+		name := bin[strings.LastIndex(bin, "/")+1:]
+		if _, err := osBrick.FindBinary(bin); err == nil {
+			results = append(results, HealthResult{name, "found", true})
+		} else {
+			results = append(results, HealthResult{name, "not found", false})
+		}
+	}
+	return results
+}
@@ -0,0 +1,49 @@
+package initiator
+
+import (
+	"fmt"
+	osBrick "github.com/ydcool/os-brick-go"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckHealthNoMultipathd(t *testing.T) {
+	fs := newMemFS(t)
+	fs.MkdirAll(FCHostSysFSPath + "/host2")
+	defer func(f string) { InitiatorNameFile = f }(InitiatorNameFile)
+	InitiatorNameFile = "/etc/iscsi/initiatorname.iscsi"
+	fs.WriteFile(InitiatorNameFile, []byte("InitiatorName=iqn.1994-05.com.redhat:node1\n"))
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		if name == "multipathd" {
+			return "", fmt.Errorf("exec: %q: %w", name, exec.ErrNotFound)
+		}
+		return "", nil
+	})
+	defer func(l osBrick.PathLookup) { osBrick.DefaultPathLookup = l }(osBrick.DefaultPathLookup)
+	osBrick.DefaultPathLookup = func(file string) (string, error) {
+		if filepath.Base(file) == "multipathd" {
+			return "", exec.ErrNotFound
+		}
+		return "/usr/sbin/" + filepath.Base(file), nil
+	}
+
+	results := make(map[string]HealthResult)
+	for _, r := range CheckHealth() {
+		results[r.Component] = r
+	}
+	for component, healthy := range map[string]bool{
+		"fc":         true,
+		"iscsi":      true,
+		"multipathd": false,
+		"scsi_id":    true,
+		"multipath":  true,
+	} {
+		if r, ok := results[component]; !ok || r.Healthy != healthy {
+			t.Errorf("%s: expected healthy %v, got %#v", component, healthy, r)
+		}
+	}
+	if results["multipathd"].Status != "not running" {
+		t.Errorf("unexpected multipathd status: %q", results["multipathd"].Status)
+	}
+}
@@ -9,14 +9,19 @@ Inspired by github.com/openstack/os-brick
 package initiator
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	osBrick "github.com/ydcool/os-brick-go"
 	"log"
+	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
 const (
 	FCHostSysFSPath           = "/sys/class/fc_host"
+	FCoEBusSysFSPath          = "/sys/bus/fcoe/devices"
 	DeviceScanAttemptsDefault = 3
 	MultipathErrorRegex       = `\w{3} \d+ \d\d:\d\d:\d\d \|.*$`
 	MultipathPathCheckRegex   = `\s+\d+:\d+:\d+:\d+\s+`
@@ -29,51 +34,292 @@ var (
 		"switchpg:": false, "rename:": false, "create:": false, "resize:": false}
 )
 
+//NormalizeWWN Normalize a WWN to lower case hex without 0x prefix or separators,
+//e.g. 0x20210002AC00383D and 20:21:00:02:ac:00:38:3d both become 20210002ac00383d.
+func NormalizeWWN(wwn string) string {
+	wwn = strings.ToLower(strings.TrimSpace(wwn))
+	wwn = strings.TrimPrefix(wwn, "0x")
+	return strings.NewReplacer(":", "", "-", "").Replace(wwn)
+}
+
 func HasFCSupport() bool {
-	return osBrick.IsFileExists(FCHostSysFSPath)
+	_, err := osBrick.DefaultFS.Stat(sysfsPath(FCHostSysFSPath))
+	return err == nil
 }
 
 //GetFCHBAsInfo Get Fibre Channel WWNs and device paths from the system, if any.
 //	Note(walter-boring) modern Linux kernels contain the FC HBA's in /sys
 //	and are obtainable via the systool app
 func GetFCHBAsInfo() ([]HBA, error) {
-	hbas, err := GetFCHBAs()
+	return GetFCHBAsInfoContext(context.Background())
+}
+
+//GetFCHBAsInfoContext Get the HBAs like GetFCHBAsInfo, running systool with
+//the executor of ctx, see osBrick.WithExecutor.
+func GetFCHBAsInfoContext(ctx context.Context) ([]HBA, error) {
+	hbas, err := GetFCHBAsContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 	hbasInfo := make([]HBA, 0)
+	seen := make(map[string]bool)
 	for _, hba := range hbas {
 		wwpn := strings.Replace(hba["port_name"], "0x", "", 1)
 		wwnn := strings.Replace(hba["node_name"], "0x", "", 1)
 		devicePath := hba["ClassDevicepath"]
 		device := hba["ClassDevice"]
-		hbasInfo = append(hbasInfo, HBA{
+		info := HBA{
 			"port_name":   wwpn,
 			"node_name":   wwnn,
 			"host_device": device,
 			"device_path": devicePath,
-		})
+		}
+		for _, attr := range FCHostLinkAttrs {
+			info[attr] = getFCHostAttr(hba, attr)
+		}
+		hbasInfo = append(hbasInfo, info)
+		seen[wwpn] = true
+	}
+	//NPIV virtual ports not reported by systool
+	vports, err := GetFCVPorts()
+	if err != nil {
+		//the FCoE hosts don't depend on the vports
+		log.Printf("failed get fc vports: %v", err)
+	}
+	for _, vport := range vports {
+		if !seen[vport["port_name"]] {
+			hbasInfo = append(hbasInfo, vport)
+			seen[vport["port_name"]] = true
+		}
+	}
+	fcoeHBAs, err := GetFCoEHBAs()
+	if err != nil {
+		log.Printf("failed get fcoe hbas: %v", err)
+		return hbasInfo, nil
+	}
+	for _, fcoe := range fcoeHBAs {
+		if !seen[fcoe["port_name"]] {
+			hbasInfo = append(hbasInfo, fcoe)
+			continue
+		}
+		//systool reports FCoE hosts too, without their interface
+		for _, hba := range hbasInfo {
+			if hba["port_name"] == fcoe["port_name"] {
+				hba["fcoe_interface"] = fcoe["fcoe_interface"]
+				if pci, ok := fcoe["pci_address"]; ok {
+					hba["pci_address"] = pci
+				}
+			}
+		}
 	}
 	return hbasInfo, nil
 }
 
+//FCHostLinkAttrs are the attributes of the link of an FC host reported by
+//GetFCHBAsInfo, e.g. speed 16 Gbit, port_type NPort (fabric via point-to-point)
+//and supported_classes Class 3.
+var FCHostLinkAttrs = []string{"speed", "port_type", "supported_classes"}
+
+//getFCHostAttr Get an attribute of an FC host from systool, or from sysfs
+//when systool didn't report it.
+func getFCHostAttr(hba HBA, attr string) string {
+	if value, ok := hba[attr]; ok {
+		return value
+	}
+	path := sysfsPath(filepath.Join(FCHostSysFSPath, hba["ClassDevice"], attr))
+	value, err := osBrick.DefaultFS.ReadFile(path)
+	if err != nil {
+		log.Printf("failed read %s: %v", path, err)
+		return ""
+	}
+	return strings.TrimSpace(string(value))
+}
+
+//GetFCoEHBAs Get the FC hosts of the FCoE controllers of the host.
+//
+//	Each host is reported like an HBA of GetFCHBAsInfo, along with the
+//	network interface of its controller as fcoe_interface. The
+//	controllers of VLAN interfaces live under /sys/devices/virtual, so
+//	the PCI address of the physical interface below the VLAN is reported
+//	as pci_address:
+//	/sys/devices/pci0000:20/0000:20:03.0/0000:21:00.2/net/ens2f2/ctlr_2/host3/fc_host/host3
+//	/sys/devices/virtual/net/ens2f2.100/ctlr_3/host4/fc_host/host4
+func GetFCoEHBAs() ([]HBA, error) {
+	ctlrs, err := osBrick.DefaultFS.Glob(sysfsPath(FCoEBusSysFSPath + "/ctlr_*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed list fcoe controllers: %v", err)
+	}
+	hbas := make([]HBA, 0)
+	for _, ctlr := range ctlrs {
+		ctlrPath, err := osBrick.DefaultFS.EvalSymlinks(ctlr)
+		if err != nil {
+			log.Printf("failed get realpath for path: %s, ERROR: %v", ctlr, err)
+			continue
+		}
+		iface := filepath.Base(filepath.Dir(ctlrPath))
+		pciAddress, err := getNetPCIAddress(iface)
+		if err != nil {
+			log.Printf("failed get pci address of fcoe interface %s: %v", iface, err)
+		}
+		hosts, err := osBrick.DefaultFS.Glob(filepath.Join(ctlrPath, "host*", "fc_host", "host*"))
+		if err != nil {
+			return nil, fmt.Errorf("failed list fc hosts of %s: %v", ctlr, err)
+		}
+		for _, host := range hosts {
+			hba := HBA{
+				"host_device":    filepath.Base(host),
+				"device_path":    filepath.Join("/sys", strings.TrimPrefix(host, sysfsPath("/sys"))),
+				"fcoe_interface": iface,
+			}
+			for _, attr := range []string{"port_name", "node_name"} {
+				value, err := osBrick.DefaultFS.ReadFile(filepath.Join(host, attr))
+				if err != nil {
+					log.Printf("failed read %s of %s: %v", attr, host, err)
+					continue
+				}
+				hba[attr] = strings.Replace(strings.TrimSpace(string(value)), "0x", "", 1)
+			}
+			if pciAddress != "" {
+				hba["pci_address"] = pciAddress
+			}
+			hbas = append(hbas, hba)
+		}
+	}
+	return hbas, nil
+}
+
+//DestroyFCoEInterface Tear down the FCoE instance of a network interface,
+//e.g. ens2f2 or its VLAN ens2f2.100, removing its FC host.
+func DestroyFCoEInterface(netdev string) error {
+	return DestroyFCoEInterfaceContext(context.Background(), netdev)
+}
+
+//DestroyFCoEInterfaceContext Tear down the FCoE instance like
+//DestroyFCoEInterface, running fcoeadm with the executor of ctx.
+func DestroyFCoEInterfaceContext(ctx context.Context, netdev string) error {
+	out, err := executeCContext(ctx, "fcoeadm", "-d", netdev)
+	if err != nil {
+		return fmt.Errorf("failed execute fcoeadm -d %s: %s, %v", netdev, out, err)
+	}
+	log.Printf("destroyed fcoe interface %s", netdev)
+	return nil
+}
+
+//HasSCSIDevices Whether a scsi host, e.g. host3, still has any scsi device.
+func HasSCSIDevices(hostDevice string) (bool, error) {
+	pattern := sysfsPath(fmt.Sprintf("/sys/bus/scsi/devices/%s:*", strings.TrimPrefix(hostDevice, "host")))
+	devices, err := osBrick.DefaultFS.Glob(pattern)
+	if err != nil {
+		return false, fmt.Errorf("failed list scsi devices of %s: %v", hostDevice, err)
+	}
+	return len(devices) > 0, nil
+}
+
+//getNetPCIAddress Get the PCI address of a network interface, going down to
+//the physical interface of VLAN interfaces.
+func getNetPCIAddress(iface string) (string, error) {
+	path := sysfsPath("/sys/class/net/" + iface)
+	if realPath, err := osBrick.DefaultFS.EvalSymlinks(path); err == nil {
+		path = realPath
+	}
+	//VLAN interfaces link their physical interface as lower_<name>
+	if lowers, _ := osBrick.DefaultFS.Glob(filepath.Join(path, "lower_*")); len(lowers) > 0 {
+		path = sysfsPath("/sys/class/net/" + strings.TrimPrefix(filepath.Base(lowers[0]), "lower_"))
+	}
+	device, err := osBrick.DefaultFS.EvalSymlinks(filepath.Join(path, "device"))
+	if err != nil {
+		return "", fmt.Errorf("failed get realpath for path: %s: %v", filepath.Join(path, "device"), err)
+	}
+	return filepath.Base(device), nil
+}
+
+//GetFCVPorts Get the NPIV virtual ports of the host.
+//
+//	Each vport is reported like an HBA of GetFCHBAsInfo, with the scsi host
+//	created for the vport as host_device and its physical host as
+//	parent_host.
+func GetFCVPorts() ([]HBA, error) {
+	paths, err := osBrick.DefaultFS.Glob(sysfsPath("/sys/class/fc_vports/vport-*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed list fc vports: %v", err)
+	}
+	vports := make([]HBA, 0)
+	for _, path := range paths {
+		vport := HBA{}
+		for _, attr := range []string{"port_name", "node_name", "vport_state"} {
+			value, err := osBrick.DefaultFS.ReadFile(filepath.Join(path, attr))
+			if err != nil {
+				log.Printf("failed read %s of %s: %v", attr, path, err)
+				continue
+			}
+			vport[attr] = strings.Replace(strings.TrimSpace(string(value)), "0x", "", 1)
+		}
+		//vports are named vport-<parent host>:<channel>-<number>
+		name := strings.TrimPrefix(filepath.Base(path), "vport-")
+		vport["parent_host"] = "host" + strings.Split(name, ":")[0]
+		//the vport gets a scsi host of its own under its device
+		devicePath, err := osBrick.DefaultFS.EvalSymlinks(filepath.Join(path, "device"))
+		if err == nil {
+			if hosts, _ := osBrick.DefaultFS.Glob(filepath.Join(devicePath, "host*")); len(hosts) > 0 {
+				host := filepath.Base(hosts[0])
+				vport["host_device"] = host
+				vport["device_path"] = filepath.Join(hosts[0], "fc_host", host)
+			}
+		}
+		vports = append(vports, vport)
+	}
+	return vports, nil
+}
+
+//CreateNPIVPort Create an NPIV virtual port on a physical FC host (e.g. host2).
+func CreateNPIVPort(hostDevice, wwpn, wwnn string) error {
+	path := sysfsPath(fmt.Sprintf("/sys/class/fc_host/%s/vport_create", hostDevice))
+	return EchoSCSICommand(path, fmt.Sprintf("%s:%s", NormalizeWWN(wwpn), NormalizeWWN(wwnn)))
+}
+
+//DeleteNPIVPort Delete an NPIV virtual port from a physical FC host (e.g. host2).
+func DeleteNPIVPort(hostDevice, wwpn, wwnn string) error {
+	path := sysfsPath(fmt.Sprintf("/sys/class/fc_host/%s/vport_delete", hostDevice))
+	return EchoSCSICommand(path, fmt.Sprintf("%s:%s", NormalizeWWN(wwpn), NormalizeWWN(wwnn)))
+}
+
+//ErrFCHostsUnreadable is returned by GetFCHBAs when the FC hosts exist but
+//couldn't be read, e.g. systool failed or lacks permissions.
+var ErrFCHostsUnreadable = errors.New("fc hosts can't be read")
+
 //GetFCHBAs Get the Fibre Channel HBA information.
 //
+//	No HBAs and no error are returned only when the host has no FC host.
 func GetFCHBAs() ([]HBA, error) {
+	return GetFCHBAsContext(context.Background())
+}
+
+//GetFCHBAsContext Get the HBAs like GetFCHBAs, with the executor of ctx.
+func GetFCHBAsContext(ctx context.Context) ([]HBA, error) {
 	if !HasFCSupport() {
 		//there is no FC support in the kernel loaded
 		//so there is no need to even try to run systool
 		return nil, fmt.Errorf("fc not supported")
 	}
-	out, err := osBrick.Execute("systool", "-c", "fc_host", "-v")
+	out, err := executeCContext(ctx, "systool", "-c", "fc_host", "-v")
+	if errors.Is(err, exec.ErrNotFound) {
+		log.Printf("systool not found, reading fc hosts from sysfs")
+		return getFCHBAsFromSysfs()
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: systool failed: %s, %v", ErrFCHostsUnreadable, strings.TrimSpace(out), err)
 	}
 	hbas := make([]HBA, 0)
-	if out == "" {
+	lines := strings.Split(out, "\n")
+	if len(lines) < 2 || strings.TrimSpace(out) == "" {
+		//systool prints nothing when it can't read the hosts too
+		hosts, err := osBrick.DefaultFS.Glob(sysfsPath(FCHostSysFSPath + "/host*"))
+		if err == nil && len(hosts) > 0 {
+			return nil, fmt.Errorf("%w: systool reported no fc hosts but sysfs has %d", ErrFCHostsUnreadable, len(hosts))
+		}
 		return hbas, nil
 	}
-	lines := strings.Split(out, "\n")[2:]
+	lines = lines[2:]
 	lastLine := ""
 	hba := HBA{}
 	for _, line := range lines {
@@ -97,22 +343,49 @@ func GetFCHBAs() ([]HBA, error) {
 	return hbas, nil
 }
 
+//getFCHBAsFromSysfs Read the FC HBAs straight from sysfs, reporting the
+//same keys as systool does.
+func getFCHBAsFromSysfs() ([]HBA, error) {
+	hosts, err := osBrick.DefaultFS.Glob(sysfsPath(FCHostSysFSPath + "/host*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed list fc hosts: %v", err)
+	}
+	hbas := make([]HBA, 0)
+	for _, host := range hosts {
+		hba := HBA{"ClassDevice": filepath.Base(host)}
+		realPath, err := osBrick.DefaultFS.EvalSymlinks(host)
+		if err != nil {
+			log.Printf("failed get realpath for path: %s, ERROR: %v", host, err)
+			continue
+		}
+		//report the path as /sys/... like systool, whatever SysFSRoot is
+		hba["ClassDevicepath"] = filepath.Join("/sys", strings.TrimPrefix(realPath, sysfsPath("/sys")))
+		for _, attr := range append([]string{"port_name", "node_name", "port_state"}, FCHostLinkAttrs...) {
+			value, err := osBrick.DefaultFS.ReadFile(filepath.Join(host, attr))
+			if err != nil {
+				log.Printf("failed read %s of %s: %v", attr, host, err)
+				continue
+			}
+			hba[attr] = strings.TrimSpace(string(value))
+		}
+		hbas = append(hbas, hba)
+	}
+	return hbas, nil
+}
+
 func RescanHosts(hbas []HBA, connProperties map[string]interface{}) {
 	log.Printf("rescaning HBAs %v with connection properties %#v", hbas, connProperties)
 	// Use initiator_target_lun_map (generated from initiator_target_map by
 	// the FC connector) as HBA exclusion map
-	var newHBAs = make([]HBA, 0)
-	if ports, ok := connProperties["initiator_target_lun_map"]; ok {
-		if portsMap, ok := ports.(map[string]interface{}); ok {
-			for _, hba := range hbas {
-				for k := range portsMap {
-					if k == hba["port_name"] {
-						newHBAs = append(newHBAs, hba)
-					}
-				}
+	if _, ok := connProperties["initiator_target_lun_map"].(map[string][]Target); ok {
+		newHBAs := make([]HBA, 0)
+		for _, hba := range hbas {
+			if _, ok := getLunMapTargets(hba, connProperties); ok {
+				newHBAs = append(newHBAs, hba)
 			}
 		}
 		log.Printf("using initiator target map to exclude HBAs: %v", newHBAs)
+		hbas = newHBAs
 	}
 
 	//Most storage arrays get their target ports automatically detected
@@ -126,65 +399,125 @@ func RescanHosts(hbas []HBA, connProperties map[string]interface{}) {
 	//the "enable_wildcard_scan" key in the connection_info to let us know
 	//they don't want us to do broad scans even in those cases.
 	broadScan := true
-	if ews, ok := connProperties["enable_wildcard_scan"]; ok {
-		broadScan = ews.(bool)
+	if ews, ok := connProperties["enable_wildcard_scan"].(bool); ok {
+		broadScan = ews
 	}
 
-	process := make([]interface{}, 0)
-	skipped := make([]interface{}, 0)
+	type hostScan struct {
+		hba  HBA
+		ctls [][]string
+	}
+	process := make([]hostScan, 0)
+	skipped := make([]hostScan, 0)
 
 	for _, hba := range hbas {
 		ctls, lunsWildcards := getHBAChannelSCSITargetLun(hba, connProperties)
 		//If we found the target ports, ignore HBAs that din't find them
 		if len(ctls) > 0 {
-			process = append(process, []interface{}{hba, ctls})
+			process = append(process, hostScan{hba, ctls})
 		} else if !broadScan {
 			//If target ports not found and should have, then the HBA is not
 			//connected to our storage
 			log.Printf("skipping HBA %s, nothing to scan, target port not connected to initiator", hba["node_name"])
 		} else if len(process) == 0 {
-			//skipped.append((hba,[('-', '-', lun) for lun in luns_wildcards]))
-			luns := make([]interface{}, 0)
-			for k := range lunsWildcards {
-				luns = append(luns, []string{"-", "-", k})
-			}
-			skipped = append(skipped, []interface{}{hba, luns})
-		}
-		//If we didn't find any target ports use wildcards if they are enabled
-		if len(process) == 0 {
-			process = skipped
-		}
-		for _, p := range process {
-			hba := p.([]interface{})[0].(HBA)
-			ctls := p.([]interface{})[1]
-			if ctlsStrs, ok := ctls.([][]string); ok {
-				for _, c := range ctlsStrs {
-					hbaChannel, targetId, targetLun := c[0], c[1], c[2]
-					log.Printf("scanning host:%v, wwnn:%s, c:%v, t:%v, l:%v", hba["host_device"], hba["node_name"], hbaChannel, targetId, targetLun)
-					err := EchoSCSICommand(fmt.Sprintf("/sys/class/scsi_host/%s/scan", hba["host_device"]),
-						fmt.Sprintf("%v %v %v", hbaChannel, targetId, targetLun))
-					if err != nil {
-						log.Printf("failed scan scsi device: %v", err)
-					}
-				}
-			} else if cltsIntfs, ok := ctls.([]interface{}); ok {
-				for _, c := range cltsIntfs {
-					cc, ok := c.([]string)
-					if !ok {
-						log.Printf("expect ctls is []string but not, %#v", c)
-						continue
-					}
-					hbaChannel, targetId, targetLun := cc[0], cc[1], cc[2]
-					log.Printf("scanning host:%v, wwnn:%s, c:%v, t:%v, l:%v", hba["host_device"], hba["node_name"], hbaChannel, targetId, targetLun)
-					err := EchoSCSICommand(fmt.Sprintf("/sys/class/scsi_host/%s/scan", hba["host_device"]),
-						fmt.Sprintf("%v %v %v", hbaChannel, targetId, targetLun))
-					if err != nil {
-						log.Printf("failed scan scsi device: %v", err)
-					}
-				}
-			} else {
-				log.Printf("expect ctls be [][]string or []interface{} but not: %#v", ctls)
+			skipped = append(skipped, hostScan{hba, wildcardCTLs(lunsWildcards)})
+		}
+	}
+	//If we didn't find any target ports use wildcards if they are enabled
+	if len(process) == 0 {
+		process = skipped
+	}
+	for _, p := range process {
+		log.Printf("scanning host:%v, wwnn:%s", p.hba["host_device"], p.hba["node_name"])
+		if err := scanSCSIHost(p.hba["host_device"], p.ctls); err != nil {
+			log.Printf("failed scan scsi device: %v", err)
+		}
+	}
+}
+
+//RescanHost Scan a single scsi host, e.g. host6, for the targets of the
+//connection properties, as completed by the FC connector.
+//
+//	Only the targets found behind the host are scanned, or every lun
+//	with wildcards when none is found and enable_wildcard_scan allows it.
+func RescanHost(hostDevice string, connProperties map[string]interface{}) error {
+	if _, ok := connProperties["targets"].([]Target); !ok {
+		return fmt.Errorf("no targets in connection properties")
+	}
+	portName, err := osBrick.DefaultFS.ReadFile(sysfsPath(fmt.Sprintf("%s/%s/port_name", FCHostSysFSPath, hostDevice)))
+	if err != nil {
+		return fmt.Errorf("failed read port name of %s: %v", hostDevice, err)
+	}
+	hba := HBA{"host_device": hostDevice, "port_name": NormalizeWWN(string(portName))}
+	ctls, lunsWildcards := getHBAChannelSCSITargetLun(hba, connProperties)
+	if len(ctls) == 0 {
+		if ews, ok := connProperties["enable_wildcard_scan"].(bool); ok && !ews {
+			return fmt.Errorf("no target port connected to %s and wildcard scan is disabled", hostDevice)
+		}
+		ctls = wildcardCTLs(lunsWildcards)
+	}
+	return scanSCSIHost(hostDevice, ctls)
+}
+
+//wildcardCTLs Get the channel, target, lun to scan every target for the luns.
+func wildcardCTLs(luns map[string]bool) [][]string {
+	ctls := make([][]string, 0, len(luns))
+	for lun := range luns {
+		ctls = append(ctls, []string{"-", "-", lun})
+	}
+	return ctls
+}
+
+//scanSCSIHost Scan each channel, target, lun of a scsi host.
+func scanSCSIHost(hostDevice string, ctls [][]string) error {
+	errs := make([]string, 0)
+	for _, c := range ctls {
+		hbaChannel, targetId, targetLun := c[0], c[1], c[2]
+		log.Printf("scanning host:%v, c:%v, t:%v, l:%v", hostDevice, hbaChannel, targetId, targetLun)
+		err := EchoSCSICommand(sysfsPath(fmt.Sprintf("/sys/class/scsi_host/%s/scan", hostDevice)),
+			fmt.Sprintf("%v %v %v", hbaChannel, targetId, targetLun))
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed scan %s: %s", hostDevice, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+//DiscoverFCTargets Do a wildcard scan of the HBAs for the luns of the volume
+//to discover target ports.
+//
+//	Used when the array doesn't register its target ports with the
+//	initiator by itself, so the narrow scans of RescanHosts can find them.
+//	Only the HBAs in initiator_target_lun_map are scanned when it's given,
+//	for their own luns. Skipped when the connection properties disable
+//	wildcard scans.
+func DiscoverFCTargets(hbas []HBA, connProperties map[string]interface{}) {
+	if ews, ok := connProperties["enable_wildcard_scan"].(bool); ok && !ews {
+		log.Printf("skipping fc target discovery, wildcard scan is disabled")
+		return
+	}
+	targets, _ := connProperties["targets"].([]Target)
+	_, useLunMap := connProperties["initiator_target_lun_map"].(map[string][]Target)
+	for _, hba := range hbas {
+		hbaTargets := targets
+		if useLunMap {
+			t, ok := getLunMapTargets(hba, connProperties)
+			if !ok {
+				log.Printf("skipping fc target discovery on host %v, not in the initiator target map", hba["host_device"])
+				continue
 			}
+			hbaTargets = t
+		}
+		luns := make(map[string]bool)
+		for _, t := range hbaTargets {
+			luns[t[1]] = true
+		}
+		log.Printf("discovering targets on host:%v, wwnn:%s", hba["host_device"], hba["node_name"])
+		if err := scanSCSIHost(hba["host_device"], wildcardCTLs(luns)); err != nil {
+			log.Printf("failed discover targets on host %v: %v", hba["host_device"], err)
 		}
 	}
 }
@@ -225,6 +558,108 @@ func GetFCWWNNS() ([]string, error) {
 	return wwpns, nil
 }
 
+//GetFCHBAHealth Get the speed and state of the link of every FC host, from sysfs.
+//
+//	The link attributes are read like the FCHostLinkAttrs of GetFCHBAsInfo.
+func GetFCHBAHealth() ([]HBAHealth, error) {
+	hosts, err := osBrick.DefaultFS.Glob(sysfsPath(FCHostSysFSPath + "/host*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed list fc hosts: %v", err)
+	}
+	health := make([]HBAHealth, 0, len(hosts))
+	for _, host := range hosts {
+		hba := HBA{"ClassDevice": filepath.Base(host)}
+		for _, attr := range append([]string{"port_name", "port_state", "supported_speeds"}, FCHostLinkAttrs...) {
+			hba[attr] = getFCHostAttr(hba, attr)
+		}
+		health = append(health, HBAHealth{
+			HostDevice:      hba["ClassDevice"],
+			PortName:        NormalizeWWN(hba["port_name"]),
+			Speed:           hba["speed"],
+			PortState:       hba["port_state"],
+			SupportedSpeeds: hba["supported_speeds"],
+		})
+	}
+	return health, nil
+}
+
+//GetFCRemotePortStates Get the port_state of the FC remote ports by normalized WWPN.
+//
+//	Remote ports which aren't logged in through any HBA are missing from
+//	the result, a remote port seen through several HBAs is reported Online
+//	if any of them is.
+func GetFCRemotePortStates() (map[string]string, error) {
+	rports, err := osBrick.DefaultFS.Glob(sysfsPath("/sys/class/fc_remote_ports/rport-*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed list fc remote ports: %v", err)
+	}
+	states := make(map[string]string)
+	for _, rport := range rports {
+		portName, err := osBrick.DefaultFS.ReadFile(filepath.Join(rport, "port_name"))
+		if err != nil {
+			log.Printf("failed read port_name of %s: %v", rport, err)
+			continue
+		}
+		portState, err := osBrick.DefaultFS.ReadFile(filepath.Join(rport, "port_state"))
+		if err != nil {
+			log.Printf("failed read port_state of %s: %v", rport, err)
+			continue
+		}
+		wwpn := NormalizeWWN(string(portName))
+		if states[wwpn] != "Online" {
+			states[wwpn] = strings.TrimSpace(string(portState))
+		}
+	}
+	return states, nil
+}
+
+//GetFCTargetAddresses Get the scsi addresses of a target port through every HBA,
+//from the fc_transport targets named target<host>:<channel>:<target>.
+//
+//	The Lun of the addresses is left empty, all the LUNs of the target
+//	are behind them.
+func GetFCTargetAddresses(targetWWN string) ([]HCTL, error) {
+	portNames, err := osBrick.DefaultFS.Glob(sysfsPath("/sys/class/fc_transport/target*/port_name"))
+	if err != nil {
+		return nil, fmt.Errorf("failed list fc transport targets: %v", err)
+	}
+	wwpn := NormalizeWWN(targetWWN)
+	addresses := make([]HCTL, 0)
+	for _, portName := range portNames {
+		content, err := osBrick.DefaultFS.ReadFile(portName)
+		if err != nil {
+			log.Printf("failed read %s: %v", portName, err)
+			continue
+		}
+		if NormalizeWWN(string(content)) != wwpn {
+			continue
+		}
+		address := strings.Split(strings.TrimPrefix(filepath.Base(filepath.Dir(portName)), "target"), ":")
+		if len(address) != 3 {
+			log.Printf("unexpected fc transport target %s", filepath.Dir(portName))
+			continue
+		}
+		addresses = append(addresses, HCTL{Host: address[0], Channel: address[1], Target: address[2]})
+	}
+	return addresses, nil
+}
+
+//getLunMapTargets Get the targets of an HBA in the initiator_target_lun_map
+//generated by the FC connector.
+func getLunMapTargets(hba HBA, connectionProperties map[string]interface{}) ([]Target, bool) {
+	lunMap, ok := connectionProperties["initiator_target_lun_map"].(map[string][]Target)
+	if !ok {
+		return nil, false
+	}
+	portName := NormalizeWWN(hba["port_name"])
+	for initiatorWWN, targets := range lunMap {
+		if NormalizeWWN(initiatorWWN) == portName {
+			return targets, true
+		}
+	}
+	return nil, false
+}
+
 //Get HBA channels, SCSI targets, LUNs to FC targets for given HBA.
 //
 //   Given an HBA and the connection properties we look for the HBA channels
@@ -251,12 +686,8 @@ func getHBAChannelSCSITargetLun(hba HBA, connectionProperties map[string]interfa
 
 	if _, ok := connectionProperties["initiator_target_map"]; ok {
 		//This map we try to use was generated by the FC connector
-		if lunMap, ok := connectionProperties["initiator_target_lun_map"]; ok {
-			if lm, ok := lunMap.(map[string]interface{}); ok {
-				if k, ok := lm[hba["port_name"]]; ok {
-					targets = k.([]Target)
-				}
-			}
+		if t, ok := getLunMapTargets(hba, connectionProperties); ok {
+			targets = t
 		}
 	}
 	//Leave only the number from the host_device field (ie: host6)
@@ -265,26 +696,35 @@ func getHBAChannelSCSITargetLun(hba HBA, connectionProperties map[string]interfa
 		hostDevice = hostDevice[4:]
 	}
 
-	path := fmt.Sprintf("/sys/class/fc_transport/target%s:", hostDevice)
+	path := sysfsPath(fmt.Sprintf("/sys/class/fc_transport/target%s:", hostDevice))
+	portNames, err := osBrick.DefaultFS.Glob(path + "*/port_name")
+	if err != nil {
+		log.Printf("failed list target port names under %s: %v", path, err)
+	}
 	ctls := make([][]string, 0)
 	lunNotFound := make(map[string]bool) //use map as set
 	for _, t := range targets {
-		wwpn, lun := t[0], t[1]
-		//cmd = 'grep -Gil "%(wwpns)s" %(path)s*/port_name' % {'wwpns': wwpn,'path': path}
-		cmd := fmt.Sprintf(`grep -Gil "%s" %s*/port_name`, wwpn, path)
-		out, err := osBrick.Execute("sh", "-c", cmd)
-		if err != nil {
-			log.Printf("could not get HBA channel and SCSI target ID, path: %s, resaon:%v", path, err)
+		wwpn, lun := NormalizeWWN(t[0]), t[1]
+		found := false
+		for _, portName := range portNames {
+			content, err := osBrick.DefaultFS.ReadFile(portName)
+			if err != nil {
+				log.Printf("failed read %s: %v", portName, err)
+				continue
+			}
+			if NormalizeWWN(string(content)) != wwpn {
+				continue
+			}
+			found = true
+			//the target directory is named target<host>:<channel>:<target>
+			address := strings.Split(filepath.Base(filepath.Dir(portName)), ":")
+			ctls = append(ctls, append(append([]string{}, address[1:]...), lun))
+		}
+		if !found {
+			log.Printf("could not get HBA channel and SCSI target ID for %s, path: %s", wwpn, path)
 			//If we didn't find any paths add it to the not found list
 			lunNotFound[fmt.Sprintf("%v", lun)] = true
 		}
-		//ctls += [  line.split('/')[4].split(':')[1:] + [lun] for line in out.split('\n') if line.startswith(path)]
-		for _, line := range strings.Split(out, "\n") {
-			if strings.HasPrefix(line, path) {
-				c := append(append([]string{}, strings.Split(strings.Split(line, "/")[4], ":")[1:]...), lun)
-				ctls = append(ctls, c)
-			}
-		}
 	}
 	return ctls, lunNotFound
 }
@@ -1,11 +1,380 @@
 package initiator
 
-import "testing"
+import (
+	"errors"
+	osBrick "github.com/ydcool/os-brick-go"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
 
 func TestGetFCHBAs(t *testing.T) {
+	const systoolOutput = `Class = "fc_host"
+
+  Class Device = "host2"
+  Class Device path = "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.2/host2/fc_host/host2"
+    node_name           = "0x200010604b010459"
+    port_name           = "0x100010604b010459"
+    port_state          = "Online"
+
+    Device = "host2"
+    Device path = "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.2/host2"
+
+
+`
+	for _, c := range []struct {
+		name       string
+		hosts      []string
+		out        string
+		err        error
+		unreadable bool
+		hbas       []HBA
+	}{
+		{name: "empty", out: "", hbas: []HBA{}},
+		{name: "empty class", out: "Class = \"fc_host\"\n\n", hbas: []HBA{}},
+		{name: "error exit", hosts: []string{"host2"}, out: "Error opening class fc_host: Permission denied\n",
+			err: errors.New("exit status 1"), unreadable: true},
+		{name: "no output with hosts", hosts: []string{"host2"}, out: "", unreadable: true},
+		{name: "populated", hosts: []string{"host2"}, out: systoolOutput, hbas: []HBA{{
+			"ClassDevice":     "host2",
+			"ClassDevicepath": "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.2/host2/fc_host/host2",
+			"node_name":       "0x200010604b010459",
+			"port_name":       "0x100010604b010459",
+			"port_state":      "Online",
+			"Device":          "host2",
+			"Devicepath":      "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.2/host2",
+		}}},
+	} {
+		fs := newMemFS(t)
+		fs.MkdirAll(FCHostSysFSPath)
+		for _, host := range c.hosts {
+			fs.MkdirAll(FCHostSysFSPath + "/" + host)
+		}
+		fakeExecutor(t, func(name string, arg ...string) (string, error) {
+			return c.out, c.err
+		})
+		hbas, err := GetFCHBAs()
+		if c.unreadable {
+			if !errors.Is(err, ErrFCHostsUnreadable) {
+				t.Errorf("%s: expected ErrFCHostsUnreadable, got %v", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !reflect.DeepEqual(hbas, c.hbas) {
+			t.Errorf("%s: expected %#v, got %#v", c.name, c.hbas, hbas)
+		}
+	}
+}
+
+func TestNormalizeWWN(t *testing.T) {
+	for _, wwn := range []string{"0x20210002ac00383d\n", "20:21:00:02:AC:00:38:3D", "20210002AC00383D"} {
+		if n := NormalizeWWN(wwn); n != "20210002ac00383d" {
+			t.Errorf("unexpected normalized wwn for %q: %q", wwn, n)
+		}
+	}
+}
+
+func TestGetHBAChannelSCSITargetLun(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "class/fc_transport/target6:0:1/port_name", "0x20210002ac00383d\n")
+	writeFakeFile(t, root, "class/fc_transport/target6:0:2/port_name", "0x20220002ac00383d\n")
+	writeFakeFile(t, root, "class/fc_transport/target7:0:1/port_name", "0x20210002ac00383d\n")
+
+	hba := HBA{"port_name": "100010604b010459", "host_device": "host6"}
+	ctls, notFound := getHBAChannelSCSITargetLun(hba, map[string]interface{}{
+		"targets": []Target{{"20:21:00:02:AC:00:38:3D", "1"}, {"20230002ac00383d", "2"}},
+	})
+	if !reflect.DeepEqual(ctls, [][]string{{"0", "1", "1"}}) {
+		t.Errorf("unexpected ctls: %#v", ctls)
+	}
+	if !reflect.DeepEqual(notFound, map[string]bool{"2": true}) {
+		t.Errorf("unexpected luns not found: %#v", notFound)
+	}
+}
+
+func TestGetFCRemotePortStates(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "class/fc_remote_ports/rport-6:0-1/port_name", "0x20210002ac00383d\n")
+	writeFakeFile(t, root, "class/fc_remote_ports/rport-6:0-1/port_state", "Blocked\n")
+	writeFakeFile(t, root, "class/fc_remote_ports/rport-7:0-1/port_name", "0x20210002ac00383d\n")
+	writeFakeFile(t, root, "class/fc_remote_ports/rport-7:0-1/port_state", "Online\n")
+	writeFakeFile(t, root, "class/fc_remote_ports/rport-7:0-2/port_name", "0x20220002ac00383d\n")
+	writeFakeFile(t, root, "class/fc_remote_ports/rport-7:0-2/port_state", "Blocked\n")
+	states, err := GetFCRemotePortStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"20210002ac00383d": "Online", "20220002ac00383d": "Blocked"}
+	if !reflect.DeepEqual(states, expected) {
+		t.Errorf("unexpected states: %#v", states)
+	}
+}
+
+func TestNPIVPort(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "class/fc_host/host2/vport_create", "")
+	writeFakeFile(t, root, "class/fc_host/host2/vport_delete", "")
+	if err := CreateNPIVPort("host2", "0x10000090FA000001", "20:00:00:90:fa:00:00:01"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteNPIVPort("host2", "10000090fa000001", "20000090fa000001"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"vport_create", "vport_delete"} {
+		out, _ := ioutil.ReadFile(filepath.Join(root, "class/fc_host/host2", f))
+		if string(out) != "10000090fa000001:20000090fa000001\n" {
+			t.Errorf("unexpected %s write: %q", f, out)
+		}
+	}
+}
+
+func TestGetFCVPorts(t *testing.T) {
+	root := newFakeSysFS(t)
+	device := filepath.Join(root, "devices/pci0000:00/0000:00:03.0/0000:05:00.2/host2/vport-2:0-0")
+	if err := os.MkdirAll(filepath.Join(device, "host5"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFakeFile(t, root, "class/fc_vports/vport-2:0-0/port_name", "0x10000090fa000001\n")
+	writeFakeFile(t, root, "class/fc_vports/vport-2:0-0/node_name", "0x20000090fa000001\n")
+	writeFakeFile(t, root, "class/fc_vports/vport-2:0-0/vport_state", "Active\n")
+	if err := os.Symlink(device, filepath.Join(root, "class/fc_vports/vport-2:0-0/device")); err != nil {
+		t.Fatal(err)
+	}
+	vports, err := GetFCVPorts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []HBA{{
+		"port_name":   "10000090fa000001",
+		"node_name":   "20000090fa000001",
+		"vport_state": "Active",
+		"parent_host": "host2",
+		"host_device": "host5",
+		"device_path": filepath.Join(device, "host5/fc_host/host5"),
+	}}
+	if !reflect.DeepEqual(vports, expected) {
+		t.Errorf("unexpected vports: %#v", vports)
+	}
+}
+
+//newMemFS points osBrick.DefaultFS at an in memory FS for the test.
+func newMemFS(t *testing.T) *osBrick.MemFS {
+	fs := osBrick.NewMemFS()
+	orig := osBrick.DefaultFS
+	osBrick.DefaultFS = fs
+	t.Cleanup(func() { osBrick.DefaultFS = orig })
+	return fs
+}
+
+func TestGetFCHBAsFromSysfs(t *testing.T) {
+	fs := newMemFS(t)
+	host := "/sys/devices/pci0000:00/0000:00:03.0/0000:05:00.2/host2/fc_host/host2"
+	fs.WriteFile(host+"/port_name", []byte("0x100010604b010459\n"))
+	fs.WriteFile(host+"/node_name", []byte("0x200010604b010459\n"))
+	fs.WriteFile(host+"/port_state", []byte("Online\n"))
+	fs.Symlink("../../devices/pci0000:00/0000:00:03.0/0000:05:00.2/host2/fc_host/host2", "/sys/class/fc_host/host2")
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+	})
+
 	hbas, err := GetFCHBAs()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	expected := []HBA{{
+		"ClassDevice":     "host2",
+		"ClassDevicepath": host,
+		"port_name":       "0x100010604b010459",
+		"node_name":       "0x200010604b010459",
+		"port_state":      "Online",
+	}}
+	if !reflect.DeepEqual(hbas, expected) {
+		t.Errorf("unexpected hbas: %v", hbas)
+	}
+}
+
+func TestGetFCoEHBAs(t *testing.T) {
+	fs := newMemFS(t)
+	nic := "/sys/devices/pci0000:20/0000:20:03.0/0000:21:00.2"
+	//ctlr_2 on the physical interface, ctlr_3 on a VLAN on top of it
+	fs.WriteFile(nic+"/net/ens2f2/ctlr_2/host3/fc_host/host3/port_name", []byte("0x2000000e1e1a2b3c\n"))
+	fs.WriteFile(nic+"/net/ens2f2/ctlr_2/host3/fc_host/host3/node_name", []byte("0x1000000e1e1a2b3c\n"))
+	fs.Symlink("../../../0000:21:00.2", nic+"/net/ens2f2/device")
+	fs.Symlink("../../devices/pci0000:20/0000:20:03.0/0000:21:00.2/net/ens2f2", "/sys/class/net/ens2f2")
+	vlan := "/sys/devices/virtual/net/ens2f2.100"
+	fs.WriteFile(vlan+"/ctlr_3/host4/fc_host/host4/port_name", []byte("0x2000000e1e1a2b3d\n"))
+	fs.WriteFile(vlan+"/ctlr_3/host4/fc_host/host4/node_name", []byte("0x1000000e1e1a2b3d\n"))
+	fs.Symlink("../../../pci0000:20/0000:20:03.0/0000:21:00.2/net/ens2f2", vlan+"/lower_ens2f2")
+	fs.Symlink("../../devices/virtual/net/ens2f2.100", "/sys/class/net/ens2f2.100")
+	fs.Symlink("../../../devices/pci0000:20/0000:20:03.0/0000:21:00.2/net/ens2f2/ctlr_2", "/sys/bus/fcoe/devices/ctlr_2")
+	fs.Symlink("../../../devices/virtual/net/ens2f2.100/ctlr_3", "/sys/bus/fcoe/devices/ctlr_3")
+
+	hbas, err := GetFCoEHBAs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []HBA{{
+		"port_name":      "2000000e1e1a2b3c",
+		"node_name":      "1000000e1e1a2b3c",
+		"host_device":    "host3",
+		"device_path":    nic + "/net/ens2f2/ctlr_2/host3/fc_host/host3",
+		"fcoe_interface": "ens2f2",
+		"pci_address":    "0000:21:00.2",
+	}, {
+		"port_name":      "2000000e1e1a2b3d",
+		"node_name":      "1000000e1e1a2b3d",
+		"host_device":    "host4",
+		"device_path":    vlan + "/ctlr_3/host4/fc_host/host4",
+		"fcoe_interface": "ens2f2.100",
+		"pci_address":    "0000:21:00.2",
+	}}
+	if !reflect.DeepEqual(hbas, expected) {
+		t.Errorf("unexpected hbas: %v", hbas)
+	}
+}
+
+//globFailFS A MemFS failing to list the paths matching pattern.
+type globFailFS struct {
+	*osBrick.MemFS
+	pattern string
+}
+
+func (fs globFailFS) Glob(pattern string) ([]string, error) {
+	if pattern == fs.pattern {
+		return nil, errors.New("permission denied")
+	}
+	return fs.MemFS.Glob(pattern)
+}
+
+func TestGetFCHBAsInfoVPortsUnreadable(t *testing.T) {
+	fs := newMemFS(t)
+	osBrick.DefaultFS = globFailFS{fs, "/sys/class/fc_vports/vport-*"}
+	fs.MkdirAll("/sys/class/fc_host")
+	nic := "/sys/devices/pci0000:20/0000:20:03.0/0000:21:00.2"
+	fs.WriteFile(nic+"/net/ens2f2/ctlr_2/host3/fc_host/host3/port_name", []byte("0x2000000e1e1a2b3c\n"))
+	fs.WriteFile(nic+"/net/ens2f2/ctlr_2/host3/fc_host/host3/node_name", []byte("0x1000000e1e1a2b3c\n"))
+	fs.Symlink("../../../devices/pci0000:20/0000:20:03.0/0000:21:00.2/net/ens2f2/ctlr_2", "/sys/bus/fcoe/devices/ctlr_2")
+	//systool doesn't report the FCoE host
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		return "", nil
+	})
+
+	hbas, err := GetFCHBAsInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hbas) != 1 || hbas[0]["port_name"] != "2000000e1e1a2b3c" || hbas[0]["fcoe_interface"] != "ens2f2" {
+		t.Errorf("expected the fcoe hba despite the unreadable vports, got %v", hbas)
+	}
+}
+
+func TestDiscoverFCTargets(t *testing.T) {
+	root := newFakeSysFS(t)
+	scanned := func(host string) string {
+		out, err := ioutil.ReadFile(filepath.Join(root, "class/scsi_host", host, "scan"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	hbas := []HBA{
+		{"port_name": "100010604b010459", "host_device": "host2"},
+		{"port_name": "100010604b01045d", "host_device": "host3"},
+	}
+	for _, c := range []struct {
+		name           string
+		connProperties map[string]interface{}
+		host3          string
+	}{
+		{"every hba", map[string]interface{}{"targets": []Target{{"20210002ac00383d", "1"}}}, "- - 1\n"},
+		{"initiator target map", map[string]interface{}{
+			"targets": []Target{{"20210002ac00383d", "1"}, {"20220002ac00383d", "2"}},
+			"initiator_target_lun_map": map[string][]Target{
+				"100010604b010459": {{"20210002ac00383d", "1"}},
+			},
+		}, ""},
+	} {
+		for _, host := range []string{"host2", "host3"} {
+			writeFakeFile(t, root, "class/scsi_host/"+host+"/scan", "")
+		}
+		DiscoverFCTargets(hbas, c.connProperties)
+		if out := scanned("host2"); out != "- - 1\n" {
+			t.Errorf("%s: unexpected host2 scan %q", c.name, out)
+		}
+		if out := scanned("host3"); out != c.host3 {
+			t.Errorf("%s: unexpected host3 scan %q", c.name, out)
+		}
+	}
+}
+
+func TestRescanHostsInitiatorTargetLunMap(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "class/fc_transport/target2:0:1/port_name", "0x20210002ac00383d\n")
+	writeFakeFile(t, root, "class/fc_transport/target3:0:1/port_name", "0x20220002ac00383d\n")
+	writeFakeFile(t, root, "class/fc_host/host3/port_name", "0x100010604b01045d\n")
+	for _, host := range []string{"host2", "host3"} {
+		writeFakeFile(t, root, "class/scsi_host/"+host+"/scan", "")
+	}
+	scanned := func(host string) string {
+		out, err := ioutil.ReadFile(filepath.Join(root, "class/scsi_host", host, "scan"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	hbas := []HBA{
+		{"port_name": "100010604b010459", "host_device": "host2"},
+		{"port_name": "100010604b01045d", "host_device": "host3"},
+	}
+	connProperties := map[string]interface{}{
+		"targets":              []Target{{"20210002ac00383d", "1"}, {"20220002ac00383d", "1"}},
+		"initiator_target_map": map[string][]string{"100010604b010459": {"20210002ac00383d"}},
+		"initiator_target_lun_map": map[string][]Target{
+			"100010604b010459": {{"20210002ac00383d", "1"}},
+		},
+	}
+
+	RescanHosts(hbas, connProperties)
+	if out := scanned("host2"); out != "0 1 1\n" {
+		t.Errorf("unexpected host2 scan %q", out)
+	}
+	if out := scanned("host3"); out != "" {
+		t.Errorf("host3 is not in the initiator target map, but scanned %q", out)
+	}
+
+	if err := RescanHost("host3", map[string]interface{}{"targets": []Target{{"20220002ac00383d", "2"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if out := scanned("host3"); out != "0 1 2\n" {
+		t.Errorf("unexpected host3 scan %q", out)
+	}
+}
+
+func TestGetFCHBAHealth(t *testing.T) {
+	fs := newMemFS(t)
+	fs.WriteFile("/sys/class/fc_host/host2/port_name", []byte("0x100010604b010459\n"))
+	fs.WriteFile("/sys/class/fc_host/host2/speed", []byte("16 Gbit\n"))
+	fs.WriteFile("/sys/class/fc_host/host2/port_state", []byte("Online\n"))
+	fs.WriteFile("/sys/class/fc_host/host2/supported_speeds", []byte("4 Gbit, 8 Gbit, 16 Gbit\n"))
+	fs.WriteFile("/sys/class/fc_host/host3/port_name", []byte("0x100010604b01045d\n"))
+	fs.WriteFile("/sys/class/fc_host/host3/speed", []byte("unknown\n"))
+	fs.WriteFile("/sys/class/fc_host/host3/port_state", []byte("Linkdown\n"))
+	fs.WriteFile("/sys/class/fc_host/host3/supported_speeds", []byte("4 Gbit, 8 Gbit, 16 Gbit\n"))
+
+	health, err := GetFCHBAHealth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []HBAHealth{
+		{"host2", "100010604b010459", "16 Gbit", "Online", "4 Gbit, 8 Gbit, 16 Gbit"},
+		{"host3", "100010604b01045d", "unknown", "Linkdown", "4 Gbit, 8 Gbit, 16 Gbit"},
+	}
+	if !reflect.DeepEqual(health, expected) {
+		t.Errorf("expected %v, got %v", expected, health)
 	}
-	t.Log(hbas)
 }
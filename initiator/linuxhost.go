@@ -0,0 +1,47 @@
+/**
+Generic linux host utilities
+
+*/
+package initiator
+
+import (
+	"fmt"
+	osBrick "github.com/ydcool/os-brick-go"
+	"log"
+	"runtime"
+	"strings"
+)
+
+//MachineIDPath is the machine-id GetHostInfo falls back to when the DMI
+//product uuid can't be read.
+var MachineIDPath = "/etc/machine-id"
+
+//GetHostInfo Get the identity of the host the backends register it with.
+//
+//	The UUID is the DMI product_uuid of the system, only readable by root,
+//	or the machine-id when it's missing, e.g. on some virtual machines.
+func GetHostInfo() (HostInfo, error) {
+	info := HostInfo{Platform: runtime.GOARCH, OSType: "linux"}
+	path := sysfsPath("/sys/class/dmi/id/product_uuid")
+	content, err := osBrick.DefaultFS.ReadFile(path)
+	if uuid := strings.ToLower(strings.TrimSpace(string(content))); err == nil && !isPlaceholderUUID(uuid) {
+		info.UUID = uuid
+		return info, nil
+	}
+	log.Printf("no product uuid in %s (%v), falling back to %s", path, err, MachineIDPath)
+	content, err = osBrick.DefaultFS.ReadFile(MachineIDPath)
+	if err != nil {
+		return info, fmt.Errorf("failed read %s: %v", MachineIDPath, err)
+	}
+	if info.UUID = strings.TrimSpace(string(content)); info.UUID == "" {
+		return info, fmt.Errorf("empty machine id in %s", MachineIDPath)
+	}
+	return info, nil
+}
+
+//isPlaceholderUUID Whether a product uuid is empty or one of the all zeros or
+//all ones placeholders some firmwares report.
+func isPlaceholderUUID(uuid string) bool {
+	digits := strings.Replace(uuid, "-", "", -1)
+	return digits == "" || strings.Trim(digits, "0") == "" || strings.Trim(digits, "f") == ""
+}
@@ -0,0 +1,36 @@
+package initiator
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestGetHostInfo(t *testing.T) {
+	for _, c := range []struct {
+		productUUID string
+		expected    string
+	}{
+		{"4C4C4544-0038-5110-8058-B4C04F4E4D32\n", "4c4c4544-0038-5110-8058-b4c04f4e4d32"},
+		//placeholders of firmwares without a uuid fall back to the machine-id
+		{"00000000-0000-0000-0000-000000000000\n", "b08dfa6083e7567a1921a715000001fb"},
+		{"", "b08dfa6083e7567a1921a715000001fb"},
+	} {
+		fs := newMemFS(t)
+		if c.productUUID != "" {
+			fs.WriteFile("/sys/class/dmi/id/product_uuid", []byte(c.productUUID))
+		}
+		fs.WriteFile("/etc/machine-id", []byte("b08dfa6083e7567a1921a715000001fb\n"))
+		info, err := GetHostInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := HostInfo{UUID: c.expected, Platform: runtime.GOARCH, OSType: "linux"}
+		if info != expected {
+			t.Errorf("product_uuid %q: expected %+v, got %+v", c.productUUID, expected, info)
+		}
+	}
+	newMemFS(t)
+	if _, err := GetHostInfo(); err == nil {
+		t.Error("expected an error without product_uuid nor machine-id")
+	}
+}
@@ -0,0 +1,220 @@
+/**
+Generic linux iSCSI utilities
+
+Inspired by github.com/openstack/os-brick
+
+*/
+package initiator
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	osBrick "github.com/ydcool/os-brick-go"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	//InitiatorNameFile is where open-iscsi keeps the host initiator name,
+	//override it when the host /etc is mounted elsewhere (e.g. containers).
+	InitiatorNameFile = "/etc/iscsi/initiatorname.iscsi"
+
+	//ErrISCSINotConfigured is returned when open-iscsi has no initiator name.
+	ErrISCSINotConfigured = errors.New("open-iscsi is not configured")
+)
+
+//GetInitiatorIQN Get the iSCSI initiator IQN of this host.
+//
+//	The IQN is read from the InitiatorName= line of InitiatorNameFile,
+//	comment lines are ignored.
+func GetInitiatorIQN() (string, error) {
+	f, err := osBrick.DefaultFS.Open(InitiatorNameFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%w: %s not found", ErrISCSINotConfigured, InitiatorNameFile)
+		}
+		return "", fmt.Errorf("failed open %s: %v", InitiatorNameFile, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "InitiatorName=") {
+			if iqn := strings.TrimSpace(strings.TrimPrefix(line, "InitiatorName=")); iqn != "" {
+				return iqn, nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed read %s: %v", InitiatorNameFile, err)
+	}
+	return "", fmt.Errorf("%w: no InitiatorName in %s", ErrISCSINotConfigured, InitiatorNameFile)
+}
+
+//iscsiTargetLocks serializes the operations on the sessions of shared targets.
+var iscsiTargetLocks osBrick.KeyedMutex
+
+//LockISCSITarget Lock the session of a target for a login, logout or rescan,
+//returns the func unlocking it.
+//
+//	Volumes of a target with shared_targets share its session, concurrent
+//	operations on it corrupt its state, so they are serialized by iqn and
+//	portal. The session of a target that isn't shared belongs to a single
+//	volume and isn't locked.
+func LockISCSITarget(portal, iqn string, sharedTargets bool) func() {
+	if !sharedTargets {
+		return func() {}
+	}
+	return iscsiTargetLocks.Lock(iqn + "," + portal)
+}
+
+//GetISCSISessions List the iSCSI sessions of this host.
+func GetISCSISessions() ([]ISCSISession, error) {
+	sessions := make([]ISCSISession, 0)
+	out, err := executeC("iscsiadm", "-m", "session")
+	if err != nil {
+		//iscsiadm exits with 21 when there is no session
+		if strings.Contains(out, "No active sessions") || strings.Contains(err.Error(), "No active sessions") {
+			return sessions, nil
+		}
+		return nil, fmt.Errorf("failed execute iscsiadm -m session: %s, %v", strings.TrimSpace(out), err)
+	}
+	//tcp: [1] 10.0.0.1:3260,1 iqn.2010-10.org.openstack:volume-1 (non-flash)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		session := ISCSISession{
+			Transport: strings.TrimSuffix(fields[0], ":"),
+			SID:       strings.Trim(fields[1], "[]"),
+			Portal:    fields[2],
+			IQN:       fields[3],
+		}
+		if i := strings.LastIndex(session.Portal, ","); i >= 0 {
+			session.Portal, session.TPGT = session.Portal[:i], session.Portal[i+1:]
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+//ISCSILogin Log in to a target portal unless there is a session already.
+//
+//	With sharedTargets the login is serialized with the other operations
+//	on the target, see LockISCSITarget, so volumes of a shared target
+//	attached concurrently log in once.
+func ISCSILogin(portal, iqn string, sharedTargets bool) error {
+	unlock := LockISCSITarget(portal, iqn, sharedTargets)
+	defer unlock()
+	sessions, err := GetISCSISessions()
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.Portal == portal && session.IQN == iqn {
+			log.Printf("already logged in to %s at %s, session %s", iqn, portal, session.SID)
+			return nil
+		}
+	}
+	out, err := osBrick.Execute("iscsiadm", "-m", "node", "-T", iqn, "-p", portal, "--login")
+	if err != nil {
+		//iscsiadm exits with 15 when the session was created meanwhile
+		if strings.Contains(out, "already present") {
+			return nil
+		}
+		return fmt.Errorf("failed login to %s at %s: %s, %v", iqn, portal, strings.TrimSpace(out), err)
+	}
+	log.Printf("logged in to %s at %s: %s", iqn, portal, out)
+	return nil
+}
+
+//getISCSISessionLuns Get the LUNs of the devices of a session, from the
+//h:c:t:l addresses of its targets in sysfs.
+func getISCSISessionLuns(sid string) ([]string, error) {
+	devices, err := osBrick.DefaultFS.Glob(sysfsPath(fmt.Sprintf("/sys/class/iscsi_session/session%s/device/target*/*:*:*:*", sid)))
+	if err != nil {
+		return nil, fmt.Errorf("failed list devices of session %s: %v", sid, err)
+	}
+	luns := make([]string, 0, len(devices))
+	for _, device := range devices {
+		hctl := strings.Split(filepath.Base(device), ":")
+		luns = append(luns, hctl[len(hctl)-1])
+	}
+	return luns, nil
+}
+
+//ISCSILogoutVolume Log out of the sessions of a target carrying the LUNs of
+//a volume.
+//
+//	The (portal, iqn) pairs to log out are taken from the sessions of iqn
+//	with a device of the volume luns. A session also carrying the LUNs of
+//	other volumes, e.g. on shared targets, is kept, logging out of it
+//	would detach them too. The session is locked across the check and
+//	the logout, so a volume attached meanwhile isn't logged out along.
+func ISCSILogoutVolume(iqn string, luns []string, sharedTargets bool) error {
+	sessions, err := GetISCSISessions()
+	if err != nil {
+		return err
+	}
+	volumeLuns := make(map[string]bool, len(luns))
+	for _, lun := range luns {
+		volumeLuns[lun] = true
+	}
+	for _, session := range sessions {
+		if session.IQN != iqn {
+			continue
+		}
+		if err := logoutVolumeSession(session, volumeLuns, sharedTargets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//logoutVolumeSession Log out of a session carrying the volumeLuns unless it
+//carries the LUNs of other volumes too.
+func logoutVolumeSession(session ISCSISession, volumeLuns map[string]bool, sharedTargets bool) error {
+	unlock := LockISCSITarget(session.Portal, session.IQN, sharedTargets)
+	defer unlock()
+	sessionLuns, err := getISCSISessionLuns(session.SID)
+	if err != nil {
+		return err
+	}
+	ours, others := 0, make([]string, 0)
+	for _, lun := range sessionLuns {
+		if volumeLuns[lun] {
+			ours++
+		} else {
+			others = append(others, lun)
+		}
+	}
+	if ours == 0 {
+		return nil
+	}
+	if len(others) > 0 {
+		log.Printf("keep session %s to %s at %s, in use by luns %v", session.SID, session.IQN, session.Portal, others)
+		return nil
+	}
+	return iscsiLogout(session.Portal, session.IQN)
+}
+
+//iscsiLogout Log out of a target portal, the caller holds LockISCSITarget.
+func iscsiLogout(portal, iqn string) error {
+	out, err := osBrick.Execute("iscsiadm", "-m", "node", "-T", iqn, "-p", portal, "--logout")
+	if err != nil {
+		//iscsiadm exits with 21 when the session is gone already
+		if strings.Contains(out, "No matching sessions") {
+			return nil
+		}
+		return fmt.Errorf("failed logout of %s at %s: %s, %v", iqn, portal, strings.TrimSpace(out), err)
+	}
+	log.Printf("logged out of %s at %s: %s", iqn, portal, out)
+	return nil
+}
@@ -0,0 +1,205 @@
+package initiator
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetInitiatorIQN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(f string) { InitiatorNameFile = f }(InitiatorNameFile)
+	InitiatorNameFile = filepath.Join(dir, "initiatorname.iscsi")
+
+	content := `## DO NOT EDIT OR REMOVE THIS FILE!
+## If you remove this file, the iSCSI daemon will not start.
+#InitiatorName=iqn.1993-08.org.debian:01:commented
+InitiatorName=iqn.1993-08.org.debian:01:b9e4a4d3c2f1
+`
+	if err := ioutil.WriteFile(InitiatorNameFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	iqn, err := GetInitiatorIQN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iqn != "iqn.1993-08.org.debian:01:b9e4a4d3c2f1" {
+		t.Errorf("unexpected iqn: %s", iqn)
+	}
+
+	InitiatorNameFile = filepath.Join(dir, "missing")
+	if _, err := GetInitiatorIQN(); !errors.Is(err, ErrISCSINotConfigured) {
+		t.Errorf("expected ErrISCSINotConfigured, got %v", err)
+	}
+}
+
+func TestGetInitiatorIQNNotSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(f string) { InitiatorNameFile = f }(InitiatorNameFile)
+	InitiatorNameFile = filepath.Join(dir, "initiatorname.iscsi")
+
+	//what open-iscsi ships before iscsi-iname was run
+	for _, content := range []string{"", "## DO NOT EDIT OR REMOVE THIS FILE!\n#InitiatorName=iqn.1993-08.org.debian:01:commented\n", "InitiatorName=\n"} {
+		if err := ioutil.WriteFile(InitiatorNameFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GetInitiatorIQN(); !errors.Is(err, ErrISCSINotConfigured) {
+			t.Errorf("%q: expected ErrISCSINotConfigured, got %v", content, err)
+		}
+	}
+}
+
+func TestGetISCSISessions(t *testing.T) {
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		return "tcp: [1] 10.0.0.1:3260,1 iqn.2010-10.org.openstack:volume-1 (non-flash)\n" +
+			"tcp: [2] [fd00::1]:3260,2 iqn.2010-10.org.openstack:volume-2 (non-flash)\n", nil
+	})
+	sessions, err := GetISCSISessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ISCSISession{
+		{"tcp", "1", "10.0.0.1:3260", "1", "iqn.2010-10.org.openstack:volume-1"},
+		{"tcp", "2", "[fd00::1]:3260", "2", "iqn.2010-10.org.openstack:volume-2"},
+	}
+	if !reflect.DeepEqual(sessions, expected) {
+		t.Errorf("expected %v, got %v", expected, sessions)
+	}
+
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		return "iscsiadm: No active sessions.\n", fmt.Errorf("exit status 21")
+	})
+	if sessions, err := GetISCSISessions(); err != nil || len(sessions) != 0 {
+		t.Errorf("expected no sessions, got %v, %v", sessions, err)
+	}
+}
+
+func TestISCSILoginSharedTarget(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		sessions []string
+		logins   int
+	)
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch strings.Join(arg, " ") {
+		case "-m session":
+			mu.Lock()
+			defer mu.Unlock()
+			if len(sessions) == 0 {
+				return "iscsiadm: No active sessions.\n", fmt.Errorf("exit status 21")
+			}
+			return strings.Join(sessions, "\n"), nil
+		case "-m node -T iqn.2010-10.org.openstack:shared -p 10.0.0.1:3260 --login":
+			//leave time to the other volume to look for the session
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			logins++
+			sessions = append(sessions, fmt.Sprintf("tcp: [%d] 10.0.0.1:3260,1 iqn.2010-10.org.openstack:shared (non-flash)", logins))
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = ISCSILogin("10.0.0.1:3260", "iqn.2010-10.org.openstack:shared", true)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if logins != 1 {
+		t.Errorf("expected a single login to the shared target, got %d", logins)
+	}
+}
+
+func TestISCSILogoutVolumeSharedTarget(t *testing.T) {
+	sysfs := newFakeSysFS(t)
+	//volume-1 is lun 1, exported through both portals, volume-2 is lun 2,
+	//exported through the first one only
+	writeFakeFile(t, sysfs, "class/iscsi_session/session1/device/target3:0:0/3:0:0:1/state", "running\n")
+	writeFakeFile(t, sysfs, "class/iscsi_session/session1/device/target3:0:0/3:0:0:2/state", "running\n")
+	writeFakeFile(t, sysfs, "class/iscsi_session/session2/device/target4:0:0/4:0:0:1/state", "running\n")
+	writeFakeFile(t, sysfs, "class/iscsi_session/session3/device/target5:0:0/5:0:0:1/state", "running\n")
+	logouts := make([]string, 0)
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		cmd := strings.Join(arg, " ")
+		if cmd == "-m session" {
+			return "tcp: [1] 10.0.0.1:3260,1 iqn.2010-10.org.openstack:shared (non-flash)\n" +
+				"tcp: [2] 10.0.0.2:3260,1 iqn.2010-10.org.openstack:shared (non-flash)\n" +
+				"tcp: [3] 10.0.0.1:3260,1 iqn.2010-10.org.openstack:other (non-flash)\n", nil
+		}
+		if strings.HasSuffix(cmd, "--logout") {
+			logouts = append(logouts, cmd)
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+
+	if err := ISCSILogoutVolume("iqn.2010-10.org.openstack:shared", []string{"1"}, true); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"-m node -T iqn.2010-10.org.openstack:shared -p 10.0.0.2:3260 --logout"}
+	if !reflect.DeepEqual(logouts, expected) {
+		t.Errorf("expected %v, got %v", expected, logouts)
+	}
+}
+
+func TestISCSILogoutVolumeLocked(t *testing.T) {
+	sysfs := newFakeSysFS(t)
+	writeFakeFile(t, sysfs, "class/iscsi_session/session1/device/target3:0:0/3:0:0:1/state", "running\n")
+	var mu sync.Mutex
+	logouts := 0
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		cmd := strings.Join(arg, " ")
+		if cmd == "-m session" {
+			return "tcp: [1] 10.0.0.1:3260,1 iqn.2010-10.org.openstack:shared (non-flash)\n", nil
+		}
+		if strings.HasSuffix(cmd, "--logout") {
+			mu.Lock()
+			logouts++
+			mu.Unlock()
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+
+	//a volume attaching through the session holds it
+	unlock := LockISCSITarget("10.0.0.1:3260", "iqn.2010-10.org.openstack:shared", true)
+	done := make(chan error, 1)
+	go func() {
+		done <- ISCSILogoutVolume("iqn.2010-10.org.openstack:shared", []string{"1"}, true)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	writeFakeFile(t, sysfs, "class/iscsi_session/session1/device/target3:0:0/3:0:0:2/state", "running\n")
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if logouts != 0 {
+		t.Error("logged out of the session of the volume attached meanwhile")
+	}
+}
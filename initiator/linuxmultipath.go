@@ -0,0 +1,229 @@
+/**
+Linux multipath output parsing
+
+Inspired by github.com/openstack/os-brick
+
+*/
+package initiator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	multipathErrorRegex     = regexp.MustCompile(MultipathErrorRegex)
+	multipathPathCheckRegex = regexp.MustCompile(MultipathPathCheckRegex)
+	//key=value and key='value with spaces' of the current output
+	multipathAttrRegex = regexp.MustCompile(`(\w+)=('[^']*'|\S+)`)
+	//[key=value] and [flag] of the old output
+	multipathBracketRegex = regexp.MustCompile(`\[([^\]]*)\]`)
+)
+
+//GetMultipathInfo Get the multipath device of a wwn as shown by multipath -ll,
+//along with the path checker of each path from multipathd.
+func GetMultipathInfo(wwn string) (MultipathInfo, error) {
+	out, err := executeC("multipath", "-ll", wwn)
+	if err != nil {
+		return MultipathInfo{}, fmt.Errorf("failed execute multipath -ll %s: %s, %v", wwn, strings.TrimSpace(out), err)
+	}
+	infos := ParseMultipathOutput(out)
+	if len(infos) == 0 {
+		return MultipathInfo{}, fmt.Errorf("no multipath device found for %s", wwn)
+	}
+	info := infos[0]
+	checkers, err := getPathCheckers()
+	if err != nil {
+		log.Printf("failed get path checkers: %v", err)
+		return info, nil
+	}
+	for _, g := range info.PathGroups {
+		for i := range g.Paths {
+			g.Paths[i].Checker = checkers[g.Paths[i].Device]
+		}
+	}
+	return info, nil
+}
+
+//GetMultipathAlias Get the name of the multipath map of a wwn from multipathd,
+//the alias set in multipath.conf if any.
+func GetMultipathAlias(wwn string) (string, error) {
+	return GetMultipathAliasContext(context.Background(), wwn)
+}
+
+//GetMultipathAliasContext Get the name of the multipath map like
+//GetMultipathAlias, with the executor of ctx.
+func GetMultipathAliasContext(ctx context.Context, wwn string) (string, error) {
+	out, err := executeCContext(ctx, "multipathd", "show", "maps", "format", "%w %n")
+	if err != nil {
+		return "", fmt.Errorf("failed execute multipathd show maps: %s, %v", strings.TrimSpace(out), err)
+	}
+	for _, l := range strings.Split(out, "\n") {
+		if fields := strings.Fields(l); len(fields) == 2 && fields[0] == wwn {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("no multipath map found for %s", wwn)
+}
+
+//getPathCheckers Get the path checker of each path device from multipathd.
+func getPathCheckers() (map[string]string, error) {
+	out, err := executeC("multipathd", "show", "paths", "format", "%d %c")
+	if err != nil {
+		return nil, fmt.Errorf("failed execute multipathd show paths: %s, %v", strings.TrimSpace(out), err)
+	}
+	checkers := make(map[string]string)
+	for _, l := range strings.Split(out, "\n") {
+		if fields := strings.Fields(l); len(fields) == 2 {
+			checkers[fields[0]] = fields[1]
+		}
+	}
+	return checkers, nil
+}
+
+//ParseMultipathOutput Parse the multipath devices of the output of multipath -ll,
+//in the current tree format or the old one with [active][ready] markers.
+func ParseMultipathOutput(out string) []MultipathInfo {
+	infos := make([]MultipathInfo, 0)
+	var info *MultipathInfo
+	for _, l := range strings.Split(out, "\n") {
+		line := strings.TrimRight(l, " ")
+		trimmed := strings.TrimLeft(line, " |`-+\\_")
+		switch {
+		case trimmed == "" || multipathErrorRegex.MatchString(line):
+			continue
+		case multipathPathCheckRegex.MatchString(" " + trimmed):
+			if info == nil {
+				continue
+			}
+			if len(info.PathGroups) == 0 {
+				info.PathGroups = append(info.PathGroups, MultipathPathGroup{})
+			}
+			g := &info.PathGroups[len(info.PathGroups)-1]
+			if p, ok := parseMultipathPath(trimmed); ok {
+				g.Paths = append(g.Paths, p)
+			}
+		case strings.HasPrefix(trimmed, "size=") || strings.HasPrefix(trimmed, "[size="):
+			if info != nil {
+				parseMultipathAttributes(info, trimmed)
+			}
+		case line != trimmed:
+			//indented, a path group
+			if info != nil {
+				info.PathGroups = append(info.PathGroups, parseMultipathPathGroup(trimmed))
+			}
+		default:
+			infos = append(infos, parseMultipathHeader(line))
+			info = &infos[len(infos)-1]
+		}
+	}
+	return infos
+}
+
+//parseMultipathHeader Parse e.g. mpatha (3600a0980383036347224000000000001) dm-0 NETAPP,LUN C-Mode,
+//the wwid is the name when friendly names are off.
+func parseMultipathHeader(line string) MultipathInfo {
+	fields := strings.Fields(line)
+	if _, ok := MultipathDeviceActions[fields[0]]; ok {
+		fields = fields[1:]
+	}
+	info := MultipathInfo{Name: fields[0], WWID: fields[0]}
+	fields = fields[1:]
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "(") {
+		info.WWID = strings.Trim(fields[0], "()")
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "dm-") {
+		info.DMName = fields[0]
+		fields = fields[1:]
+	}
+	vendorProduct := strings.SplitN(strings.Join(fields, " "), ",", 2)
+	info.Vendor = vendorProduct[0]
+	if len(vendorProduct) > 1 {
+		info.Product = vendorProduct[1]
+	}
+	return info
+}
+
+//parseMultipathAttributes Parse size=2.0G features='1 queue_if_no_path' hwhandler='1 alua' wp=rw
+//or [size=50G][features=1 queue_if_no_path][hwhandler=0][rw].
+func parseMultipathAttributes(info *MultipathInfo, line string) {
+	attrs := make(map[string]string)
+	if strings.HasPrefix(line, "[") {
+		for _, m := range multipathBracketRegex.FindAllStringSubmatch(line, -1) {
+			if kv := strings.SplitN(m[1], "=", 2); len(kv) == 2 {
+				attrs[kv[0]] = kv[1]
+			} else if m[1] == "rw" || m[1] == "ro" {
+				attrs["wp"] = m[1]
+			}
+		}
+	} else {
+		for _, m := range multipathAttrRegex.FindAllStringSubmatch(line, -1) {
+			attrs[m[1]] = strings.Trim(m[2], "'")
+		}
+	}
+	info.Size = attrs["size"]
+	info.Features = attrs["features"]
+	info.HWHandler = attrs["hwhandler"]
+	info.WriteProtect = attrs["wp"]
+}
+
+//parseMultipathPathGroup Parse policy='service-time 0' prio=50 status=active
+//or round-robin 0 [prio=1][active].
+func parseMultipathPathGroup(line string) MultipathPathGroup {
+	g := MultipathPathGroup{}
+	attrs := make(map[string]string)
+	if i := strings.Index(line, "["); i >= 0 && !strings.Contains(line, "policy=") {
+		g.Policy = strings.TrimSpace(line[:i])
+		for _, m := range multipathBracketRegex.FindAllStringSubmatch(line, -1) {
+			if kv := strings.SplitN(m[1], "=", 2); len(kv) == 2 {
+				attrs[kv[0]] = kv[1]
+			} else {
+				attrs["status"] = m[1]
+			}
+		}
+	} else {
+		for _, m := range multipathAttrRegex.FindAllStringSubmatch(line, -1) {
+			attrs[m[1]] = strings.Trim(m[2], "'")
+		}
+		g.Policy = attrs["policy"]
+	}
+	g.Prio, _ = strconv.Atoi(attrs["prio"])
+	g.Status = attrs["status"]
+	return g
+}
+
+//parseMultipathPath Parse 2:0:0:1 sdb 8:16 active ready running
+//or 1:0:0:1 sdb 8:16  [active][ready].
+func parseMultipathPath(line string) (MultipathPath, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return MultipathPath{}, false
+	}
+	address := strings.Split(fields[0], ":")
+	if len(address) != 4 {
+		return MultipathPath{}, false
+	}
+	p := MultipathPath{
+		HCTL:   HCTL{Host: address[0], Channel: address[1], Target: address[2], Lun: address[3]},
+		Device: fields[1],
+		DevT:   fields[2],
+	}
+	states := fields[3:]
+	if len(states) > 0 && strings.HasPrefix(states[0], "[") {
+		states = make([]string, 0)
+		for _, m := range multipathBracketRegex.FindAllStringSubmatch(strings.Join(fields[3:], ""), -1) {
+			states = append(states, m[1])
+		}
+	}
+	for i, field := range []*string{&p.DMState, &p.CheckerState, &p.DeviceState} {
+		if i < len(states) {
+			*field = states[i]
+		}
+	}
+	return p, true
+}
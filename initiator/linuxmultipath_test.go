@@ -0,0 +1,137 @@
+package initiator
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const multipathOutput = `Oct 16 10:00:01 | sdf: couldn't get target port group
+mpatha (3600a0980383036347224000000000001) dm-0 NETAPP,LUN C-Mode
+size=2.0G features='3 queue_if_no_path pg_init_retries 50' hwhandler='1 alua' wp=rw
+|-+- policy='service-time 0' prio=50 status=active
+| |- 2:0:0:1 sdb 8:16 active ready running
+| ` + "`" + `- 3:0:0:1 sdc 8:32 active ready running
+` + "`" + `-+- policy='service-time 0' prio=10 status=enabled
+  |- 2:0:1:1 sdd 8:48 failed faulty offline
+  ` + "`" + `- 3:0:1:1 sde 8:64 active ghost running
+`
+
+const multipathOldOutput = `mpath0 (360060160b5d02200a6c4b3dd0b1fde11) dm-2 DGC,RAID 5
+[size=50G][features=1 queue_if_no_path][hwhandler=1 emc][rw]
+\_ round-robin 0 [prio=2][active]
+ \_ 1:0:0:1 sdb 8:16  [active][ready]
+ \_ 2:0:0:1 sdd 8:48  [active][ready]
+\_ round-robin 0 [prio=0][enabled]
+ \_ 1:0:1:1 sdc 8:32  [failed][faulty]
+`
+
+func TestParseMultipathOutput(t *testing.T) {
+	for name, c := range map[string]struct {
+		out      string
+		expected MultipathInfo
+	}{
+		"current": {multipathOutput, MultipathInfo{
+			Name: "mpatha", WWID: "3600a0980383036347224000000000001", DMName: "dm-0",
+			Vendor: "NETAPP", Product: "LUN C-Mode",
+			Size: "2.0G", Features: "3 queue_if_no_path pg_init_retries 50", HWHandler: "1 alua", WriteProtect: "rw",
+			PathGroups: []MultipathPathGroup{
+				{Policy: "service-time 0", Prio: 50, Status: "active", Paths: []MultipathPath{
+					{HCTL{"2", "0", "0", "1"}, "sdb", "8:16", "active", "ready", "running", ""},
+					{HCTL{"3", "0", "0", "1"}, "sdc", "8:32", "active", "ready", "running", ""},
+				}},
+				{Policy: "service-time 0", Prio: 10, Status: "enabled", Paths: []MultipathPath{
+					{HCTL{"2", "0", "1", "1"}, "sdd", "8:48", "failed", "faulty", "offline", ""},
+					{HCTL{"3", "0", "1", "1"}, "sde", "8:64", "active", "ghost", "running", ""},
+				}},
+			},
+		}},
+		"old": {multipathOldOutput, MultipathInfo{
+			Name: "mpath0", WWID: "360060160b5d02200a6c4b3dd0b1fde11", DMName: "dm-2",
+			Vendor: "DGC", Product: "RAID 5",
+			Size: "50G", Features: "1 queue_if_no_path", HWHandler: "1 emc", WriteProtect: "rw",
+			PathGroups: []MultipathPathGroup{
+				{Policy: "round-robin 0", Prio: 2, Status: "active", Paths: []MultipathPath{
+					{HCTL{"1", "0", "0", "1"}, "sdb", "8:16", "active", "ready", "", ""},
+					{HCTL{"2", "0", "0", "1"}, "sdd", "8:48", "active", "ready", "", ""},
+				}},
+				{Policy: "round-robin 0", Prio: 0, Status: "enabled", Paths: []MultipathPath{
+					{HCTL{"1", "0", "1", "1"}, "sdc", "8:32", "failed", "faulty", "", ""},
+				}},
+			},
+		}},
+	} {
+		infos := ParseMultipathOutput(c.out)
+		if len(infos) != 1 || !reflect.DeepEqual(infos[0], c.expected) {
+			t.Errorf("%s: expected %+v, got %+v", name, c.expected, infos)
+		}
+	}
+}
+
+func TestGetMultipathInfo(t *testing.T) {
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch name {
+		case "multipath":
+			return multipathOutput, nil
+		case "multipathd":
+			return "sdb tur\nsdc tur\nsdd directio\nsde tur\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+
+	info, err := GetMultipathInfo("3600a0980383036347224000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkers := make(map[string]string)
+	for _, g := range info.PathGroups {
+		for _, p := range g.Paths {
+			checkers[p.Device] = p.Checker
+		}
+	}
+	expected := map[string]string{"sdb": "tur", "sdc": "tur", "sdd": "directio", "sde": "tur"}
+	if !reflect.DeepEqual(checkers, expected) {
+		t.Errorf("expected checkers %v, got %v", expected, checkers)
+	}
+
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		return "", nil
+	})
+	if _, err := GetMultipathInfo("3600a0980383036347224000000000002"); err == nil {
+		t.Error("expected an error when there is no multipath device")
+	}
+}
+
+func TestFindMultipathDevicePathAlias(t *testing.T) {
+	fs := newMemFS(t)
+	fs.WriteFile("/dev/dm-3", nil)
+	fs.Symlink("../dm-3", "/dev/mapper/oradata01")
+	defer func(a int, i time.Duration) { PathWaitAttempts, PathWaitInterval = a, i }(PathWaitAttempts, PathWaitInterval)
+	PathWaitAttempts, PathWaitInterval = 1, time.Millisecond
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		if name == "multipathd" && strings.Join(arg, " ") == "show maps format %w %n" {
+			return "uuid                              name\n" +
+				"3600a0980383036347224000000000001 mpatha\n" +
+				"3600a0980383036347224000000000002 oradata01\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+
+	alias, err := GetMultipathAlias("3600a0980383036347224000000000002")
+	if err != nil || alias != "oradata01" {
+		t.Fatalf("expected alias oradata01, got %q, %v", alias, err)
+	}
+	path, err := FindMultipathDevicePath("3600a0980383036347224000000000002")
+	if err != nil || path != "/dev/mapper/oradata01" {
+		t.Errorf("expected /dev/mapper/oradata01, got %q, %v", path, err)
+	}
+	path, err = WaitForMultipathDevice("3600a0980383036347224000000000002", 5*time.Millisecond)
+	if err != nil || path != "/dev/mapper/oradata01" {
+		t.Errorf("expected to wait for /dev/mapper/oradata01, got %q, %v", path, err)
+	}
+	if _, err := GetMultipathAlias("3600a0980383036347224000000000009"); err == nil {
+		t.Error("expected error for a wwn without multipath map")
+	}
+}
@@ -0,0 +1,193 @@
+/**
+Generic linux NVMe utilities
+
+Inspired by github.com/openstack/os-brick
+
+*/
+package initiator
+
+import (
+	"fmt"
+	osBrick "github.com/ydcool/os-brick-go"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+//NVMeByIDRoot is where udev links the NVMe namespaces by their identifiers.
+var NVMeByIDRoot = "/dev/disk/by-id"
+
+//nvmePathRegex matches the hidden path devices of a native NVMe multipath
+//namespace, e.g. nvme0c1n1, which can't be used directly.
+var nvmePathRegex = regexp.MustCompile(`^nvme\d+c\d+n\d+$`)
+
+//anaStatePriority The ANA states of a namespace path by preference, a path
+//without ana_state is as good as an optimized one.
+var anaStatePriority = map[string]int{"": 0, "optimized": 0, "non-optimized": 1}
+
+//GetNVMeController Get the /dev/nvmeX controller of a /dev/nvmeXnY namespace.
+func GetNVMeController(device string) (string, error) {
+	if realPath, err := osBrick.DefaultFS.EvalSymlinks(device); err == nil {
+		device = realPath
+	}
+	path := sysfsPath(fmt.Sprintf("/sys/block/%s/device", filepath.Base(device)))
+	realPath, err := osBrick.DefaultFS.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("failed get realpath for path: %s: %v", path, err)
+	}
+	return "/dev/" + filepath.Base(realPath), nil
+}
+
+//RescanNVMeNamespace Rescan the namespaces of the controller of a /dev/nvmeXnY
+//namespace, so the kernel picks up its new size.
+func RescanNVMeNamespace(device string) error {
+	controller, err := GetNVMeController(device)
+	if err != nil {
+		return err
+	}
+	out, err := osBrick.Execute("nvme", "ns-rescan", controller)
+	if err != nil {
+		return fmt.Errorf("failed execute nvme ns-rescan %s: %s, %v", controller, out, err)
+	}
+	log.Printf("execute nvme ns-rescan %s: %s", controller, out)
+	return nil
+}
+
+//FindNVMeDevice Find the /dev/nvmeXnY namespace of an NVMe-oF volume.
+//
+//	Arrays identify the namespace by volume_uuid, volume_nguid or ns_id,
+//	they are tried in that order. The udev links are looked up first,
+//	nvme-uuid.<uuid> for the uuid, nvme-eui.<nguid> and nvme-<nguid> for
+//	the nguid, then the uuid, nguid and nsid attributes of the namespaces
+//	in sysfs. An ns_id is only unique within a subsystem, it's only used
+//	along with the target_nqn to match.
+//
+//	With native NVMe multipath the namespace head is returned and the
+//	kernel picks the paths by their ANA state. Without it, the namespace
+//	of each path shares the identifiers, the one in the best ANA state is
+//	returned, a linked namespace in a worse state than optimized is
+//	compared with the others in sysfs.
+func FindNVMeDevice(connectionProperties map[string]interface{}) (string, error) {
+	uuid, _ := connectionProperties["volume_uuid"].(string)
+	uuid = strings.ToLower(strings.TrimSpace(uuid))
+	nguid, _ := connectionProperties["volume_nguid"].(string)
+	nguid = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(nguid))
+	nsid := ""
+	if v, ok := connectionProperties["ns_id"]; ok && v != nil {
+		n, err := osBrick.ToInt64(v)
+		if err != nil {
+			return "", fmt.Errorf("invalid ns_id %v: %v", v, err)
+		}
+		nsid = fmt.Sprintf("%d", n)
+	}
+	nqn, _ := connectionProperties["target_nqn"].(string)
+	nqn = strings.TrimSpace(nqn)
+	if nsid != "" && nqn == "" {
+		if uuid == "" && nguid == "" {
+			return "", fmt.Errorf("ns_id %s without target_nqn, it may match a namespace of another subsystem", nsid)
+		}
+		log.Printf("ignore ns_id %s without target_nqn", nsid)
+		nsid = ""
+	}
+	if uuid == "" && nguid == "" && nsid == "" {
+		return "", fmt.Errorf("no volume_uuid, volume_nguid nor ns_id in connection properties")
+	}
+	type identifier struct {
+		links []string
+		attr  string
+		value string
+	}
+	identifiers := make([]identifier, 0, 3)
+	if uuid != "" {
+		identifiers = append(identifiers, identifier{[]string{"nvme-uuid." + uuid}, "uuid", uuid})
+	}
+	if nguid != "" {
+		identifiers = append(identifiers, identifier{[]string{"nvme-eui." + nguid, "nvme-" + nguid}, "nguid", nguid})
+	}
+	if nsid != "" {
+		identifiers = append(identifiers, identifier{nil, "nsid", nsid})
+	}
+	for _, id := range identifiers {
+		linked := ""
+		for _, link := range id.links {
+			path := filepath.Join(NVMeByIDRoot, link)
+			device, err := osBrick.DefaultFS.EvalSymlinks(path)
+			if err != nil || nvmePathRegex.MatchString(filepath.Base(device)) {
+				continue
+			}
+			if nvmeANAPriority(filepath.Base(device)) == 0 {
+				log.Printf("found nvme namespace %s by %s", device, path)
+				return device, nil
+			}
+			//another path of the namespace may be in a better state
+			if linked == "" {
+				linked = device
+			}
+		}
+		device, err := findNVMeNamespace(id.attr, id.value, nqn)
+		if err != nil {
+			return "", err
+		}
+		if device == "" && linked != "" {
+			log.Printf("found nvme namespace %s by its %s link", linked, id.attr)
+			return linked, nil
+		}
+		if device != "" {
+			log.Printf("found nvme namespace %s by %s %s", device, id.attr, id.value)
+			return device, nil
+		}
+	}
+	return "", fmt.Errorf("no nvme namespace found for uuid %q, nguid %q, nsid %q", uuid, nguid, nsid)
+}
+
+//findNVMeNamespace Find the namespace whose sysfs attr is value, in the
+//subsystem nqn when given. Returns an empty device when there's none.
+func findNVMeNamespace(attr, value, nqn string) (string, error) {
+	namespaces, err := osBrick.DefaultFS.Glob(sysfsPath("/sys/block/nvme*"))
+	if err != nil {
+		return "", fmt.Errorf("failed list nvme namespaces: %v", err)
+	}
+	found, foundPriority := "", 0
+	for _, ns := range namespaces {
+		name := filepath.Base(ns)
+		if nvmePathRegex.MatchString(name) {
+			continue
+		}
+		content, err := osBrick.DefaultFS.ReadFile(filepath.Join(ns, attr))
+		if err != nil {
+			continue
+		}
+		v := strings.ToLower(strings.TrimSpace(string(content)))
+		if attr == "nguid" {
+			v = strings.Replace(v, "-", "", -1)
+		}
+		if v != value {
+			continue
+		}
+		if nqn != "" {
+			//the subsystem of a head, the controller of a plain namespace
+			subsysNQN, err := osBrick.DefaultFS.ReadFile(filepath.Join(ns, "device", "subsysnqn"))
+			if err != nil || strings.TrimSpace(string(subsysNQN)) != nqn {
+				continue
+			}
+		}
+		priority := nvmeANAPriority(name)
+		if found == "" || priority < foundPriority {
+			found, foundPriority = "/dev/"+name, priority
+		}
+	}
+	return found, nil
+}
+
+//nvmeANAPriority Get the anaStatePriority of the ana_state of a namespace,
+//lower is better.
+func nvmeANAPriority(name string) int {
+	state, _ := osBrick.DefaultFS.ReadFile(sysfsPath(fmt.Sprintf("/sys/block/%s/ana_state", name)))
+	priority, ok := anaStatePriority[strings.TrimSpace(string(state))]
+	if !ok {
+		//inaccessible, persistent-loss or change
+		priority = len(anaStatePriority)
+	}
+	return priority
+}
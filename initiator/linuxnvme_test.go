@@ -0,0 +1,148 @@
+package initiator
+
+import (
+	"fmt"
+	osBrick "github.com/ydcool/os-brick-go"
+	"reflect"
+	"testing"
+)
+
+func TestGetDeviceType(t *testing.T) {
+	fs := newMemFS(t)
+	fs.MkdirAll("/sys/devices/virtual/nvme-fabrics/ctl/nvme0")
+	fs.MkdirAll("/sys/devices/virtual/nvme-subsystem/nvme-subsys1")
+	fs.Symlink("../../devices/virtual/nvme-fabrics/ctl/nvme0", "/sys/block/nvme0n1/device")
+	fs.Symlink("../../devices/virtual/nvme-subsystem/nvme-subsys1", "/sys/block/nvme1n1/device")
+	fs.WriteFile("/dev/sdb", nil)
+	fs.WriteFile("/dev/dm-0", nil)
+	fs.WriteFile("/dev/nvme0n1", nil)
+	fs.WriteFile("/dev/nvme1n1", nil)
+	fs.Symlink("../dm-0", "/dev/mapper/mpatha")
+
+	for device, expected := range map[string]DeviceType{
+		"/dev/sdb":           DeviceTypeSCSI,
+		"/dev/mapper/mpatha": DeviceTypeDM,
+		"/dev/nvme0n1":       DeviceTypeNVMe,
+		"/dev/nvme1n1":       DeviceTypeNVMeMultipath,
+		"/dev/vda":           DeviceTypeUnknown,
+	} {
+		if deviceType, err := GetDeviceType(device); err != nil || deviceType != expected {
+			t.Errorf("%s: expected %s, got %s, %v", device, expected, deviceType, err)
+		}
+	}
+}
+
+func TestDoExtendVolumeNVMe(t *testing.T) {
+	fs := newMemFS(t)
+	fs.MkdirAll("/sys/devices/virtual/nvme-fabrics/ctl/nvme0")
+	fs.Symlink("../../devices/virtual/nvme-fabrics/ctl/nvme0", "/sys/block/nvme0n1/device")
+	fs.WriteFile("/dev/nvme0n1", nil)
+
+	var commands [][]string
+	size := "1073741824"
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		commands = append(commands, append([]string{name}, arg...))
+		switch name {
+		case "blockdev":
+			return size + "\n", nil
+		case "nvme":
+			size = "2147483648"
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+
+	newSize, err := DoExtendVolume([]string{"/dev/nvme0n1"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newSize != 2147483648 {
+		t.Errorf("unexpected new size %f", newSize)
+	}
+	expected := [][]string{
+		{"blockdev", "--getsize64", "/dev/nvme0n1"},
+		{"nvme", "ns-rescan", "/dev/nvme0"},
+		{"blockdev", "--getsize64", "/dev/nvme0n1"},
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("unexpected commands %v", commands)
+	}
+}
+
+func TestFindNVMeDevice(t *testing.T) {
+	const (
+		uuid  = "2d4e1a6b-7c3f-4a5e-9b2d-8f1e6c0a3b7d"
+		nguid = "6b4e7f5a2c9d3e1f0025385a91b2c3d4"
+		nqn   = "nqn.2010-06.com.purestorage:flasharray.1"
+	)
+	for _, c := range []struct {
+		name     string
+		props    map[string]interface{}
+		fixture  func(fs *osBrick.MemFS)
+		expected string
+	}{
+		{"uuid link", map[string]interface{}{"volume_uuid": uuid, "volume_nguid": nguid}, func(fs *osBrick.MemFS) {
+			fs.Symlink("../../nvme1n1", "/dev/disk/by-id/nvme-uuid."+uuid)
+			fs.Symlink("../../nvme0n1", "/dev/disk/by-id/nvme-eui."+nguid)
+		}, "/dev/nvme1n1"},
+		{"eui link", map[string]interface{}{"volume_nguid": "6B4E7F5A-2C9D-3E1F-0025-385A91B2C3D4"}, func(fs *osBrick.MemFS) {
+			fs.Symlink("../../nvme0n1", "/dev/disk/by-id/nvme-eui."+nguid)
+		}, "/dev/nvme0n1"},
+		{"nguid link", map[string]interface{}{"volume_uuid": uuid, "volume_nguid": nguid}, func(fs *osBrick.MemFS) {
+			fs.Symlink("../../nvme0n1", "/dev/disk/by-id/nvme-"+nguid)
+		}, "/dev/nvme0n1"},
+		{"uuid attribute of a native multipath head", map[string]interface{}{"volume_uuid": uuid}, func(fs *osBrick.MemFS) {
+			fs.WriteFile("/sys/block/nvme0c0n1/uuid", []byte(uuid+"\n"))
+			fs.WriteFile("/sys/block/nvme0n1/uuid", []byte(uuid+"\n"))
+		}, "/dev/nvme0n1"},
+		{"ns_id of the target subsystem", map[string]interface{}{"ns_id": float64(2), "target_nqn": nqn}, func(fs *osBrick.MemFS) {
+			fs.WriteFile("/sys/devices/virtual/nvme-subsystem/nvme-subsys0/subsysnqn", []byte("nqn.2014-08.org.nvmexpress:other\n"))
+			fs.WriteFile("/sys/devices/virtual/nvme-subsystem/nvme-subsys1/subsysnqn", []byte(nqn+"\n"))
+			fs.WriteFile("/sys/block/nvme0n2/nsid", []byte("2\n"))
+			fs.Symlink("../../devices/virtual/nvme-subsystem/nvme-subsys0", "/sys/block/nvme0n2/device")
+			fs.WriteFile("/sys/block/nvme1n2/nsid", []byte("2\n"))
+			fs.Symlink("../../devices/virtual/nvme-subsystem/nvme-subsys1", "/sys/block/nvme1n2/device")
+		}, "/dev/nvme1n2"},
+		{"optimized ANA path", map[string]interface{}{"volume_nguid": nguid}, func(fs *osBrick.MemFS) {
+			fs.WriteFile("/sys/block/nvme0n1/nguid", []byte("6b4e7f5a-2c9d-3e1f-0025-385a91b2c3d4\n"))
+			fs.WriteFile("/sys/block/nvme0n1/ana_state", []byte("non-optimized\n"))
+			fs.WriteFile("/sys/block/nvme1n1/nguid", []byte("6b4e7f5a-2c9d-3e1f-0025-385a91b2c3d4\n"))
+			fs.WriteFile("/sys/block/nvme1n1/ana_state", []byte("optimized\n"))
+		}, "/dev/nvme1n1"},
+		{"optimized ANA path over a non-optimized link", map[string]interface{}{"volume_nguid": nguid}, func(fs *osBrick.MemFS) {
+			fs.Symlink("../../nvme0n1", "/dev/disk/by-id/nvme-eui."+nguid)
+			fs.WriteFile("/sys/block/nvme0n1/nguid", []byte(nguid+"\n"))
+			fs.WriteFile("/sys/block/nvme0n1/ana_state", []byte("non-optimized\n"))
+			fs.WriteFile("/sys/block/nvme1n1/nguid", []byte(nguid+"\n"))
+			fs.WriteFile("/sys/block/nvme1n1/ana_state", []byte("optimized\n"))
+		}, "/dev/nvme1n1"},
+		{"non-optimized link without sysfs attributes", map[string]interface{}{"volume_nguid": nguid}, func(fs *osBrick.MemFS) {
+			fs.Symlink("../../nvme0n1", "/dev/disk/by-id/nvme-eui."+nguid)
+			fs.WriteFile("/sys/block/nvme0n1/ana_state", []byte("non-optimized\n"))
+		}, "/dev/nvme0n1"},
+		{"ns_id without target_nqn along with a uuid", map[string]interface{}{"volume_uuid": uuid, "ns_id": "010"}, func(fs *osBrick.MemFS) {
+			fs.WriteFile("/sys/block/nvme0n8/nsid", []byte("8\n"))
+			fs.WriteFile("/sys/block/nvme1n1/uuid", []byte(uuid+"\n"))
+		}, "/dev/nvme1n1"},
+	} {
+		fs := newMemFS(t)
+		fs.WriteFile("/dev/nvme0n1", nil)
+		fs.WriteFile("/dev/nvme1n1", nil)
+		c.fixture(fs)
+		device, err := FindNVMeDevice(c.props)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if device != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, device)
+		}
+	}
+	newMemFS(t)
+	if _, err := FindNVMeDevice(map[string]interface{}{"volume_uuid": uuid}); err == nil {
+		t.Error("expected an error when no namespace matches")
+	}
+	fs := newMemFS(t)
+	fs.WriteFile("/sys/block/nvme0n2/nsid", []byte("2\n"))
+	if device, err := FindNVMeDevice(map[string]interface{}{"ns_id": 2}); err == nil {
+		t.Errorf("expected ns_id without target_nqn to be rejected, got %s", device)
+	}
+}
@@ -0,0 +1,92 @@
+/**
+Generic linux block device QoS utilities
+
+Inspired by github.com/openstack/os-brick
+
+*/
+package initiator
+
+import (
+	"fmt"
+	osBrick "github.com/ydcool/os-brick-go"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+//BlkioCgroupPath is the blkio cgroup the QoS limits are applied to, used as
+//is, it's not under SysFSRoot.
+var BlkioCgroupPath = "/sys/fs/cgroup/blkio"
+
+//QoSSpec I/O limits from connection_properties["qos_specs"], 0 means unlimited.
+type QoSSpec struct {
+	ReadIOPSSec   int64
+	WriteIOPSSec  int64
+	ReadBytesSec  int64
+	WriteBytesSec int64
+}
+
+//ParseQoSSpec Parse the qos_specs entry of the connection properties.
+//
+//	Returns nil when qos_specs is absent or null.
+func ParseQoSSpec(connProperties map[string]interface{}) (*QoSSpec, error) {
+	specs, ok := connProperties["qos_specs"]
+	if !ok || specs == nil {
+		return nil, nil
+	}
+	m, ok := specs.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("qos_specs should be a map: %#v", specs)
+	}
+	spec := &QoSSpec{}
+	for key, field := range map[string]*int64{
+		"read_iops_sec":   &spec.ReadIOPSSec,
+		"write_iops_sec":  &spec.WriteIOPSSec,
+		"read_bytes_sec":  &spec.ReadBytesSec,
+		"write_bytes_sec": &spec.WriteBytesSec,
+	} {
+		v, ok := m[key]
+		if !ok {
+			continue
+		}
+		n, err := osBrick.ToInt64(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid qos_specs %s: %#v", key, v)
+		}
+		*field = n
+	}
+	return spec, nil
+}
+
+//ApplyQoSSpec Apply the QoS limits to a block device through the blkio cgroup throttle files.
+func ApplyQoSSpec(device string, spec *QoSSpec) error {
+	if spec == nil {
+		return nil
+	}
+	realPath, err := osBrick.DefaultFS.EvalSymlinks(device)
+	if err != nil {
+		return fmt.Errorf("failed get realpath for path: %s: %v", device, err)
+	}
+	devNum, err := osBrick.DefaultFS.ReadFile(sysfsPath(fmt.Sprintf("/sys/block/%s/dev", filepath.Base(realPath))))
+	if err != nil {
+		return fmt.Errorf("failed read major:minor of %s: %v", realPath, err)
+	}
+	majMin := strings.TrimSpace(string(devNum))
+	for file, limit := range map[string]int64{
+		"blkio.throttle.read_iops_device":  spec.ReadIOPSSec,
+		"blkio.throttle.write_iops_device": spec.WriteIOPSSec,
+		"blkio.throttle.read_bps_device":   spec.ReadBytesSec,
+		"blkio.throttle.write_bps_device":  spec.WriteBytesSec,
+	} {
+		if limit == 0 {
+			continue
+		}
+		path := filepath.Join(BlkioCgroupPath, file)
+		log.Printf("applying qos %s %s %d", file, majMin, limit)
+		if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("%s %d\n", majMin, limit)), 0644); err != nil {
+			return fmt.Errorf("failed write %s: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package initiator
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseQoSSpec(t *testing.T) {
+	spec, err := ParseQoSSpec(map[string]interface{}{
+		"qos_specs": map[string]interface{}{"read_iops_sec": 1000, "write_iops_sec": "500", "write_bytes_sec": 1048576.0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *spec != (QoSSpec{ReadIOPSSec: 1000, WriteIOPSSec: 500, WriteBytesSec: 1048576}) {
+		t.Errorf("unexpected spec: %#v", spec)
+	}
+	if spec, err := ParseQoSSpec(map[string]interface{}{"qos_specs": nil}); spec != nil || err != nil {
+		t.Errorf("expected no spec, got %#v, %v", spec, err)
+	}
+	if _, err := ParseQoSSpec(map[string]interface{}{"qos_specs": map[string]interface{}{"read_iops_sec": "fast"}}); err == nil {
+		t.Error("expected error for invalid read_iops_sec")
+	}
+}
+
+func TestApplyQoSSpec(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "block/dm-2/dev", "253:2\n")
+	dev := filepath.Join(root, "dm-2")
+	writeFakeFile(t, root, "dm-2", "")
+	//the cgroup isn't moved along with the sysfs
+	cgroup := filepath.Join(root, "cgroup")
+	defer func(orig string) { BlkioCgroupPath = orig }(BlkioCgroupPath)
+	BlkioCgroupPath = cgroup
+	writeFakeFile(t, cgroup, "blkio.throttle.read_iops_device", "")
+	writeFakeFile(t, cgroup, "blkio.throttle.write_iops_device", "")
+
+	if err := ApplyQoSSpec(dev, &QoSSpec{ReadIOPSSec: 1000, WriteIOPSSec: 500}); err != nil {
+		t.Fatal(err)
+	}
+	for file, expected := range map[string]string{
+		"blkio.throttle.read_iops_device":  "253:2 1000\n",
+		"blkio.throttle.write_iops_device": "253:2 500\n",
+	} {
+		out, err := ioutil.ReadFile(filepath.Join(cgroup, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != expected {
+			t.Errorf("unexpected %s: %q", file, out)
+		}
+	}
+}
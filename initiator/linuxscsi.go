@@ -9,55 +9,448 @@ Inspired by github.com/openstack/os-brick
 package initiator
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	osBrick "github.com/ydcool/os-brick-go"
+	"io/ioutil"
 	"log"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+//multipathLock serializes multipathd reconfigure and resize map, a
+//reconfigure is global and makes a concurrent resize map fail.
+var multipathLock sync.Mutex
+
+//SysFSRoot is where sysfs is mounted, override it when the host /sys is
+//mounted elsewhere (e.g. containers) or to point at a fake tree in tests.
+var SysFSRoot = "/sys"
+
+//sysfsPath maps an absolute /sys path onto SysFSRoot.
+func sysfsPath(path string) string {
+	return filepath.Join(SysFSRoot, strings.TrimPrefix(path, "/sys"))
+}
+
+//scsiDeleteLock serializes the writes to the sysfs delete of the scsi devices,
+//concurrent deletes of devices of the same host race in the kernel.
+var scsiDeleteLock sync.Mutex
+
 //RemoveSCSIDevice Removes a scsi device based upon /dev/sdX name.
+//
+//	The devices may be flushed concurrently, their removals are serialized.
 func RemoveSCSIDevice(device string, flush bool) error {
-	path := fmt.Sprintf("/sys/block/%s/device/delete", strings.Replace(device, "/dev/", "", 1))
+	return RemoveSCSIDeviceContext(context.Background(), device, flush)
+}
+
+//RemoveSCSIDeviceContext Remove a scsi device like RemoveSCSIDevice, flushing
+//it with the executor of ctx, see osBrick.WithExecutor.
+func RemoveSCSIDeviceContext(ctx context.Context, device string, flush bool) error {
+	path := sysfsPath(fmt.Sprintf("/sys/block/%s/device/delete", strings.Replace(device, "/dev/", "", 1)))
 	if osBrick.IsFileExists(path) {
 		if flush {
-			if err := FlushDeviceIO(device); err != nil {
+			if err := FlushDeviceIOContext(ctx, device); err != nil {
 				return err
 			}
 		}
+		scsiDeleteLock.Lock()
+		defer scsiDeleteLock.Unlock()
 		return EchoSCSICommand(path, "1")
 	}
 	return nil
 }
 
+//CloseCryptHolders Close the dm-crypt devices on top of a device, directly or
+//through a multipath device or a partition, so the device can be removed.
+//
+//	An encrypted volume can't be flushed nor removed while its dm-crypt
+//	mapper is open, the removal fails with device busy.
+func CloseCryptHolders(device string) error {
+	return CloseCryptHoldersContext(context.Background(), device)
+}
+
+//CloseCryptHoldersContext Close the dm-crypt devices like CloseCryptHolders,
+//running cryptsetup with the executor of ctx.
+func CloseCryptHoldersContext(ctx context.Context, device string) error {
+	if realPath, err := osBrick.DefaultFS.EvalSymlinks(device); err == nil {
+		device = realPath
+	}
+	holders, err := osBrick.DefaultFS.Glob(sysfsPath(fmt.Sprintf("/sys/block/%s/holders/*", filepath.Base(device))))
+	if err != nil {
+		return fmt.Errorf("failed list holders of %s: %v", device, err)
+	}
+	for _, h := range holders {
+		holder := filepath.Base(h)
+		uuid, err := osBrick.DefaultFS.ReadFile(sysfsPath(fmt.Sprintf("/sys/block/%s/dm/uuid", holder)))
+		if err != nil || !strings.HasPrefix(string(uuid), "CRYPT-") {
+			//a multipath device or a partition, the mapper may be on top of it
+			if err := CloseCryptHoldersContext(ctx, "/dev/"+holder); err != nil {
+				return err
+			}
+			continue
+		}
+		name, err := osBrick.DefaultFS.ReadFile(sysfsPath(fmt.Sprintf("/sys/block/%s/dm/name", holder)))
+		if err != nil {
+			return fmt.Errorf("failed get the name of dm-crypt device %s of %s: %v", holder, device, err)
+		}
+		mapper := strings.TrimSpace(string(name))
+		if out, err := osBrick.ExecuteContext(ctx, "cryptsetup", "luksClose", mapper); err != nil {
+			return fmt.Errorf("failed close dm-crypt device %s of %s: %s, %v", mapper, device, strings.TrimSpace(out), err)
+		}
+		log.Printf("closed dm-crypt device %s of %s", mapper, device)
+	}
+	return nil
+}
+
+//RemovePath Remove a single path of a volume, e.g. a failed path of a
+//multipath device, leaving the other paths alone.
+//
+//	The path is first removed from its multipath map, multipathd would
+//	add it back otherwise, then flushed if requested and deleted.
+func RemovePath(devicePath string, flush bool) error {
+	device := devicePath
+	if realPath, err := osBrick.DefaultFS.EvalSymlinks(devicePath); err == nil {
+		device = realPath
+	}
+	name := filepath.Base(device)
+	if strings.HasPrefix(name, "dm-") {
+		return fmt.Errorf("%s is a multipath device, not a path", devicePath)
+	}
+	if out, err := executeC("multipathd", "del", "path", name); err != nil || multipathdFailed(out) {
+		//a path multipath doesn't manage isn't in any map
+		log.Printf("failed remove path %s from its multipath map: %s, %v", name, strings.TrimSpace(out), err)
+	} else {
+		log.Printf("removed path %s from its multipath map", name)
+	}
+	return RemoveSCSIDevice("/dev/"+name, flush)
+}
+
+//FlushDrainTimeout is how long FlushDeviceIO waits for the inflight IO of
+//the device to drain after flushing the buffers, 0 doesn't wait.
+var FlushDrainTimeout time.Duration
+
+//FlushDrainInterval is how often the inflight IO is checked while draining.
+var FlushDrainInterval = time.Second
+
+//GetInflightIO Get the number of reads and writes issued to a /dev/sdX device
+//but not completed yet.
+func GetInflightIO(device string) (int, error) {
+	path := sysfsPath(fmt.Sprintf("/sys/block/%s/inflight", filepath.Base(device)))
+	content, err := osBrick.DefaultFS.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed read %s: %v", path, err)
+	}
+	//reads writes
+	fields := strings.Fields(string(content))
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("unexpected inflight %q of device %s", content, device)
+	}
+	inflight := 0
+	for _, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected inflight %q of device %s", content, device)
+		}
+		inflight += n
+	}
+	return inflight, nil
+}
+
+//waitForIODrain Wait until the device has no inflight IO.
+func waitForIODrain(device string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		inflight, err := GetInflightIO(device)
+		if err != nil {
+			return err
+		}
+		if inflight == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("device %s still has %d inflight IO after %v", device, inflight, timeout)
+		}
+		log.Printf("waiting for %d inflight IO of device %s", inflight, device)
+		time.Sleep(FlushDrainInterval)
+	}
+}
+
+//FlushRetryAttempts is how many times FlushDeviceIO runs blockdev --flushbufs,
+//waiting FlushRetryInterval before the first retry and FlushRetryBackoff
+//times longer before each next one, e.g. 20 then 40 seconds. No retry is
+//started past FlushRetryMaxElapsed since the first attempt, 0 means no limit.
+var (
+	FlushRetryAttempts   = 3
+	FlushRetryInterval   = 20 * time.Second
+	FlushRetryBackoff    = 2.0
+	FlushRetryMaxElapsed time.Duration
+)
+
+//flushRetrySleep is replaced in tests to record the retry intervals.
+var flushRetrySleep = time.Sleep
+
 //FlushDeviceIO This is used to flush any remaining IO in the buffers.
+//
+//	When FlushDrainTimeout is set, also wait for the writeback to complete
+//	since flushbufs may return before it does.
 func FlushDeviceIO(device string) error {
+	return FlushDeviceIOContext(context.Background(), device)
+}
+
+//FlushDeviceIOContext Flush a device like FlushDeviceIO, running blockdev with
+//the executor of ctx.
+//
+//	The flush isn't cut short when ctx is done, only by its own timeout.
+func FlushDeviceIOContext(ctx context.Context, device string) error {
 	if osBrick.IsFileExists(device) {
 		//NOTE(geguileo): With 30% connection error rates flush can get
 		//stuck, set timeout to prevent it from hanging here forever.
-		//Retry twice after 20 and 40 seconds.
-		osBrick.RunWithRetry(3, time.Second*10, func(_ int) bool {
-			out, err := osBrick.ExecWithTimeout(time.Minute*3, "blockdev", "--flushbufs", device)
-			if err != nil {
-				log.Printf("failed execute blockdev --flushbufs %s: %s, ERROR: %v", device, out, err)
-				return false
+		//Retry with an increasing interval so a flaky path can recover.
+		start := time.Now()
+		interval := FlushRetryInterval
+		for try := 1; ; try++ {
+			out, err := osBrick.ExecWithTimeoutContext(ctx, time.Minute*3, "blockdev", "--flushbufs", device)
+			if err == nil {
+				log.Printf("execute blockdev --flushbufs %s: %s", device, out)
+				break
 			}
-			log.Printf("execute blockdev --flushbufs %s: %s", device, out)
-			return true
-		})
+			log.Printf("failed execute blockdev --flushbufs %s: %s, ERROR: %v", device, out, err)
+			if try >= FlushRetryAttempts {
+				log.Printf("giving up flushing %s after %d attempts", device, try)
+				break
+			}
+			if FlushRetryMaxElapsed > 0 && time.Since(start)+interval > FlushRetryMaxElapsed {
+				log.Printf("giving up flushing %s, retrying in %v would exceed %v", device, interval, FlushRetryMaxElapsed)
+				break
+			}
+			flushRetrySleep(interval)
+			interval = time.Duration(float64(interval) * FlushRetryBackoff)
+		}
+		if FlushDrainTimeout > 0 {
+			return waitForIODrain(device, FlushDrainTimeout)
+		}
 	}
 	return nil
 }
 
+//SCSIWWNAttempts is how many times WaitForSCSIWWN runs scsi_id for the WWN of
+//a freshly scanned device, which may still be settling, SCSIWWNRetryInterval
+//apart.
+var (
+	SCSIWWNAttempts      = 3
+	SCSIWWNRetryInterval = time.Second
+)
+
 //Read the WWN from page 0x83 value for a SCSI device.
 func GetSCSIWWN(path string) (string, error) {
-	out, err := osBrick.Execute("/lib/udev/scsi_id", "--page", "0x83", "--whitelisted", path)
+	return GetSCSIWWNContext(context.Background(), path)
+}
+
+//GetSCSIWWNContext Read the WWN like GetSCSIWWN, with the executor of ctx.
+func GetSCSIWWNContext(ctx context.Context, path string) (string, error) {
+	out, err := osBrick.ExecuteContext(ctx, "/lib/udev/scsi_id", "--page", "0x83", "--whitelisted", path)
+	return strings.TrimSpace(out), err
+}
+
+//WaitForSCSIWWN Read the WWN of a freshly scanned SCSI device like GetSCSIWWN.
+//
+//	An empty WWN or a failure is retried, the result of the last attempt
+//	is returned when they're exhausted.
+func WaitForSCSIWWN(path string) (string, error) {
+	return WaitForSCSIWWNContext(context.Background(), path)
+}
+
+//WaitForSCSIWWNContext Wait for the WWN like WaitForSCSIWWN, running scsi_id
+//with the executor of ctx.
+func WaitForSCSIWWNContext(ctx context.Context, path string) (string, error) {
+	var (
+		wwn string
+		err error
+	)
+	osBrick.RunWithRetry(SCSIWWNAttempts, SCSIWWNRetryInterval, func(try int) bool {
+		wwn, err = GetSCSIWWNContext(ctx, path)
+		if err == nil && wwn != "" {
+			return true
+		}
+		log.Printf("no scsi wwn for %s on attempt %d: %v", path, try, err)
+		return false
+	})
+	return wwn, err
+}
+
+//SCSIWWNConcurrency is how many scsi_id GetSCSIWWNs runs at once.
+var SCSIWWNConcurrency = 8
+
+//GetSCSIWWNs Read the WWNs of many paths concurrently.
+//
+//	Returns the WWN by path, the paths which failed are missing from the
+//	result. An error is only returned when none of the paths succeeded.
+func GetSCSIWWNs(paths []string) (map[string]string, error) {
+	return GetSCSIWWNsContext(context.Background(), paths)
+}
+
+//GetSCSIWWNsContext Read the WWNs like GetSCSIWWNs, with the executor of ctx.
+func GetSCSIWWNsContext(ctx context.Context, paths []string) (map[string]string, error) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		lastErr error
+	)
+	wwns := make(map[string]string, len(paths))
+	sem := make(chan struct{}, SCSIWWNConcurrency)
+	for _, path := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(path string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			wwn, err := GetSCSIWWNContext(ctx, path)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil || wwn == "" {
+				log.Printf("failed get scsi wwn for path %s, ERROR: %v", path, err)
+				lastErr = fmt.Errorf("failed get scsi wwn for path %s: %v", path, err)
+				return
+			}
+			wwns[path] = wwn
+		}(path)
+	}
+	wg.Wait()
+	if len(paths) > 0 && len(wwns) == 0 {
+		return wwns, lastErr
+	}
+	return wwns, nil
+}
+
+//WWNCache Remembers the WWN of the devices seen during a single connect or
+//disconnect, so scsi_id runs once per device.
+//
+//	Devices are keyed by realpath, so the by-path links and the /dev/sdX
+//	of a device share an entry. Don't keep a cache across operations,
+//	device names are reused once a volume is gone.
+type WWNCache struct {
+	mu   sync.Mutex
+	wwns map[string]string
+}
+
+//NewWWNCache Create an empty cache for a single operation.
+func NewWWNCache() *WWNCache {
+	return &WWNCache{wwns: make(map[string]string)}
+}
+
+//GetSCSIWWN Same as GetSCSIWWN, failures aren't cached.
+func (c *WWNCache) GetSCSIWWN(path string) (string, error) {
+	key, err := osBrick.DefaultFS.EvalSymlinks(path)
+	if err != nil {
+		key = path
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if wwn, ok := c.wwns[key]; ok {
+		return wwn, nil
+	}
+	wwn, err := GetSCSIWWN(path)
+	if err != nil {
+		return wwn, err
+	}
+	c.wwns[key] = wwn
+	return wwn, nil
+}
+
+//GetSCSISerial Read the serial from page 0x80 value for a SCSI device.
+func GetSCSISerial(path string) (string, error) {
+	return GetSCSISerialContext(context.Background(), path)
+}
+
+//GetSCSISerialContext Read the serial like GetSCSISerial, with the executor of ctx.
+func GetSCSISerialContext(ctx context.Context, path string) (string, error) {
+	out, err := osBrick.ExecuteContext(ctx, "/lib/udev/scsi_id", "--page", "0x80", "--whitelisted", path)
 	return strings.TrimSpace(out), err
 }
 
+//ErrNoSCSIID is returned by GetSCSIID when scsi_id reports no identifier on
+//any page, e.g. for some passthrough devices.
+var ErrNoSCSIID = errors.New("no scsi id found")
+
+//GetSCSIID Read the identifier of a SCSI device.
+//
+//	The WWN from page 0x83 is preferred, some older or virtual devices only
+//	expose a serial on page 0x80 which is used as a fallback and tagged as
+//	such so it isn't mistaken for a multipath WWID.
+func GetSCSIID(path string) (SCSIID, error) {
+	return getSCSIID(context.Background(), path, GetSCSIWWNContext)
+}
+
+//WaitForSCSIID Read the identifier of a freshly scanned SCSI device like
+//GetSCSIID, the WWN is waited for with WaitForSCSIWWN before falling back.
+func WaitForSCSIID(path string) (SCSIID, error) {
+	return WaitForSCSIIDContext(context.Background(), path)
+}
+
+//WaitForSCSIIDContext Read the identifier like WaitForSCSIID, running scsi_id
+//with the executor of ctx.
+func WaitForSCSIIDContext(ctx context.Context, path string) (SCSIID, error) {
+	return getSCSIID(ctx, path, WaitForSCSIWWNContext)
+}
+
+func getSCSIID(ctx context.Context, path string, getSCSIWWN func(context.Context, string) (string, error)) (SCSIID, error) {
+	wwn, err := getSCSIWWN(ctx, path)
+	if err == nil && wwn != "" {
+		return SCSIID{ID: wwn, Type: SCSIIDTypeWWN}, nil
+	}
+	log.Printf("no wwn on page 0x83 for %s (%v), falling back to serial on page 0x80", path, err)
+	serial, err := GetSCSISerialContext(ctx, path)
+	if err != nil {
+		return SCSIID{}, fmt.Errorf("failed get scsi id for path %s: %v", path, err)
+	}
+	if serial == "" {
+		return SCSIID{}, fmt.Errorf("%w on page 0x83 or 0x80 for path %s", ErrNoSCSIID, path)
+	}
+	return SCSIID{ID: serial, Type: SCSIIDTypeSerial}, nil
+}
+
+//GetMultipathDeviceForPath Find the multipath map owning a /dev/sdX device.
+//
+//	The holders of the device in sysfs are checked for a dm-multipath map,
+//	returns empty wwn and mpath when the device is not part of any map.
+func GetMultipathDeviceForPath(devicePath string) (string, string, error) {
+	dev := filepath.Base(devicePath)
+	holdersPath := sysfsPath(fmt.Sprintf("/sys/block/%s/holders", dev))
+	holders, err := osBrick.DefaultFS.ReadDir(holdersPath)
+	if err != nil {
+		return "", "", fmt.Errorf("failed read holders of %s: %v", devicePath, err)
+	}
+	for _, h := range holders {
+		if !strings.HasPrefix(h.Name(), "dm-") {
+			continue
+		}
+		uuid, err := osBrick.DefaultFS.ReadFile(sysfsPath(fmt.Sprintf("/sys/block/%s/dm/uuid", h.Name())))
+		if err != nil {
+			log.Printf("failed read dm uuid of holder %s for %s: %v", h.Name(), devicePath, err)
+			continue
+		}
+		//multipath maps have an uuid in the format of mpath-<WWN>
+		wwn := strings.TrimSpace(string(uuid))
+		if !strings.HasPrefix(wwn, "mpath-") {
+			continue
+		}
+		wwn = strings.TrimPrefix(wwn, "mpath-")
+		mpath := "/dev/" + h.Name()
+		if name, err := osBrick.DefaultFS.ReadFile(sysfsPath(fmt.Sprintf("/sys/block/%s/dm/name", h.Name()))); err == nil {
+			mpath = "/dev/mapper/" + strings.TrimSpace(string(name))
+		}
+		return wwn, mpath, nil
+	}
+	return "", "", nil
+}
+
 //Look for the multipath device file for a volume WWN.
 //
 //	Multipath devices can show up in several places on
@@ -74,21 +467,88 @@ func GetSCSIWWN(path string) (string, error) {
 //	    /dev/disk/by-id/dm-uuid-mpath-<WWN>
 //	    /dev/disk/by-id/scsi-<WWN>
 //	    /dev/mapper/<WWN>
+//
+//	3) When an alias is set in multipath.conf:
+//	    /dev/mapper/<alias>
 func FindMultipathDevicePath(deviceWwn string) (string, error) {
-	//First look for the common path
-	path := "/dev/disk/by-id/dm-uuid-mpath-" + deviceWwn
-	if WaitForPath(path) {
-		return path, nil
+	return FindMultipathDevicePathContext(context.Background(), deviceWwn)
+}
+
+//FindMultipathDevicePathContext Find the multipath device path like
+//FindMultipathDevicePath, asking multipathd with the executor of ctx.
+func FindMultipathDevicePathContext(ctx context.Context, deviceWwn string) (string, error) {
+	//First look for the common path, for some reason the common path
+	//may not be found, then the dev mapper path
+	for _, path := range multipathDevicePaths(deviceWwn) {
+		if WaitForPath(path) {
+			return path, nil
+		}
 	}
-	//for some reason the common path wasn't found
-	//lets try the dev mapper path
-	path = "/dev/mapper/" + deviceWwn
-	if WaitForPath(path) {
+	//the map may be named after an alias of multipath.conf
+	if path, ok := multipathAliasPath(ctx, deviceWwn); ok && WaitForPath(path) {
 		return path, nil
 	}
 	return "", fmt.Errorf("couldn't find a valid multipath device path for %s", deviceWwn)
 }
 
+//multipathDevicePaths The paths the multipath device of a WWN shows up at
+//whatever the friendly names setting, in the order to look at them.
+func multipathDevicePaths(deviceWwn string) []string {
+	return []string{"/dev/disk/by-id/dm-uuid-mpath-" + deviceWwn, "/dev/mapper/" + deviceWwn}
+}
+
+//multipathAliasPath The /dev/mapper path of the multipath device of a WWN
+//when multipath.conf sets an alias for it, ok is false when there is none.
+func multipathAliasPath(ctx context.Context, deviceWwn string) (string, bool) {
+	alias, err := GetMultipathAliasContext(ctx, deviceWwn)
+	if err != nil {
+		log.Printf("failed get multipath alias of %s: %v", deviceWwn, err)
+		return "", false
+	}
+	if alias == deviceWwn {
+		return "", false
+	}
+	return "/dev/mapper/" + alias, true
+}
+
+//WaitForMultipathDevice Wait up to timeout for the multipath device of a WWN
+//to show up, at the paths FindMultipathDevicePath looks at.
+//
+//	The paths are checked together every PathWaitInterval, unlike
+//	FindMultipathDevicePath which waits PathWaitAttempts for each in turn.
+func WaitForMultipathDevice(deviceWwn string, timeout time.Duration) (string, error) {
+	return WaitForMultipathDeviceContext(context.Background(), deviceWwn, timeout)
+}
+
+//WaitForMultipathDeviceContext Wait for the multipath device like
+//WaitForMultipathDevice, asking multipathd with the executor of ctx.
+func WaitForMultipathDeviceContext(ctx context.Context, deviceWwn string, timeout time.Duration) (string, error) {
+	exists := func(path string) bool {
+		_, err := osBrick.DefaultFS.Stat(path)
+		return err == nil
+	}
+	found := ""
+	attempts := int(timeout/PathWaitInterval) + 1
+	osBrick.RunWithRetry(attempts, PathWaitInterval, func(_ int) bool {
+		for _, path := range multipathDevicePaths(deviceWwn) {
+			if exists(path) {
+				found = path
+				return true
+			}
+		}
+		//the alias is only known once the map is assembled
+		if path, ok := multipathAliasPath(ctx, deviceWwn); ok && exists(path) {
+			found = path
+			return true
+		}
+		return false
+	})
+	if found == "" {
+		return "", fmt.Errorf("couldn't find a valid multipath device path for %s within %v", deviceWwn, timeout)
+	}
+	return found, nil
+}
+
 //Discover multipath devices for a mpath device.
 //
 //	This uses the slow multipath -l command to find a
@@ -96,6 +556,12 @@ func FindMultipathDevicePath(deviceWwn string) (string, error) {
 //	the output to discover the multipath device name
 //	and it's devices.
 func FindMultipathDevice(deviceName string) (map[string]interface{}, error) {
+	return FindMultipathDeviceContext(context.Background(), deviceName)
+}
+
+//FindMultipathDeviceContext Discover the multipath device like
+//FindMultipathDevice, running multipath -l with the executor of ctx.
+func FindMultipathDeviceContext(ctx context.Context, deviceName string) (map[string]interface{}, error) {
 	var (
 		mDev     string
 		mDevID   string
@@ -104,7 +570,7 @@ func FindMultipathDevice(deviceName string) (map[string]interface{}, error) {
 		out      string
 		err      error
 	)
-	out, err = osBrick.Execute("multipath", "-l", deviceName)
+	out, err = executeCContext(ctx, "multipath", "-l", deviceName)
 	if err != nil {
 		return nil, err
 	}
@@ -133,16 +599,22 @@ func FindMultipathDevice(deviceName string) (map[string]interface{}, error) {
 				return nil, fmt.Errorf("couldn't find multipath device %s", mDev)
 			}
 
-			reg, err = regexp.Compile(MultipathWWIDRegex)
-			if err != nil {
-				return nil, err
-			}
-
-			wwidSearch := reg.FindStringSubmatch(newLines[0])
-			if len(wwidSearch) > 0 {
-				mDevID = wwidSearch[1]
+			//the dm uuid is reliable whatever the multipath config,
+			//the output may not show the wwid with friendly names on
+			if wwn, err := GetMultipathWWN(mDev); err == nil {
+				mDevID = wwn
 			} else {
-				mDevID = mDevName
+				log.Printf("failed get wwid of %s from sysfs, parsing multipath output: %v", mDev, err)
+				reg, err = regexp.Compile(MultipathWWIDRegex)
+				if err != nil {
+					return nil, err
+				}
+				wwidSearch := reg.FindStringSubmatch(newLines[0])
+				if len(wwidSearch) > 0 {
+					mDevID = wwidSearch[1]
+				} else {
+					mDevID = mDevName
+				}
 			}
 			deviceLines := newLines[3:]
 			for _, l := range deviceLines {
@@ -159,6 +631,10 @@ func FindMultipathDevice(deviceName string) (map[string]interface{}, error) {
 					"id":      address[2],
 					"lun":     address[3],
 				}
+				//the dm status of the path, active or failed
+				if len(devInfo) > 3 {
+					dev["dm_status"] = devInfo[3]
+				}
 				devices = append(devices, dev)
 			}
 		}
@@ -176,53 +652,193 @@ func FindMultipathDevice(deviceName string) (map[string]interface{}, error) {
 	return nil, nil
 }
 
+//PathWaitAttempts is how many times WaitForPath checks for a path,
+//PathWaitInterval apart.
+var (
+	PathWaitAttempts = 3
+	PathWaitInterval = time.Second
+)
+
 //Wait for a path to show up.
 func WaitForPath(path string) bool {
 	if osBrick.IsFileExists(path) {
 		return true
 	}
-	return osBrick.RunWithRetry(3, time.Second, func(_ int) bool {
+	return osBrick.RunWithRetry(PathWaitAttempts, PathWaitInterval, func(_ int) bool {
 		return osBrick.IsFileExists(path)
 	})
 }
 
+//ErrDeviceReadOnly is returned by WaitForRW when a device stays read-only,
+//e.g. the backend exported the LUN read-only.
+var ErrDeviceReadOnly = errors.New("device is read-only")
+
+//RWWaitAttempts is how many times WaitForRW checks a device is read-write,
+//RWWaitInterval apart, reloading the multipath maps in between.
+var (
+	RWWaitAttempts = 5
+	RWWaitInterval = time.Second
+)
+
 //WaitForRW Wait for block device to be Read-Write.
+//
+//	Multipath devices sometimes show up as read only initially and need
+//	additional time/rescans to get to RW, an ErrDeviceReadOnly is returned
+//	when the device is still read-only after RWWaitAttempts.
 func WaitForRW(deviceWwn string, devicePath string) error {
+	return WaitForRWContext(context.Background(), deviceWwn, devicePath)
+}
+
+//WaitForRWContext Wait for the block device to be read-write like WaitForRW,
+//running lsblk and multipath with the executor of ctx.
+func WaitForRWContext(ctx context.Context, deviceWwn string, devicePath string) error {
 	log.Printf("checking to see if %s is read-only", devicePath)
-	out, err := osBrick.Execute("lsblk", "-o", "NAME,RO", "-l", "-n")
+	var err error
+	rw := osBrick.RunWithRetry(RWWaitAttempts, RWWaitInterval, func(try int) bool {
+		var blkdevs []BlockDevice
+		if blkdevs, err = lsblk(ctx); err != nil {
+			return false
+		}
+		//We must validate that all pieces of the dm-# device are rw,
+		//if some are still ro it can cause problems.
+		ro := false
+		walkBlockDevices(blkdevs, func(d BlockDevice) {
+			ro = ro || (strings.Contains(d.Name, deviceWwn) && d.ReadOnly)
+		})
+		if ro {
+			log.Printf("block device %s is read-only on attempt %d", devicePath, try)
+			if out, err := multipathReload(ctx); err != nil {
+				log.Printf("failed execute multipath -r: %s, %v", out, err)
+			}
+			return false
+		}
+		return true
+	})
+	if rw {
+		log.Printf("Block device %s is not read-only.", devicePath)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	blkdevs := strings.Split(out, "\n")
-	for _, l := range blkdevs {
-		//Entries might look like:
-		//
-		//   "3624a93709a738ed78583fd120013902b (dm-1)  1"
-		//
-		// or
-		//
-		//   "sdd                                       0"
-		//
-		// We are looking for the first and last part of them. For FC
-		// multipath devices the name is in the format of '<WWN> (dm-<ID>)'
-		blkdevParts := strings.Split(l, " ")
-		ro := blkdevParts[len(blkdevParts)-1]
-		name := blkdevParts[0]
+	return fmt.Errorf("%w: %s still read-only after %d attempts", ErrDeviceReadOnly, devicePath, RWWaitAttempts)
+}
 
-		//We must validate that all pieces of the dm-# device are rw,
-		//if some are still ro it can cause problems.
-		roi, err := strconv.Atoi(ro)
+//GetBlockDevices Get the tree of the block devices of the host from lsblk.
+func GetBlockDevices() ([]BlockDevice, error) {
+	return lsblk(context.Background())
+}
+
+//lsblkDevice A device of the lsblk JSON output.
+//
+//	util-linux before 2.33 reports every column as a string, e.g. "ro": "0"
+//	and "size": "10737418240", later versions use booleans and numbers.
+type lsblkDevice struct {
+	Name       string        `json:"name"`
+	KName      string        `json:"kname"`
+	Type       string        `json:"type"`
+	RO         interface{}   `json:"ro"`
+	MountPoint string        `json:"mountpoint"`
+	Size       interface{}   `json:"size"`
+	Children   []lsblkDevice `json:"children"`
+}
+
+//lsblk Run lsblk -J with args and get the devices reported.
+func lsblk(ctx context.Context, args ...string) ([]BlockDevice, error) {
+	cmdArgs := append([]string{"-J", "-O", "-b"}, args...)
+	out, err := executeCContext(ctx, "lsblk", cmdArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed execute lsblk %s: %s, %v", strings.Join(cmdArgs, " "), out, err)
+	}
+	var output struct {
+		BlockDevices []lsblkDevice `json:"blockdevices"`
+	}
+	if err = json.Unmarshal([]byte(out), &output); err != nil {
+		return nil, fmt.Errorf("unexpected lsblk output %q: %v", out, err)
+	}
+	return toBlockDevices(output.BlockDevices)
+}
+
+func toBlockDevices(devices []lsblkDevice) ([]BlockDevice, error) {
+	blkdevs := make([]BlockDevice, 0, len(devices))
+	for _, d := range devices {
+		blkdev := BlockDevice{Name: d.Name, KName: d.KName, Type: d.Type, MountPoint: d.MountPoint}
+		switch ro := d.RO.(type) {
+		case bool:
+			blkdev.ReadOnly = ro
+		case string:
+			blkdev.ReadOnly = ro == "1"
+		case nil:
+		default:
+			return nil, fmt.Errorf("unexpected lsblk ro %#v of %s", d.RO, d.Name)
+		}
+		if d.Size != nil {
+			size, err := osBrick.ToInt64(d.Size)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected lsblk size of %s: %v", d.Name, err)
+			}
+			blkdev.Size = size
+		}
+		children, err := toBlockDevices(d.Children)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if strings.Contains(name, deviceWwn) && roi == 1 {
-			log.Printf("block device %s is read-only", devicePath)
-			_, err := osBrick.Execute("multipath", "-r")
-			return err
+		if len(children) > 0 {
+			blkdev.Children = children
 		}
+		blkdevs = append(blkdevs, blkdev)
 	}
-	log.Printf("Block device %s is not read-only.", devicePath)
-	return nil
+	return blkdevs, nil
+}
+
+//walkBlockDevices Call fn for each device of the trees, parents first.
+func walkBlockDevices(blkdevs []BlockDevice, fn func(BlockDevice)) {
+	for _, d := range blkdevs {
+		fn(d)
+		walkBlockDevices(d.Children, fn)
+	}
+}
+
+//GetBlockDevicesRO Get the read-only state of all block devices by name.
+//
+//	A multipath device is a child of each of its paths, it is read-only
+//	when it is on any of them.
+func GetBlockDevicesRO() (map[string]bool, error) {
+	blkdevs, err := GetBlockDevices()
+	if err != nil {
+		return nil, err
+	}
+	ro := make(map[string]bool)
+	walkBlockDevices(blkdevs, func(d BlockDevice) {
+		ro[d.Name] = ro[d.Name] || d.ReadOnly
+	})
+	return ro, nil
+}
+
+//IsDeviceReadOnly Whether the block device, e.g. /dev/sdb or /dev/dm-0, is read-only.
+//
+//	The device is matched by its kernel name in the lsblk tree, a
+//	multipath device is read-only when it is on any of its paths.
+func IsDeviceReadOnly(device string) (bool, error) {
+	realpath, err := osBrick.DefaultFS.EvalSymlinks(device)
+	if err != nil {
+		return false, fmt.Errorf("failed get realpath of %s: %v", device, err)
+	}
+	kname := filepath.Base(realpath)
+	blkdevs, err := GetBlockDevices()
+	if err != nil {
+		return false, err
+	}
+	found, ro := false, false
+	walkBlockDevices(blkdevs, func(d BlockDevice) {
+		if d.KName == kname || (d.KName == "" && d.Name == kname) {
+			found, ro = true, ro || d.ReadOnly
+		}
+	})
+	if !found {
+		return false, fmt.Errorf("block device %s not found in lsblk output", device)
+	}
+	return ro, nil
 }
 
 func ProcessLunID(lunIDs interface{}) (interface{}, error) {
@@ -254,53 +870,374 @@ func formatLunID(x interface{}) (interface{}, error) {
 			return fmt.Sprintf("0x%04x%04x00000000", lunID&0xffff, lunID>>16&0xffff), nil
 		}
 	} else if s, ok := x.(string); ok {
-		i, err := strconv.Atoi(s)
+		//some backends send hex luns like 0x1
+		i, err := osBrick.ParseInt(s)
 		if err != nil {
 			return nil, fmt.Errorf("lun_id cannot convert to int: %s", s)
 		}
-		return i, nil
+		return formatLunID(int(i))
 	}
 	return nil, fmt.Errorf("lun_id should be int value: %#v", x)
 }
 
-//Used to echo strings to scsi subsystem.
-func EchoSCSICommand(path, content string) error {
-	//out, err := Execute("tee", "-a", path, content)
-	cmd := fmt.Sprintf(`echo '%s' > %s`, content, path)
-	_, err := osBrick.Execute("sh", "-c", cmd)
-	return err
-}
-
-//Translates /dev/disk/by-path/ entry to /dev/sdX.
-func GetNameFromPath(path string) string {
-	name, err := filepath.EvalSymlinks(path)
+//GetHCTL Get the SCSI address of a /dev/sdX device from sysfs.
+//
+//	/sys/block/sdX/device links to the scsi device directory, which is
+//	named after the host:channel:target:lun of the device.
+func GetHCTL(device string) (HCTL, error) {
+	path := sysfsPath(fmt.Sprintf("/sys/block/%s/device", filepath.Base(device)))
+	realPath, err := osBrick.DefaultFS.EvalSymlinks(path)
 	if err != nil {
-		log.Printf("failed get realpath for path: %s, ERROR: %v", path, err)
-		return ""
+		return HCTL{}, fmt.Errorf("failed get realpath for path: %s: %v", path, err)
 	}
-	if strings.HasPrefix(name, "/dev/") {
-		return name
-	} else {
-		return ""
+	address := strings.Split(filepath.Base(realPath), ":")
+	if len(address) != 4 {
+		return HCTL{}, fmt.Errorf("unexpected scsi address %s for device %s", filepath.Base(realPath), device)
 	}
+	return HCTL{Host: address[0], Channel: address[1], Target: address[2], Lun: address[3]}, nil
 }
 
-func FlushMultipathDevice(wwn string) {
-	log.Printf("flush multipath device %s", wwn)
-	//NOTE(geguileo): With 30% connection error rates flush can get stuck,
-	//set timeout to prevent it from hanging here forever.  Retry twice
-	//after 20 and 40 seconds.
-	osBrick.RunWithRetry(3, time.Second*10, func(_ int) bool {
-		out, err := osBrick.ExecWithTimeout(time.Minute*3, "multipath", "-f", wwn)
-		log.Printf("exec multipath -f %s: %s", wwn, out)
-		return err == nil
-	})
+//GetDeviceType Tell what kind of block device a device path is.
+//
+//	The namespace heads of native NVMe multipath are told apart from
+//	plain namespaces by their sysfs device, which is the nvme subsystem
+//	rather than a controller.
+func GetDeviceType(device string) (DeviceType, error) {
+	if realPath, err := osBrick.DefaultFS.EvalSymlinks(device); err == nil {
+		device = realPath
+	}
+	name := filepath.Base(device)
+	switch {
+	case strings.HasPrefix(name, "sd"):
+		return DeviceTypeSCSI, nil
+	case strings.HasPrefix(name, "dm-"):
+		return DeviceTypeDM, nil
+	case strings.HasPrefix(name, "nvme"):
+		path := sysfsPath(fmt.Sprintf("/sys/block/%s/device", name))
+		realPath, err := osBrick.DefaultFS.EvalSymlinks(path)
+		if err != nil {
+			return DeviceTypeUnknown, fmt.Errorf("failed get realpath for path: %s: %v", path, err)
+		}
+		if strings.HasPrefix(filepath.Base(realPath), "nvme-subsys") {
+			return DeviceTypeNVMeMultipath, nil
+		}
+		return DeviceTypeNVMe, nil
+	}
+	return DeviceTypeUnknown, nil
 }
 
-func GetDeviceInfo(device string) (map[string]string, error) {
-	out, err := osBrick.Execute("sg_scan", device)
-	log.Printf("exec sg_scan %s: %s", device, out)
-	if err != nil {
+//GetDeviceKind Tell whether a device is a whole disk, a partition or a
+//dm-multipath map, from sysfs.
+//
+//	Partitions of multipath maps created by kpartx are dm devices too,
+//	their dm uuid starts with part<N>- instead of mpath-.
+func GetDeviceKind(device string) (string, error) {
+	if realPath, err := osBrick.DefaultFS.EvalSymlinks(device); err == nil {
+		device = realPath
+	}
+	path := sysfsPath("/sys/class/block/" + filepath.Base(device))
+	if _, err := osBrick.DefaultFS.Stat(path); err != nil {
+		return "", fmt.Errorf("device %s not found in sysfs: %v", device, err)
+	}
+	if uuid, err := osBrick.DefaultFS.ReadFile(filepath.Join(path, "dm/uuid")); err == nil {
+		switch {
+		case strings.HasPrefix(string(uuid), "mpath-"):
+			return DeviceKindMultipath, nil
+		case strings.HasPrefix(string(uuid), "part"):
+			return DeviceKindPartition, nil
+		}
+		return DeviceKindDisk, nil
+	}
+	if _, err := osBrick.DefaultFS.Stat(filepath.Join(path, "partition")); err == nil {
+		return DeviceKindPartition, nil
+	}
+	return DeviceKindDisk, nil
+}
+
+//ResolveBlockDevice Resolve a symlink like /dev/disk/by-path/xxx to the block device it points to.
+//
+//	by-path links may outlive the device they point to, so the device
+//	must both exist under /dev and still be known to the kernel in sysfs.
+func ResolveBlockDevice(path string) (string, error) {
+	realPath, err := osBrick.DefaultFS.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("failed get realpath for path: %s: %v", path, err)
+	}
+	name := filepath.Base(realPath)
+	if _, err := osBrick.DefaultFS.Stat(sysfsPath("/sys/block/" + name)); err != nil {
+		return "", fmt.Errorf("device %s of path %s is not a block device: %v", realPath, path, err)
+	}
+	return realPath, nil
+}
+
+//RescanSCSIDevice Make the kernel read the capacity of a scsi device again,
+//writing 1 to /sys/bus/scsi/devices/<HCTL>/rescan.
+func RescanSCSIDevice(hctl HCTL) error {
+	path := sysfsPath(fmt.Sprintf("/sys/bus/scsi/devices/%s:%s:%s:%s/rescan", hctl.Host, hctl.Channel, hctl.Target, hctl.Lun))
+	log.Printf("rescanning scsi device %s", path)
+	return EchoSCSICommand(path, "1")
+}
+
+//RescanHCTL Do a narrow scan of a single channel, target and lun on a scsi host.
+//
+//	It finds new devices, an existing device is rescanned with
+//	RescanSCSIDevice instead.
+func RescanHCTL(host, channel, target, lun string) error {
+	path := sysfsPath(fmt.Sprintf("/sys/class/scsi_host/host%s/scan", host))
+	log.Printf("scanning host:%s, c:%s, t:%s, l:%s", host, channel, target, lun)
+	return EchoSCSICommand(path, fmt.Sprintf("%s %s %s", channel, target, lun))
+}
+
+//ScanAllSCSIHosts Do a wildcard scan, "- - -", of every scsi host.
+//
+//	Unlike RescanHosts it's not limited to the FC hosts nor the targets of
+//	a volume, e.g. for SAS or other SCSI volumes. All the hosts are scanned
+//	even when some fail, their errors are returned together.
+func ScanAllSCSIHosts() error {
+	hosts, err := osBrick.DefaultFS.Glob(sysfsPath("/sys/class/scsi_host/host*"))
+	if err != nil {
+		return fmt.Errorf("failed list scsi hosts: %v", err)
+	}
+	if len(hosts) == 0 {
+		log.Printf("no scsi host to scan")
+		return nil
+	}
+	errs := make([]string, 0)
+	for _, host := range hosts {
+		if err := scanSCSIHost(filepath.Base(host), [][]string{{"-", "-", "-"}}); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed scan scsi hosts: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+//GetSCSIQueueDepth Get the queue depth of a /dev/sdX device.
+func GetSCSIQueueDepth(device string) (int, error) {
+	hctl, err := GetHCTL(device)
+	if err != nil {
+		return 0, err
+	}
+	return readSCSIDeviceInt(hctl, "queue_depth")
+}
+
+//SetSCSIQueueDepth Set the queue depth of a /dev/sdX device.
+//
+//	The depth is checked against the queue_depth_max advertised by the
+//	device when there's one.
+func SetSCSIQueueDepth(device string, depth int) error {
+	if depth < 1 {
+		return fmt.Errorf("invalid queue depth %d for %s", depth, device)
+	}
+	hctl, err := GetHCTL(device)
+	if err != nil {
+		return err
+	}
+	if max, err := readSCSIDeviceInt(hctl, "queue_depth_max"); err == nil && depth > max {
+		return fmt.Errorf("queue depth %d for %s is over the maximum %d", depth, device, max)
+	}
+	path := sysfsPath(fmt.Sprintf("/sys/bus/scsi/devices/%s:%s:%s:%s/queue_depth", hctl.Host, hctl.Channel, hctl.Target, hctl.Lun))
+	log.Printf("setting queue depth of %s to %d", device, depth)
+	return EchoSCSICommand(path, strconv.Itoa(depth))
+}
+
+//getIOSchedulers Get the scheduler of a device and the ones available to it.
+func getIOSchedulers(device string) (string, []string, error) {
+	path := sysfsPath(fmt.Sprintf("/sys/block/%s/queue/scheduler", filepath.Base(device)))
+	out, err := osBrick.DefaultFS.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed read %s: %v", path, err)
+	}
+	//mq-deadline kyber [bfq] none
+	current := ""
+	available := make([]string, 0)
+	for _, sched := range strings.Fields(string(out)) {
+		if strings.HasPrefix(sched, "[") {
+			sched = strings.Trim(sched, "[]")
+			current = sched
+		}
+		available = append(available, sched)
+	}
+	if current == "" && len(available) == 1 {
+		current = available[0]
+	}
+	return current, available, nil
+}
+
+//GetIOScheduler Get the IO scheduler of a device, e.g. none or mq-deadline.
+func GetIOScheduler(device string) (string, error) {
+	current, _, err := getIOSchedulers(device)
+	return current, err
+}
+
+//SetIOScheduler Set the IO scheduler of a device, it has to be one of the
+//schedulers available to the device.
+func SetIOScheduler(device, sched string) error {
+	current, available, err := getIOSchedulers(device)
+	if err != nil {
+		return err
+	}
+	if current == sched {
+		return nil
+	}
+	for _, s := range available {
+		if s == sched {
+			path := sysfsPath(fmt.Sprintf("/sys/block/%s/queue/scheduler", filepath.Base(device)))
+			log.Printf("setting io scheduler of %s to %s", device, sched)
+			return EchoSCSICommand(path, sched)
+		}
+	}
+	return fmt.Errorf("io scheduler %s not available for %s, expected one of %v", sched, device, available)
+}
+
+func readSCSIDeviceInt(hctl HCTL, attr string) (int, error) {
+	path := sysfsPath(fmt.Sprintf("/sys/bus/scsi/devices/%s:%s:%s:%s/%s", hctl.Host, hctl.Channel, hctl.Target, hctl.Lun, attr))
+	out, err := osBrick.DefaultFS.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed read %s: %v", path, err)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+//EchoSCSICommand Write content to the scsi subsystem attribute at path, like
+//echo 'content' > path.
+//
+//	The attribute is written directly, not with sh -c through the executor,
+//	so DefaultExecutor doesn't see the write; callers resolve path with
+//	sysfsPath to let SysFSRoot redirect it, e.g. in tests.
+func EchoSCSICommand(path, content string) error {
+	if err := ioutil.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed echo '%s' > %s: %v", content, path, err)
+	}
+	return nil
+}
+
+//UdevSettle Wait for udev to process the queued events, e.g. to create the
+//links of the devices just scanned, up to timeout.
+//
+//	Hosts without udevadm are skipped, nothing to wait for.
+func UdevSettle(timeout time.Duration) error {
+	return UdevSettleContext(context.Background(), timeout)
+}
+
+//UdevSettleContext Wait for udev like UdevSettle, with the executor of ctx.
+func UdevSettleContext(ctx context.Context, timeout time.Duration) error {
+	if _, err := osBrick.FindBinary("udevadm"); err != nil {
+		log.Printf("udevadm not found, skip udev settle: %v", err)
+		return nil
+	}
+	out, err := osBrick.ExecuteContext(ctx, "udevadm", "settle", fmt.Sprintf("--timeout=%d", int(timeout.Seconds())))
+	if err != nil {
+		return fmt.Errorf("failed udevadm settle: %s, %v", strings.TrimSpace(out), err)
+	}
+	return nil
+}
+
+//CommandEnv is added to the environment of the commands whose output is
+//parsed, so a localized output can't break the parsing.
+var CommandEnv = []string{"LANG=C", "LC_ALL=C"}
+
+//executeC Execute a command whose output is parsed, with CommandEnv.
+func executeC(name string, arg ...string) (string, error) {
+	return executeCContext(context.Background(), name, arg...)
+}
+
+//executeCContext Execute a command like executeC, with the executor of ctx.
+func executeCContext(ctx context.Context, name string, arg ...string) (string, error) {
+	return osBrick.ExecuteEnvContext(ctx, CommandEnv, name, arg...)
+}
+
+//multipathdFailed Whether the reply of a multipathd command is fail, it
+//replies ok or fail even when it exits 0. Other output merely containing
+//fail, e.g. "failback", isn't a failure.
+func multipathdFailed(out string) bool {
+	fields := strings.Fields(out)
+	return len(fields) > 0 && fields[0] == "fail"
+}
+
+//Translates /dev/disk/by-path/ entry to /dev/sdX.
+func GetNameFromPath(path string) string {
+	name, err := osBrick.DefaultFS.EvalSymlinks(path)
+	if err != nil {
+		log.Printf("failed get realpath for path: %s, ERROR: %v", path, err)
+		return ""
+	}
+	if strings.HasPrefix(name, "/dev/") {
+		return name
+	} else {
+		return ""
+	}
+}
+
+//FlushMultipathDevice Flush a multipath device, see FlushMultipathDeviceContext.
+func FlushMultipathDevice(wwn string) error {
+	return FlushMultipathDeviceContext(context.Background(), wwn)
+}
+
+//MultipathFlushRetryIntervals are the waits before each retry of a failed
+//multipath -f, the retries stop when MultipathFlushTimeout is reached.
+var MultipathFlushRetryIntervals = []time.Duration{time.Second * 20, time.Second * 40}
+
+//MultipathFlushTimeout caps the time spent flushing a multipath device,
+//each multipath -f is also killed after 3 minutes.
+var MultipathFlushTimeout = time.Minute * 5
+
+//FlushMultipathDeviceContext Flush a multipath device, until ctx is done.
+//
+//	Failed flushes are retried after MultipathFlushRetryIntervals, the error
+//	of the last attempt is returned when they all failed. When ctx is done
+//	the running multipath -f is killed and ctx.Err() is returned.
+//	multipath -f is run with the executor of ctx, DefaultExecutor if it
+//	carries none, see osBrick.ExecWithContext.
+func FlushMultipathDeviceContext(ctx context.Context, wwn string) error {
+	log.Printf("flush multipath device %s", wwn)
+	//NOTE(geguileo): With 30% connection error rates flush can get stuck,
+	//set timeout to prevent it from hanging here forever.  Retry twice
+	//after 20 and 40 seconds.
+	flushCtx, cancel := context.WithTimeout(ctx, MultipathFlushTimeout)
+	defer cancel()
+	var err error
+	for i := 0; i <= len(MultipathFlushRetryIntervals); i++ {
+		if i > 0 {
+			select {
+			case <-flushCtx.Done():
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return ctxErr
+				}
+				return fmt.Errorf("failed flush multipath device %s within %v: %v", wwn, MultipathFlushTimeout, err)
+			case <-time.After(MultipathFlushRetryIntervals[i-1]):
+			}
+		}
+		attemptCtx, cancelAttempt := context.WithTimeout(flushCtx, time.Minute*3)
+		var out string
+		out, err = osBrick.ExecWithContext(attemptCtx, "multipath", "-f", wwn)
+		cancelAttempt()
+		log.Printf("exec multipath -f %s: %s", wwn, out)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err == context.DeadlineExceeded {
+			err = fmt.Errorf("multipath -f %s timed out", wwn)
+		} else if err == nil {
+			return nil
+		}
+		log.Printf("failed flush multipath device %s on attempt %d: %v", wwn, i+1, err)
+	}
+	return fmt.Errorf("failed flush multipath device %s after %d attempts: %v", wwn, len(MultipathFlushRetryIntervals)+1, err)
+}
+
+func GetDeviceInfo(device string) (map[string]string, error) {
+	return GetDeviceInfoContext(context.Background(), device)
+}
+
+//GetDeviceInfoContext Get the scsi address of a device like GetDeviceInfo,
+//running sg_scan with the executor of ctx.
+func GetDeviceInfoContext(ctx context.Context, device string) (map[string]string, error) {
+	out, err := osBrick.ExecuteContext(ctx, "sg_scan", device)
+	log.Printf("exec sg_scan %s: %s", device, out)
+	if err != nil {
 		return nil, fmt.Errorf("failed execute sg_scan %s: %v", device, err)
 	}
 	deviceInfo := map[string]string{
@@ -324,6 +1261,19 @@ func GetDeviceInfo(device string) (map[string]string, error) {
 			}
 		}
 	}
+	if deviceInfo["host"] == "" || deviceInfo["channel"] == "" || deviceInfo["id"] == "" || deviceInfo["lun"] == "" {
+		//sg_scan output format differs across devices and versions,
+		//fall back to the scsi address in sysfs
+		log.Printf("no scsi address in sg_scan output for %s, falling back to sysfs", device)
+		hctl, err := GetHCTL(device)
+		if err != nil {
+			return nil, fmt.Errorf("failed get scsi address of %s from sg_scan output %q or sysfs: %v", device, out, err)
+		}
+		deviceInfo["host"] = hctl.Host
+		deviceInfo["channel"] = hctl.Channel
+		deviceInfo["id"] = hctl.Target
+		deviceInfo["lun"] = hctl.Lun
+	}
 	return deviceInfo, nil
 }
 
@@ -342,6 +1292,51 @@ func GetDevPath(connProperties map[string]interface{}, deviceInfo map[string]str
 	return ""
 }
 
+//IsMultipathPath Tell whether a path, e.g. /dev/disk/by-id/dm-uuid-mpath-<wwn>
+//or /dev/mapper/<name>, resolves to a multipath device or a partition of one.
+//
+//	The dm uuid in sysfs is checked, so any symlink form is classified the
+//	same way. A dm-crypt mapper is classified by the device it's opened
+//	on. Paths that can't be resolved anymore are classified by form.
+func IsMultipathPath(path string) bool {
+	realPath, err := osBrick.DefaultFS.EvalSymlinks(path)
+	if err != nil {
+		log.Printf("failed get realpath for path: %s, classifying by name: %v", path, err)
+		return strings.HasPrefix(path, "/dev/disk/by-id/dm-uuid-mpath-") ||
+			strings.HasPrefix(path, "/dev/mapper/") || strings.HasPrefix(path, "/dev/dm-")
+	}
+	return isMultipathDM(filepath.Base(realPath))
+}
+
+//isMultipathDM Tell whether a block device, e.g. dm-0, is a multipath device,
+//a partition of one or a dm-crypt mapper on top of them.
+func isMultipathDM(name string) bool {
+	if !strings.HasPrefix(name, "dm-") {
+		return false
+	}
+	uuid, err := osBrick.DefaultFS.ReadFile(sysfsPath(fmt.Sprintf("/sys/block/%s/dm/uuid", name)))
+	if err != nil {
+		log.Printf("failed read dm uuid of %s: %v", name, err)
+		return false
+	}
+	u := strings.TrimSpace(string(uuid))
+	if strings.HasPrefix(u, "CRYPT-") {
+		slaves, err := osBrick.DefaultFS.ReadDir(sysfsPath(fmt.Sprintf("/sys/block/%s/slaves", name)))
+		if err != nil {
+			log.Printf("failed read slaves of dm-crypt device %s: %v", name, err)
+			return false
+		}
+		for _, slave := range slaves {
+			if isMultipathDM(slave.Name()) {
+				return true
+			}
+		}
+		return false
+	}
+	//kpartx partitions are part<N>-mpath-<wwid>
+	return strings.HasPrefix(u, "mpath-") || (strings.HasPrefix(u, "part") && strings.Contains(u, "-mpath-"))
+}
+
 //Check if a device needs to be flushed when detaching.
 //
 //	A device representing a single path connection to a volume must only be
@@ -359,52 +1354,67 @@ func RequiresFlush(devicePath string, pathUsed string, wasMultipath bool) (bool,
 	//We need to flush the single path that was used.
 	//For encrypted volumes the symlink has been replaced, so realpath
 	//won't return device under /dev but under /dev/disk/...
-	rPath, err := filepath.EvalSymlinks(devicePath)
+	rPath, err := osBrick.DefaultFS.EvalSymlinks(devicePath)
 	if err != nil {
 		return false, fmt.Errorf("failed get realpath for path:%s: %v", devicePath, err)
 	}
-	rPathUsed, err := filepath.EvalSymlinks(pathUsed)
+	rPathUsed, err := osBrick.DefaultFS.EvalSymlinks(pathUsed)
 	if err != nil {
 		return false, fmt.Errorf("failed get realpath for path:%s: %v", pathUsed, err)
 	}
-	dir, _ := filepath.Split(rPathUsed)
-	return rPathUsed == rPath || dir != "/dev", nil
+	return rPathUsed == rPath || filepath.Dir(rPathUsed) != "/dev", nil
 }
 
+//ExtendRescanAttempts is how many more times DoExtendVolume rescans the
+//member paths of a multipath device whose rescan failed, ExtendRescanInterval
+//apart, before giving up on resizing the map.
+var (
+	ExtendRescanAttempts = 3
+	ExtendRescanInterval = time.Second
+)
+
 //Signal the SCSI subsystem to test for volume resize.
 //
 //	This function tries to signal the local system's kernel
 //	that an already attached volume might have been resized.
+//	The multipath map is only resized once the rescan of all its
+//	member paths was written, the ones failing are retried first.
 func DoExtendVolume(volumePaths []string, useMultipath bool) (float64, error) {
 	log.Printf("extending volume %v", volumePaths)
 	var newSize = 0.0
+	nvmePaths := 0
+	failed := make([]string, 0)
 	for _, volumePath := range volumePaths {
-		device, err := GetDeviceInfo(volumePath)
-		if err != nil {
-			log.Printf("failed get device info for path: %s, ERROR: %v", volumePath, err)
-			continue
-		}
-		log.Printf("volume device info: %#v", device)
-		deviceId := fmt.Sprintf("%s:%s:%s:%s", device["host"], device["channel"], device["id"], device["lun"])
-		scsiPath := fmt.Sprintf("/sys/bus/scsi/drivers/sd/%s", deviceId)
-		size, err := GetDeviceSize(volumePath)
-		if err != nil {
+		//a path that can't be read still has to be rescanned
+		if size, err := GetDeviceSize(volumePath); err != nil {
 			log.Printf("failed get device size for path: %s, ERROR: %v", volumePath, err)
-			continue
+		} else {
+			log.Printf("starting size: %f", size)
 		}
-		log.Printf("starting size: %f", size)
 
-		//now issue the device rescan
-		err = EchoSCSICommand(scsiPath+"/rescan", "1")
+		deviceType, err := GetDeviceType(volumePath)
 		if err != nil {
-			log.Printf("failed echo '1' > %s, ERROR: %s", scsiPath+"/rescan", err)
+			log.Printf("failed get device type for path: %s, ERROR: %v", volumePath, err)
+		}
+		if deviceType == DeviceTypeNVMe || deviceType == DeviceTypeNVMeMultipath {
+			nvmePaths++
+		}
+		//now issue the device rescan
+		if err = rescanVolumePath(volumePath, deviceType); err != nil {
+			log.Printf("%v", err)
+			failed = append(failed, volumePath)
+			continue
 		}
 		newSize, err = GetDeviceSize(volumePath)
 		if err != nil {
 			log.Printf("failed get device size for path: %s, ERROR: %s", volumePath, err)
 			continue
 		}
-		log.Printf("volume size after scsi device rescan %f", newSize)
+		log.Printf("volume size after device rescan %f", newSize)
+	}
+	if nvmePaths > 0 && nvmePaths == len(volumePaths) {
+		//NVMe namespaces aren't part of dm-multipath maps
+		return newSize, nil
 	}
 
 	scsiWWN, err := GetSCSIWWN(volumePaths[0])
@@ -412,43 +1422,325 @@ func DoExtendVolume(volumePaths []string, useMultipath bool) (float64, error) {
 		return 0, fmt.Errorf("failed get scsi wwn for path: %s", volumePaths[0])
 	}
 	if useMultipath {
+		//a member not rescanned keeps the map at the old size
+		if len(failed) > 0 {
+			osBrick.RunWithRetry(ExtendRescanAttempts, ExtendRescanInterval, func(try int) bool {
+				remaining := make([]string, 0, len(failed))
+				for _, volumePath := range failed {
+					deviceType, _ := GetDeviceType(volumePath)
+					if err := rescanVolumePath(volumePath, deviceType); err != nil {
+						log.Printf("%v, attempt %d", err, try)
+						remaining = append(remaining, volumePath)
+					}
+				}
+				failed = remaining
+				return len(failed) == 0
+			})
+			if len(failed) > 0 {
+				return 0, fmt.Errorf("failed rescan member paths %v of volume %v", failed, volumePaths)
+			}
+		}
 		mPathDevice, err := FindMultipathDevicePath(scsiWWN)
 		if err != nil {
 			return 0, fmt.Errorf("failed find multipath device path for wwn %s : %v", scsiWWN, err)
 		}
 		if mPathDevice != "" {
-			//Force a reconfigure so that resize works
-			if err = MultipathReConfigure(); err != nil {
-				return 0, fmt.Errorf("failed reconfigure multipath: %v", err)
+			if newSize, err = resizeMultipathDevice(scsiWWN, mPathDevice); err != nil {
+				return 0, fmt.Errorf("failed resize multipath device %s for volume %v: %v", mPathDevice, volumePaths, err)
 			}
-			size, err := GetDeviceSize(mPathDevice)
-			if err != nil {
-				return 0, fmt.Errorf("failed get device size for path %s after reconfigure: ", mPathDevice)
-			}
-			log.Printf("mpath %s current size: %f", mPathDevice, size)
-			result, err := MultipathResizeMap(scsiWWN)
+		}
+	}
+	return newSize, nil
+}
+
+//rescanVolumePath Signal the kernel to read the size of a volume path again.
+func rescanVolumePath(volumePath string, deviceType DeviceType) error {
+	switch deviceType {
+	case DeviceTypeNVMe:
+		if err := RescanNVMeNamespace(volumePath); err != nil {
+			return fmt.Errorf("failed rescan nvme namespace %s, ERROR: %v", volumePath, err)
+		}
+	case DeviceTypeNVMeMultipath:
+		//the kernel updates the head when its controllers rescan,
+		//only the size needs to be read again
+	default:
+		//the HCTL from sysfs, or from sg_scan when the device isn't linked
+		hctl, err := GetHCTL(GetNameFromPath(volumePath))
+		if err != nil {
+			device, err := GetDeviceInfo(volumePath)
 			if err != nil {
-				return 0, fmt.Errorf("failed multipath resize map: %v", err)
-			}
-			if strings.Contains(result, "fail") {
-				return 0, fmt.Errorf("multipathd failed to update the size mapping of multipath device %s volume %v", scsiWWN, volumePaths)
-			}
-			if newSize, err = GetDeviceSize(mPathDevice); err != nil {
-				return 0, fmt.Errorf("failed get device size for path %s after resize map: ", mPathDevice)
+				return fmt.Errorf("failed get device info for path: %s, ERROR: %v", volumePath, err)
 			}
+			log.Printf("volume device info: %#v", device)
+			hctl = HCTL{Host: device["host"], Channel: device["channel"], Target: device["id"], Lun: device["lun"]}
+		}
+		if err = RescanSCSIDevice(hctl); err != nil {
+			return fmt.Errorf("failed rescan %s, ERROR: %v", volumePath, err)
 		}
 	}
-	return newSize, nil
+	return nil
+}
+
+//GetMultipathWWN Get the WWN of a multipath device from the uuid of its dm map.
+func GetMultipathWWN(mpathPath string) (string, error) {
+	realPath, err := osBrick.DefaultFS.EvalSymlinks(mpathPath)
+	if err != nil {
+		return "", fmt.Errorf("failed get realpath for path: %s: %v", mpathPath, err)
+	}
+	path := sysfsPath(fmt.Sprintf("/sys/block/%s/dm/uuid", filepath.Base(realPath)))
+	uuid, err := osBrick.DefaultFS.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed read %s: %v", path, err)
+	}
+	wwn := strings.TrimSpace(string(uuid))
+	if !strings.HasPrefix(wwn, "mpath-") {
+		return "", fmt.Errorf("%s is not a multipath device, dm uuid: %s", mpathPath, wwn)
+	}
+	return strings.TrimPrefix(wwn, "mpath-"), nil
+}
+
+//ExtendMultipathDevice Update the size of a volume when only its multipath
+//device is known, returns the new size in bytes.
+//
+//	Every member path is rescanned, through its /sys/bus/scsi/devices
+//	rescan, before the multipath map is resized, like DoExtendVolume does
+//	starting from the volume paths.
+func ExtendMultipathDevice(mpathPath string) (int64, error) {
+	wwn, err := GetMultipathWWN(mpathPath)
+	if err != nil {
+		return 0, err
+	}
+	mpath, err := FindMultipathDevice(mpathPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed find multipath device %s: %v", mpathPath, err)
+	}
+	if mpath == nil {
+		return 0, fmt.Errorf("multipath device %s not found", mpathPath)
+	}
+	devices, _ := mpath["devices"].([]MultipathDevice)
+	if len(devices) == 0 {
+		return 0, fmt.Errorf("multipath device %s has no paths", mpathPath)
+	}
+	for _, d := range devices {
+		hctl := HCTL{Host: d["host"], Channel: d["channel"], Target: d["id"], Lun: d["lun"]}
+		if err = RescanSCSIDevice(hctl); err != nil {
+			//a member not rescanned keeps the map at the old size
+			return 0, fmt.Errorf("failed rescan path %s of %s: %v", d["device"], mpathPath, err)
+		}
+	}
+	size, err := resizeMultipathDevice(wwn, mpathPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed resize multipath device %s: %v", mpathPath, err)
+	}
+	return int64(size), nil
+}
+
+//GetSCSIDeviceState Get the state of a scsi device /dev/sdX from sysfs, e.g.
+//running, offline, blocked or transport-offline.
+func GetSCSIDeviceState(device string) (string, error) {
+	path := sysfsPath(fmt.Sprintf("/sys/block/%s/device/state", filepath.Base(device)))
+	out, err := osBrick.DefaultFS.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed read state of %s: %v", device, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+//IsSCSIDeviceOnline Tell whether a scsi device /dev/sdX is running, I/O to
+//offline or blocked devices hangs or fails.
+func IsSCSIDeviceOnline(device string) bool {
+	state, err := GetSCSIDeviceState(device)
+	if err != nil {
+		log.Printf("%v", err)
+		return false
+	}
+	return state == "running"
+}
+
+//GetFailedMultipathPaths Get the member paths of a multipath device that
+//are failed in the multipath map or not running in sysfs.
+func GetFailedMultipathPaths(mpathPath string) ([]string, error) {
+	return GetFailedMultipathPathsContext(context.Background(), mpathPath)
+}
+
+//GetFailedMultipathPathsContext Get the failed paths like
+//GetFailedMultipathPaths, running multipath with the executor of ctx.
+func GetFailedMultipathPathsContext(ctx context.Context, mpathPath string) ([]string, error) {
+	mpath, err := FindMultipathDeviceContext(ctx, mpathPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed find multipath device %s: %v", mpathPath, err)
+	}
+	if mpath == nil {
+		return nil, fmt.Errorf("multipath device %s not found", mpathPath)
+	}
+	devices, _ := mpath["devices"].([]MultipathDevice)
+	failed := make([]string, 0)
+	for _, d := range devices {
+		if d["dm_status"] == "failed" {
+			failed = append(failed, d["device"])
+			continue
+		}
+		state, err := GetSCSIDeviceState(d["device"])
+		if err != nil {
+			log.Printf("path %s of %s looks gone: %v", d["device"], mpathPath, err)
+			failed = append(failed, d["device"])
+		} else if state != "running" {
+			log.Printf("path %s of %s is %s", d["device"], mpathPath, state)
+			failed = append(failed, d["device"])
+		}
+	}
+	return failed, nil
+}
+
+//resizeMultipathDevice Resize the map of a multipath device.
+//
+//	The map is resized with multipathd resize map, multipathd is only
+//	reconfigured when that fails, a reconfigure re-reads all the maps and
+//	stalls the I/O of the other volumes. The multipath lock is held for the
+//	whole sequence so concurrent extends can't reconfigure in between
+//	another extend's reconfigure and resize.
+func resizeMultipathDevice(wwn, mPathDevice string) (float64, error) {
+	multipathLock.Lock()
+	defer multipathLock.Unlock()
+	result, err := multipathResizeMap(wwn)
+	if err != nil || multipathdFailed(result) {
+		log.Printf("multipathd resize map %s failed: %s, %v, retrying after reconfigure", wwn, strings.TrimSpace(result), err)
+		if err := multipathReConfigure(); err != nil {
+			return 0, fmt.Errorf("failed reconfigure multipath: %v", err)
+		}
+		result, err = multipathResizeMap(wwn)
+	}
+	if err != nil || multipathdFailed(result) {
+		//older multipath-tools don't support resize map, a reload of
+		//the maps picks up the new size too
+		log.Printf("multipathd resize map %s failed: %s, %v, falling back to multipath -r", wwn, strings.TrimSpace(result), err)
+		if out, err := multipathReload(context.Background()); err != nil {
+			return 0, fmt.Errorf("multipathd failed to update the size mapping of multipath device %s, and multipath -r failed: %s, %v", wwn, out, err)
+		}
+		log.Printf("multipath device %s resized with multipath -r", wwn)
+	} else {
+		log.Printf("multipath device %s resized with multipathd resize map", wwn)
+	}
+	//the size of the map, cross-checked with the size of the block device
+	size, err := waitForDMSize(mPathDevice)
+	if err == nil {
+		return size, nil
+	} else {
+		log.Printf("failed cross-check the size of %s with its dm table: %v", mPathDevice, err)
+	}
+	//the dm layer's own view of the size, blockdev is the fallback
+	if sysfsSize, err := GetDeviceSizeSysfs(mPathDevice); err == nil {
+		return float64(sysfsSize), nil
+	} else {
+		log.Printf("failed get sysfs size of %s, falling back to blockdev: %v", mPathDevice, err)
+	}
+	if size, err = GetDeviceSize(mPathDevice); err != nil {
+		return 0, fmt.Errorf("failed get device size for path %s after resize map: %v", mPathDevice, err)
+	}
+	return size, nil
+}
+
+//DMSizeWaitTimeout is how long an extend waits for the size of a multipath
+//device to match the size of its map after a resize.
+var DMSizeWaitTimeout = time.Second * 10
+
+//DMSizeWaitInterval is how often the sizes are compared meanwhile.
+var DMSizeWaitInterval = time.Second
+
+//GetDMTableSize Get the size in bytes of the map of a dm device, e.g.
+///dev/mapper/mpatha or /dev/dm-0, from its dmsetup table.
+func GetDMTableSize(device string) (int64, error) {
+	name, err := getDMName(device)
+	if err != nil {
+		return 0, err
+	}
+	out, err := osBrick.Execute("dmsetup", "table", name)
+	if err != nil {
+		return 0, fmt.Errorf("failed execute dmsetup table %s: %s, %v", name, strings.TrimSpace(out), err)
+	}
+	//<start sector> <length in sectors> <target type> <args>, a line per target
+	var sectors int64
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return 0, fmt.Errorf("unexpected dm table of %s: %q", name, line)
+		}
+		length, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("dm table length not numeric in %q", line)
+		}
+		sectors += length
+	}
+	return sectors * 512, nil
+}
+
+//getDMName Get the name of the map of a dm device.
+func getDMName(device string) (string, error) {
+	if strings.HasPrefix(device, "/dev/mapper/") {
+		return filepath.Base(device), nil
+	}
+	realPath, err := osBrick.DefaultFS.EvalSymlinks(device)
+	if err != nil {
+		return "", fmt.Errorf("failed get realpath of %s: %v", device, err)
+	}
+	path := sysfsPath(fmt.Sprintf("/sys/block/%s/dm/name", filepath.Base(realPath)))
+	name, err := osBrick.DefaultFS.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed read %s: %v", path, err)
+	}
+	return strings.TrimSpace(string(name)), nil
+}
+
+//waitForDMSize Get the size of a multipath device once blockdev agrees with
+//the size of its map.
+//
+//	The size of the block device lags behind the map until multipathd
+//	has updated it, so right after a resize blockdev may still report the
+//	old size. When they still differ after DMSizeWaitTimeout the size of
+//	the map is returned.
+func waitForDMSize(mPathDevice string) (float64, error) {
+	deadline := time.Now().Add(DMSizeWaitTimeout)
+	for {
+		tableSize, err := GetDMTableSize(mPathDevice)
+		if err != nil {
+			return 0, err
+		}
+		size, err := GetDeviceSize(mPathDevice)
+		if err != nil {
+			return 0, err
+		}
+		if size == float64(tableSize) {
+			return size, nil
+		}
+		if time.Now().After(deadline) {
+			log.Printf("WARNING: size of %s is still %f after %v, its map is %d", mPathDevice, size, DMSizeWaitTimeout, tableSize)
+			return float64(tableSize), nil
+		}
+		log.Printf("size of %s is %f, waiting for the size of its map %d", mPathDevice, size, tableSize)
+		time.Sleep(DMSizeWaitInterval)
+	}
 }
 
 //Issue a multipath resize map on device.
 //
 //	This forces the multipath daemon to update it's
 //	size information a particular multipath device.
+//	Serialized with other multipathd reconfigure and resize calls.
 func MultipathResizeMap(wwn string) (string, error) {
+	multipathLock.Lock()
+	defer multipathLock.Unlock()
+	return multipathResizeMap(wwn)
+}
+
+func multipathResizeMap(wwn string) (string, error) {
 	return osBrick.Execute("multipathd", "resize", "map", wwn)
 }
 
+//multipathReload Reload all the multipath maps.
+func multipathReload(ctx context.Context) (string, error) {
+	return osBrick.ExecuteContext(ctx, "multipath", "-r")
+}
+
 //Get the size in bytes of a volume
 func GetDeviceSize(path string) (float64, error) {
 	out, err := osBrick.Execute("blockdev", "--getsize64", path)
@@ -462,13 +1754,230 @@ func GetDeviceSize(path string) (float64, error) {
 	return 0, fmt.Errorf("device size not numeric: %s", s)
 }
 
+//GetDeviceSizeBytes Get the size in bytes of a volume as an integer.
+func GetDeviceSizeBytes(path string) (int64, error) {
+	out, err := osBrick.Execute("blockdev", "--getsize64", path)
+	if err != nil {
+		return 0, fmt.Errorf("failed execute blockdev --getsize64 %s: %v", path, err)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("device size not numeric: %s", strings.TrimSpace(out))
+	}
+	return size, nil
+}
+
+//GetBlockSizes Get the logical and physical block sizes of a volume.
+func GetBlockSizes(path string) (int, int, error) {
+	out, err := osBrick.Execute("blockdev", "--getss", "--getpbsz", path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed execute blockdev --getss --getpbsz %s: %v", path, err)
+	}
+	sizes := strings.Fields(out)
+	if len(sizes) != 2 {
+		return 0, 0, fmt.Errorf("unexpected block sizes of %s: %q", path, out)
+	}
+	logical, err := strconv.Atoi(sizes[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("logical block size not numeric: %s", sizes[0])
+	}
+	physical, err := strconv.Atoi(sizes[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("physical block size not numeric: %s", sizes[1])
+	}
+	return logical, physical, nil
+}
+
+//ProbeDevice Get the metadata of a device in a single call.
+//
+//	Every probe is best effort, the ones failing are recorded in the
+//	Errors of the result and the rest of the fields are still filled.
+func ProbeDevice(path string) (*DeviceDetails, error) {
+	if !osBrick.IsFileExists(path) {
+		return nil, fmt.Errorf("device %s not found", path)
+	}
+	details := &DeviceDetails{Path: path, Errors: make(map[string]error)}
+	var err error
+	if details.WWN, err = GetSCSIWWN(path); err != nil {
+		details.Errors["WWN"] = err
+	}
+	if details.Size, err = GetDeviceSizeBytes(path); err != nil {
+		details.Errors["Size"] = err
+	}
+	if details.LogicalBlockSize, details.PhysicalBlockSize, err = GetBlockSizes(path); err != nil {
+		details.Errors["BlockSizes"] = err
+	}
+	name := path
+	if realPath, err := osBrick.DefaultFS.EvalSymlinks(path); err == nil {
+		name = realPath
+	}
+	if details.MultipathWWN, details.MultipathDevice, err = GetMultipathDeviceForPath(name); err != nil {
+		details.Errors["Multipath"] = err
+	}
+	if roDevices, err := GetBlockDevicesRO(); err != nil {
+		details.Errors["ReadOnly"] = err
+	} else {
+		details.ReadOnly = roDevices[filepath.Base(name)]
+	}
+	if details.FSType, err = osBrick.GetFSType(path); err != nil {
+		details.Errors["FSType"] = err
+	}
+	return details, nil
+}
+
+//GetFirstPartition Get the first partition of a device, or the device itself if it has none.
+//
+//	lsblk reports the full path of the partitions, which for multipath
+//	devices are /dev/mapper/ entries rather than /dev/ ones.
+func GetFirstPartition(device string) (string, error) {
+	blkdevs, err := lsblk(context.Background(), "-p", device)
+	if err != nil {
+		return "", err
+	}
+	partition := ""
+	walkBlockDevices(blkdevs, func(d BlockDevice) {
+		if partition == "" && d.Type == "part" {
+			partition = d.Name
+		}
+	})
+	if partition != "" {
+		return partition, nil
+	}
+	return device, nil
+}
+
+//GetDeviceSizeSysfs Get the size in bytes of a volume from /sys/block/<dev>/size.
+//
+//	Symlinks like /dev/mapper/<WWN> are resolved to the dm-X device first.
+func GetDeviceSizeSysfs(device string) (int64, error) {
+	if realPath, err := osBrick.DefaultFS.EvalSymlinks(device); err == nil {
+		device = realPath
+	}
+	path := sysfsPath(fmt.Sprintf("/sys/block/%s/size", filepath.Base(device)))
+	out, err := osBrick.DefaultFS.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed read %s: %v", path, err)
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("device size not numeric in %s: %v", path, err)
+	}
+	//the size is always in 512-byte sectors
+	return sectors * 512, nil
+}
+
+//SupportsDiscard Tell whether a device passes discard (UNMAP/TRIM) down to the backend.
+func SupportsDiscard(device string) (bool, error) {
+	if realPath, err := osBrick.DefaultFS.EvalSymlinks(device); err == nil {
+		device = realPath
+	}
+	path := sysfsPath(fmt.Sprintf("/sys/block/%s/queue/discard_max_bytes", filepath.Base(device)))
+	out, err := osBrick.DefaultFS.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("failed read %s: %v", path, err)
+	}
+	maxBytes, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("discard_max_bytes not numeric in %s: %v", path, err)
+	}
+	return maxBytes > 0, nil
+}
+
+//HasMultipath Check that multipathd is running and answering commands.
+func HasMultipath() bool {
+	out, err := executeC("multipathd", "show", "status")
+	if err != nil {
+		log.Printf("multipathd is not running: %s, %v", strings.TrimSpace(out), err)
+		return false
+	}
+	return true
+}
+
+//ErrMultipathUnavailable is returned when multipath is requested on a host
+//without the multipath tools installed.
+var ErrMultipathUnavailable = errors.New("multipath tools are not available")
+
+//CheckMultipathTools Check the multipath and multipathd commands are installed.
+func CheckMultipathTools() error {
+	for _, bin := range []string{"multipath", "multipathd"} {
+		if _, err := osBrick.FindBinary(bin); err != nil {
+			return fmt.Errorf("%w: %s not found", ErrMultipathUnavailable, bin)
+		}
+	}
+	return nil
+}
+
+//MultipathWWIDsFile is where multipath records the wwids it manages.
+var MultipathWWIDsFile = "/etc/multipath/wwids"
+
+//IsMultipathManaged Tell whether multipath is expected to manage the wwn of
+//device /dev/sdX, i.e. multipathd monitors a path of it, it is in
+//MultipathWWIDsFile or multipath -c accepts device as a path.
+//
+//	Only a device multipath -c rejects, e.g. blacklisted in the multipath
+//	config, isn't managed, so the wait for its multipath device can be
+//	skipped. When it can't be told, e.g. multipath isn't there, the wwn is
+//	taken as managed and the error is returned along.
+func IsMultipathManaged(wwn string, device string) (bool, error) {
+	return IsMultipathManagedContext(context.Background(), wwn, device)
+}
+
+//IsMultipathManagedContext Tell whether multipath manages the wwn like
+//IsMultipathManaged, with the executor of ctx.
+func IsMultipathManagedContext(ctx context.Context, wwn string, device string) (bool, error) {
+	out, err := executeCContext(ctx, "multipathd", "show", "paths", "format", "%w")
+	if err == nil {
+		for _, l := range strings.Split(out, "\n") {
+			if strings.TrimSpace(l) == wwn {
+				return true, nil
+			}
+		}
+	} else {
+		log.Printf("failed execute multipathd show paths: %s, %v", strings.TrimSpace(out), err)
+	}
+	if wwids, err := osBrick.DefaultFS.ReadFile(MultipathWWIDsFile); err == nil {
+		//the entries look like /3600a0980383036347224000000000001/
+		for _, l := range strings.Split(string(wwids), "\n") {
+			if strings.Trim(strings.TrimSpace(l), "/") == wwn {
+				return true, nil
+			}
+		}
+	}
+	out, err = executeCContext(ctx, "multipath", "-c", device)
+	if err == nil {
+		return true, nil
+	}
+	if strings.Contains(out, "is not a valid multipath device path") {
+		return false, nil
+	}
+	return true, fmt.Errorf("failed execute multipath -c %s: %s, %v", device, strings.TrimSpace(out), err)
+}
+
+//MultipathAddPath Have multipathd add a path /dev/sdX to its multipath device,
+//creating the device if needed.
+func MultipathAddPath(device string) error {
+	out, err := osBrick.Execute("multipathd", "add", "path", device)
+	log.Printf("execute multipathd add path %s: %s", device, out)
+	if err != nil {
+		return fmt.Errorf("failed add path %s to multipathd: %s, %v", device, strings.TrimSpace(out), err)
+	}
+	return nil
+}
+
 //Issue a multipathd reconfigure.
 //
 //	When attachments come and go, the multipathd seems
 //	to get lost and not see the maps.  This causes
 //	resize map to fail 100%.  To overcome this we have
 //	to issue a reconfigure prior to resize map.
+//	Serialized with other multipathd reconfigure and resize calls.
 func MultipathReConfigure() error {
+	multipathLock.Lock()
+	defer multipathLock.Unlock()
+	return multipathReConfigure()
+}
+
+func multipathReConfigure() error {
 	out, err := osBrick.Execute("multipathd", "reconfigure")
 	log.Printf("execute multipathd reconfigure: %s", out)
 	return err
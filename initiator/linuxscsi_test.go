@@ -1 +1,1329 @@
 package initiator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	osBrick "github.com/ydcool/os-brick-go"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//newFakeSysFS points SysFSRoot at a temporary directory for the test.
+func newFakeSysFS(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := SysFSRoot
+	SysFSRoot = dir
+	t.Cleanup(func() {
+		SysFSRoot = root
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+//fakeExecutor replaces the command executors with handler for the test, the
+//env of ExecuteEnv is dropped.
+func fakeExecutor(t *testing.T, handler osBrick.Executor) {
+	e, env := osBrick.DefaultExecutor, osBrick.DefaultEnvExecutor
+	osBrick.DefaultExecutor = handler
+	osBrick.DefaultEnvExecutor = func(_ []string, name string, arg ...string) (string, error) {
+		return handler(name, arg...)
+	}
+	t.Cleanup(func() { osBrick.DefaultExecutor, osBrick.DefaultEnvExecutor = e, env })
+}
+
+//fastSCSIWWNRetry shortens the interval between scsi_id attempts for the test.
+func fastSCSIWWNRetry(t *testing.T) {
+	interval := SCSIWWNRetryInterval
+	SCSIWWNRetryInterval = time.Millisecond
+	t.Cleanup(func() { SCSIWWNRetryInterval = interval })
+}
+
+//writeFakeFile creates a file with content under root, creating parents.
+func writeFakeFile(t *testing.T, root, path, content string) {
+	p := filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetMultipathDeviceForPath(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "block/dm-3/dm/uuid", "mpath-3600a098038303634722b4d59614c5a41\n")
+	writeFakeFile(t, root, "block/dm-3/dm/name", "mpatha\n")
+	if err := os.MkdirAll(filepath.Join(root, "block/sdb/holders/dm-3"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "block/sdc/holders"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	wwn, mpath, err := GetMultipathDeviceForPath("/dev/sdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wwn != "3600a098038303634722b4d59614c5a41" || mpath != "/dev/mapper/mpatha" {
+		t.Errorf("unexpected wwn %q, mpath %q", wwn, mpath)
+	}
+
+	wwn, mpath, err = GetMultipathDeviceForPath("/dev/sdc")
+	if err != nil || wwn != "" || mpath != "" {
+		t.Errorf("expected no multipath for sdc, got %q, %q, %v", wwn, mpath, err)
+	}
+}
+
+func TestGetHCTL(t *testing.T) {
+	root := newFakeSysFS(t)
+	target := filepath.Join(root, "devices/pci0000:00/0000:00:03.0/host3/rport-3:0-0/target3:0:1/3:0:1:2")
+	if err := os.MkdirAll(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "block/sdb"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(root, "block/sdb/device")); err != nil {
+		t.Fatal(err)
+	}
+	hctl, err := GetHCTL("/dev/sdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hctl != (HCTL{Host: "3", Channel: "0", Target: "1", Lun: "2"}) {
+		t.Errorf("unexpected hctl: %#v", hctl)
+	}
+}
+
+func TestRescanHCTL(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "class/scsi_host/host3/scan", "")
+	writeFakeFile(t, root, "class/scsi_host/host4/scan", "")
+	if err := RescanHCTL("3", "0", "1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(filepath.Join(root, "class/scsi_host/host3/scan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "0 1 2\n" {
+		t.Errorf("unexpected scan string: %q", out)
+	}
+	if out, _ := ioutil.ReadFile(filepath.Join(root, "class/scsi_host/host4/scan")); len(out) != 0 {
+		t.Errorf("unexpected scan on host4: %q", out)
+	}
+}
+
+func TestRescanSCSIDevice(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "bus/scsi/devices/3:0:1:2/rescan", "")
+	if err := RescanSCSIDevice(HCTL{Host: "3", Channel: "0", Target: "1", Lun: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := ioutil.ReadFile(filepath.Join(root, "bus/scsi/devices/3:0:1:2/rescan")); string(out) != "1\n" {
+		t.Errorf("unexpected rescan string: %q", out)
+	}
+	if err := RescanSCSIDevice(HCTL{Host: "4", Channel: "0", Target: "0", Lun: "1"}); err == nil {
+		t.Error("expected an error for a missing device")
+	}
+}
+
+//fakeSCSIID answers scsi_id with the output configured for each page.
+func fakeSCSIID(pages map[string]string) osBrick.Executor {
+	return func(name string, arg ...string) (string, error) {
+		if name != "/lib/udev/scsi_id" {
+			return "", fmt.Errorf("unexpected command %s %s", name, strings.Join(arg, " "))
+		}
+		return pages[arg[1]], nil
+	}
+}
+
+func TestGetSCSIIDPage83(t *testing.T) {
+	fakeExecutor(t, fakeSCSIID(map[string]string{
+		"0x83": "3600a098038303634722b4d59614c5a41\n",
+		"0x80": "SNETAPP_LUN_C-Mode_80-Pk$L4ZA\n",
+	}))
+	id, err := GetSCSIID("/dev/sdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != (SCSIID{ID: "3600a098038303634722b4d59614c5a41", Type: SCSIIDTypeWWN}) {
+		t.Errorf("unexpected id: %#v", id)
+	}
+}
+
+func TestGetSCSIIDPage80Fallback(t *testing.T) {
+	fakeExecutor(t, fakeSCSIID(map[string]string{
+		"0x83": "",
+		"0x80": "SQEMU_QEMU_HARDDISK_drive-scsi0-0-0-1\n",
+	}))
+	id, err := GetSCSIID("/dev/sdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != (SCSIID{ID: "SQEMU_QEMU_HARDDISK_drive-scsi0-0-0-1", Type: SCSIIDTypeSerial}) {
+		t.Errorf("unexpected id: %#v", id)
+	}
+	serial, err := GetSCSISerial("/dev/sdb")
+	if err != nil || serial != "SQEMU_QEMU_HARDDISK_drive-scsi0-0-0-1" {
+		t.Errorf("unexpected serial %q, %v", serial, err)
+	}
+
+	fakeExecutor(t, fakeSCSIID(map[string]string{}))
+	if _, err := GetSCSIID("/dev/sdb"); err == nil {
+		t.Error("expected error when both pages are empty")
+	}
+}
+
+func TestResizeMultipathDeviceSerialized(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		ops     []string
+		resized = make(map[string]bool)
+	)
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch {
+		case name == "multipathd" && arg[0] == "reconfigure":
+			mu.Lock()
+			ops = append(ops, "reconfigure")
+			mu.Unlock()
+			//give a concurrent extend the chance to interleave
+			time.Sleep(10 * time.Millisecond)
+			return "ok\n", nil
+		case name == "multipathd" && arg[0] == "resize":
+			mu.Lock()
+			defer mu.Unlock()
+			ops = append(ops, "resize "+arg[2])
+			//the first resize of each map needs a reconfigure
+			if !resized[arg[2]] {
+				resized[arg[2]] = true
+				return "fail\n", nil
+			}
+			return "ok\n", nil
+		case name == "blockdev":
+			return "2147483648\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+
+	var wg sync.WaitGroup
+	for _, wwn := range []string{"wwn1", "wwn2"} {
+		wg.Add(1)
+		go func(wwn string) {
+			defer wg.Done()
+			if _, err := resizeMultipathDevice(wwn, "/dev/mapper/"+wwn); err != nil {
+				t.Error(err)
+			}
+		}(wwn)
+	}
+	wg.Wait()
+
+	if len(ops) != 6 {
+		t.Fatalf("unexpected ops: %v", ops)
+	}
+	for i := 0; i < len(ops); i += 3 {
+		if !strings.HasPrefix(ops[i], "resize ") || ops[i+1] != "reconfigure" || ops[i+2] != ops[i] {
+			t.Errorf("reconfigure and resize interleaved: %v", ops)
+		}
+	}
+}
+
+func TestResizeMultipathDeviceWithoutReconfigure(t *testing.T) {
+	//a reply merely mentioning fail, e.g. failback, is a success
+	for _, reply := range []string{"ok\n", "ok\nfailback immediate\n"} {
+		ops := make([]string, 0)
+		fakeExecutor(t, func(name string, arg ...string) (string, error) {
+			switch {
+			case name == "multipathd":
+				ops = append(ops, name+" "+strings.Join(arg, " "))
+				return reply, nil
+			case name == "dmsetup":
+				return "0 4194304 multipath 0 1 alua 1 1 service-time 0 1 1 8:16 1\n", nil
+			case name == "blockdev":
+				return "2147483648\n", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		})
+		size, err := resizeMultipathDevice("wwn1", "/dev/mapper/wwn1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != 2147483648 {
+			t.Errorf("expected 2147483648, got %f", size)
+		}
+		expected := []string{"multipathd resize map wwn1"}
+		if !reflect.DeepEqual(ops, expected) {
+			t.Errorf("%q: expected %v, got %v", reply, expected, ops)
+		}
+	}
+}
+
+func TestDoExtendVolumeRetriesMemberRescan(t *testing.T) {
+	root := newFakeSysFS(t)
+	fs := newMemFS(t)
+	for device, hctl := range map[string]string{"sdb": "2:0:0:1", "sdc": "3:0:0:1"} {
+		fs.WriteFile("/dev/"+device, nil)
+		fs.MkdirAll(root + "/devices/platform/" + hctl)
+		fs.Symlink("../../devices/platform/"+hctl, root+"/block/"+device+"/device")
+	}
+	fs.WriteFile("/dev/disk/by-id/dm-uuid-mpath-3600a0980383036347224000000000001", nil)
+	//3:0:0:1 is missing, its member fails to rescan until it's back
+	writeFakeFile(t, root, "bus/scsi/devices/2:0:0:1/rescan", "")
+	defer func(attempts int, interval time.Duration) {
+		ExtendRescanAttempts, ExtendRescanInterval = attempts, interval
+	}(ExtendRescanAttempts, ExtendRescanInterval)
+	ExtendRescanAttempts, ExtendRescanInterval = 3, time.Millisecond
+
+	ops := make([]string, 0)
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch name {
+		case "blockdev":
+			//sdc can't be read either while 3:0:0:1 is missing
+			if _, err := os.Stat(filepath.Join(root, "bus/scsi/devices/3:0:0:1")); err != nil && arg[len(arg)-1] == "/dev/sdc" {
+				return "", fmt.Errorf("exit status 1")
+			}
+			return "2147483648\n", nil
+		case "/lib/udev/scsi_id":
+			writeFakeFile(t, root, "bus/scsi/devices/3:0:0:1/rescan", "")
+			return "3600a0980383036347224000000000001\n", nil
+		case "multipathd":
+			//the map is only resized once both members were rescanned
+			for _, hctl := range []string{"2:0:0:1", "3:0:0:1"} {
+				rescan, _ := ioutil.ReadFile(filepath.Join(root, "bus/scsi/devices", hctl, "rescan"))
+				ops = append(ops, hctl+" "+strings.TrimSpace(string(rescan)))
+			}
+			ops = append(ops, name+" "+strings.Join(arg, " "))
+			return "ok\n", nil
+		case "dmsetup":
+			return "0 4194304 multipath 0 1 alua 1 1 service-time 0 1 1 8:16 1\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+
+	size, err := DoExtendVolume([]string{"/dev/sdb", "/dev/sdc"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 2147483648 {
+		t.Errorf("expected 2147483648, got %f", size)
+	}
+	expected := []string{"2:0:0:1 1", "3:0:0:1 1", "multipathd resize map 3600a0980383036347224000000000001"}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected %v, got %v", expected, ops)
+	}
+
+	//a member which can't be rescanned fails the extend
+	if err := os.RemoveAll(filepath.Join(root, "class/scsi_host/host3")); err != nil {
+		t.Fatal(err)
+	}
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch name {
+		case "blockdev":
+			return "2147483648\n", nil
+		case "/lib/udev/scsi_id":
+			return "3600a0980383036347224000000000001\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	if _, err := DoExtendVolume([]string{"/dev/sdb", "/dev/sdc"}, true); err == nil || !strings.Contains(err.Error(), "/dev/sdc") {
+		t.Errorf("expected the rescan of /dev/sdc to fail the extend, got %v", err)
+	}
+}
+
+func TestScanAllSCSIHosts(t *testing.T) {
+	root := newFakeSysFS(t)
+	hosts := []string{"host0", "host2", "host7"}
+	for _, host := range hosts {
+		writeFakeFile(t, root, "class/scsi_host/"+host+"/scan", "")
+	}
+	if err := ScanAllSCSIHosts(); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range hosts {
+		scan, err := ioutil.ReadFile(filepath.Join(root, "class/scsi_host", host, "scan"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(scan) != "- - -\n" {
+			t.Errorf("%s: expected a wildcard scan, got %q", host, scan)
+		}
+	}
+}
+
+func TestGetDeviceInfo(t *testing.T) {
+	newFakeSysFS(t)
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		return "/dev/sdb: scsi2 channel=0 id=1 lun=3 [em]\n", nil
+	})
+	info, err := GetDeviceInfo("/dev/sdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info["host"] != "2" || info["channel"] != "0" || info["id"] != "1" || info["lun"] != "3" {
+		t.Errorf("unexpected device info: %#v", info)
+	}
+}
+
+func TestGetDeviceInfoMalformedOutput(t *testing.T) {
+	root := newFakeSysFS(t)
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		return "/dev/sdb: [=sg_scan unknown format]\n", nil
+	})
+	if _, err := GetDeviceInfo("/dev/sdb"); err == nil {
+		t.Error("expected error when neither sg_scan nor sysfs has the scsi address")
+	}
+
+	target := filepath.Join(root, "devices/host2/target2:0:1/2:0:1:3")
+	if err := os.MkdirAll(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "block/sdb"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(root, "block/sdb/device")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := GetDeviceInfo("/dev/sdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info["host"] != "2" || info["channel"] != "0" || info["id"] != "1" || info["lun"] != "3" {
+		t.Errorf("unexpected device info: %#v", info)
+	}
+}
+
+func TestGetDeviceSizeSysfs(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "block/dm-2/size", "4194304\n")
+	size, err := GetDeviceSizeSysfs("/dev/dm-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 2147483648 {
+		t.Errorf("unexpected size: %d", size)
+	}
+	if _, err := GetDeviceSizeSysfs("/dev/dm-3"); err == nil {
+		t.Error("expected error for missing size file")
+	}
+}
+
+//fakeSCSIDevice links /sys/block/<dev>/device to the scsi device hctl.
+func fakeSCSIDevice(t *testing.T, root, dev, hctl string) string {
+	target := filepath.Join(root, "bus/scsi/devices", hctl)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "block", dev), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(root, "block", dev, "device")); err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+func TestSetSCSIQueueDepth(t *testing.T) {
+	root := newFakeSysFS(t)
+	target := fakeSCSIDevice(t, root, "sdb", "2:0:1:3")
+	writeFakeFile(t, target, "queue_depth", "32\n")
+	writeFakeFile(t, target, "queue_depth_max", "64\n")
+
+	if depth, err := GetSCSIQueueDepth("/dev/sdb"); err != nil || depth != 32 {
+		t.Errorf("unexpected queue depth %d, %v", depth, err)
+	}
+	if err := SetSCSIQueueDepth("/dev/sdb", 64); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := ioutil.ReadFile(filepath.Join(target, "queue_depth")); string(out) != "64\n" {
+		t.Errorf("unexpected queue_depth written: %q", out)
+	}
+	for _, depth := range []int{0, 65} {
+		if err := SetSCSIQueueDepth("/dev/sdb", depth); err == nil {
+			t.Errorf("expected queue depth %d to be rejected", depth)
+		}
+	}
+	if out, _ := ioutil.ReadFile(filepath.Join(target, "queue_depth")); string(out) != "64\n" {
+		t.Errorf("queue_depth changed by rejected values: %q", out)
+	}
+}
+
+func TestSetIOScheduler(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "block/sdb/queue/scheduler", "mq-deadline kyber [bfq] none\n")
+	writeFakeFile(t, root, "block/sdc/queue/scheduler", "none\n")
+
+	if sched, err := GetIOScheduler("/dev/sdb"); err != nil || sched != "bfq" {
+		t.Errorf("unexpected io scheduler %q, %v", sched, err)
+	}
+	if sched, err := GetIOScheduler("/dev/sdc"); err != nil || sched != "none" {
+		t.Errorf("unexpected io scheduler %q, %v", sched, err)
+	}
+	if err := SetIOScheduler("/dev/sdb", "mq-deadline"); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := ioutil.ReadFile(filepath.Join(root, "block/sdb/queue/scheduler")); string(out) != "mq-deadline\n" {
+		t.Errorf("unexpected scheduler written: %q", out)
+	}
+	if err := SetIOScheduler("/dev/sdc", "mq-deadline"); err == nil {
+		t.Error("expected an unavailable scheduler to be rejected")
+	}
+}
+
+func TestSCSIAttributesFromDefaultFS(t *testing.T) {
+	fs := newMemFS(t)
+	fs.WriteFile(sysfsPath("/sys/block/sdb/queue/scheduler"), []byte("mq-deadline [none]\n"))
+	fs.WriteFile(sysfsPath("/sys/bus/scsi/devices/2:0:1:3/queue_depth"), []byte("32\n"))
+	fs.Symlink("../../bus/scsi/devices/2:0:1:3", sysfsPath("/sys/block/sdb/device"))
+	fs.WriteFile(sysfsPath("/sys/class/fc_transport/target2:0:1/port_name"), []byte("0x20210002ac00383d\n"))
+
+	if sched, err := GetIOScheduler("/dev/sdb"); err != nil || sched != "none" {
+		t.Errorf("unexpected io scheduler %q, %v", sched, err)
+	}
+	if depth, err := GetSCSIQueueDepth("/dev/sdb"); err != nil || depth != 32 {
+		t.Errorf("unexpected queue depth %d, %v", depth, err)
+	}
+	addresses, err := GetFCTargetAddresses("20210002ac00383d")
+	if err != nil || !reflect.DeepEqual(addresses, []HCTL{{Host: "2", Channel: "0", Target: "1"}}) {
+		t.Errorf("unexpected target addresses %v, %v", addresses, err)
+	}
+}
+
+func TestProbeDevice(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "block/dm-0/dm/uuid", "mpath-3600a0980383036347224000000000001\n")
+	writeFakeFile(t, root, "block/dm-0/dm/name", "mpatha\n")
+	writeFakeFile(t, root, "block/sdb/holders/dm-0", "")
+	dev := filepath.Join(t.TempDir(), "sdb")
+	writeFakeFile(t, "/", dev, "")
+
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch name {
+		case "/lib/udev/scsi_id":
+			return "3600a0980383036347224000000000001\n", nil
+		case "blockdev":
+			if arg[0] == "--getsize64" {
+				return "10737418240\n", nil
+			}
+			return "512\n4096\n", nil
+		case "lsblk":
+			return `{"blockdevices": [{"name": "sda", "ro": false}, {"name": "sdb", "ro": true, "children": [{"name": "mpatha", "ro": true}]}]}`, nil
+		case "blkid":
+			return "", fmt.Errorf("blkid failed")
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+
+	details, err := ProbeDevice(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.WWN != "3600a0980383036347224000000000001" || details.Size != 10737418240 ||
+		details.LogicalBlockSize != 512 || details.PhysicalBlockSize != 4096 ||
+		details.MultipathWWN != "3600a0980383036347224000000000001" || details.MultipathDevice != "/dev/mapper/mpatha" ||
+		!details.ReadOnly || details.FSType != "" {
+		t.Errorf("unexpected details: %#v", details)
+	}
+	if len(details.Errors) != 1 || details.Errors["FSType"] == nil {
+		t.Errorf("expected only the FSType probe to fail: %v", details.Errors)
+	}
+}
+
+func TestGetFirstPartition(t *testing.T) {
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch arg[len(arg)-1] {
+		case "/dev/mapper/mpatha":
+			return `{"blockdevices": [{"name": "/dev/mapper/mpatha", "type": "mpath", "children": [` +
+				`{"name": "/dev/mapper/mpatha1", "type": "part"}, {"name": "/dev/mapper/mpatha2", "type": "part"}]}]}`, nil
+		case "/dev/sdc":
+			return `{"blockdevices": [{"name": "/dev/sdc", "type": "disk"}]}`, nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	if part, err := GetFirstPartition("/dev/mapper/mpatha"); err != nil || part != "/dev/mapper/mpatha1" {
+		t.Errorf("unexpected partition %q, %v", part, err)
+	}
+	if part, err := GetFirstPartition("/dev/sdc"); err != nil || part != "/dev/sdc" {
+		t.Errorf("expected the device itself, got %q, %v", part, err)
+	}
+}
+
+func TestFormatLunIDString(t *testing.T) {
+	for _, lun := range []string{"0x10", "16"} {
+		id, err := formatLunID(lun)
+		if err != nil {
+			t.Errorf("lun %s: %v", lun, err)
+		} else if id != 16 {
+			t.Errorf("lun %s: expected 16, got %#v", lun, id)
+		}
+	}
+	//a leading zero is still decimal
+	if id, err := formatLunID("010"); err != nil || id != 10 {
+		t.Errorf("lun 010: expected 10, got %#v, %v", id, err)
+	}
+	if _, err := formatLunID("lun1"); err == nil {
+		t.Error("expected error for a bad lun")
+	}
+}
+
+func TestFlushDeviceIORetryBackoff(t *testing.T) {
+	fs := newMemFS(t)
+	//the device only exists in the fake fs, blockdev fails on it
+	fs.WriteFile("/dev/os-brick-no-such-device", []byte{})
+	defer func(f func(time.Duration)) { flushRetrySleep = f }(flushRetrySleep)
+	defer func(d time.Duration) { FlushRetryMaxElapsed = d }(FlushRetryMaxElapsed)
+	for _, c := range []struct {
+		maxElapsed time.Duration
+		intervals  []time.Duration
+	}{
+		{0, []time.Duration{20 * time.Second, 40 * time.Second}},
+		{30 * time.Second, []time.Duration{20 * time.Second}},
+	} {
+		intervals := make([]time.Duration, 0)
+		flushRetrySleep = func(d time.Duration) { intervals = append(intervals, d) }
+		FlushRetryMaxElapsed = c.maxElapsed
+		if err := FlushDeviceIO("/dev/os-brick-no-such-device"); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(intervals, c.intervals) {
+			t.Errorf("max elapsed %v: expected retry intervals %v, got %v", c.maxElapsed, c.intervals, intervals)
+		}
+	}
+}
+
+func TestWaitForIODrain(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "block/sdb/inflight", "2 1\n")
+	defer func(d time.Duration) { FlushDrainInterval = d }(FlushDrainInterval)
+	FlushDrainInterval = time.Millisecond
+
+	if err := waitForIODrain("/dev/sdb", 5*time.Millisecond); err == nil {
+		t.Fatal("expected timeout while IO is inflight")
+	}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		time.Sleep(10 * time.Millisecond)
+		//replace the file at once so a read never sees it half written
+		tmp := filepath.Join(root, "block/sdb/inflight.tmp")
+		if err := ioutil.WriteFile(tmp, []byte("0 0\n"), 0644); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := os.Rename(tmp, filepath.Join(root, "block/sdb/inflight")); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := waitForIODrain("/dev/sdb", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	<-drained
+}
+
+func TestGetInflightIO(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "block/sdb/inflight", "       3        4\n")
+	if n, err := GetInflightIO("/dev/sdb"); err != nil || n != 7 {
+		t.Errorf("expected 7 inflight, got %d, %v", n, err)
+	}
+	writeFakeFile(t, root, "block/sdb/inflight", "busy\n")
+	if _, err := GetInflightIO("/dev/sdb"); err == nil {
+		t.Error("expected error for malformed inflight")
+	}
+}
+
+func TestWWNCache(t *testing.T) {
+	dev := newFakeSysFS(t)
+	for _, d := range []string{"sdb", "sdc"} {
+		writeFakeFile(t, dev, d, "")
+	}
+	byPath := filepath.Join(dev, "pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1")
+	if err := os.Symlink(filepath.Join(dev, "sdb"), byPath); err != nil {
+		t.Fatal(err)
+	}
+	calls := make(map[string]int)
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		device := arg[len(arg)-1]
+		calls[filepath.Base(device)]++
+		if filepath.Base(device) == "sdc" && calls["sdc"] == 1 {
+			return "", fmt.Errorf("scsi_id failed")
+		}
+		return "3600a0980383036347224000000000001\n", nil
+	})
+
+	cache := NewWWNCache()
+	for _, path := range []string{byPath, filepath.Join(dev, "sdb"), byPath, filepath.Join(dev, "sdc"), filepath.Join(dev, "sdc")} {
+		cache.GetSCSIWWN(path)
+	}
+	if calls["sdb"]+calls[filepath.Base(byPath)] != 1 {
+		t.Errorf("expected scsi_id to run once for sdb, got %v", calls)
+	}
+	//a failure isn't cached
+	if calls["sdc"] != 2 {
+		t.Errorf("expected scsi_id to run twice for sdc, got %v", calls)
+	}
+}
+
+func BenchmarkWWNCache(b *testing.B) {
+	orig := osBrick.DefaultExecutor
+	defer func() { osBrick.DefaultExecutor = orig }()
+	osBrick.DefaultExecutor = func(name string, arg ...string) (string, error) {
+		return "3600a0980383036347224000000000001\n", nil
+	}
+	paths := []string{"/dev/sdb", "/dev/sdc", "/dev/sdd", "/dev/sde"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache := NewWWNCache()
+		for j := 0; j < 4; j++ {
+			for _, path := range paths {
+				if _, err := cache.GetSCSIWWN(path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func TestExtendMultipathDevice(t *testing.T) {
+	root := newFakeSysFS(t)
+	for _, hctl := range []string{"2:0:0:1", "3:0:0:1"} {
+		writeFakeFile(t, root, "bus/scsi/devices/"+hctl+"/rescan", "")
+	}
+	fs := newMemFS(t)
+	fs.WriteFile("/dev/dm-0", nil)
+	fs.Symlink("../dm-0", "/dev/mapper/mpatha")
+	fs.WriteFile(filepath.Join(root, "block/dm-0/dm/uuid"), []byte("mpath-3600a0980383036347224000000000001\n"))
+
+	var resized string
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch {
+		case name == "multipath" && arg[0] == "-l":
+			return "mpatha (3600a0980383036347224000000000001) dm-0 NETAPP,LUN C-Mode\n" +
+				"size=2.0G features='1 queue_if_no_path' hwhandler='1 alua' wp=rw\n" +
+				"|-+- policy='service-time 0' prio=0 status=active\n" +
+				"| `- 2:0:0:1 sdb 8:16 active undef running\n" +
+				"`-+- policy='service-time 0' prio=0 status=enabled\n" +
+				"  `- 3:0:0:1 sdc 8:32 active undef running\n", nil
+		case name == "multipathd" && arg[0] == "reconfigure":
+			return "ok\n", nil
+		case name == "multipathd" && arg[0] == "resize":
+			resized = arg[2]
+			return "ok\n", nil
+		case name == "blockdev":
+			return "2147483648\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+
+	size, err := ExtendMultipathDevice("/dev/mapper/mpatha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 2147483648 {
+		t.Errorf("unexpected size %d", size)
+	}
+	if resized != "3600a0980383036347224000000000001" {
+		t.Errorf("unexpected map resized: %q", resized)
+	}
+	for _, hctl := range []string{"2:0:0:1", "3:0:0:1"} {
+		rescan, err := ioutil.ReadFile(filepath.Join(root, "bus/scsi/devices", hctl, "rescan"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rescan) != "1\n" {
+			t.Errorf("%s: unexpected rescan %q", hctl, rescan)
+		}
+	}
+
+	//the map isn't resized while a member keeps the old size
+	resized = ""
+	if err := os.RemoveAll(filepath.Join(root, "bus/scsi/devices/3:0:0:1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExtendMultipathDevice("/dev/mapper/mpatha"); err == nil || resized != "" {
+		t.Errorf("expected a failed member rescan to stop the resize, got %v, %q", err, resized)
+	}
+}
+
+func TestResizeMultipathDeviceReloadFallback(t *testing.T) {
+	for _, resize := range []struct {
+		out string
+		err error
+	}{
+		{"fail\n", nil},
+		{"", fmt.Errorf("exit status 1")},
+	} {
+		var (
+			ops  []string
+			size = "1073741824"
+		)
+		fakeExecutor(t, func(name string, arg ...string) (string, error) {
+			ops = append(ops, name+" "+strings.Join(arg, " "))
+			switch {
+			case name == "multipathd" && arg[0] == "reconfigure":
+				return "ok\n", nil
+			case name == "multipathd" && arg[0] == "resize":
+				return resize.out, resize.err
+			case name == "multipath" && arg[0] == "-r":
+				size = "2147483648"
+				return "", nil
+			case name == "dmsetup":
+				return "0 4194304 multipath 1 queue_if_no_path 0 1 1 service-time 0 1 1 8:16 1\n", nil
+			case name == "blockdev":
+				return size + "\n", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		})
+		newSize, err := resizeMultipathDevice("wwn1", "/dev/mapper/wwn1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if newSize != 2147483648 {
+			t.Errorf("resize %v: expected size re-read after reload, got %f", resize, newSize)
+		}
+		//followed by the size cross-check, dmsetup table and blockdev
+		if ops[len(ops)-3] != "multipath -r" {
+			t.Errorf("resize %v: expected reload fallback, got %v", resize, ops)
+		}
+	}
+}
+
+func TestResizeMultipathDeviceWaitsForDMSize(t *testing.T) {
+	defer func(timeout, interval time.Duration) {
+		DMSizeWaitTimeout, DMSizeWaitInterval = timeout, interval
+	}(DMSizeWaitTimeout, DMSizeWaitInterval)
+	DMSizeWaitInterval = time.Millisecond
+
+	for _, c := range []struct {
+		//how many times blockdev reports the old size after the resize
+		lag      int
+		timeout  time.Duration
+		expected float64
+	}{
+		{0, time.Second, 2147483648},
+		{3, time.Second, 2147483648},
+		//blockdev never catches up, the size of the map is trusted
+		{1000, 10 * time.Millisecond, 2147483648},
+	} {
+		DMSizeWaitTimeout = c.timeout
+		var (
+			resized bool
+			polls   int
+		)
+		fakeExecutor(t, func(name string, arg ...string) (string, error) {
+			switch {
+			case name == "multipathd" && arg[0] == "reconfigure":
+				return "ok\n", nil
+			case name == "multipathd" && arg[0] == "resize":
+				resized = true
+				return "ok\n", nil
+			case name == "dmsetup":
+				if !resized {
+					return "0 2097152 multipath 0 1 alua 1 1 service-time 0 1 1 8:16 1\n", nil
+				}
+				return "0 4194304 multipath 0 1 alua 1 1 service-time 0 1 1 8:16 1\n", nil
+			case name == "blockdev":
+				if resized {
+					if polls++; polls > c.lag {
+						return "2147483648\n", nil
+					}
+				}
+				return "1073741824\n", nil
+			}
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		})
+		size, err := resizeMultipathDevice("wwn1", "/dev/mapper/wwn1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != c.expected {
+			t.Errorf("lag %d: expected size %f, got %f", c.lag, c.expected, size)
+		}
+		if c.lag < 1000 && polls != c.lag+1 {
+			t.Errorf("lag %d: expected to wait for blockdev, polled %d times", c.lag, polls)
+		}
+	}
+}
+
+func TestWaitForSCSIWWN(t *testing.T) {
+	fastSCSIWWNRetry(t)
+	calls := 0
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		//the device is still settling on the first call
+		if calls++; calls == 1 {
+			return "\n", nil
+		}
+		return "3600a0980383036347224000000000001\n", nil
+	})
+	wwn, err := WaitForSCSIWWN("/dev/sdb")
+	if err != nil || wwn != "3600a0980383036347224000000000001" {
+		t.Errorf("unexpected wwn %q, %v", wwn, err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 scsi_id calls, got %d", calls)
+	}
+
+	calls = 0
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		calls++
+		return "", fmt.Errorf("exit status 1")
+	})
+	if _, err := WaitForSCSIWWN("/dev/sdb"); err == nil {
+		t.Error("expected error once the attempts are exhausted")
+	}
+	if calls != SCSIWWNAttempts {
+		t.Errorf("expected %d scsi_id calls, got %d", SCSIWWNAttempts, calls)
+	}
+
+	//the other callers don't wait
+	calls = 0
+	if _, err := GetSCSIWWN("/dev/sdb"); err == nil || calls != 1 {
+		t.Errorf("expected a single failed scsi_id call, got %d, %v", calls, err)
+	}
+	calls = 0
+	if _, err := GetSCSIID("/dev/sdb"); err == nil || calls != 2 {
+		t.Errorf("expected a scsi_id call per page, got %d, %v", calls, err)
+	}
+}
+
+func TestGetDeviceKind(t *testing.T) {
+	fs := newMemFS(t)
+	fs.MkdirAll("/sys/class/block/sdb")
+	fs.WriteFile("/sys/class/block/sdb1/partition", []byte("1\n"))
+	fs.WriteFile("/sys/class/block/dm-0/dm/uuid", []byte("mpath-3600a0980383036347224000000000001\n"))
+	fs.WriteFile("/sys/class/block/dm-1/dm/uuid", []byte("part1-mpath-3600a0980383036347224000000000001\n"))
+	fs.WriteFile("/dev/dm-0", nil)
+	fs.Symlink("../dm-0", "/dev/mapper/mpatha")
+
+	for device, expected := range map[string]string{
+		"/dev/sdb":           DeviceKindDisk,
+		"/dev/sdb1":          DeviceKindPartition,
+		"/dev/mapper/mpatha": DeviceKindMultipath,
+		"/dev/dm-1":          DeviceKindPartition,
+	} {
+		if kind, err := GetDeviceKind(device); err != nil || kind != expected {
+			t.Errorf("%s: expected %s, got %q, %v", device, expected, kind, err)
+		}
+	}
+	if _, err := GetDeviceKind("/dev/sdz"); err == nil {
+		t.Error("expected error for a device missing in sysfs")
+	}
+}
+
+func TestWaitForRWStaysReadOnly(t *testing.T) {
+	defer func(d time.Duration) { RWWaitInterval = d }(RWWaitInterval)
+	RWWaitInterval = time.Millisecond
+	reloads := 0
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch name {
+		case "lsblk":
+			return `{"blockdevices": [` +
+				`{"name": "sdb", "ro": "1", "children": [{"name": "3600a0980383036347224000000000001", "ro": "1"}]},` +
+				`{"name": "sdc", "ro": "1", "children": [{"name": "3600a0980383036347224000000000001", "ro": "1"}]}]}`, nil
+		case "multipath":
+			reloads++
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	err := WaitForRW("3600a0980383036347224000000000001", "/dev/mapper/mpatha")
+	if !errors.Is(err, ErrDeviceReadOnly) {
+		t.Fatalf("expected ErrDeviceReadOnly, got %v", err)
+	}
+	if reloads != RWWaitAttempts {
+		t.Errorf("expected %d reloads, got %d", RWWaitAttempts, reloads)
+	}
+}
+
+func TestWaitForRWAfterReload(t *testing.T) {
+	ro := "1"
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		switch name {
+		case "lsblk":
+			return `{"blockdevices": [{"name": "3600a0980383036347224000000000001", "ro": "` + ro + `"}]}`, nil
+		case "multipath":
+			ro = "0"
+			return "", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+	defer func(d time.Duration) { RWWaitInterval = d }(RWWaitInterval)
+	RWWaitInterval = time.Millisecond
+	if err := WaitForRW("3600a0980383036347224000000000001", "/dev/mapper/mpatha"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetSCSIWWNs(t *testing.T) {
+	defer func(n int) { SCSIWWNConcurrency = n }(SCSIWWNConcurrency)
+	SCSIWWNConcurrency = 2
+	var (
+		mu               sync.Mutex
+		running, maxSeen int
+	)
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		mu.Lock()
+		if running++; running > maxSeen {
+			maxSeen = running
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		switch arg[len(arg)-1] {
+		case "/dev/sdb", "/dev/sdc":
+			return "3600a0980383036347224000000000001\n", nil
+		case "/dev/sdd":
+			return "3600a0980383036347224000000000002\n", nil
+		}
+		return "", fmt.Errorf("scsi_id failed")
+	})
+
+	wwns, err := GetSCSIWWNs([]string{"/dev/sdb", "/dev/sdc", "/dev/sdd", "/dev/sde"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"/dev/sdb": "3600a0980383036347224000000000001",
+		"/dev/sdc": "3600a0980383036347224000000000001",
+		"/dev/sdd": "3600a0980383036347224000000000002",
+	}
+	if !reflect.DeepEqual(wwns, expected) {
+		t.Errorf("unexpected wwns %v", wwns)
+	}
+	if maxSeen > 2 {
+		t.Errorf("expected at most 2 concurrent scsi_id, got %d", maxSeen)
+	}
+	if _, err := GetSCSIWWNs([]string{"/dev/sde"}); err == nil {
+		t.Error("expected error when no path succeeded")
+	}
+}
+
+func TestFindMultipathDeviceWWIDFromSysfs(t *testing.T) {
+	for _, header := range []string{
+		//friendly names on, no wwid shown
+		"mpatha dm-0 NETAPP,LUN C-Mode\n",
+		//alias in the parentheses instead of the wwid
+		"mpatha (mpatha) dm-0 NETAPP,LUN C-Mode\n",
+	} {
+		fs := newMemFS(t)
+		fs.WriteFile("/dev/dm-0", nil)
+		fs.Symlink("../dm-0", "/dev/mapper/mpatha")
+		fs.WriteFile("/sys/block/dm-0/dm/uuid", []byte("mpath-3600a0980383036347224000000000001\n"))
+		fakeExecutor(t, func(name string, arg ...string) (string, error) {
+			return header +
+				"size=2.0G features='1 queue_if_no_path' hwhandler='1 alua' wp=rw\n" +
+				"`-+- policy='service-time 0' prio=0 status=active\n" +
+				"  `- 2:0:0:1 sdb 8:16 active undef running\n", nil
+		})
+		info, err := FindMultipathDevice("/dev/sdb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info["id"] != "3600a0980383036347224000000000001" || info["name"] != "mpatha" {
+			t.Errorf("%q: unexpected multipath info %v", header, info)
+		}
+	}
+}
+
+func TestFlushMultipathDeviceContextCancel(t *testing.T) {
+	//a multipath -f stuck on a dead path
+	release := make(chan struct{})
+	defer close(release)
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		<-release
+		return "", nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := FlushMultipathDeviceContext(ctx, "3600a0980383036347224000000000001"); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancel took %v", elapsed)
+	}
+}
+
+func TestFlushMultipathDeviceBackoff(t *testing.T) {
+	//a multipath -f failing every time, recording when it ran
+	var times []time.Time
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		if name != "multipath" || strings.Join(arg, " ") != "-f 3600a0980383036347224000000000001" {
+			return "", fmt.Errorf("unexpected command %s %v", name, arg)
+		}
+		times = append(times, time.Now())
+		return "", errors.New("map in use")
+	})
+	defer func(intervals []time.Duration, timeout time.Duration) {
+		MultipathFlushRetryIntervals, MultipathFlushTimeout = intervals, timeout
+	}(MultipathFlushRetryIntervals, MultipathFlushTimeout)
+	MultipathFlushRetryIntervals = []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}
+	MultipathFlushTimeout = time.Minute
+
+	err := FlushMultipathDevice("3600a0980383036347224000000000001")
+	if err == nil || !strings.Contains(err.Error(), "map in use") {
+		t.Fatalf("expected the error of the last attempt, got %v", err)
+	}
+	if len(times) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(times))
+	}
+	for i, interval := range MultipathFlushRetryIntervals {
+		if gap := times[i+1].Sub(times[i]); gap < interval {
+			t.Errorf("retry %d after %v, expected at least %v", i+1, gap, interval)
+		}
+	}
+
+	//the retries stop at the timeout
+	MultipathFlushTimeout = 50 * time.Millisecond
+	times = nil
+	if err := FlushMultipathDevice("3600a0980383036347224000000000001"); err == nil {
+		t.Error("expected an error")
+	}
+	if len(times) != 1 {
+		t.Errorf("expected a single attempt within the timeout, got %d", len(times))
+	}
+}
+
+func TestIsMultipathPathAndRequiresFlush(t *testing.T) {
+	fs := newMemFS(t)
+	fs.WriteFile("/dev/dm-0", nil)
+	fs.WriteFile("/sys/block/dm-0/dm/uuid", []byte("mpath-3600a0980383036347224000000000001\n"))
+	fs.Symlink("../../dm-0", "/dev/disk/by-id/dm-uuid-mpath-3600a0980383036347224000000000001")
+	fs.Symlink("../dm-0", "/dev/mapper/mpathb")
+	fs.WriteFile("/dev/sdb", nil)
+	fs.Symlink("../../sdb", "/dev/disk/by-path/pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1")
+	//crypt-mpath opened on the multipath device, crypt-sdb on the path
+	fs.WriteFile("/dev/dm-1", nil)
+	fs.Symlink("../dm-1", "/dev/mapper/crypt-mpath")
+	fs.WriteFile("/sys/block/dm-1/dm/uuid", []byte("CRYPT-LUKS2-4b2d3ad5a3b14a8aa0e7e1e52e5c2f0e-crypt-mpath\n"))
+	fs.WriteFile("/sys/block/dm-1/slaves/dm-0", nil)
+	fs.WriteFile("/dev/dm-2", nil)
+	fs.Symlink("../dm-2", "/dev/mapper/crypt-sdb")
+	fs.WriteFile("/sys/block/dm-2/dm/uuid", []byte("CRYPT-LUKS2-5c3e4be6b4c25b9bb1f8f2f63f6d3f1f-crypt-sdb\n"))
+	fs.WriteFile("/sys/block/dm-2/slaves/sdb", nil)
+
+	for _, c := range []struct {
+		pathUsed  string
+		multipath bool
+		flush     bool
+	}{
+		{"/dev/disk/by-id/dm-uuid-mpath-3600a0980383036347224000000000001", true, false},
+		{"/dev/mapper/mpathb", true, false},
+		{"/dev/disk/by-path/pci-0000:05:00.2-fc-0x20210002ac00383d-lun-1", false, true},
+		{"/dev/mapper/crypt-mpath", true, false},
+		{"/dev/mapper/crypt-sdb", false, false},
+	} {
+		multipath := IsMultipathPath(c.pathUsed)
+		if multipath != c.multipath {
+			t.Errorf("%s: expected multipath %t", c.pathUsed, c.multipath)
+		}
+		flush, err := RequiresFlush("/dev/sdb", c.pathUsed, multipath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flush != c.flush {
+			t.Errorf("%s: expected flush %t", c.pathUsed, c.flush)
+		}
+	}
+}
+
+func TestIsMultipathManaged(t *testing.T) {
+	const wwn = "3600a0980383036347224000000000001"
+	rejected := "/dev/sdb is not a valid multipath device path\n"
+	for _, c := range []struct {
+		name     string
+		paths    string
+		pathErr  error
+		wwids    string
+		check    string
+		checkErr error
+		managed  bool
+		err      bool
+	}{
+		{name: "monitored", paths: "uuid\n" + wwn + "\n", managed: true},
+		{name: "in wwids", paths: "uuid\n", wwids: "# Multipath wwids, Version : 1.0\n/" + wwn + "/\n", managed: true},
+		{name: "accepted", paths: "uuid\n", check: "/dev/sdb is a valid multipath device path\n", managed: true},
+		{name: "blacklisted", paths: "uuid\n3600a0980383036347224000000000002\n", wwids: "\n", check: rejected, checkErr: errors.New("exit status 1")},
+		{name: "no multipathd, in wwids", pathErr: errors.New("exit status 1"), wwids: "/" + wwn + "/\n", managed: true},
+		{name: "no multipathd, blacklisted", pathErr: errors.New("exit status 1"), check: rejected, checkErr: errors.New("exit status 1")},
+		{name: "unknown", pathErr: errors.New("exit status 1"), checkErr: exec.ErrNotFound, managed: true, err: true},
+	} {
+		fs := newMemFS(t)
+		if c.wwids != "" {
+			fs.WriteFile(MultipathWWIDsFile, []byte(c.wwids))
+		}
+		fakeExecutor(t, func(name string, arg ...string) (string, error) {
+			if name == "multipath" {
+				if strings.Join(arg, " ") != "-c /dev/sdb" {
+					t.Errorf("%s: unexpected multipath %v", c.name, arg)
+				}
+				return c.check, c.checkErr
+			}
+			return c.paths, c.pathErr
+		})
+		managed, err := IsMultipathManaged(wwn, "/dev/sdb")
+		if (err != nil) != c.err || managed != c.managed {
+			t.Errorf("%s: unexpected managed %t, error %v", c.name, managed, err)
+		}
+	}
+}
+
+func TestRemovePath(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "block/sdc/device/delete", "")
+	deleteFile := filepath.Join(root, "block/sdc/device/delete")
+	var ops []string
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		if name == "multipathd" && strings.Join(arg, " ") == "del path sdc" {
+			if content, _ := ioutil.ReadFile(deleteFile); len(content) > 0 {
+				t.Error("path deleted before its removal from the multipath map")
+			}
+			ops = append(ops, "del path")
+			return "ok\n", nil
+		}
+		return "", fmt.Errorf("unexpected command %s %v", name, arg)
+	})
+
+	if err := RemovePath("/dev/sdc", false); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(deleteFile); string(content) != "1\n" {
+		t.Errorf("expected sdc deleted, got %q", content)
+	}
+	if !reflect.DeepEqual(ops, []string{"del path"}) {
+		t.Errorf("expected the path removed from the map, got %v", ops)
+	}
+	if err := RemovePath("/dev/dm-0", false); err == nil {
+		t.Error("expected a multipath device to be rejected")
+	}
+}
+
+func TestParsedCommandsEnv(t *testing.T) {
+	root := newFakeSysFS(t)
+	writeFakeFile(t, root, "block/sdc/device/delete", "")
+	fakeExecutor(t, func(name string, arg ...string) (string, error) {
+		return "", fmt.Errorf("unexpected command without env %s %v", name, arg)
+	})
+	envs := make(map[string][]string)
+	osBrick.DefaultEnvExecutor = func(env []string, name string, arg ...string) (string, error) {
+		envs[name+" "+strings.Join(arg, " ")] = env
+		return "ok\n", nil
+	}
+	if !HasMultipath() {
+		t.Error("expected multipathd to be running")
+	}
+	if err := DestroyFCoEInterface("ens2f2"); err != nil {
+		t.Error(err)
+	}
+	if err := RemovePath("/dev/sdc", false); err != nil {
+		t.Error(err)
+	}
+	for _, cmd := range []string{"multipathd show status", "fcoeadm -d ens2f2", "multipathd del path sdc"} {
+		if !reflect.DeepEqual(envs[cmd], []string{"LANG=C", "LC_ALL=C"}) {
+			t.Errorf("%s: expected LC_ALL=C in the env, got %v", cmd, envs[cmd])
+		}
+	}
+}
+
+func TestMultipathdFailed(t *testing.T) {
+	for out, failed := range map[string]bool{
+		"ok\n":                       false,
+		"fail\n":                     true,
+		"":                           false,
+		"ok\nfailback immediate\n":   false,
+		"timeout receiving packet\n": false,
+	} {
+		if multipathdFailed(out) != failed {
+			t.Errorf("%q: expected failed %t", out, failed)
+		}
+	}
+}
+
+//lsblk -J -O -b of util-linux 2.32, every column is a string
+const lsblkJSONStrings = `{
+   "blockdevices": [
+      {"name": "sda", "kname": "sda", "maj:min": "8:0", "fstype": null, "mountpoint": null, "label": null, "uuid": null, "ro": "0", "rm": "0", "size": "53687091200", "state": "running", "type": "disk", "hctl": "0:0:0:0",
+         "children": [
+            {"name": "sda1", "kname": "sda1", "maj:min": "8:1", "fstype": "xfs", "mountpoint": "/", "label": null, "uuid": "5b0c0b8e-3b6f-4c2a-a0f4-f0a4f0a4f0a4", "ro": "0", "rm": "0", "size": "53686042624", "state": null, "type": "part", "hctl": null}
+         ]
+      },
+      {"name": "sdb", "kname": "sdb", "maj:min": "8:16", "fstype": "mpath_member", "mountpoint": null, "label": null, "uuid": null, "ro": "1", "rm": "0", "size": "2147483648", "state": "running", "type": "disk", "hctl": "2:0:0:1",
+         "children": [
+            {"name": "mpatha", "kname": "dm-0", "maj:min": "253:0", "fstype": "ext4", "mountpoint": "/mnt/data", "label": "vol-1", "uuid": null, "ro": "1", "rm": "0", "size": "2147483648", "state": "running", "type": "mpath", "hctl": null}
+         ]
+      }
+   ]
+}`
+
+//lsblk -J -O -b of util-linux 2.37, with booleans, numbers and mountpoints
+const lsblkJSONTyped = `{
+   "blockdevices": [
+      {"alignment": 0, "name": "sdb", "kname": "sdb", "path": "/dev/sdb", "maj:min": "8:16", "fstype": "mpath_member", "mountpoint": null, "mountpoints": [null], "ro": false, "rm": false, "size": 2147483648, "state": "running", "type": "disk", "hctl": "2:0:0:1",
+         "children": [
+            {"alignment": 0, "name": "mpatha", "kname": "dm-0", "path": "/dev/mapper/mpatha", "maj:min": "253:0", "fstype": null, "mountpoint": null, "mountpoints": [null], "ro": false, "rm": false, "size": 2147483648, "state": "running", "type": "mpath", "hctl": null,
+               "children": [
+                  {"alignment": 0, "name": "mpatha1", "kname": "dm-1", "path": "/dev/mapper/mpatha1", "maj:min": "253:1", "fstype": "ext4", "mountpoint": "/mnt/data", "mountpoints": ["/mnt/data"], "ro": false, "rm": false, "size": 2146435072, "state": "running", "type": "part", "hctl": null}
+               ]
+            }
+         ]
+      }
+   ]
+}`
+
+func TestGetBlockDevices(t *testing.T) {
+	for name, c := range map[string]struct {
+		out      string
+		expected []BlockDevice
+	}{
+		"strings": {lsblkJSONStrings, []BlockDevice{
+			{Name: "sda", KName: "sda", Type: "disk", Size: 53687091200, Children: []BlockDevice{
+				{Name: "sda1", KName: "sda1", Type: "part", MountPoint: "/", Size: 53686042624},
+			}},
+			{Name: "sdb", KName: "sdb", Type: "disk", ReadOnly: true, Size: 2147483648, Children: []BlockDevice{
+				{Name: "mpatha", KName: "dm-0", Type: "mpath", ReadOnly: true, MountPoint: "/mnt/data", Size: 2147483648},
+			}},
+		}},
+		"typed": {lsblkJSONTyped, []BlockDevice{
+			{Name: "sdb", KName: "sdb", Type: "disk", Size: 2147483648, Children: []BlockDevice{
+				{Name: "mpatha", KName: "dm-0", Type: "mpath", Size: 2147483648, Children: []BlockDevice{
+					{Name: "mpatha1", KName: "dm-1", Type: "part", MountPoint: "/mnt/data", Size: 2146435072},
+				}},
+			}},
+		}},
+	} {
+		fakeExecutor(t, func(string, ...string) (string, error) {
+			return c.out, nil
+		})
+		blkdevs, err := GetBlockDevices()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(blkdevs, c.expected) {
+			t.Errorf("%s: expected %+v, got %+v", name, c.expected, blkdevs)
+		}
+	}
+
+	fakeExecutor(t, func(string, ...string) (string, error) {
+		return lsblkJSONStrings, nil
+	})
+	ro, err := GetBlockDevicesRO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ro, map[string]bool{"sda": false, "sda1": false, "sdb": true, "mpatha": true}) {
+		t.Errorf("unexpected read-only states %v", ro)
+	}
+}
@@ -9,3 +9,139 @@ type Device []string
 
 //(wwn,lun)
 type Target []string
+
+//SCSI address of a device, (host,channel,target,lun)
+type HCTL struct {
+	Host    string
+	Channel string
+	Target  string
+	Lun     string
+}
+
+//Kind of block device, telling how it's rescanned
+type DeviceType string
+
+const (
+	DeviceTypeSCSI DeviceType = "scsi"
+	DeviceTypeNVMe DeviceType = "nvme"
+	//namespace head of a native NVMe multipath subsystem
+	DeviceTypeNVMeMultipath DeviceType = "nvme-multipath"
+	DeviceTypeDM            DeviceType = "dm"
+	DeviceTypeUnknown       DeviceType = "unknown"
+)
+
+//What a block device is to the host, see GetDeviceKind
+const (
+	DeviceKindDisk      = "disk"
+	DeviceKindPartition = "partition"
+	DeviceKindMultipath = "multipath"
+)
+
+const (
+	SCSIIDTypeWWN    = "wwn"
+	SCSIIDTypeSerial = "serial"
+)
+
+//Identifier of a scsi device, Type tells whether ID is a WWN (page 0x83)
+//or only a serial (page 0x80) which must not be used as a multipath WWID.
+type SCSIID struct {
+	ID   string
+	Type string
+}
+
+//Metadata of a block device, the probes failed are recorded in Errors by field name.
+type DeviceDetails struct {
+	Path              string
+	WWN               string
+	Size              int64
+	LogicalBlockSize  int
+	PhysicalBlockSize int
+	MultipathWWN      string
+	MultipathDevice   string
+	ReadOnly          bool
+	FSType            string
+	Errors            map[string]error
+}
+
+//A multipath device as shown by multipath -ll, see GetMultipathInfo
+type MultipathInfo struct {
+	Name    string
+	WWID    string
+	DMName  string
+	Vendor  string
+	Product string
+	//attributes of the map, e.g. size=2.0G features='1 queue_if_no_path'
+	Size         string
+	Features     string
+	HWHandler    string
+	WriteProtect string
+	PathGroups   []MultipathPathGroup
+}
+
+//A path group of a multipath device, Status is e.g. active or enabled
+type MultipathPathGroup struct {
+	Policy string
+	Prio   int
+	Status string
+	Paths  []MultipathPath
+}
+
+//A path of a multipath device
+type MultipathPath struct {
+	HCTL   HCTL
+	Device string
+	DevT   string
+	//active or failed in the dm table
+	DMState string
+	//result of the path checker, e.g. ready, faulty or ghost
+	CheckerState string
+	//scsi device state, e.g. running or offline, not shown by old versions
+	DeviceState string
+	//path checker, e.g. tur or directio, from multipathd
+	Checker string
+}
+
+//An iSCSI session as listed by iscsiadm -m session
+type ISCSISession struct {
+	Transport string
+	SID       string
+	//ip:port of the target portal, without the portal group tag
+	Portal string
+	TPGT   string
+	IQN    string
+}
+
+//A block device as reported by lsblk, see GetBlockDevices
+type BlockDevice struct {
+	Name string
+	//kernel name, e.g. dm-0 for mpatha
+	KName      string
+	Type       string
+	ReadOnly   bool
+	MountPoint string
+	//in bytes
+	Size int64
+	//partitions, holders like multipath devices on top of a path, etc
+	Children []BlockDevice
+}
+
+//Identity of the host, see GetHostInfo
+type HostInfo struct {
+	//system uuid, e.g. 4c4c4544-0038-5110-8058-b4c04f4e4d32
+	UUID string
+	//e.g. amd64 or arm64
+	Platform string
+	OSType   string
+}
+
+//Health of the link of an FC host, see GetFCHBAHealth
+type HBAHealth struct {
+	//e.g. host2
+	HostDevice string
+	PortName   string
+	//negotiated speed, e.g. 16 Gbit, unknown when the link is down
+	Speed string
+	//e.g. Online or Linkdown
+	PortState       string
+	SupportedSpeeds string
+}
@@ -2,18 +2,91 @@ package os_brick
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+//Executor runs a command and returns its combined stdout and stderr.
+type Executor func(name string, arg ...string) (string, error)
+
+//DefaultExecutor is used by Execute to run commands, replace it to
+//intercept the commands issued by this library, e.g. in tests.
+var DefaultExecutor Executor = execCommand
+
 func Execute(name string, arg ...string) (string, error) {
+	return DefaultExecutor(name, arg...)
+}
+
+//ExecuteContext Execute a command like Execute, with the executor of ctx,
+//see WithExecutor.
+//
+//	ctx only picks the executor, the command isn't cut short when ctx is
+//	done, see ExecWithContext for that.
+func ExecuteContext(ctx context.Context, name string, arg ...string) (string, error) {
+	return ExecutorFromContext(ctx)(name, arg...)
+}
+
+//PathLookup finds the full path of a command, like exec.LookPath.
+type PathLookup func(file string) (string, error)
+
+//DefaultPathLookup is used by FindBinary, replace it to fake the commands
+//installed on the host, e.g. in tests.
+var DefaultPathLookup PathLookup = exec.LookPath
+
+//FindBinary Get the full path of a command, an error if it is not installed.
+func FindBinary(name string) (string, error) {
+	return DefaultPathLookup(name)
+}
+
+func execCommand(name string, arg ...string) (string, error) {
+	cmd := exec.Command(name, arg...)
+	stdoutStderr, err := cmd.CombinedOutput()
+	return string(stdoutStderr), err
+}
+
+//EnvExecutor runs a command like Executor, with env, e.g. LC_ALL=C, added to
+//the environment of this process.
+type EnvExecutor func(env []string, name string, arg ...string) (string, error)
+
+//DefaultEnvExecutor is used by ExecuteEnv to run commands, replace it along
+//with DefaultExecutor to intercept every command issued by this library.
+var DefaultEnvExecutor EnvExecutor = execCommandEnv
+
+//ExecuteEnv Execute a command with env, e.g. LC_ALL=C, added to the environment
+//of this process.
+func ExecuteEnv(env []string, name string, arg ...string) (string, error) {
+	return DefaultEnvExecutor(env, name, arg...)
+}
+
+//ExecuteEnvContext Execute a command like ExecuteEnv, with the executor of
+//ctx, see WithExecutor, DefaultEnvExecutor if it carries none.
+//
+//	The executor of ctx is given the command without env, like the
+//	Executor replacing DefaultExecutor would.
+func ExecuteEnvContext(ctx context.Context, env []string, name string, arg ...string) (string, error) {
+	if executor, ok := contextExecutor(ctx); ok {
+		return executor(name, arg...)
+	}
+	return DefaultEnvExecutor(env, name, arg...)
+}
+
+func execCommandEnv(env []string, name string, arg ...string) (string, error) {
 	cmd := exec.Command(name, arg...)
+	cmd.Env = append(os.Environ(), env...)
 	stdoutStderr, err := cmd.CombinedOutput()
 	return string(stdoutStderr), err
 }
@@ -22,12 +95,82 @@ func Execute(name string, arg ...string) (string, error) {
 // The program path is defined by the name arguments, args are passed as arguments to the program.
 //
 // ExecWithTimeout returns process output as a string (stdout) , and stderr as an error.
+// When the timeout expires the command is killed along with its children.
 func ExecWithTimeout(timeout time.Duration, name string, args ...string) (string, error) {
+	return ExecWithTimeoutContext(context.Background(), timeout, name, args...)
+}
+
+//ExecWithTimeoutContext Execute a command like ExecWithTimeout, with the
+//executor of ctx, see WithExecutor.
+//
+//	Only the timeout cuts the command short, not ctx being done.
+func ExecWithTimeoutContext(ctx context.Context, timeout time.Duration, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(WithExecutor(context.Background(), ExecutorFromContext(ctx)), timeout)
+	defer cancel()
+	res, err := ExecWithContext(ctx, name, args...)
+	if err == context.DeadlineExceeded {
+		return res, fmt.Errorf("%s timed out after %v", name, timeout)
+	}
+	return res, err
+}
+
+type executorKey struct{}
+
+//WithExecutor Get a copy of ctx carrying executor, which the context-aware
+//command helpers like ExecuteContext and ExecWithContext run the commands with.
+//
+//	Unlike replacing DefaultExecutor it only applies to the calls given
+//	ctx, e.g. to fake the commands of a single request.
+func WithExecutor(ctx context.Context, executor Executor) context.Context {
+	return context.WithValue(ctx, executorKey{}, executor)
+}
+
+//ExecutorFromContext Get the executor carried by ctx, DefaultExecutor if none.
+func ExecutorFromContext(ctx context.Context) Executor {
+	if executor, ok := contextExecutor(ctx); ok {
+		return executor
+	}
+	return DefaultExecutor
+}
+
+//contextExecutor Get the executor carried by ctx, ok is false if none.
+func contextExecutor(ctx context.Context) (Executor, bool) {
+	executor, ok := ctx.Value(executorKey{}).(Executor)
+	return executor, ok && executor != nil
+}
+
+//ExecWithContext Execute a command like ExecWithTimeout, until ctx is done.
+//
+//	The command runs in its own process group, which is killed when ctx
+//	is done, so children holding its output don't keep it running, and
+//	ctx.Err() is returned. When ctx carries an executor, see WithExecutor,
+//	or DefaultExecutor was replaced, the command is run by that executor
+//	instead. It can't be killed, ctx.Err() is returned when ctx is done
+//	while it keeps running in its own goroutine, its result discarded.
+func ExecWithContext(ctx context.Context, name string, args ...string) (string, error) {
+	if executor := ExecutorFromContext(ctx); !isExecCommand(executor) {
+		type result struct {
+			out string
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			out, err := executor(name, args...)
+			done <- result{out, err}
+		}()
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case r := <-done:
+			return r.out, r.err
+		}
+	}
 	c := exec.Command(name, args...)
 	stdout := &bytes.Buffer{}
 	stderr := &bytes.Buffer{}
 	c.Stdout = stdout
 	c.Stderr = stderr
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
 	if err := c.Start(); err != nil {
 		return "", err
@@ -35,24 +178,73 @@ func ExecWithTimeout(timeout time.Duration, name string, args ...string) (string
 
 	done := make(chan error, 1)
 	go func() {
-		_, err := c.Process.Wait()
-		done <- err
+		done <- c.Wait()
 	}()
 	select {
-	case <-time.After(timeout):
-		_ = c.Process.Signal(os.Kill)
+	case <-ctx.Done():
+		_ = syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		<-done
+		return stdout.String(), ctx.Err()
 	case <-done:
 	}
 
-	res := string(stdout.Bytes())
-	if err := string(stderr.Bytes()); len(err) > 0 {
+	res := stdout.String()
+	if err := stderr.String(); len(err) > 0 {
 		return res, errors.New(err)
 	}
 	return res, nil
 }
 
+//isExecCommand Whether executor is the stock one running the command, which
+//ExecWithContext runs as a process it can kill instead.
+func isExecCommand(executor Executor) bool {
+	return reflect.ValueOf(executor).Pointer() == reflect.ValueOf(execCommand).Pointer()
+}
+
+//WriteTempSecret Write a secret to a file only readable by the current user.
+//
+//	The file is created with O_EXCL in a new private directory, so it can't
+//	be raced through a planted symlink. The returned cleanup overwrites the
+//	secret with zeros and removes the file and its directory.
+func WriteTempSecret(content []byte) (string, func(), error) {
+	dir, err := ioutil.TempDir("", "os-brick-secret")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed create secret dir: %v", err)
+	}
+	cleanupDir := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("failed remove secret dir %s: %v", dir, err)
+		}
+	}
+	path := filepath.Join(dir, "secret")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		cleanupDir()
+		return "", nil, fmt.Errorf("failed create secret file: %v", err)
+	}
+	if _, err = f.Write(content); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanupDir()
+		return "", nil, fmt.Errorf("failed write secret file: %v", err)
+	}
+	cleanup := func() {
+		if f, err := os.OpenFile(path, os.O_WRONLY, 0); err == nil {
+			_, _ = f.Write(make([]byte, len(content)))
+			_ = f.Sync()
+			_ = f.Close()
+		}
+		cleanupDir()
+	}
+	return path, cleanup, nil
+}
+
 func IsFileExists(file string) bool {
-	if _, err := os.Stat(file); err == nil {
+	if _, err := DefaultFS.Stat(file); err == nil {
 		return true
 	} else if os.IsNotExist(err) {
 		return false
@@ -85,7 +277,56 @@ func RunWithRetry(maxRetry int, interval time.Duration, exec func(currentTry int
 	}
 }
 
+//KeyedMutex A mutex per key, e.g. to serialize the operations on a target
+//or a volume while the others run concurrently. The zero value is ready to use.
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+//Lock Lock key, returns the func unlocking it.
+func (m *KeyedMutex) Lock(key string) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		//forget the keys nobody holds, volumes and targets come and go
+		if l.refs--; l.refs == 0 {
+			delete(m.locks, key)
+		}
+	}
+}
+
+//DeviceValidator tells whether a device can be read.
+type DeviceValidator func(device string) bool
+
+//DefaultDeviceValidator is used by CheckValidDevice, replace it with
+//ReadValidDevice where dd or /dev/null can't be used, e.g. in sandboxes.
+var DefaultDeviceValidator DeviceValidator = ddValidDevice
+
 func CheckValidDevice(device string) bool {
+	return DefaultDeviceValidator(device)
+}
+
+func ddValidDevice(device string) bool {
 	_, err := Execute("dd", "if="+device, "of=/dev/null", "count=1")
 	if err != nil {
 		log.Print("failed to access the device on the path ", device, err)
@@ -94,11 +335,183 @@ func CheckValidDevice(device string) bool {
 	return true
 }
 
+//ReadValidDevice Validate a device by reading its first block, without dd.
+func ReadValidDevice(device string) bool {
+	f, err := os.Open(device)
+	if err != nil {
+		log.Print("failed to access the device on the path ", device, err)
+		return false
+	}
+	defer f.Close()
+	if _, err = f.Read(make([]byte, 512)); err != nil && err != io.EOF {
+		log.Print("failed to read the device on the path ", device, err)
+		return false
+	}
+	return true
+}
+
 func IsNumeric(s string) (bool, float64) {
 	f, err := strconv.ParseFloat(s, 64)
 	return err == nil, f
 }
 
+//ToInt64 Coerce a loosely typed value (e.g. from decoded JSON) to int64.
+//
+//	Strings and json.Number are parsed with ParseInt.
+func ToInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case float64:
+		if n != float64(int64(n)) {
+			return 0, fmt.Errorf("not an integer: %v", n)
+		}
+		return int64(n), nil
+	case json.Number:
+		return ParseInt(n.String())
+	case string:
+		return ParseInt(n)
+	}
+	return 0, fmt.Errorf("not an integer: %#v", v)
+}
+
+//ParseInt Parse a decimal integer, or a hex one when it has the 0x prefix.
+//
+//	A leading zero doesn't make it octal, "010" is 10.
+func ParseInt(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		return strconv.ParseInt(s[2:], 16, 64)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+//MountInfoPath is the mountinfo of the mount namespace the mounts are looked up in.
+var MountInfoPath = "/proc/self/mountinfo"
+
+//mountInfo A mount of the mountinfo file.
+type mountInfo struct {
+	//major:minor of the mounted device
+	devNum     string
+	root       string
+	mountPoint string
+	fsType     string
+	source     string
+}
+
+func readMountInfo() ([]mountInfo, error) {
+	content, err := DefaultFS.ReadFile(MountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed read %s: %v", MountInfoPath, err)
+	}
+	mounts := make([]mountInfo, 0)
+	for _, line := range strings.Split(string(content), "\n") {
+		//36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(line)
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 6 || len(fields) < sep+3 {
+			continue
+		}
+		mounts = append(mounts, mountInfo{
+			devNum:     fields[2],
+			root:       fields[3],
+			mountPoint: unescapeMountPath(fields[4]),
+			fsType:     fields[sep+1],
+			source:     unescapeMountPath(fields[sep+2]),
+		})
+	}
+	return mounts, nil
+}
+
+//unescapeMountPath Undo the octal escaping of spaces and such in mountinfo paths.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+//sameDevice Tell whether two device paths point to the same device.
+func sameDevice(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ra, errA := DefaultFS.EvalSymlinks(a)
+	rb, errB := DefaultFS.EvalSymlinks(b)
+	return errA == nil && errB == nil && ra == rb
+}
+
+//GetMountpoints Get where a device is mounted.
+func GetMountpoints(device string) ([]string, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	mountPoints := make([]string, 0)
+	for _, m := range mounts {
+		if strings.HasPrefix(m.source, "/dev/") && sameDevice(m.source, device) {
+			mountPoints = append(mountPoints, m.mountPoint)
+		}
+	}
+	return mountPoints, nil
+}
+
+//ErrNotMounted is returned when a path is not a mountpoint.
+var ErrNotMounted = errors.New("not mounted")
+
+//GetDeviceForMountpoint Get the device mounted on mountPoint, the reverse of
+//GetMountpoints, with the symlinks resolved, e.g. /dev/dm-0 for /dev/mapper/mpatha.
+//
+//	The device of a bind mount is the one of the mount it was taken from.
+//	When mounts are stacked on mountPoint the top one is visible, so it
+//	is returned.
+func GetDeviceForMountpoint(mountPoint string) (string, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return "", err
+	}
+	mountPoint = filepath.Clean(mountPoint)
+	source := ""
+	for _, m := range mounts {
+		if m.mountPoint == mountPoint {
+			source = m.source
+		}
+	}
+	if source == "" {
+		return "", fmt.Errorf("%w: %s", ErrNotMounted, mountPoint)
+	}
+	//tmpfs, proc, server:/export and such
+	if !filepath.IsAbs(source) {
+		return "", fmt.Errorf("%s is not backed by a device but %s", mountPoint, source)
+	}
+	device, err := DefaultFS.EvalSymlinks(source)
+	if err != nil {
+		return "", fmt.Errorf("failed get realpath of %s mounted on %s: %v", source, mountPoint, err)
+	}
+	return device, nil
+}
+
 // MountDir
 func MountDir(path, dir string, flag string) error {
 	// mount -o rw /dev/dm-X /mnt/vdisk/X
@@ -110,18 +523,197 @@ func MountDir(path, dir string, flag string) error {
 	return nil
 }
 
+//GetFSType Get the filesystem type of a device, empty if it has none.
+func GetFSType(device string) (string, error) {
+	out, err := Execute("blkid", "-o", "value", "-s", "TYPE", device)
+	if err != nil {
+		//blkid exits with 2 when no filesystem was found
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+			return "", nil
+		}
+		return "", fmt.Errorf("execute blkid %s failed: %s, %v", device, out, err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+//ResizeFS Grow the filesystem of device, mounted on mountPoint, to the size
+//of the device.
+//
+//	ext filesystems are grown through the device, xfs and btrfs through
+//	their mountpoint.
+func ResizeFS(device, mountPoint string) error {
+	fsType, err := GetFSType(device)
+	if err != nil {
+		return err
+	}
+	var args []string
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		args = []string{"resize2fs", device}
+	case "xfs":
+		args = []string{"xfs_growfs", mountPoint}
+	case "btrfs":
+		args = []string{"btrfs", "filesystem", "resize", "max", mountPoint}
+	case "":
+		return fmt.Errorf("no filesystem found on %s", device)
+	default:
+		return fmt.Errorf("resize of filesystem %s on %s not supported", fsType, device)
+	}
+	out, err := Execute(args[0], args[1:]...)
+	if err != nil {
+		return fmt.Errorf("execute %s failed: %s, %v", strings.Join(args, " "), strings.TrimSpace(out), err)
+	}
+	log.Printf("execute %s : %s", strings.Join(args, " "), out)
+	return nil
+}
+
+//GetFSSize Get the size in bytes of the filesystem mounted on mountPoint.
+func GetFSSize(mountPoint string) (int64, error) {
+	out, err := Execute("df", "--output=size", "-B1", mountPoint)
+	if err != nil {
+		return 0, fmt.Errorf("execute df %s failed: %s, %v", mountPoint, strings.TrimSpace(out), err)
+	}
+	//1B-blocks
+	//2105540608
+	lines := strings.Fields(out)
+	if len(lines) == 0 {
+		return 0, fmt.Errorf("no size in df output for %s", mountPoint)
+	}
+	size, err := strconv.ParseInt(lines[len(lines)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed parse df output for %s: %v", mountPoint, err)
+	}
+	return size, nil
+}
+
+//DefaultFSType is the filesystem created by the mkfs helpers when no type is given.
+var DefaultFSType = "ext4"
+
+//MaxFSLabelLength The longest label, in bytes, each filesystem accepts.
+var MaxFSLabelLength = map[string]int{
+	"ext2":  16,
+	"ext3":  16,
+	"ext4":  16,
+	"xfs":   12,
+	"btrfs": 255,
+}
+
 // Mkfs
 func Mkfs(device, fsType string) error {
-	// mkfs -t ext4 /dev/sdj
-	out, err := Execute("mkfs", "-t", fsType, device)
+	return MkfsWithArgs(device, fsType, nil)
+}
+
+//MkfsWithLabel Create a filesystem labeled label, e.g. to find the volume in
+//lsblk -f, without relabeling it afterwards with e2label or xfs_admin.
+func MkfsWithLabel(device, fsType, label string) error {
+	args, err := mkfsLabelArgs(fsType, label)
 	if err != nil {
-		return fmt.Errorf("execute mkfs -t %s %s failed: %v", fsType, device, err)
+		return err
+	}
+	return MkfsWithArgs(device, fsType, args)
+}
+
+//mkfsLabelArgs Get the mkfs args setting label, none when label is empty.
+func mkfsLabelArgs(fsType, label string) ([]string, error) {
+	if label == "" {
+		return nil, nil
+	}
+	if fsType == "" {
+		fsType = DefaultFSType
+	}
+	maxLen, ok := MaxFSLabelLength[fsType]
+	if !ok {
+		return nil, fmt.Errorf("labels not supported for filesystem %s", fsType)
+	}
+	if len(label) > maxLen {
+		return nil, fmt.Errorf("label %q too long for %s, at most %d bytes", label, fsType, maxLen)
+	}
+	return []string{"-L", label}, nil
+}
+
+//MkfsWithArgs Create a filesystem passing extra args to mkfs, e.g. -m 0 or
+//-E lazy_itable_init=0 for ext4, -K for xfs.
+//
+//	The args are placed between the filesystem type and the device.
+func MkfsWithArgs(device, fsType string, args []string) error {
+	if err := validateMkfsArgs(args); err != nil {
+		return err
+	}
+	if fsType == "" {
+		fsType = DefaultFSType
+	}
+	// mkfs -t ext4 -m 0 /dev/sdj
+	cmdArgs := append(append([]string{"-t", fsType}, args...), device)
+	out, err := Execute("mkfs", cmdArgs...)
+	if err != nil {
+		return fmt.Errorf("execute mkfs %s failed: %v", strings.Join(cmdArgs, " "), err)
+	}
+	log.Printf("execute mkfs %s : %s", strings.Join(cmdArgs, " "), out)
+	return nil
+}
+
+//validateMkfsArgs Reject mkfs args which could change the filesystem type,
+//point mkfs at another device, or smuggle in shell syntax.
+func validateMkfsArgs(args []string) error {
+	for _, arg := range args {
+		switch {
+		case arg == "":
+			return fmt.Errorf("empty mkfs arg")
+		case arg == "-t" || strings.HasPrefix(arg, "--type"):
+			return fmt.Errorf("mkfs arg %q not allowed, the filesystem type is set separately", arg)
+		case strings.HasPrefix(arg, "/dev/"):
+			return fmt.Errorf("mkfs arg %q not allowed, looks like a device", arg)
+		case strings.ContainsAny(arg, ";|&`$<>\n\x00"):
+			return fmt.Errorf("mkfs arg %q contains forbidden characters", arg)
+		}
 	}
-	log.Printf("execute mkfs -t %s %s : %s", fsType, device, out)
 	return nil
 }
 
+//MkfsIfEmpty Create a filesystem on device unless it already has one,
+//args are passed to mkfs like MkfsWithArgs.
+func MkfsIfEmpty(device, fsType string, args ...string) error {
+	existing, err := GetFSType(device)
+	if err != nil {
+		return err
+	}
+	if existing != "" {
+		log.Printf("device %s already has a %s filesystem", device, existing)
+		return nil
+	}
+	return MkfsWithArgs(device, fsType, args)
+}
+
+//RemoveDirTimeout is how long UnmountDir waits for the removal of the
+//unmounted directory, a stale mount underneath can hang it.
+var RemoveDirTimeout = time.Second * 30
+
+//removeDir removes the unmounted directory, replaced in tests.
+var removeDir = os.Remove
+
+//IsMounted Tell whether dir is a mountpoint.
+func IsMounted(dir string) (bool, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return false, err
+	}
+	dir = filepath.Clean(dir)
+	for _, m := range mounts {
+		if m.mountPoint == dir {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // UnmountDir
+//
+//	With rmDir dir is removed once it is no longer a mountpoint, a
+//	directory still mounted, e.g. the umount silently failed or it was
+//	mounted more than once, is never removed. Only an empty dir is
+//	removed, whatever is left in it, e.g. a mount underneath, is kept,
+//	and the removal gives up after RemoveDirTimeout.
 func UnmountDir(dir string, rmDir bool) error {
 	// umount /opt/kubelet/pods/xxx/volumes/xxx
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
@@ -129,24 +721,44 @@ func UnmountDir(dir string, rmDir bool) error {
 		return nil
 	}
 
-	out, err := ExecWithTimeout(time.Second*10, "umount", dir)
+	mounted, err := IsMounted(dir)
 	if err != nil {
-		if strings.Contains(err.Error(), "no such file or directory") {
-			log.Printf("execute umount faild, file already deleted")
-			return nil
+		return fmt.Errorf("failed check whether %s is mounted: %v", dir, err)
+	}
+	if mounted {
+		out, err := ExecWithTimeout(time.Second*10, "umount", dir)
+		if err != nil {
+			if strings.Contains(err.Error(), "no such file or directory") {
+				log.Printf("execute umount faild, file already deleted")
+				return nil
+			}
+			return fmt.Errorf("execute umount failed: %v", err)
 		}
-		return fmt.Errorf("execute umount failed: %v", err)
+		log.Printf("execute umount SUCCESS: %s", out)
+	} else {
+		log.Printf("%s is not mounted, skipping umount", dir)
 	}
-	log.Printf("execute umount SUCCESS: %s", out)
 
 	if rmDir {
-		err = os.RemoveAll(dir)
-		//out, err = internal.ExecLocal("rm", "-rf", dir)
-		//if err != nil && err.Error() != ErrorNoResult {
+		if mounted, err = IsMounted(dir); err != nil {
+			return fmt.Errorf("failed check whether %s is unmounted, not removing it: %v", dir, err)
+		}
+		if mounted {
+			return fmt.Errorf("%s is still mounted, not removing it", dir)
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- removeDir(dir)
+		}()
+		select {
+		case err = <-done:
+		case <-time.After(RemoveDirTimeout):
+			err = fmt.Errorf("timed out after %v", RemoveDirTimeout)
+		}
 		if err != nil {
 			return fmt.Errorf("remove dir %s failed: %v", dir, err)
 		}
-		log.Printf("execute rm -rf %s : %s, %v", dir, out, err)
+		log.Printf("removed dir %s", dir)
 	}
 
 	return nil
@@ -0,0 +1,378 @@
+package os_brick
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTempSecret(t *testing.T) {
+	path, cleanup, err := WriteTempSecret([]byte("s3cr3t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected secret file mode: %v", info.Mode())
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "s3cr3t" {
+		t.Errorf("unexpected secret content: %q", content)
+	}
+	cleanup()
+	if IsFileExists(path) || IsFileExists(filepath.Dir(path)) {
+		t.Errorf("secret %s not removed", path)
+	}
+}
+
+func TestMkfsWithArgs(t *testing.T) {
+	var cmd []string
+	defer func(e Executor) { DefaultExecutor = e }(DefaultExecutor)
+	DefaultExecutor = func(name string, arg ...string) (string, error) {
+		cmd = append([]string{name}, arg...)
+		return "", nil
+	}
+	if err := MkfsWithArgs("/dev/sdb", "ext4", []string{"-F", "-m", "0", "-E", "lazy_itable_init=0"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"mkfs", "-t", "ext4", "-F", "-m", "0", "-E", "lazy_itable_init=0", "/dev/sdb"}
+	if !reflect.DeepEqual(cmd, expected) {
+		t.Errorf("expected %v, got %v", expected, cmd)
+	}
+
+	for _, args := range [][]string{{"-t", "xfs"}, {"/dev/sdc"}, {"-L", "data; rm -rf /"}, {""}} {
+		cmd = nil
+		if err := MkfsWithArgs("/dev/sdb", "ext4", args); err == nil || cmd != nil {
+			t.Errorf("%q: expected args to be rejected", args)
+		}
+	}
+}
+
+func TestMkfsWithLabel(t *testing.T) {
+	var cmd []string
+	defer func(e Executor) { DefaultExecutor = e }(DefaultExecutor)
+	DefaultExecutor = func(name string, arg ...string) (string, error) {
+		cmd = append([]string{name}, arg...)
+		return "", nil
+	}
+	for fsType, expected := range map[string][]string{
+		"xfs": {"mkfs", "-t", "xfs", "-L", "vol-0a1b2c3d", "/dev/sdb"},
+		"":    {"mkfs", "-t", "ext4", "-L", "vol-0a1b2c3d", "/dev/sdb"},
+	} {
+		if err := MkfsWithLabel("/dev/sdb", fsType, "vol-0a1b2c3d"); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cmd, expected) {
+			t.Errorf("%q: expected %v, got %v", fsType, expected, cmd)
+		}
+	}
+
+	for fsType, label := range map[string]string{
+		"ext4": "vol-0a1b2c3d-4e5f-6",
+		"xfs":  "vol-0a1b2c3d4",
+		"vfat": "vol",
+	} {
+		cmd = nil
+		if err := MkfsWithLabel("/dev/sdb", fsType, label); err == nil || cmd != nil {
+			t.Errorf("%s: expected label %q to be rejected", fsType, label)
+		}
+	}
+}
+
+func TestExecuteEnv(t *testing.T) {
+	defer os.Setenv("LC_ALL", os.Getenv("LC_ALL"))
+	os.Setenv("LC_ALL", "de_DE.UTF-8")
+	out, err := ExecuteEnv([]string{"LANG=C", "LC_ALL=C"}, "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := strings.Split(out, "\n")
+	for _, v := range []string{"LANG=C", "LC_ALL=C"} {
+		found := false
+		for _, e := range env {
+			if e == v {
+				found = true
+			}
+			if strings.HasPrefix(e, "LC_ALL=") && e != "LC_ALL=C" {
+				t.Errorf("LC_ALL of this process not overridden: %s", e)
+			}
+		}
+		if !found {
+			t.Errorf("expected %s in the environment, got %q", v, out)
+		}
+	}
+}
+
+func TestToInt64(t *testing.T) {
+	for v, expected := range map[interface{}]int64{
+		8:                 8,
+		"8":               8,
+		" 010 ":           10,
+		"0x10":            16,
+		"0X1f":            31,
+		2.0:               2,
+		json.Number("12"): 12,
+	} {
+		if n, err := ToInt64(v); err != nil || n != expected {
+			t.Errorf("%#v: expected %d, got %d, %v", v, expected, n, err)
+		}
+	}
+	for _, v := range []interface{}{"0o10", "0b1", "abc", 1.5, nil} {
+		if _, err := ToInt64(v); err == nil {
+			t.Errorf("%#v: expected an error", v)
+		}
+	}
+}
+
+func TestReadValidDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	device := filepath.Join(dir, "sdb")
+	if err := ioutil.WriteFile(device, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(v DeviceValidator) { DefaultDeviceValidator = v }(DefaultDeviceValidator)
+	DefaultDeviceValidator = ReadValidDevice
+	if !CheckValidDevice(device) {
+		t.Errorf("expected %s to be valid", device)
+	}
+	if CheckValidDevice(filepath.Join(dir, "sdc")) {
+		t.Error("expected a missing device to be invalid")
+	}
+}
+
+func TestExecWithContextKillsProcessGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	//the background sleep holds stdout, only killing the group ends it
+	_, err := ExecWithContext(ctx, "sh", "-c", "sleep 30 & wait")
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancel took %v", elapsed)
+	}
+
+	if _, err := ExecWithTimeout(100*time.Millisecond, "sleep", "30"); err == nil {
+		t.Error("expected a timeout error")
+	}
+}
+
+func TestExecuteContext(t *testing.T) {
+	defer func(e Executor, env EnvExecutor) { DefaultExecutor, DefaultEnvExecutor = e, env }(DefaultExecutor, DefaultEnvExecutor)
+	DefaultExecutor = func(name string, arg ...string) (string, error) { return "default " + name, nil }
+	DefaultEnvExecutor = func(env []string, name string, arg ...string) (string, error) {
+		return "default env " + strings.Join(env, ",") + " " + name, nil
+	}
+	ctx := WithExecutor(context.Background(), func(name string, arg ...string) (string, error) { return "context " + name, nil })
+	cases := []struct {
+		run      func(context.Context) (string, error)
+		expected string
+	}{
+		{func(ctx context.Context) (string, error) { return ExecuteContext(ctx, "true") }, "context true"},
+		{func(ctx context.Context) (string, error) { return ExecuteEnvContext(ctx, []string{"LC_ALL=C"}, "true") }, "context true"},
+		{func(ctx context.Context) (string, error) { return ExecWithContext(ctx, "true") }, "context true"},
+		{func(ctx context.Context) (string, error) {
+			return ExecWithTimeoutContext(ctx, time.Second, "true")
+		}, "context true"},
+	}
+	for i, c := range cases {
+		if out, err := c.run(ctx); err != nil || out != c.expected {
+			t.Errorf("case %d: expected %q, got %q, %v", i, c.expected, out, err)
+		}
+	}
+	//without an executor in the context the default ones run the commands
+	expected := []string{"default true", "default env LC_ALL=C true", "default true", "default true"}
+	for i, c := range cases {
+		if out, err := c.run(context.Background()); err != nil || out != expected[i] {
+			t.Errorf("case %d: expected %q, got %q, %v", i, expected[i], out, err)
+		}
+	}
+}
+
+func TestExecWithContextExecutorCancel(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithCancel(WithExecutor(context.Background(), func(name string, arg ...string) (string, error) {
+		<-release
+		return "", nil
+	}))
+	time.AfterFunc(10*time.Millisecond, cancel)
+	//the executor can't be killed, the result is given up on
+	if _, err := ExecWithContext(ctx, "sleep", "30"); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestGetDeviceForMountpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dev := filepath.Join(dir, "dev")
+	if err := os.MkdirAll(filepath.Join(dev, "mapper"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dev, "dm-0"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mapper := filepath.Join(dev, "mapper/mpatha")
+	if err := os.Symlink("../dm-0", mapper); err != nil {
+		t.Fatal(err)
+	}
+	content := "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n" +
+		"98 22 253:0 / /mnt/data rw,relatime shared:50 - ext4 " + mapper + " rw\n" +
+		//a bind mount of a directory of the volume into a pod
+		"120 22 253:0 /pods/vol /var/lib/kubelet/pods/1/volumes/vol rw,relatime shared:50 - ext4 " + mapper + " rw\n" +
+		"121 22 0:45 / /var/lib/kubelet/pods/1/volumes/secret rw,relatime - tmpfs tmpfs rw\n"
+	defer func(orig string) { MountInfoPath = orig }(MountInfoPath)
+	MountInfoPath = filepath.Join(dir, "mountinfo")
+	if err := ioutil.WriteFile(MountInfoPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mountPoint := range []string{"/mnt/data", "/mnt/data/", "/var/lib/kubelet/pods/1/volumes/vol"} {
+		if device, err := GetDeviceForMountpoint(mountPoint); err != nil || device != filepath.Join(dev, "dm-0") {
+			t.Errorf("%s: expected %s, got %s, %v", mountPoint, filepath.Join(dev, "dm-0"), device, err)
+		}
+	}
+	if _, err := GetDeviceForMountpoint("/var/lib/kubelet/pods/1/volumes/secret"); err == nil {
+		t.Error("expected an error for a tmpfs mount")
+	}
+	if _, err := GetDeviceForMountpoint("/mnt/other"); !errors.Is(err, ErrNotMounted) {
+		t.Errorf("expected ErrNotMounted, got %v", err)
+	}
+}
+
+func TestGetDeviceForMountpointMemFS(t *testing.T) {
+	fs := NewMemFS()
+	defer func(orig FS) { DefaultFS = orig }(DefaultFS)
+	DefaultFS = fs
+	defer func(orig string) { MountInfoPath = orig }(MountInfoPath)
+	MountInfoPath = "/proc/self/mountinfo"
+	fs.WriteFile(MountInfoPath, []byte("98 22 253:0 / /mnt/data rw,relatime shared:50 - ext4 /dev/mapper/mpatha rw\n"))
+	fs.WriteFile("/dev/dm-0", nil)
+	fs.Symlink("../dm-0", "/dev/mapper/mpatha")
+
+	if device, err := GetDeviceForMountpoint("/mnt/data"); err != nil || device != "/dev/dm-0" {
+		t.Errorf("expected /dev/dm-0, got %s, %v", device, err)
+	}
+	if mountPoints, err := GetMountpoints("/dev/dm-0"); err != nil || !reflect.DeepEqual(mountPoints, []string{"/mnt/data"}) {
+		t.Errorf("unexpected mountpoints %v, %v", mountPoints, err)
+	}
+}
+
+func TestUnmountDirRemove(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "unmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer func(orig string) { MountInfoPath = orig }(MountInfoPath)
+	MountInfoPath = filepath.Join(tmp, "mountinfo")
+	bin := filepath.Join(tmp, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	for _, c := range []struct {
+		name string
+		//the fake umount, silently failing or emptying the mountinfo
+		umount  string
+		empty   bool
+		removed bool
+	}{
+		{"still mounted", "#!/bin/sh\nexit 0\n", true, false},
+		{"unmounted", "#!/bin/sh\n: > " + MountInfoPath + "\n", true, true},
+		{"not empty", "#!/bin/sh\n: > " + MountInfoPath + "\n", false, false},
+	} {
+		dir := filepath.Join(tmp, "mnt")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if !c.empty {
+			if err := os.MkdirAll(filepath.Join(dir, "data"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mountInfo := "98 22 253:0 / " + dir + " rw,relatime shared:50 - ext4 /dev/mapper/mpatha rw\n"
+		if err := ioutil.WriteFile(MountInfoPath, []byte(mountInfo), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(bin, "umount"), []byte(c.umount), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := UnmountDir(dir, true)
+		if c.removed && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !c.removed && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if IsFileExists(dir) == c.removed {
+			t.Errorf("%s: expected removed %t", c.name, c.removed)
+		}
+		if !c.empty && !IsFileExists(filepath.Join(dir, "data")) {
+			t.Errorf("%s: expected the content to be kept", c.name)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUnmountDirRemoveTimeout(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "unmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer func(orig string) { MountInfoPath = orig }(MountInfoPath)
+	MountInfoPath = filepath.Join(tmp, "mountinfo")
+	if err := ioutil.WriteFile(MountInfoPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(tmp, "mnt")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	//a removal hanging on a stale mount underneath
+	release := make(chan struct{})
+	defer close(release)
+	defer func(orig func(string) error) { removeDir = orig }(removeDir)
+	removeDir = func(string) error {
+		<-release
+		return nil
+	}
+	defer func(orig time.Duration) { RemoveDirTimeout = orig }(RemoveDirTimeout)
+	RemoveDirTimeout = time.Millisecond * 50
+
+	done := make(chan error, 1)
+	go func() {
+		done <- UnmountDir(dir, true)
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Errorf("expected a timeout, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("UnmountDir blocked on the removal")
+	}
+}